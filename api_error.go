@@ -0,0 +1,162 @@
+package elasticthought
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/couchbaselabs/logg"
+	"github.com/dustin/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// The codes of APIErrors, which clients can switch on rather than parsing
+// messages
+const (
+	ERROR_CODE_VALIDATION     = "validation_failed" // 400
+	ERROR_CODE_UNAUTHORIZED   = "unauthorized"      // 401
+	ERROR_CODE_FORBIDDEN      = "forbidden"         // 403
+	ERROR_CODE_NOT_FOUND      = "not_found"         // 404
+	ERROR_CODE_CONFLICT       = "conflict"          // 409
+	ERROR_CODE_TOO_LARGE      = "request_too_large" // 413
+	ERROR_CODE_INVALID_SPEC   = "invalid_spec"      // 422
+	ERROR_CODE_QUOTA_EXCEEDED = "quota_exceeded"    // 403 or 429, see QuotaError
+	ERROR_CODE_INTERNAL       = "internal_error"    // 500
+)
+
+// Clients can pass in a request id (or a load balancer can add one), and
+// otherwise one is generated.  It's returned in this header of every
+// response, and in the body of error responses.
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+// The JSON body of every failed request
+type APIError struct {
+	Status    int         `json:"-"`
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request-id"`
+}
+
+func NewAPIError(status int, code string, err error) APIError {
+	return APIError{
+		Status:  status,
+		Code:    code,
+		Message: err.Error(),
+	}
+}
+
+func (e APIError) Error() string {
+	return e.Message
+}
+
+func validationError(err error) APIError {
+	return NewAPIError(400, ERROR_CODE_VALIDATION, err)
+}
+
+func unauthorizedError(err error) APIError {
+	return NewAPIError(401, ERROR_CODE_UNAUTHORIZED, err)
+}
+
+func forbiddenError(err error) APIError {
+	return NewAPIError(403, ERROR_CODE_FORBIDDEN, err)
+}
+
+func notFoundError(err error) APIError {
+	return NewAPIError(404, ERROR_CODE_NOT_FOUND, err)
+}
+
+func conflictError(err error) APIError {
+	return NewAPIError(409, ERROR_CODE_CONFLICT, err)
+}
+
+// The error for a failed lookup of a doc or blob: a 404 with the given
+// message if there's no such thing, and otherwise whatever err maps to, since
+// eg the document store being down isn't the client's fault
+func lookupError(err error, message error) error {
+	if httputil.IsHTTPStatus(err, 404) || os.IsNotExist(err) {
+		return notFoundError(message)
+	}
+	return err
+}
+
+// Convert an error to the APIError sent to the client.  Errors which the
+// client can do something about have their own types, and anything else is
+// an internal error.
+func toAPIError(err error) APIError {
+
+	switch err := err.(type) {
+	case APIError:
+		return err
+	case InvalidSpecError:
+		apiErr := NewAPIError(422, ERROR_CODE_INVALID_SPEC, err)
+		apiErr.Details = map[string]interface{}{"spec": err.Spec}
+		return apiErr
+	case QuotaError:
+		apiErr := NewAPIError(err.Status, ERROR_CODE_QUOTA_EXCEEDED, err)
+		apiErr.Details = map[string]interface{}{
+			"quota": err.Quota,
+			"limit": err.Limit,
+			"used":  err.Used,
+		}
+		return apiErr
+	case DependentsError:
+		apiErr := conflictError(err)
+		apiErr.Details = map[string]interface{}{"dependents": err.Dependents}
+		return apiErr
+	}
+
+	if err == ErrQueueLeaseLost {
+		return conflictError(err)
+	}
+
+	return NewAPIError(500, ERROR_CODE_INTERNAL, err)
+
+}
+
+// Fail the request, sending the APIError for err as the response body and
+// stopping any handlers after this one from running.  The details of
+// internal errors are only logged, since they can give away how the server
+// is set up, and the client gets the request id to report instead.
+func failRequest(c *gin.Context, err error) {
+
+	apiErr := toAPIError(err)
+	apiErr.RequestID = requestID(c)
+
+	logg.LogTo("REST", "Request %v failed with %v %v: %v", apiErr.RequestID, apiErr.Status, apiErr.Code, apiErr.Message)
+
+	if apiErr.Code == ERROR_CODE_INTERNAL {
+		apiErr.Message = fmt.Sprintf("Internal server error.  The details are logged with request id: %v", apiErr.RequestID)
+	}
+
+	c.Error(apiErr, "Operation aborted")
+	c.JSON(apiErr.Status, apiErr)
+	c.Abort(-1)
+
+}
+
+// Bind the JSON request body to obj, checking its binding:"required" fields.
+// If it's invalid the request is failed with a 400 and false is returned.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+
+	if err := binding.JSON.Bind(c.Request, obj); err != nil {
+		failRequest(c, validationError(fmt.Errorf("Invalid request body: %v", err)))
+		return false
+	}
+	return true
+
+}
+
+// The id of the request, which is set by the RequestIdentifier middleware
+func requestID(c *gin.Context) string {
+
+	id := c.Request.Header.Get(REQUEST_ID_HEADER)
+	if len(id) == 0 {
+		// the middleware isn't in use
+		id = NewUuid()
+		c.Request.Header.Set(REQUEST_ID_HEADER, id)
+		c.Writer.Header().Set(REQUEST_ID_HEADER, id)
+	}
+	return id
+
+}
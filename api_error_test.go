@@ -0,0 +1,156 @@
+package elasticthought
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+	"github.com/gin-gonic/gin"
+)
+
+func TestToAPIError(t *testing.T) {
+
+	apiErr := toAPIError(errors.New("disk full"))
+	assert.Equals(t, apiErr.Status, 500)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_INTERNAL)
+	assert.Equals(t, apiErr.Message, "disk full")
+
+	apiErr = toAPIError(notFoundError(errors.New("no such thing")))
+	assert.Equals(t, apiErr.Status, 404)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_NOT_FOUND)
+
+	apiErr = toAPIError(InvalidSpecError{Spec: "http://foo/solver.prototxt", Err: errors.New("bad syntax")})
+	assert.Equals(t, apiErr.Status, 422)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_INVALID_SPEC)
+
+	apiErr = toAPIError(DependentsError{DocId: "datafile", Dependents: []string{"dataset"}})
+	assert.Equals(t, apiErr.Status, 409)
+	assert.DeepEquals(t, apiErr.Details, map[string]interface{}{"dependents": []string{"dataset"}})
+
+	apiErr = toAPIError(QuotaError{Status: 429, Quota: QUOTA_ACTION_TRAIN, Limit: 1, Used: 1})
+	assert.Equals(t, apiErr.Status, 429)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_QUOTA_EXCEEDED)
+
+	apiErr = toAPIError(ErrQueueLeaseLost)
+	assert.Equals(t, apiErr.Status, 409)
+
+}
+
+func TestLookupError(t *testing.T) {
+
+	missing := errors.New("Unable to find datafile with id: foo")
+
+	apiErr := toAPIError(lookupError(documentStoreError(404, "Not found"), missing))
+	assert.Equals(t, apiErr.Status, 404)
+	assert.Equals(t, apiErr.Message, missing.Error())
+
+	_, err := os.Open(fmt.Sprintf("%v/missing", TempDir()))
+	apiErr = toAPIError(lookupError(err, missing))
+	assert.Equals(t, apiErr.Status, 404)
+
+	// the document store failing isn't the same as the doc not existing
+	err = documentStoreError(503, "Service unavailable")
+	assert.Equals(t, lookupError(err, missing), err)
+	assert.Equals(t, toAPIError(lookupError(err, missing)).Status, 500)
+
+	err = errors.New("connection refused")
+	assert.Equals(t, lookupError(err, missing), err)
+
+}
+
+func TestFailRequestHidesInternalErrors(t *testing.T) {
+
+	router := gin.New()
+	router.Use(RequestIdentifier())
+	router.GET("/fail", func(c *gin.Context) {
+		failRequest(c, errors.New("Error connecting to http://admin:secret@db:4985"))
+	})
+
+	req, _ := http.NewRequest("GET", "/fail", nil)
+	req.Header.Set(REQUEST_ID_HEADER, "my-request")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equals(t, recorder.Code, 500)
+
+	apiErr := APIError{}
+	err := json.Unmarshal(recorder.Body.Bytes(), &apiErr)
+	assert.True(t, err == nil)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_INTERNAL)
+	assert.False(t, strings.Contains(apiErr.Message, "secret"))
+	assert.True(t, strings.Contains(apiErr.Message, "my-request"))
+
+}
+
+func TestErrorResponses(t *testing.T) {
+
+	config := *NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://api_error_test_%v", NewUuid())
+	config.WorkDirectory = TempDir()
+
+	router := NewRouter(config, &EndpointContext{Configuration: config})
+
+	// returns the decoded error body, after checking it has the request id
+	request := func(method, path, requestID string, body []byte, expectedStatus int) APIError {
+		req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+		req.SetBasicAuth("foo", "bar")
+		if len(requestID) > 0 {
+			req.Header.Set(REQUEST_ID_HEADER, requestID)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equals(t, recorder.Code, expectedStatus)
+
+		apiErr := APIError{}
+		if expectedStatus >= 400 {
+			err := json.Unmarshal(recorder.Body.Bytes(), &apiErr)
+			assert.True(t, err == nil)
+			assert.True(t, len(apiErr.RequestID) > 0)
+			assert.Equals(t, apiErr.RequestID, recorder.Header().Get(REQUEST_ID_HEADER))
+		}
+		return apiErr
+	}
+
+	user := []byte(`{"username": "foo", "password": "bar"}`)
+	request("POST", "/users", "", user, 201)
+
+	apiErr := request("POST", "/users", "my-request", user, 409)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_CONFLICT)
+	assert.Equals(t, apiErr.RequestID, "my-request")
+
+	apiErr = request("POST", "/users", "", []byte(`{"username": `), 400)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_VALIDATION)
+
+	// missing the required url
+	apiErr = request("POST", "/datafiles", "", []byte(`{}`), 400)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_VALIDATION)
+
+	apiErr = request("POST", "/classifiers/missing/classify", "", nil, 404)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_NOT_FOUND)
+
+	apiErr = request("GET", "/datafiles/missing", "", nil, 404)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_NOT_FOUND)
+
+	apiErr = request("POST", "/classifier-bundles", "", []byte("not a tar.gz"), 422)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_INVALID_SPEC)
+
+	// errors from the middleware have the same format
+	req, _ := http.NewRequest("GET", "/users/me/usage", nil)
+	req.SetBasicAuth("foo", "wrong")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equals(t, recorder.Code, 401)
+	err := json.Unmarshal(recorder.Body.Bytes(), &apiErr)
+	assert.True(t, err == nil)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_UNAUTHORIZED)
+
+	apiErr = request("POST", "/queue/leases", "", []byte(`{}`), 404)
+	assert.Equals(t, apiErr.Code, ERROR_CODE_NOT_FOUND)
+
+}
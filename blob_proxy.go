@@ -0,0 +1,264 @@
+package elasticthought
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+	"github.com/dustin/httputil"
+)
+
+// How many references (eg, classify job -> classifier -> training job)
+// to follow when looking for the owner of a document
+const maxOwnerLookupDepth = 5
+
+// The fields needed to figure out who owns a document.  Documents which
+// don't have a user-id are owned by whoever owns the document they refer to.
+type ownedDoc struct {
+	ElasticThoughtDoc
+	UserID          string          `json:"user-id"`
+	TrainingDataset TrainingDataset `json:"training"`
+	TestDataset     TestDataset     `json:"test"`
+	DatasetId       string          `json:"dataset-id"`
+	SolverId        string          `json:"solver-id"`
+	TrainingJobID   string          `json:"training-job-id"`
+	ClassifierID    string          `json:"classifier-id"`
+}
+
+// The ids of the docs this doc refers to, eg, the solver of a training job
+func (d ownedDoc) parentIds() []string {
+
+	parentIds := []string{}
+	switch d.Type {
+	case DOC_TYPE_DATASET:
+		parentIds = append(parentIds, d.TrainingDataset.DatafileID)
+		if d.TestDataset.DatafileID != d.TrainingDataset.DatafileID {
+			parentIds = append(parentIds, d.TestDataset.DatafileID)
+		}
+	case DOC_TYPE_SOLVER:
+		parentIds = append(parentIds, d.DatasetId)
+	case DOC_TYPE_TRAINING_JOB:
+		parentIds = append(parentIds, d.SolverId)
+	case DOC_TYPE_CLASSIFIER:
+		parentIds = append(parentIds, d.TrainingJobID)
+	case DOC_TYPE_CLASSIFY_JOB:
+		parentIds = append(parentIds, d.ClassifierID)
+	}
+	return parentIds
+
+}
+
+// Find the user id of the user who owns the given document, or an empty id
+// if neither it nor the documents it refers to have an owner.  If the
+// document (or one it refers to) doesn't exist, the 404 from the document
+// store is returned as is, so callers can tell that apart from the store
+// failing.
+func FindDocumentOwner(db DocumentStore, docId string) (string, error) {
+
+	for i := 0; i < maxOwnerLookupDepth; i++ {
+
+		doc := ownedDoc{}
+		if err := db.Retrieve(docId, &doc); err != nil {
+			if httputil.IsHTTPStatus(err, 404) {
+				return "", err
+			}
+			return "", fmt.Errorf("Didn't retrieve: %v - %v", docId, err)
+		}
+
+		if len(doc.UserID) > 0 {
+			return doc.UserID, nil
+		}
+
+		// a dataset's test datafile is always owned by the same user as
+		// its training datafile, so following the first parent is enough
+		parentIds := doc.parentIds()
+		if len(parentIds) == 0 || len(parentIds[0]) == 0 {
+			break
+		}
+		docId = parentIds[0]
+
+	}
+
+	return "", nil
+
+}
+
+// Given a blob path such as <doc-id>/trained.caffemodel, return the doc id
+// of the document the blob belongs to.
+func blobPathDocId(blobPath string) (string, error) {
+
+	cleaned := path.Clean(strings.TrimPrefix(blobPath, "/"))
+	components := strings.Split(cleaned, "/")
+	if len(components) < 2 || containsString(components, "..") {
+		return "", fmt.Errorf("Invalid blob path: %v", blobPath)
+	}
+	return components[0], nil
+
+}
+
+// Stream a blob from the blob store as an http response.  Range requests
+// and conditional requests (If-None-Match) are handled by http.ServeContent.
+// Blob stores that don't return a seekable reader are read through a
+// blobReadSeeker, so that a Range request only fetches the part of the blob
+// it needs.
+func serveBlob(w http.ResponseWriter, r *http.Request, blobStore BlobStore, blobPath string) error {
+
+	reader, err := blobStore.Get(blobPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var content io.ReadSeeker
+	var modTime time.Time
+	var etag string
+
+	contentType := mime.TypeByExtension(path.Ext(blobPath))
+
+	switch blobFile := reader.(type) {
+	case *os.File:
+		fileInfo, err := blobFile.Stat()
+		if err != nil {
+			return err
+		}
+		content = blobFile
+		modTime = fileInfo.ModTime()
+		etag = fmt.Sprintf("\"%x-%x\"", modTime.UnixNano(), fileInfo.Size())
+	default:
+		blobInfo, err := blobStore.Stat(blobPath)
+		if err != nil {
+			return err
+		}
+		blobReader := &blobReadSeeker{
+			blobStore: blobStore,
+			blobPath:  blobPath,
+			size:      blobInfo.Size,
+			reader:    reader,
+		}
+		defer blobReader.Close()
+		content = blobReader
+		modTime = blobInfo.ModTime
+		etag = fmt.Sprintf("\"%x-%x\"", modTime.UnixNano(), blobInfo.Size)
+		if len(blobInfo.Checksum) > 0 {
+			etag = fmt.Sprintf("\"%v\"", blobInfo.Checksum)
+		}
+		// otherwise http.ServeContent would read the start of the blob to
+		// sniff the type, and then have to fetch it again
+		if contentType == "" {
+			contentType = blobInfo.ContentType
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	}
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", etag)
+
+	logg.LogTo("REST", "Serving blob %v etag: %v", blobPath, etag)
+
+	http.ServeContent(w, r, path.Base(blobPath), modTime, content)
+
+	return nil
+
+}
+
+// An io.ReadSeeker over a blob.  Seeking doesn't do anything by itself, and
+// it's only if the next read isn't where the last one left off that the blob
+// is fetched again from the new offset onwards.
+type blobReadSeeker struct {
+	blobStore BlobStore
+	blobPath  string
+	size      int64
+	offset    int64
+
+	// the blob contents from readerOffset onwards, or nil if it needs to be
+	// fetched again
+	reader       io.ReadCloser
+	readerOffset int64
+}
+
+func (b *blobReadSeeker) Read(p []byte) (int, error) {
+
+	if b.reader != nil && b.readerOffset != b.offset {
+		if err := b.Close(); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.reader == nil {
+		if b.offset >= b.size {
+			return 0, io.EOF
+		}
+		reader, err := getBlobFrom(b.blobStore, b.blobPath, b.offset)
+		if err != nil {
+			return 0, err
+		}
+		b.reader = reader
+		b.readerOffset = b.offset
+	}
+
+	n, err := b.reader.Read(p)
+	b.offset += int64(n)
+	b.readerOffset = b.offset
+	return n, err
+
+}
+
+func (b *blobReadSeeker) Seek(offset int64, whence int) (int64, error) {
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, fmt.Errorf("Invalid whence: %v", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid offset: %v", offset)
+	}
+
+	b.offset = offset
+	return offset, nil
+
+}
+
+func (b *blobReadSeeker) Close() error {
+	if b.reader == nil {
+		return nil
+	}
+	err := b.reader.Close()
+	b.reader = nil
+	return err
+}
+
+// Get the contents of a blob from the given offset onwards.  Blob stores
+// which can't do that themselves have the start of the blob skipped over.
+func getBlobFrom(blobStore BlobStore, blobPath string, offset int64) (io.ReadCloser, error) {
+
+	if rangeBlobStore, ok := blobStore.(RangeBlobStore); ok && offset > 0 {
+		return rangeBlobStore.GetFrom(blobPath, offset)
+	}
+
+	reader, err := blobStore.Get(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+
+}
@@ -0,0 +1,95 @@
+package elasticthought
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestBlobPathDocId(t *testing.T) {
+
+	docId, err := blobPathDocId("/training-job/trained.caffemodel")
+	assert.True(t, err == nil)
+	assert.Equals(t, docId, "training-job")
+
+	_, err = blobPathDocId("training-job")
+	assert.True(t, err != nil)
+
+	_, err = blobPathDocId("../../etc/passwd")
+	assert.True(t, err != nil)
+
+}
+
+func TestServeBlobRange(t *testing.T) {
+
+	rootPath := filepath.Join(TempDir(), "blob-proxy-test")
+	blobStore, err := NewFileSystemBlobStore(rootPath)
+	assert.True(t, err == nil)
+
+	content := "0123456789"
+	err = blobStore.Put("", "doc/stdout", bytes.NewBufferString(content), BlobPutOptions{})
+	assert.True(t, err == nil)
+
+	request, _ := http.NewRequest("GET", "/blobs/doc/stdout", nil)
+	request.Header.Set("Range", "bytes=2-5")
+	recorder := httptest.NewRecorder()
+
+	err = serveBlob(recorder, request, blobStore, "doc/stdout")
+	assert.True(t, err == nil)
+	assert.Equals(t, recorder.Code, 206)
+	assert.Equals(t, recorder.Body.String(), "2345")
+	assert.True(t, len(recorder.Header().Get("ETag")) > 0)
+
+}
+
+func TestServeBlobNotSeekable(t *testing.T) {
+
+	blobStore := &MockBlobStore{
+		GetResponses: map[string]ResponseQueue{},
+	}
+	err := blobStore.Put("", "doc/result.json", bytes.NewBufferString(`{"a": "b"}`), BlobPutOptions{})
+	assert.True(t, err == nil)
+	blobStore.QueueGetResponse("doc/result.json", bytes.NewBufferString(`{"a": "b"}`))
+
+	request, _ := http.NewRequest("GET", "/blobs/doc/result.json", nil)
+	recorder := httptest.NewRecorder()
+
+	err = serveBlob(recorder, request, blobStore, "doc/result.json")
+	assert.True(t, err == nil)
+	assert.Equals(t, recorder.Code, 200)
+	assert.Equals(t, recorder.Header().Get("Content-Type"), "application/json")
+
+	body, _ := ioutil.ReadAll(recorder.Body)
+	assert.Equals(t, string(body), `{"a": "b"}`)
+
+}
+
+func TestServeBlobRangeNotSeekable(t *testing.T) {
+
+	fakeS3 := newFakeS3Server()
+	server := httptest.NewServer(fakeS3)
+	defer server.Close()
+
+	s3BlobStore := newTestS3BlobStore(t, server)
+	fakeS3.objects["/bucket/prefix/doc/stdout"] = []byte("0123456789")
+
+	request, _ := http.NewRequest("GET", "/blobs/doc/stdout", nil)
+	request.Header.Set("Range", "bytes=6-8")
+	recorder := httptest.NewRecorder()
+
+	err := serveBlob(recorder, request, s3BlobStore, "doc/stdout")
+	assert.True(t, err == nil)
+	assert.Equals(t, recorder.Code, 206)
+	assert.Equals(t, recorder.Body.String(), "678")
+	assert.Equals(t, recorder.Header().Get("ETag"), `"etag"`)
+
+	// the range was passed through to s3 rather than the whole blob
+	// being fetched
+	assert.True(t, containsString(fakeS3.ranges, "bytes=6-"))
+
+}
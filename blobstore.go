@@ -16,6 +16,32 @@ type BlobStore interface {
 	Put(srcname, dest string, r io.Reader, opts BlobPutOptions) error
 	Rm(fn string) error
 	OpenFile(path string) (BlobHandle, error)
+
+	// List all blobs whose path starts with the given prefix (eg, <doc-id>/)
+	List(prefix string) ([]BlobInfo, error)
+
+	// Get the metadata for the blob at the given path
+	Stat(path string) (BlobInfo, error)
+}
+
+// Implemented by blob stores which can fetch a blob from part way through,
+// without the bytes before it (eg, with an http Range request)
+type RangeBlobStore interface {
+	GetFrom(path string, offset int64) (io.ReadCloser, error)
+}
+
+// Metadata about a blob in the blob store
+type BlobInfo struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content-type"`
+	ModTime     time.Time `json:"modified"`
+
+	// Checksum of the blob contents.  The algorithm depends on the
+	// blob store (sha1 for cbfs and the filesystem, the ETag for s3).  The
+	// filesystem blob store only computes it in Stat, and leaves it out of
+	// List, since it means reading every blob.
+	Checksum string `json:"checksum,omitempty"`
 }
 
 // Calling OpenFile with a path on a BlobStore returns a
@@ -37,6 +63,9 @@ func NewBlobStore(rawurl string) (BlobStore, error) {
 	// http://ip:port  (cbfs)
 	// mock://mock (mock)
 	// file:///path/to/dir (local filesystem)
+	//
+	// s3://bucket/prefix is also supported, but since it needs credentials
+	// it must be created via Configuration.NewBlobStoreClient()
 
 	url, err := url.Parse(rawurl)
 	log.Printf("url: %v, scheme: %v, path: %v, err: %v", url, url.Scheme, url.Path, err)
@@ -48,6 +77,8 @@ func NewBlobStore(rawurl string) (BlobStore, error) {
 		return NewMockBlobStore(), nil
 	case "file":
 		return NewFileSystemBlobStore(url.Path)
+	case "s3":
+		return nil, fmt.Errorf("Use Configuration.NewBlobStoreClient() for s3 blob stores")
 	default:
 		msg := "Unrecognized blob store URI: %v.  If you are trying " +
 			"to use cbfs, make sure it ends with port 8484. " +
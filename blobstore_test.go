@@ -1,6 +1,9 @@
 package elasticthought
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/couchbaselabs/go.assert"
@@ -19,3 +22,70 @@ func TestNewBlobStore(t *testing.T) {
 	assert.True(t, ok)
 
 }
+
+func TestFileSystemBlobStoreListStat(t *testing.T) {
+
+	rootPath := filepath.Join(TempDir(), "list-stat-test")
+	os.RemoveAll(rootPath)
+	blobStore, err := NewFileSystemBlobStore(rootPath)
+	assert.True(t, err == nil)
+
+	blobs := []string{"job/stdout", "job/snapshots/snapshot_iter_100.caffemodel", "job2/stdout"}
+	for _, blob := range blobs {
+		err := blobStore.Put("", blob, bytes.NewBufferString("hello"), BlobPutOptions{})
+		assert.True(t, err == nil)
+	}
+
+	blobInfos, err := blobStore.List("job/")
+	assert.True(t, err == nil)
+	assert.Equals(t, len(blobInfos), 2)
+	assert.Equals(t, blobInfos[0].Path, "job/snapshots/snapshot_iter_100.caffemodel")
+	assert.Equals(t, blobInfos[1].Path, "job/stdout")
+	assert.Equals(t, blobInfos[1].Size, int64(5))
+
+	// listings leave out the checksum, which Stat fills in
+	assert.Equals(t, blobInfos[1].Checksum, "")
+
+	// entries which can't be read are skipped, rather than failing the listing
+	err = os.Symlink(filepath.Join(rootPath, "missing"), filepath.Join(rootPath, "job2", "dangling"))
+	assert.True(t, err == nil)
+
+	blobInfos, err = blobStore.List("job")
+	assert.True(t, err == nil)
+	assert.Equals(t, len(blobInfos), 3)
+
+	blobInfos, err = blobStore.List("nothing/")
+	assert.True(t, err == nil)
+	assert.Equals(t, len(blobInfos), 0)
+
+	blobInfo, err := blobStore.Stat("job/stdout")
+	assert.True(t, err == nil)
+	assert.Equals(t, blobInfo.Size, int64(5))
+	assert.Equals(t, blobInfo.Checksum, "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d")
+
+	_, err = blobStore.Stat("job/stderr")
+	assert.True(t, err != nil)
+
+}
+
+func TestMockBlobStoreListStat(t *testing.T) {
+
+	blobStore := &MockBlobStore{}
+
+	options := BlobPutOptions{}
+	options.ContentType = "text/plain"
+	err := blobStore.Put("", "job/stdout", bytes.NewBufferString("hello"), options)
+	assert.True(t, err == nil)
+
+	blobInfos, err := blobStore.List("job/")
+	assert.True(t, err == nil)
+	assert.Equals(t, len(blobInfos), 1)
+	assert.Equals(t, blobInfos[0].ContentType, "text/plain")
+
+	err = blobStore.Rm("job/stdout")
+	assert.True(t, err == nil)
+
+	_, err = blobStore.Stat("job/stdout")
+	assert.True(t, err != nil)
+
+}
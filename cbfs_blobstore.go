@@ -1,11 +1,18 @@
 package elasticthought
 
 import (
+	"fmt"
 	"io"
+	"path"
+	"sort"
+	"strings"
 
 	"github.com/couchbaselabs/cbfs/client"
 )
 
+// How deep to recurse into subdirectories when listing blobs
+const cbfsListDepth = 32
+
 type CbfsBlobStore struct {
 	uri string
 	*cbfsclient.Client
@@ -34,6 +41,78 @@ func (c *CbfsBlobStore) Put(srcname, dest string, r io.Reader, opts BlobPutOptio
 	return c.Client.Put(srcname, dest, r, cbfsPutOptions)
 }
 
+func (c *CbfsBlobStore) List(prefix string) ([]BlobInfo, error) {
+
+	// cbfs lists directories, so list the directory containing the
+	// prefix and filter out anything that doesn't match
+	dir := strings.TrimPrefix(prefix, "/")
+	if !strings.HasSuffix(dir, "/") {
+		dir = cbfsDir(dir)
+	}
+
+	listResult, err := c.Client.ListDepth(dir, cbfsListDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	blobInfos := []BlobInfo{}
+	for name, fileMeta := range listResult.Files {
+		blobPath := path.Join(dir, name)
+		if !strings.HasPrefix(blobPath, strings.TrimPrefix(prefix, "/")) {
+			continue
+		}
+		blobInfos = append(blobInfos, cbfsBlobInfo(blobPath, fileMeta))
+	}
+
+	sort.Sort(blobInfosByPath(blobInfos))
+
+	return blobInfos, nil
+
+}
+
+func (c *CbfsBlobStore) Stat(blobPath string) (BlobInfo, error) {
+
+	blobPath = strings.TrimPrefix(blobPath, "/")
+
+	listResult, err := c.Client.List(cbfsDir(blobPath))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	fileMeta, ok := listResult.Files[path.Base(blobPath)]
+	if !ok {
+		return BlobInfo{}, fmt.Errorf("No blob found at: %v", blobPath)
+	}
+
+	return cbfsBlobInfo(blobPath, fileMeta), nil
+
+}
+
+// The directory containing the given blob path, or "" for the root
+func cbfsDir(blobPath string) string {
+	dir := path.Dir(blobPath)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+func cbfsBlobInfo(blobPath string, fileMeta cbfsclient.FileMeta) BlobInfo {
+	return BlobInfo{
+		Path:        blobPath,
+		Size:        fileMeta.Length,
+		ContentType: fileMeta.Headers.Get("Content-Type"),
+		ModTime:     fileMeta.Modified,
+		Checksum:    fileMeta.OID,
+	}
+}
+
+type blobInfosByPath []BlobInfo
+
+func (b blobInfosByPath) Len() int           { return len(b) }
+func (b blobInfosByPath) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b blobInfosByPath) Less(i, j int) bool { return b[i].Path < b[j].Path }
+
 /*
 func (c *CbfsBlobStore) OpenFile(path string) (BlobHandle, error) {
 	cbfsFileHandle, err := c.Client.OpenFile(path)
@@ -2,11 +2,14 @@ package elasticthought
 
 import (
 	"bufio"
+	"crypto/sha1"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"strings"
 
 	"github.com/couchbaselabs/logg"
@@ -61,6 +64,38 @@ func saveUrlToBlobStore(sourceUrl, destPath string, blobStore BlobStore) error {
 
 }
 
+// Save a file uploaded in a multipart form to <destDir>/<sha1 of contents>
+// and return the dest path
+func saveUploadToBlobStore(fileHeader *multipart.FileHeader, destDir string, blobStore BlobStore) (string, error) {
+
+	f, err := fileHeader.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+	destPath := path.Join(destDir, fmt.Sprintf("%x", hash.Sum(nil)))
+
+	options := BlobPutOptions{}
+	options.ContentType = fileHeader.Header.Get("Content-Type")
+
+	if err := blobStore.Put("", destPath, f, options); err != nil {
+		return "", fmt.Errorf("Error writing %v to blobStore: %v", destPath, err)
+	}
+
+	logg.LogTo("CBFS", "Wrote upload %v to blobStore: %v", fileHeader.Filename, destPath)
+
+	return destPath, nil
+
+}
+
 // Get the content from cbfs from given sourcepath
 func getContentFromBlobStore(blobStore BlobStore, sourcePath string) ([]byte, error) {
 
@@ -4,22 +4,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/couchbaselabs/logg"
 	"github.com/tleyden/go-couch"
 )
 
 // A changes listener listens for changes on the _changes feed and reacts to them.
-// The changes listener currently runs as a goroutine in the httpd process, and
-// so the system only currently supports having a single httpd process, because otherwise
-// there would be multiple changes listeners on the same changes feed, which will
-// cause duplicate jobs to get kicked off.  If the system needs to support multiple
-// http processes, then the changes listener needs to run in its own process.
+// The changes listener runs as a goroutine in the httpd process.  When there are
+// multiple httpd processes, only the one elected leader (see LeaderElector) should
+// follow the changes feed, since otherwise duplicate jobs would get kicked off.
 type ChangesListener struct {
 	Configuration Configuration
-	Database      couch.Database
+	Database      DocumentStore
 	JobScheduler  JobScheduler
+
+	// If set, the changes listener stops following the changes feed as soon as
+	// this returns false.  If nil, it follows the changes feed forever.
+	IsLeader func() bool
 }
 
 // Create a new ChangesListener
@@ -39,10 +43,24 @@ func (c ChangesListener) FollowChangesFeed() {
 
 	logg.LogTo("CHANGES", "going to follow changes feed")
 
-	var since interface{}
+	// pick up where we left off before the last restart
+	since, err := c.loadCheckpoint()
+	if err != nil {
+		logg.LogTo("CHANGES", "No checkpoint, starting from scratch: %v", err)
+	}
+
+	// catch any pending docs that were missed, eg because they were created
+	// while the server was down, or were already behind the checkpoint
+	if err := c.SchedulePendingDocs(); err != nil {
+		logg.LogError(fmt.Errorf("Error scheduling pending docs: %v", err))
+	}
 
 	handleChange := func(reader io.Reader) interface{} {
 		logg.LogTo("CHANGES", "handleChange() callback called")
+		if !c.isLeader() {
+			logg.LogTo("CHANGES", "No longer the leader, stop following changes")
+			return nil
+		}
 		changes, err := decodeChanges(reader)
 		if err != nil {
 			// it's very common for this to timeout while waiting for new changes.
@@ -52,6 +70,12 @@ func (c ChangesListener) FollowChangesFeed() {
 		}
 		c.processChanges(changes)
 
+		if needsCheckpoint(changes) {
+			if err := c.saveCheckpoint(changes.LastSequence); err != nil {
+				logg.LogError(fmt.Errorf("Error saving checkpoint: %v", err))
+			}
+		}
+
 		since = changes.LastSequence
 		logg.LogTo("CHANGES", "returning since: %v", since)
 		return since
@@ -60,22 +84,149 @@ func (c ChangesListener) FollowChangesFeed() {
 
 	options := map[string]interface{}{}
 	options["feed"] = "longpoll"
+	if since != nil {
+		options["since"] = since
+	}
+	if c.IsLeader != nil {
+		// wake up regularly to notice if leadership has been lost
+		options["timeout"] = int(DEFAULT_LEADER_LEASE_TTL / time.Millisecond)
+	}
 
 	logg.LogTo("CHANGES", "Following changes feed: %+v.", options)
 
 	// this will block until the handleChange callback returns nil
 	c.Database.Changes(handleChange, options)
 
+	if !c.isLeader() {
+		return
+	}
+
 	logg.LogPanic("Changes listener died -- this should never happen")
 
 }
 
+func (c ChangesListener) isLeader() bool {
+	return c.IsLeader == nil || c.IsLeader()
+}
+
+// Schedule every job doc that is in the Pending state
+func (c ChangesListener) SchedulePendingDocs() error {
+
+	rows, err := allDocs(c.Database)
+	if err != nil {
+		return err
+	}
+
+	pendingDocIds, err := findPendingDocIds(rows)
+	if err != nil {
+		return err
+	}
+
+	logg.LogTo("CHANGES", "Scheduling %v pending docs", len(pendingDocIds))
+
+	changes := couch.Changes{}
+	for _, docId := range pendingDocIds {
+		changes.Results = append(changes.Results, couch.Change{Id: docId})
+	}
+	c.processChanges(changes)
+
+	return nil
+
+}
+
+// The checkpoint records the last sequence of the changes feed that was
+// processed, so that the changes listener can resume from there on restart.
+type ChangesCheckpoint struct {
+	ElasticThoughtDoc
+	LastSequence interface{} `json:"last-sequence"`
+}
+
+func (c ChangesListener) loadCheckpoint() (interface{}, error) {
+	checkpoint := ChangesCheckpoint{}
+	if err := c.Database.Retrieve(CHANGES_CHECKPOINT_DOC_ID, &checkpoint); err != nil {
+		return nil, err
+	}
+	logg.LogTo("CHANGES", "Loaded checkpoint: %v", checkpoint.LastSequence)
+	return checkpoint.LastSequence, nil
+}
+
+func (c ChangesListener) saveCheckpoint(lastSequence interface{}) error {
+
+	checkpoint := &ChangesCheckpoint{}
+	if err := c.Database.Retrieve(CHANGES_CHECKPOINT_DOC_ID, checkpoint); err != nil {
+		checkpoint = &ChangesCheckpoint{
+			ElasticThoughtDoc: ElasticThoughtDoc{Type: DOC_TYPE_CHECKPOINT},
+			LastSequence:      lastSequence,
+		}
+		_, _, err := c.Database.InsertWith(checkpoint, CHANGES_CHECKPOINT_DOC_ID)
+		return err
+	}
+
+	updater := func(checkpointPtr interface{}) {
+		checkpointPtr.(*ChangesCheckpoint).LastSequence = lastSequence
+	}
+
+	doneMetric := func(checkpointPtr interface{}) bool {
+		return reflect.DeepEqual(checkpointPtr.(*ChangesCheckpoint).LastSequence, lastSequence)
+	}
+
+	refresh := func(checkpointPtr interface{}) error {
+		return c.Database.Retrieve(CHANGES_CHECKPOINT_DOC_ID, checkpointPtr)
+	}
+
+	_, err := casUpdate(c.Database, checkpoint, updater, doneMetric, refresh)
+	return err
+
+}
+
+// Only save a checkpoint if the changes include something other than the
+// checkpoint itself, otherwise every checkpoint save would show up on the
+// changes feed and trigger another checkpoint save.  The job queue doc and
+// the leader lease doc are ignored too, since they change every time a worker
+// touches a job or the leader renews its lease.
+func needsCheckpoint(changes couch.Changes) bool {
+	for _, change := range changes.Results {
+		switch change.Id {
+		case CHANGES_CHECKPOINT_DOC_ID, JOB_QUEUE_DOC_ID, LEADER_LEASE_DOC_ID:
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Find the ids of all job docs in the Pending state
+func findPendingDocIds(rows []allDocsRow) ([]string, error) {
+
+	pendingDocIds := []string{}
+	for _, row := range rows {
+
+		doc := struct {
+			ElasticThoughtDoc
+			ProcessingState *ProcessingState `json:"processing-state"`
+		}{}
+		if err := json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, fmt.Errorf("Error decoding doc: %v.  Err: %v", row.Id, err)
+		}
+
+		if doc.ProcessingState != nil && *doc.ProcessingState == Pending {
+			pendingDocIds = append(pendingDocIds, row.Id)
+		}
+
+	}
+	return pendingDocIds, nil
+
+}
+
 func (c ChangesListener) processChanges(changes couch.Changes) {
 
 	for _, change := range changes.Results {
 
 		if change.Deleted {
 			logg.LogTo("CHANGES", "change was deleted, skipping")
+			if observer, ok := c.JobScheduler.(JobStateObserver); ok {
+				observer.JobDeleted(change.Id)
+			}
 			continue
 		}
 
@@ -122,6 +273,8 @@ func (c ChangesListener) handleTrainingJobChange(change couch.Change, doc Elasti
 		return
 	}
 
+	c.observeJobState(doc.Id, trainingJob.ProcessingState)
+
 	// check the state, only schedule if state == pending
 	if trainingJob.ProcessingState != Pending {
 		logg.LogTo("CHANGES", "State != pending: %+v", trainingJob)
@@ -145,6 +298,8 @@ func (c ChangesListener) handleClassifyJobChange(change couch.Change, doc Elasti
 		return
 	}
 
+	c.observeJobState(doc.Id, classifyJob.ProcessingState)
+
 	// check the state, only schedule if state == pending
 	if classifyJob.ProcessingState != Pending {
 		logg.LogTo("CHANGES", "State != pending: %+v", classifyJob)
@@ -170,6 +325,8 @@ func (c ChangesListener) handleDatasetChange(change couch.Change, doc ElasticTho
 
 	logg.LogTo("CHANGES", "convert to dataset: %+v", dataset)
 
+	c.observeJobState(doc.Id, dataset.ProcessingState)
+
 	// check the state, only schedule if state == pending
 	if dataset.ProcessingState != Pending {
 		logg.LogTo("CHANGES", "Dataset state != pending: %+v", dataset)
@@ -195,6 +352,8 @@ func (c ChangesListener) handleDatafileChange(change couch.Change, doc ElasticTh
 
 	logg.LogTo("CHANGES", "convert to datafile: %+v", datafile)
 
+	c.observeJobState(doc.Id, datafile.ProcessingState)
+
 	// check the state, only schedule if state == pending
 	if datafile.ProcessingState != Pending {
 		logg.LogTo("CHANGES", "Datafile state != pending: %+v", datafile)
@@ -206,6 +365,13 @@ func (c ChangesListener) handleDatafileChange(change couch.Change, doc ElasticTh
 
 }
 
+// Let the job scheduler know about the job's state, if it wants to know
+func (c ChangesListener) observeJobState(docId string, state ProcessingState) {
+	if observer, ok := c.JobScheduler.(JobStateObserver); ok {
+		observer.JobStateChanged(docId, state)
+	}
+}
+
 func decodeChanges(reader io.Reader) (couch.Changes, error) {
 
 	changes := couch.Changes{}
@@ -0,0 +1,43 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+	"github.com/tleyden/go-couch"
+)
+
+func TestNeedsCheckpoint(t *testing.T) {
+
+	changes := couch.Changes{
+		Results: []couch.Change{
+			{Id: CHANGES_CHECKPOINT_DOC_ID},
+			{Id: JOB_QUEUE_DOC_ID},
+			{Id: LEADER_LEASE_DOC_ID},
+		},
+	}
+	assert.False(t, needsCheckpoint(changes))
+
+	changes.Results = append(changes.Results, couch.Change{Id: "training-job"})
+	assert.True(t, needsCheckpoint(changes))
+
+	assert.False(t, needsCheckpoint(couch.Changes{}))
+
+}
+
+func TestFindPendingDocIds(t *testing.T) {
+
+	rows := []allDocsRow{
+		{Id: "datafile", Doc: json.RawMessage(`{"type": "datafile", "processing-state": "finished_successfully"}`)},
+		{Id: "dataset", Doc: json.RawMessage(`{"type": "dataset", "processing-state": "pending"}`)},
+		{Id: "solver", Doc: json.RawMessage(`{"type": "solver"}`)},
+		{Id: "training-job", Doc: json.RawMessage(`{"type": "training-job", "processing-state": "processing"}`)},
+		{Id: "classify-job", Doc: json.RawMessage(`{"type": "classify-job", "processing-state": "pending"}`)},
+	}
+
+	pendingDocIds, err := findPendingDocIds(rows)
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, pendingDocIds, []string{"dataset", "classify-job"})
+
+}
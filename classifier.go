@@ -8,12 +8,12 @@ import (
 	"github.com/couchbaselabs/logg"
 	"github.com/golang/protobuf/proto"
 	"github.com/tleyden/elastic-thought/caffe"
-	"github.com/tleyden/go-couch"
 )
 
 // A classifier uses a trained model to classify new incoming data points
 type Classifier struct {
 	ElasticThoughtDoc
+	UserID           string `json:"user-id"`
 	SpecificationUrl string `json:"specification-url" binding:"required"`
 	TrainingJobID    string `json:"training-job-id" binding:"required"`
 	Scale            string `json:"scale" binding:"required"`
@@ -22,10 +22,15 @@ type Classifier struct {
 	Color            bool   `json:"color"`
 	Gpu              bool   `json:"gpu"`
 
+	// The docker image to classify with, when using the docker executor.  If
+	// empty, Configuration.DockerImage is used.
+	CaffeImage string `json:"caffe-image"`
+
 	// had to make exported, due to https://github.com/gin-gonic/gin/pull/123
 	// waiting for this to get merged into master branch, since go get
-	// pulls from master branch.
-	Configuration Configuration
+	// pulls from master branch.  It's never saved in the doc or sent to
+	// clients, since it holds credentials such as S3 keys and the queue token.
+	Configuration Configuration `json:"-"`
 }
 
 // Create a new classifier.  If you don't use this, you must set the
@@ -97,13 +102,14 @@ func (c *Classifier) casUpdate(updater func(*Classifier), doneMetric func(Classi
 
 }
 
-func (c *Classifier) RefreshFromDB(db couch.Database) error {
+func (c *Classifier) RefreshFromDB(db DocumentStore) error {
 	classifier := Classifier{}
 	err := db.Retrieve(c.Id, &classifier)
 	if err != nil {
 		logg.LogTo("CLASSIFIER", "Error getting latest: %v", err)
 		return err
 	}
+	classifier.Configuration = c.Configuration
 	*c = classifier
 	return nil
 }
@@ -154,7 +160,7 @@ func (c Classifier) validateClassifierNet() error {
 
 	_, err := c.classifierNet()
 	if err != nil {
-		return err
+		return InvalidSpecError{Spec: c.SpecificationUrl, Err: err}
 	}
 	return nil
 
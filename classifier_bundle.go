@@ -0,0 +1,393 @@
+package elasticthought
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/couchbaselabs/logg"
+)
+
+// The files (other than the manifest) that make up a classifier bundle
+var bundleFiles = []string{
+	BUNDLE_CAFFE_MODEL,
+	BUNDLE_CLASSIFIER_SPEC,
+	BUNDLE_LABELS,
+	BUNDLE_SOLVER_SPEC,
+	BUNDLE_SOLVER_NET_SPEC,
+}
+
+// The manifest of a classifier bundle.  A bundle is a .tar.gz file which
+// contains everything needed to run a classifier outside of elastic-thought,
+// or to re-create it in another elastic-thought instance.
+type ClassifierBundleManifest struct {
+	ClassifierID  string    `json:"classifier-id"`
+	TrainingJobID string    `json:"training-job-id"`
+	SolverID      string    `json:"solver-id"`
+	LayerType     LayerType `json:"layer-type"`
+	Scale         string    `json:"scale"`
+	ImageWidth    string    `json:"image-width"`
+	ImageHeight   string    `json:"image-height"`
+	Color         bool      `json:"color"`
+	CaffeImage    string    `json:"caffe-image"`
+
+	// Key: filename within the bundle
+	// Value: sha1 checksum of the file contents
+	Checksums map[string]string `json:"checksums"`
+}
+
+// Write a .tar.gz bundle of this classifier to the given writer.  Nothing
+// will be written to the writer if an error occurs while collecting the
+// bundle contents.
+func (c Classifier) WriteBundle(w io.Writer) error {
+
+	trainingJob, err := c.getTrainingJob()
+	if err != nil {
+		return fmt.Errorf("Error getting training job: %v.  Err: %v", c.TrainingJobID, err)
+	}
+
+	if trainingJob.ProcessingState != FinishedSuccessfully {
+		return fmt.Errorf("Training job %v is not finished yet", trainingJob.Id)
+	}
+
+	solver, err := trainingJob.getSolver()
+	if err != nil {
+		return err
+	}
+
+	blobStore, err := c.Configuration.NewBlobStoreClient()
+	if err != nil {
+		return err
+	}
+
+	bundleDir := c.newBundleDirectory()
+	if err := Mkdir(bundleDir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(bundleDir)
+
+	// download the blobs that go into the bundle
+	sources := []struct {
+		Uri      string
+		Filename string
+	}{
+		{trainingJob.TrainedModelUrl, BUNDLE_CAFFE_MODEL},
+		{c.SpecificationUrl, BUNDLE_CLASSIFIER_SPEC},
+		{solver.SpecificationUrl, BUNDLE_SOLVER_SPEC},
+		{solver.SpecificationNetUrl, BUNDLE_SOLVER_NET_SPEC},
+	}
+	for _, source := range sources {
+		destPath := filepath.Join(bundleDir, source.Filename)
+		logg.LogTo("CLASSIFIER", "Bundle %v -> %v", source.Uri, destPath)
+		if err := downloadFromBlobStore(blobStore, source.Uri, destPath); err != nil {
+			return fmt.Errorf("Error downloading %v.  Err: %v", source.Uri, err)
+		}
+	}
+
+	// write out the label index, one label per line
+	labelsPath := filepath.Join(bundleDir, BUNDLE_LABELS)
+	if err := writeTocToFile(trainingJob.Labels, labelsPath); err != nil {
+		return err
+	}
+
+	manifest := ClassifierBundleManifest{
+		ClassifierID:  c.Id,
+		TrainingJobID: trainingJob.Id,
+		SolverID:      solver.Id,
+		LayerType:     solver.LayerType,
+		Scale:         c.Scale,
+		ImageWidth:    c.ImageWidth,
+		ImageHeight:   c.ImageHeight,
+		Color:         c.Color,
+		CaffeImage:    c.CaffeImage,
+	}
+
+	return writeClassifierBundle(w, bundleDir, manifest)
+
+}
+
+// Recreate a classifier from a bundle created by WriteBundle.  Since a
+// classifier depends on a training job and a solver, those will be
+// re-created as well, with the training job already marked as finished.
+func ImportClassifierBundle(config Configuration, userID string, r io.Reader) (classifier *Classifier, err error) {
+
+	importDir := filepath.Join(config.WorkDirectory, fmt.Sprintf("bundle-%v", NewUuid()))
+	if err := Mkdir(importDir); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(importDir)
+
+	manifest, err := readClassifierBundle(r, importDir)
+	if err != nil {
+		return nil, InvalidSpecError{Spec: "classifier bundle", Err: err}
+	}
+
+	labels, err := readLabelsFile(filepath.Join(importDir, BUNDLE_LABELS))
+	if err != nil {
+		return nil, InvalidSpecError{Spec: BUNDLE_LABELS, Err: err}
+	}
+
+	db := config.DbConnection()
+
+	blobStore, err := config.NewBlobStoreClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// the docs created so far, dependents first, so that they can be
+	// removed along with their blobs if a later step fails
+	created := []string{}
+	defer func() {
+		if err == nil || len(created) == 0 {
+			return
+		}
+		if deleteErr := DeleteDocuments(config, created); deleteErr != nil {
+			logg.LogError(fmt.Errorf("Error cleaning up import of classifier bundle: %v.  Err: %v", created, deleteErr))
+		}
+	}()
+
+	// solver
+	solver := NewSolver(config)
+	solver.UserID = userID
+	solver.LayerType = manifest.LayerType
+	solver, err = solver.Insert(db)
+	if err != nil {
+		return nil, err
+	}
+	created = append([]string{solver.Id}, created...)
+	solver.Configuration = config
+
+	solverSpecPath := path.Join(solver.Id, BUNDLE_SOLVER_SPEC)
+	solverNetSpecPath := path.Join(solver.Id, BUNDLE_SOLVER_NET_SPEC)
+	if err := saveFileToBlobStore(filepath.Join(importDir, BUNDLE_SOLVER_SPEC), solverSpecPath, "text/plain", blobStore); err != nil {
+		return nil, err
+	}
+	if err := saveFileToBlobStore(filepath.Join(importDir, BUNDLE_SOLVER_NET_SPEC), solverNetSpecPath, "text/plain", blobStore); err != nil {
+		return nil, err
+	}
+	solver.SpecificationUrl = fmt.Sprintf("%v%v", CBFS_URI_PREFIX, solverSpecPath)
+	solver.SpecificationNetUrl = fmt.Sprintf("%v%v", CBFS_URI_PREFIX, solverNetSpecPath)
+	solver, err = solver.Save(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// training job, which is inserted as already finished so that
+	// the changes listener won't try to run it
+	trainingJob := NewTrainingJob(config)
+	trainingJob.UserID = userID
+	trainingJob.SolverId = solver.Id
+	trainingJob.Labels = labels
+	trainingJob.ProcessingState = FinishedSuccessfully
+	trainingJob, err = trainingJob.Insert(db)
+	if err != nil {
+		return nil, err
+	}
+	created = append([]string{trainingJob.Id}, created...)
+	trainingJob.Configuration = config
+
+	if err := trainingJob.uploadCaffeModelToCbfs(filepath.Join(importDir, BUNDLE_CAFFE_MODEL)); err != nil {
+		return nil, err
+	}
+	if err := trainingJob.updateCaffeModelUrl(); err != nil {
+		return nil, err
+	}
+
+	// classifier
+	classifier = NewClassifier(config)
+	classifier.UserID = userID
+	classifier.TrainingJobID = trainingJob.Id
+	classifier.Scale = manifest.Scale
+	classifier.ImageWidth = manifest.ImageWidth
+	classifier.ImageHeight = manifest.ImageHeight
+	classifier.Color = manifest.Color
+	classifier.CaffeImage = manifest.CaffeImage
+	if err := classifier.Insert(); err != nil {
+		return nil, err
+	}
+	created = append([]string{classifier.Id}, created...)
+
+	classifierSpecPath := path.Join(classifier.Id, BUNDLE_CLASSIFIER_SPEC)
+	if err := saveFileToBlobStore(filepath.Join(importDir, BUNDLE_CLASSIFIER_SPEC), classifierSpecPath, "text/plain", blobStore); err != nil {
+		return nil, err
+	}
+	specUrlCbfs := fmt.Sprintf("%v%v", CBFS_URI_PREFIX, classifierSpecPath)
+	if err := classifier.SetSpecificationUrl(specUrlCbfs); err != nil {
+		return nil, err
+	}
+
+	logg.LogTo("CLASSIFIER", "Imported classifier bundle %v as %v", manifest.ClassifierID, classifier.Id)
+
+	return classifier, nil
+
+}
+
+// A directory to collect the bundle files in, which is different for every
+// call so that concurrent downloads of the same classifier don't clash
+func (c Classifier) newBundleDirectory() string {
+	return filepath.Join(c.Configuration.WorkDirectory, c.Id, fmt.Sprintf("bundle-%v", NewUuid()))
+}
+
+// Write the files in bundleDir along with the manifest to a .tar.gz stream.
+// The manifest is the first entry so that readers can inspect it without
+// reading the whole bundle.
+func writeClassifierBundle(w io.Writer, bundleDir string, manifest ClassifierBundleManifest) error {
+
+	manifest.Checksums = map[string]string{}
+	for _, filename := range bundleFiles {
+		checksum, err := sha1File(filepath.Join(bundleDir, filename))
+		if err != nil {
+			return err
+		}
+		manifest.Checksums[filename] = checksum
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	hdr := &tar.Header{
+		Name: BUNDLE_MANIFEST,
+		Mode: 0644,
+		Size: int64(len(manifestBytes)),
+	}
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(manifestBytes); err != nil {
+		return err
+	}
+
+	for _, filename := range bundleFiles {
+		if err := addFileToTar(tarWriter, filepath.Join(bundleDir, filename)); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+
+}
+
+// Extract a classifier bundle .tar.gz stream into destDir, and verify
+// that all files are present and match the checksums in the manifest.
+func readClassifierBundle(r io.Reader, destDir string) (*ClassifierBundleManifest, error) {
+
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	limitedReader := &io.LimitedReader{R: gzipReader, N: MAX_CLASSIFIER_BUNDLE_BYTES + 1}
+	_, err = untarWithToc(limitedReader, destDir)
+	if limitedReader.N <= 0 {
+		return nil, fmt.Errorf("Bundle is larger than %v bytes once extracted", MAX_CLASSIFIER_BUNDLE_BYTES)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifestFile, err := os.Open(filepath.Join(destDir, BUNDLE_MANIFEST))
+	if err != nil {
+		return nil, fmt.Errorf("Bundle has no %v", BUNDLE_MANIFEST)
+	}
+	defer manifestFile.Close()
+
+	manifest := &ClassifierBundleManifest{}
+	if err := json.NewDecoder(manifestFile).Decode(manifest); err != nil {
+		return nil, err
+	}
+
+	for _, filename := range bundleFiles {
+		expected, ok := manifest.Checksums[filename]
+		if !ok {
+			return nil, fmt.Errorf("No checksum for %v in manifest", filename)
+		}
+		actual, err := sha1File(filepath.Join(destDir, filename))
+		if err != nil {
+			return nil, fmt.Errorf("Bundle has no %v", filename)
+		}
+		if actual != expected {
+			return nil, fmt.Errorf("Checksum mismatch for %v: %v != %v", filename, actual, expected)
+		}
+	}
+
+	return manifest, nil
+
+}
+
+func addFileToTar(tarWriter *tar.Writer, sourcePath string) error {
+
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(fileInfo, "")
+	if err != nil {
+		return err
+	}
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tarWriter, f)
+	return err
+
+}
+
+// Read a file with one label per line
+func readLabelsFile(sourcePath string) ([]string, error) {
+
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	labels := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		label := strings.TrimSpace(scanner.Text())
+		if len(label) > 0 {
+			labels = append(labels, label)
+		}
+	}
+	return labels, scanner.Err()
+
+}
+
+func sha1File(sourcePath string) (string, error) {
+
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+
+}
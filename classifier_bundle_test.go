@@ -0,0 +1,129 @@
+package elasticthought
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestClassifierBundleRoundTrip(t *testing.T) {
+
+	sourceDir := filepath.Join(TempDir(), NewUuid())
+	err := Mkdir(sourceDir)
+	assert.True(t, err == nil)
+
+	for _, filename := range bundleFiles {
+		err := ioutil.WriteFile(filepath.Join(sourceDir, filename), []byte(filename), 0644)
+		assert.True(t, err == nil)
+	}
+
+	manifest := ClassifierBundleManifest{
+		ClassifierID: "classifier",
+		LayerType:    IMAGE_DATA,
+		Scale:        "255",
+		ImageWidth:   "28",
+		ImageHeight:  "28",
+	}
+
+	buf := new(bytes.Buffer)
+	err = writeClassifierBundle(buf, sourceDir, manifest)
+	assert.True(t, err == nil)
+
+	destDir := filepath.Join(TempDir(), NewUuid())
+	err = Mkdir(destDir)
+	assert.True(t, err == nil)
+
+	readManifest, err := readClassifierBundle(buf, destDir)
+	assert.True(t, err == nil)
+	assert.Equals(t, readManifest.ClassifierID, "classifier")
+	assert.Equals(t, readManifest.LayerType, IMAGE_DATA)
+	assert.Equals(t, readManifest.ImageWidth, "28")
+	assert.Equals(t, len(readManifest.Checksums), len(bundleFiles))
+
+	content, err := ioutil.ReadFile(filepath.Join(destDir, BUNDLE_CAFFE_MODEL))
+	assert.True(t, err == nil)
+	assert.Equals(t, string(content), BUNDLE_CAFFE_MODEL)
+
+}
+
+func TestClassifierBundleChecksumMismatch(t *testing.T) {
+
+	manifest := ClassifierBundleManifest{
+		Checksums: map[string]string{},
+	}
+	files := []tarFile{}
+	for _, filename := range bundleFiles {
+		manifest.Checksums[filename] = "bogus"
+		files = append(files, tarFile{filename, filename})
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	assert.True(t, err == nil)
+	files = append(files, tarFile{BUNDLE_MANIFEST, string(manifestBytes)})
+
+	tarBuf := new(bytes.Buffer)
+	createArchive(tarBuf, files)
+
+	buf := new(bytes.Buffer)
+	gzipWriter := gzip.NewWriter(buf)
+	_, err = gzipWriter.Write(tarBuf.Bytes())
+	assert.True(t, err == nil)
+	err = gzipWriter.Close()
+	assert.True(t, err == nil)
+
+	destDir := filepath.Join(TempDir(), NewUuid())
+	_, err = readClassifierBundle(buf, destDir)
+	assert.True(t, err != nil)
+
+}
+
+func TestImportClassifierBundleCleansUpOnError(t *testing.T) {
+
+	sourceDir := filepath.Join(TempDir(), NewUuid())
+	err := Mkdir(sourceDir)
+	assert.True(t, err == nil)
+	for _, filename := range bundleFiles {
+		err := ioutil.WriteFile(filepath.Join(sourceDir, filename), []byte(filename), 0644)
+		assert.True(t, err == nil)
+	}
+	buf := new(bytes.Buffer)
+	err = writeClassifierBundle(buf, sourceDir, ClassifierBundleManifest{LayerType: IMAGE_DATA})
+	assert.True(t, err == nil)
+
+	// the trained model can't be uploaded, which happens after the solver
+	// and training job docs have been created
+	fakeS3 := newFakeS3Server()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "trained.caffemodel") {
+			w.WriteHeader(500)
+			return
+		}
+		fakeS3.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	config := *NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://classifier_bundle_test_%v", NewUuid())
+	config.CbfsUrl = "s3://bucket/prefix"
+	config.S3Endpoint = server.URL
+	config.S3AccessKey = "access"
+	config.S3SecretKey = "secret"
+
+	_, err = ImportClassifierBundle(config, "user:foo", buf)
+	assert.True(t, err != nil)
+
+	// nothing is left behind
+	rows, err := allDocs(config.DbConnection())
+	assert.True(t, err == nil)
+	assert.Equals(t, len(rows), 0)
+	assert.Equals(t, len(fakeS3.objects), 0)
+
+}
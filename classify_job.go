@@ -4,15 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/couchbaselabs/logg"
-	"github.com/tleyden/go-couch"
 )
 
 // A classify job tries to classify images given by user against
@@ -21,9 +20,14 @@ type ClassifyJob struct {
 	ElasticThoughtDoc
 	ProcessingState ProcessingState `json:"processing-state"`
 	ProcessingLog   string          `json:"processing-log"`
+	Lease           JobLease        `json:"lease"`
+	Attempts        []JobAttempt    `json:"attempts"`
+	UserID          string          `json:"user-id"`
+	Priority        int             `json:"priority"`
 	StdOutUrl       string          `json:"std-out-url"`
 	StdErrUrl       string          `json:"std-err-url"`
 	ClassifierID    string          `json:"classifier-id"`
+	CreatedAt       time.Time       `json:"created-at"`
 
 	// Key: image url of image in cbfs
 	// Value: the classification result for that image
@@ -31,8 +35,9 @@ type ClassifyJob struct {
 
 	// had to make exported, due to https://github.com/gin-gonic/gin/pull/123
 	// waiting for this to get merged into master branch, since go get
-	// pulls from master branch.
-	Configuration Configuration
+	// pulls from master branch.  It's never saved in the doc or sent to
+	// clients, since it holds credentials such as S3 keys and the queue token.
+	Configuration Configuration `json:"-"`
 }
 
 // Create a new classify job.  If you don't use this, you must set the
@@ -44,6 +49,10 @@ func NewClassifyJob(c Configuration) *ClassifyJob {
 	}
 }
 
+func (c *ClassifyJob) JobType() string {
+	return DOC_TYPE_CLASSIFY_JOB
+}
+
 // Run this job
 func (c *ClassifyJob) Run(wg *sync.WaitGroup) {
 
@@ -51,7 +60,7 @@ func (c *ClassifyJob) Run(wg *sync.WaitGroup) {
 
 	logg.LogTo("CLASSIFY_JOB", "Run() called!")
 
-	updatedState, err := c.UpdateProcessingState(Processing)
+	updatedState, stopLease, err := startJobLease(c.Configuration, c, c.Id)
 	if err != nil {
 		c.recordProcessingError(err)
 		return
@@ -61,6 +70,7 @@ func (c *ClassifyJob) Run(wg *sync.WaitGroup) {
 		logg.LogTo("CLASSIFY_JOB", "%+v already processed.  Ignoring.", c)
 		return
 	}
+	defer stopLease()
 
 	// TODO: add code to run job
 
@@ -162,28 +172,24 @@ func (c ClassifyJob) invokeCaffe(saveStdoutCbfs bool, classifier Classifier) (ma
 		cmdArgs = append(cmdArgs, "--gpu")
 	}
 
-	python := "python"
-
-	// debugging
-	logg.LogTo("CLASSIFY_JOB", "Running %v with args %v", python, cmdArgs)
-	logg.LogTo("CLASSIFY_JOB", "Path %v", os.Getenv("PATH"))
-
-	// explicitly check if caffe binary found on the PATH
-	lookPathResult, err := exec.LookPath("python")
+	executor, err := c.Configuration.NewExecutor()
 	if err != nil {
-		logg.LogError(fmt.Errorf("python not found on path: %v", err))
+		return nil, err
 	}
-	logg.LogTo("CLASSIFY_JOB", "python found on path: %v", lookPathResult)
-
-	// Create command, but don't actually run it yet
-	cmd := exec.Command(python, cmdArgs...)
 
-	// set the directory where the command will be run in (important
-	// because we depend on relative file paths to work)
-	cmd.Dir = c.getWorkDirectory()
+	spec := ExecSpec{
+		JobId:      c.Id,
+		Command:    "python",
+		Args:       cmdArgs,
+		Dir:        c.getWorkDirectory(),
+		StdOutPath: c.getStdOutPath(),
+		StdErrPath: c.getStdErrPath(),
+		Image:      classifier.CaffeImage,
+		Gpu:        classifier.Gpu,
+	}
 
-	// run the command and save stdio to files and tee to stdio streams
-	if err := runCmdTeeStdio(cmd, c.getStdOutPath(), c.getStdErrPath()); err != nil {
+	// run the command and save stdio to files
+	if err := executor.Execute(spec); err != nil {
 		return nil, err
 	}
 
@@ -517,12 +523,15 @@ func (c *ClassifyJob) Insert() error {
 }
 
 // CodeReview: duplication with RefreshFromDB in many places
-func (c *ClassifyJob) RefreshFromDB(db couch.Database) error {
+func (c *ClassifyJob) RefreshFromDB(db DocumentStore) error {
 	classifyJob := ClassifyJob{}
 	err := db.Retrieve(c.Id, &classifyJob)
 	if err != nil {
 		return err
 	}
+	// keep this process's configuration rather than the one saved in the
+	// doc by whichever process created it
+	classifyJob.Configuration = c.Configuration
 	*c = classifyJob
 	return nil
 }
@@ -540,15 +549,13 @@ func (c *ClassifyJob) Find(id string) error {
 
 // Codereview: de-dupe
 func (c ClassifyJob) recordProcessingError(err error) {
-	logg.LogError(err)
-	db := c.Configuration.DbConnection()
-	if err := c.Failed(db, err); err != nil {
-		errMsg := fmt.Errorf("Error setting training job as failed: %v", err)
+	if err := recordJobFailure(c.Configuration, &c, err, systemClock{}); err != nil {
+		errMsg := fmt.Errorf("Error setting classify job as failed: %v", err)
 		logg.LogError(errMsg)
 	}
 }
 
-func (c ClassifyJob) Failed(db couch.Database, processingErr error) error {
+func (c ClassifyJob) Failed(db DocumentStore, processingErr error) error {
 
 	_, err := c.UpdateProcessingState(Failed)
 	if err != nil {
@@ -1,12 +1,15 @@
-// Command line utility to launch the ElasticThought REST API server.
+// Command line utility to launch the ElasticThought REST API server, the
+// scheduler and workers, either separately or all in one process.
 package main
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"os"
 
 	"github.com/couchbaselabs/logg"
 	"github.com/docopt/docopt-go"
-	"github.com/gin-gonic/gin"
 	et "github.com/tleyden/elastic-thought"
 )
 
@@ -14,22 +17,45 @@ func init() {
 	et.EnableAllLogKeys()
 }
 
-func main() {
+// The parts of ElasticThought that a command runs
+type roles struct {
+	serve    bool // the REST API server
+	schedule bool // the changes listener, which queues up jobs
+	work     bool // a worker running jobs from the nsq or durable queue
+}
+
+// A worker which can be shut down gracefully
+type drainer interface {
+	Drain()
+}
 
-	// TODO: customize listen port (defaults to 8080)
+func main() {
 
-	usage := `ElasticThought REST API server.
+	usage := fmt.Sprintf(`ElasticThought.
 
 Usage:
-  elastic-thought [--sync-gw-url=<sgu>] [--blob-store-url=<bsu>]
+  elastic-thought serve [options]
+  elastic-thought worker [options]
+  elastic-thought scheduler [options]
+  elastic-thought all-in-one [options]
+  elastic-thought config print [--show-secrets] [options]
+  elastic-thought [options]
+
+Commands:
+  serve       Run the REST API server.
+  worker      Run jobs from the nsq or durable queue.
+  scheduler   Follow the changes feed and queue up jobs.  With the goroutine queue type, the jobs run in this process.
+  all-in-one  Run the REST API server, the scheduler and a worker in one process (the default).
+  config print  Print the configuration as a config file, with secrets redacted unless --show-secrets is given.
+
+Options are layered: the defaults, then the config file, then the environment variables given, then the flags.
 
 Options:
-  -h --help     Show this screen.
-  --sync-gw-url=<sgu>  Sync Gateway DB URL [default: http://localhost:4985/elastic-thought].
-  --blob-store-url=<bsu>  Blob store URL [default: file:///tmp].`
+  -h --help  Show this screen.
+  --show-secrets  Include secrets when printing the configuration.
+%v`, et.ConfigOptionsUsage())
 
 	parsedDocOptArgs, _ := docopt.Parse(usage, nil, true, "ElasticThought alpha", false)
-	fmt.Println(parsedDocOptArgs)
 
 	config := *(et.NewDefaultConfiguration())
 
@@ -39,59 +65,161 @@ Options:
 		return
 	}
 
+	command := func(name string) bool {
+		given, _ := parsedDocOptArgs[name].(bool)
+		return given
+	}
+
+	if command("config") {
+		if err := config.WriteYaml(os.Stdout, !command("--show-secrets")); err != nil {
+			logg.LogFatal("Error printing configuration: %v", err)
+		}
+		return
+	}
+
+	logg.LogTo("CLI", "Configuration:\n%v", config.Redacted())
+
 	if err := et.EnvironmentSanityCheck(config); err != nil {
 		logg.LogFatal("Failed environment sanity check: %v", err)
 		return
 	}
 
-	var jobScheduler et.JobScheduler
+	switch {
+	case command("serve"):
+		err = run(config, roles{serve: true})
+	case command("worker"):
+		err = run(config, roles{work: true})
+	case command("scheduler"):
+		err = run(config, roles{schedule: true})
+	default:
+		err = run(config, roles{serve: true, schedule: true, work: true})
+	}
+
+	if err != nil {
+		logg.LogFatal("%v", err)
+	}
+
+}
+
+// Start the given roles, and run until the process gets a SIGINT or SIGTERM
+func run(config et.Configuration, r roles) error {
+
+	if !(r.serve && r.schedule && r.work) && et.IsEmbeddedDocumentStore(config.DbUrl) {
+		return fmt.Errorf("The embedded document store %v can only be used by one process.  "+
+			"Use all-in-one, or a Sync Gateway url to run serve, scheduler and worker separately", config.DbUrl)
+	}
+
+	// listen before starting anything else, so that eg the port being in
+	// use fails the command rather than leaving it running without an api
+	var listener net.Listener
+	if r.serve {
+		var err error
+		listener, err = net.Listen("tcp", config.ListenAddress)
+		if err != nil {
+			return fmt.Errorf("Error listening on %v: %v", config.ListenAddress, err)
+		}
+	}
+
+	context := &et.EndpointContext{
+		Configuration: config,
+		UsageCache:    et.NewUsageCache(config),
+	}
+
+	// where the scheduler hands off jobs, and the worker to run them
+	var downstream et.JobScheduler
+	var worker drainer
 
 	switch config.QueueType {
 	case et.Nsq:
-		jobScheduler = et.NewNsqJobScheduler(config)
+		if r.schedule {
+			downstream = et.NewNsqJobScheduler(config)
+		}
+		if r.work {
+			nsqWorker := et.NewNsqWorker(config)
+			if err := nsqWorker.HandleEvents(); err != nil {
+				return fmt.Errorf("Error starting nsq worker: %v", err)
+			}
+			worker = nsqWorker
+		}
 	case et.Goroutine:
-		jobScheduler = et.NewInProcessJobScheduler(config)
+		if r.work && !r.schedule {
+			return fmt.Errorf("With the %v queue type, jobs run in the scheduler rather than in workers", config.QueueType)
+		}
+		if r.schedule {
+			inProcessJobScheduler := et.NewInProcessJobScheduler(config)
+			context.WorkerPool = inProcessJobScheduler.WorkerPool
+			downstream = inProcessJobScheduler
+		}
+	case et.Durable:
+		queue := et.NewDocumentStoreQueue(config)
+		downstream = queue
+		if r.serve {
+			context.QueueBackend = queue
+		}
+		if r.work {
+			var workerQueue et.QueueBackend = queue
+			if len(config.QueueUrl) > 0 {
+				workerQueue = et.NewHttpQueue(config)
+			}
+			queueWorker := et.NewQueueWorker(config, workerQueue)
+			queueWorker.HandleEvents()
+			worker = queueWorker
+		}
 	default:
-		logg.LogFatal("Unexpected queue type: %v", config.QueueType)
+		return fmt.Errorf("Unexpected queue type: %v", config.QueueType)
 	}
 
-	context := &et.EndpointContext{
-		Configuration: config,
+	if r.schedule {
+		if err := startScheduler(config, context, downstream); err != nil {
+			return err
+		}
 	}
 
-	changesListener, err := et.NewChangesListener(config, jobScheduler)
-	if err != nil {
-		logg.LogPanic("Error creating changes listener: %v", err)
+	if r.serve {
+		ginEngine := et.NewRouter(config, context)
+		go func() {
+			if err := http.Serve(listener, ginEngine); err != nil {
+				logg.LogFatal("REST API server stopped: %v", err)
+			}
+		}()
+		logg.LogTo("CLI", "REST API server listening on %v", config.ListenAddress)
 	}
-	go changesListener.FollowChangesFeed()
-
-	ginEngine := gin.Default()
-
-	// all requests wrapped in database connection middleware
-	ginEngine.Use(et.DbConnector(config.DbUrl))
-
-	// endpoint to create a new user (db auth not required)
-	ginEngine.POST("/users", context.CreateUserEndpoint)
-
-	// TODO: bundle in static assets from ../../example directory into the
-	// binary using gobin-data and then allow them to be served up
-	// via the /example REST endpoint.
-	// ginEngine.Static("/example", "../../example")  <-- uncomment for quick hack rel path
-
-	// all endpoints in the authorized group require Basic Auth credentials
-	// which is enforced by the DbAuthRequired middleware.
-	authorized := ginEngine.Group("/")
-	authorized.Use(et.DbAuthRequired())
-	{
-		authorized.POST("/datafiles", context.CreateDataFileEndpoint)
-		authorized.POST("/datasets", context.CreateDataSetsEndpoint)
-		authorized.POST("/solvers", context.CreateSolverEndpoint)
-		authorized.POST("/training-jobs", context.CreateTrainingJob)
-		authorized.POST("/classifiers", context.CreateClassifierEndpoint)
-		authorized.POST("/classifiers/:classifier-id/classify", context.CreateClassificationJobEndpoint)
+
+	received := et.WaitForShutdownSignal()
+	logg.LogTo("CLI", "Got %v, shutting down", received)
+
+	if worker != nil {
+		worker.Drain()
 	}
 
-	// Listen and serve on 0.0.0.0:8080
-	ginEngine.Run(":8080")
+	return nil
+
+}
+
+// Follow the changes feed while this process is the leader, putting jobs in
+// the priority queue in front of the downstream scheduler
+func startScheduler(config et.Configuration, context *et.EndpointContext, downstream et.JobScheduler) error {
+
+	// jobs wait in a priority queue which interleaves users fairly, and
+	// are only handed off to the job scheduler when there is room for them
+	jobQueue := et.NewPriorityJobScheduler(config, downstream)
+	context.JobQueue = jobQueue
+
+	changesListener, err := et.NewChangesListener(config, jobQueue)
+	if err != nil {
+		return fmt.Errorf("Error creating changes listener: %v", err)
+	}
+
+	// only the leader among all of the schedulers follows the changes feed
+	leaderElector := et.NewLeaderElector(config)
+	changesListener.IsLeader = leaderElector.IsLeader
+	go leaderElector.RunWhileLeader(changesListener.FollowChangesFeed)
+
+	// put jobs whose worker died back into the pending state
+	leaseReaper := et.NewLeaseReaper(config)
+	leaseReaper.IsLeader = leaderElector.IsLeader
+	go leaseReaper.ReapForever()
+
+	return nil
 
 }
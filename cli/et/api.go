@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	et "github.com/tleyden/elastic-thought"
+)
+
+// Makes requests to the REST API server of a profile, with its credentials
+type apiClient struct {
+	profile profile
+	client  *http.Client
+}
+
+func newApiClient(p profile) apiClient {
+	return apiClient{
+		profile: p,
+		client:  &http.Client{},
+	}
+}
+
+// Send a request, returning an error which includes the body of the response
+// unless the server responds with a 2xx status
+func (c apiClient) do(method, path, contentType string, body io.Reader) (*http.Response, error) {
+
+	url := strings.TrimSuffix(c.profile.Url, "/") + path
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.SetBasicAuth(c.profile.Username, c.profile.Password)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(resp.Body)
+		apiErr := et.APIError{}
+		if err := json.Unmarshal(message, &apiErr); err == nil && len(apiErr.Code) > 0 {
+			return nil, fmt.Errorf("%v %v failed: %v %v: %v (request id: %v)", method, path, resp.Status, apiErr.Code, apiErr.Message, apiErr.RequestID)
+		}
+		return nil, fmt.Errorf("%v %v failed: %v %v", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+
+}
+
+// Send a request with the given body and content type, and unmarshal the
+// JSON response into response unless it's nil.  The raw response is returned
+// as well, for --json.
+func (c apiClient) send(method, path, contentType string, body io.Reader, response interface{}) ([]byte, error) {
+
+	resp, err := c.do(method, path, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response != nil && len(raw) > 0 {
+		if err := json.Unmarshal(raw, response); err != nil {
+			return nil, fmt.Errorf("Unexpected response to %v %v: %v.  Err: %v", method, path, string(raw), err)
+		}
+	}
+	return raw, nil
+
+}
+
+// Send request (unless it's nil) as JSON.  See send.
+func (c apiClient) sendJson(method, path string, request, response interface{}) ([]byte, error) {
+
+	if request == nil {
+		return c.send(method, path, "", nil, response)
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(method, path, "application/json", bytes.NewReader(body), response)
+
+}
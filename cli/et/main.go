@@ -0,0 +1,608 @@
+// Command line client for the ElasticThought REST API.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	et "github.com/tleyden/elastic-thought"
+)
+
+// The parsed command line
+type args map[string]interface{}
+
+func (a args) bool(name string) bool {
+	value, _ := a[name].(bool)
+	return value
+}
+
+func (a args) string(name string) string {
+	value, _ := a[name].(string)
+	return value
+}
+
+func (a args) strings(name string) []string {
+	value, _ := a[name].([]string)
+	return value
+}
+
+// How the results of a command are printed
+type output struct {
+	json bool // the JSON responses from the server, for scripting
+}
+
+// Print the raw JSON response with --json, otherwise call human to print it
+// in a readable form
+func (o output) print(raw []byte, human func()) {
+	if !o.json {
+		human()
+		return
+	}
+	indented := &bytes.Buffer{}
+	if err := json.Indent(indented, raw, "", "  "); err != nil {
+		os.Stdout.Write(raw)
+		fmt.Println()
+		return
+	}
+	fmt.Println(indented.String())
+}
+
+// Progress messages go to stderr, so they don't get mixed up with --json
+func (o output) progress(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+func main() {
+
+	usage := `et, the ElasticThought command line client.
+
+Usage:
+  et user create <server-url> <username> <password> [--email=<email>] [options]
+  et user usage [options]
+  et login <server-url> <username> <password> [options]
+  et datafile create (--url=<url> | --file=<path>) [options]
+  et dataset create <datafile-id> [--split=<split>] [--testing=<datafile-id>] [options]
+  et solver create <dataset-id> --spec=<url> --net-spec=<url> [options]
+  et train <solver-id> [--priority=<priority>] [--watch] [options]
+  et classifier create <training-job-id> --spec=<url> --scale=<scale> --width=<pixels> --height=<pixels> [--color] [--gpu] [options]
+  et classify <classifier-id> --image=<image>... [--watch] [options]
+  et artifacts get <training-job-id> [<path>] [--output=<path>] [options]
+  et get <doc-type> <id> [--watch] [options]
+
+Commands:
+  user create      Create a user, and save their credentials in the profile.
+  user usage       Show how much of the cluster you are using, and your quota.
+  login            Check your credentials, and save them in the profile.
+  datafile create  Create a datafile from a .tar.gz, either at a url or uploaded from a local file.
+  dataset create   Create a dataset by splitting a datafile, eg --split 70/30, or from separate
+                   training and --testing datafiles.
+  solver create    Create a solver from the urls of its prototxt specs.
+  train            Start a training job, and with --watch, wait for it to finish.
+  classifier create  Create a classifier from a finished training job.
+  classify         Classify images, given as urls or local files.
+  artifacts get    List the artifacts of a training job, or download the one at <path>.
+  get              Show a datafile, dataset, solver, training-job, classifier or classify-job.
+
+Profiles are saved in ~/.et-profiles.json, or the file given by ET_PROFILES.
+
+Options:
+  -h --help          Show this screen.
+  --profile=<name>   The saved server url and credentials to use [default: default].
+  --json             Print the JSON responses from the server, for scripting.
+  --poll=<interval>  How often --watch checks on a job [default: 5s].`
+
+	parsed, err := docopt.Parse(usage, nil, true, "ElasticThought alpha", false)
+	if err != nil {
+		fail(err)
+	}
+	if err := run(args(parsed)); err != nil {
+		fail(err)
+	}
+
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "et: %v\n", err)
+	os.Exit(1)
+}
+
+func run(a args) error {
+
+	out := output{json: a.bool("--json")}
+	profileName := a.string("--profile")
+
+	// the commands which save a profile rather than using one
+	switch {
+	case a.bool("user") && a.bool("create"):
+		return createUser(a, out, profileName)
+	case a.bool("login"):
+		return login(a, out, profileName)
+	}
+
+	p, err := loadProfile(profileName)
+	if err != nil {
+		return err
+	}
+	client := newApiClient(p)
+
+	poll, err := time.ParseDuration(a.string("--poll"))
+	if err != nil {
+		return fmt.Errorf("Invalid --poll: %v", err)
+	}
+
+	switch {
+	case a.bool("user") && a.bool("usage"):
+		return showUsage(client, out)
+	case a.bool("datafile"):
+		return createDatafile(client, a, out)
+	case a.bool("dataset"):
+		return createDataset(client, a, out)
+	case a.bool("solver"):
+		return createSolver(client, a, out)
+	case a.bool("train"):
+		return train(client, a, out, poll)
+	case a.bool("classifier"):
+		return createClassifier(client, a, out)
+	case a.bool("classify"):
+		return classify(client, a, out, poll)
+	case a.bool("artifacts"):
+		return getArtifacts(client, a, out)
+	case a.bool("get"):
+		if !isDocType(a.string("<doc-type>")) {
+			return fmt.Errorf("Unknown doc type: %v, expected one of %v", a.string("<doc-type>"), docTypes)
+		}
+		return getDoc(client, a.string("<doc-type>"), a.string("<id>"), a.bool("--watch"), out, poll)
+	}
+	return fmt.Errorf("Unknown command")
+
+}
+
+func createUser(a args, out output, profileName string) error {
+
+	p := profile{
+		Url:      a.string("<server-url>"),
+		Username: a.string("<username>"),
+		Password: a.string("<password>"),
+	}
+	user := et.User{
+		Username: p.Username,
+		Password: p.Password,
+		Email:    a.string("--email"),
+	}
+	raw, err := newApiClient(p).sendJson("POST", "/users", user, nil)
+	if err != nil {
+		return err
+	}
+	if err := saveProfile(profileName, p); err != nil {
+		return err
+	}
+
+	out.print(raw, func() {
+		fmt.Printf("Created user %v, saved as profile %v\n", p.Username, profileName)
+	})
+	return nil
+
+}
+
+func login(a args, out output, profileName string) error {
+
+	p := profile{
+		Url:      a.string("<server-url>"),
+		Username: a.string("<username>"),
+		Password: a.string("<password>"),
+	}
+
+	// any authenticated request will do to check the credentials
+	raw, err := newApiClient(p).sendJson("GET", "/users/me/usage", nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := saveProfile(profileName, p); err != nil {
+		return err
+	}
+
+	out.print(raw, func() {
+		fmt.Printf("Logged in as %v, saved as profile %v\n", p.Username, profileName)
+	})
+	return nil
+
+}
+
+func showUsage(client apiClient, out output) error {
+
+	response := struct {
+		Usage et.Usage `json:"usage"`
+		Quota et.Quota `json:"quota"`
+	}{}
+	raw, err := client.sendJson("GET", "/users/me/usage", nil, &response)
+	if err != nil {
+		return err
+	}
+
+	// a limit of 0 means unlimited
+	limit := func(value interface{}) string {
+		if fmt.Sprint(value) == "0" {
+			return "unlimited"
+		}
+		return fmt.Sprint(value)
+	}
+
+	out.print(raw, func() {
+		usage, quota := response.Usage, response.Quota
+		fmt.Printf("blob bytes:                %v of %v\n", usage.BlobBytes, limit(quota.MaxBlobBytes))
+		fmt.Printf("concurrent training jobs:  %v of %v\n", usage.ConcurrentTrainingJobs, limit(quota.MaxConcurrentTrainingJobs))
+		fmt.Printf("training hours this month: %.1f of %v\n", usage.TrainingHoursThisMonth, limit(quota.MaxTrainingHoursPerMonth))
+		fmt.Printf("classify requests today:   %v of %v\n", usage.ClassifyRequestsToday, limit(quota.MaxClassifyRequestsPerDay))
+	})
+	return nil
+
+}
+
+func createDatafile(client apiClient, a args, out output) error {
+
+	response := struct {
+		Id string `json:"id"`
+	}{}
+
+	var raw []byte
+	var err error
+	if sourcePath := a.string("--file"); len(sourcePath) > 0 {
+		f, openErr := os.Open(sourcePath)
+		if openErr != nil {
+			return openErr
+		}
+		defer f.Close()
+		uploadPath := fmt.Sprintf("/datafiles?filename=%v", url.QueryEscape(filepath.Base(sourcePath)))
+		raw, err = client.send("POST", uploadPath, "application/x-gzip", f, &response)
+	} else {
+		request := map[string]string{"url": a.string("--url")}
+		raw, err = client.sendJson("POST", "/datafiles", request, &response)
+	}
+	if err != nil {
+		return err
+	}
+
+	out.print(raw, func() {
+		fmt.Printf("Created datafile %v\n", response.Id)
+	})
+	return nil
+
+}
+
+func createDataset(client apiClient, a args, out output) error {
+
+	dataset := et.Dataset{}
+	dataset.TrainingDataset.DatafileID = a.string("<datafile-id>")
+	dataset.TestDataset.DatafileID = a.string("<datafile-id>")
+
+	if testing := a.string("--testing"); len(testing) > 0 {
+		dataset.TestDataset.DatafileID = testing
+	} else {
+		split := a.string("--split")
+		if len(split) == 0 {
+			split = "70/30"
+		}
+		training, test, err := parseSplit(split)
+		if err != nil {
+			return err
+		}
+		dataset.TrainingDataset.SplitPercentage = training
+		dataset.TestDataset.SplitPercentage = test
+	}
+
+	request := map[string]interface{}{
+		"training": dataset.TrainingDataset,
+		"test":     dataset.TestDataset,
+	}
+	created := et.Dataset{}
+	raw, err := client.sendJson("POST", "/datasets", request, &created)
+	if err != nil {
+		return err
+	}
+
+	out.print(raw, func() {
+		fmt.Printf("Created dataset %v (%v)\n", created.Id, created.ProcessingState)
+	})
+	return nil
+
+}
+
+// Parse a training/testing split such as 70/30 into fractions
+func parseSplit(split string) (float64, float64, error) {
+
+	parts := strings.Split(split, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid --split: %v, expected training/testing percentages such as 70/30", split)
+	}
+	training, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid --split: %v.  Err: %v", split, err)
+	}
+	test, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid --split: %v.  Err: %v", split, err)
+	}
+	if training <= 0 || test <= 0 || training+test != 100 {
+		return 0, 0, fmt.Errorf("Invalid --split: %v, the percentages must both be positive and add up to 100", split)
+	}
+	return training / 100, test / 100, nil
+
+}
+
+func createSolver(client apiClient, a args, out output) error {
+
+	request := map[string]string{
+		"dataset-id":            a.string("<dataset-id>"),
+		"specification-url":     a.string("--spec"),
+		"specification-net-url": a.string("--net-spec"),
+	}
+	created := et.Solver{}
+	raw, err := client.sendJson("POST", "/solvers", request, &created)
+	if err != nil {
+		return err
+	}
+
+	out.print(raw, func() {
+		fmt.Printf("Created solver %v\n", created.Id)
+	})
+	return nil
+
+}
+
+func train(client apiClient, a args, out output, poll time.Duration) error {
+
+	request := map[string]interface{}{
+		"solver-id": a.string("<solver-id>"),
+	}
+	if priority := a.string("--priority"); len(priority) > 0 {
+		value, err := strconv.Atoi(priority)
+		if err != nil {
+			return fmt.Errorf("Invalid --priority: %v", priority)
+		}
+		request["priority"] = value
+	}
+
+	created := et.TrainingJob{}
+	raw, err := client.sendJson("POST", "/training-jobs", request, &created)
+	if err != nil {
+		return err
+	}
+
+	if a.bool("--watch") {
+		out.progress("Created training job %v", created.Id)
+		return getDoc(client, et.DOC_TYPE_TRAINING_JOB, created.Id, true, out, poll)
+	}
+
+	out.print(raw, func() {
+		fmt.Printf("Created training job %v (%v)\n", created.Id, created.ProcessingState)
+	})
+	return nil
+
+}
+
+func createClassifier(client apiClient, a args, out output) error {
+
+	request := map[string]interface{}{
+		"training-job-id":   a.string("<training-job-id>"),
+		"specification-url": a.string("--spec"),
+		"scale":             a.string("--scale"),
+		"image-width":       a.string("--width"),
+		"image-height":      a.string("--height"),
+		"color":             a.bool("--color"),
+		"gpu":               a.bool("--gpu"),
+	}
+	created := et.Classifier{}
+	raw, err := client.sendJson("POST", "/classifiers", request, &created)
+	if err != nil {
+		return err
+	}
+
+	out.print(raw, func() {
+		fmt.Printf("Created classifier %v\n", created.Id)
+	})
+	return nil
+
+}
+
+// Images given as http(s) urls are fetched by the server, anything else is
+// uploaded from a local file
+func classify(client apiClient, a args, out output, poll time.Duration) error {
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for _, image := range a.strings("--image") {
+		if strings.HasPrefix(image, "http://") || strings.HasPrefix(image, "https://") {
+			if err := form.WriteField("urls", image); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := addFormFile(form, "files", image); err != nil {
+			return err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	classifyPath := fmt.Sprintf("/classifiers/%v/classify", a.string("<classifier-id>"))
+	created := et.ClassifyJob{}
+	raw, err := client.send("POST", classifyPath, form.FormDataContentType(), body, &created)
+	if err != nil {
+		return err
+	}
+
+	if a.bool("--watch") {
+		out.progress("Created classify job %v", created.Id)
+		return getDoc(client, et.DOC_TYPE_CLASSIFY_JOB, created.Id, true, out, poll)
+	}
+
+	out.print(raw, func() {
+		fmt.Printf("Created classify job %v (%v)\n", created.Id, created.ProcessingState)
+	})
+	return nil
+
+}
+
+func addFormFile(form *multipart.Writer, field, sourcePath string) error {
+
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	part, err := form.CreateFormFile(field, filepath.Base(sourcePath))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+
+}
+
+// List the artifacts of a training job, or download one of them to --output
+// (by default, a file with the same name in the current directory)
+func getArtifacts(client apiClient, a args, out output) error {
+
+	trainingJobId := a.string("<training-job-id>")
+
+	artifactPath := a.string("<path>")
+	if len(artifactPath) == 0 {
+		response := struct {
+			Artifacts []et.BlobInfo `json:"artifacts"`
+		}{}
+		raw, err := client.sendJson("GET", fmt.Sprintf("/training-jobs/%v/artifacts", trainingJobId), nil, &response)
+		if err != nil {
+			return err
+		}
+		out.print(raw, func() {
+			for _, artifact := range response.Artifacts {
+				fmt.Printf("%12d  %v  %v\n", artifact.Size, artifact.ModTime.Format(time.RFC3339), artifact.Path)
+			}
+		})
+		return nil
+	}
+
+	// artifact paths may be given relative to the training job
+	blobPath := strings.TrimPrefix(artifactPath, "/")
+	if !strings.HasPrefix(blobPath, trainingJobId+"/") {
+		blobPath = path.Join(trainingJobId, blobPath)
+	}
+
+	resp, err := client.do("GET", "/blobs/"+blobPath, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	destPath := a.string("--output")
+	if len(destPath) == 0 {
+		destPath = path.Base(blobPath)
+	}
+
+	var dest io.Writer = os.Stdout
+	if destPath != "-" {
+		f, err := os.Create(destPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dest = f
+	}
+
+	written, err := io.Copy(dest, resp.Body)
+	if err != nil {
+		return err
+	}
+	if destPath != "-" {
+		out.progress("Saved %v (%v bytes) to %v", blobPath, written, destPath)
+	}
+	return nil
+
+}
+
+// The doc types which can be shown by et get
+var docTypes = []string{
+	et.DOC_TYPE_DATAFILE,
+	et.DOC_TYPE_DATASET,
+	et.DOC_TYPE_SOLVER,
+	et.DOC_TYPE_TRAINING_JOB,
+	et.DOC_TYPE_CLASSIFIER,
+	et.DOC_TYPE_CLASSIFY_JOB,
+}
+
+func isDocType(docType string) bool {
+	for _, known := range docTypes {
+		if docType == known {
+			return true
+		}
+	}
+	return false
+}
+
+// The fields of a doc shown by et get
+type docStatus struct {
+	ProcessingState *et.ProcessingState `json:"processing-state"`
+	ProcessingLog   string              `json:"processing-log"`
+	Results         map[string]string   `json:"results"`
+}
+
+// Show a doc, and with watch, poll it until it has finished processing.  A
+// job that fails is an error, so that et exits with a non-zero status.
+func getDoc(client apiClient, docType, docId string, watch bool, out output, poll time.Duration) error {
+
+	docPath := fmt.Sprintf("/%vs/%v", docType, docId)
+
+	var lastState *et.ProcessingState
+	for {
+
+		status := docStatus{}
+		raw, err := client.sendJson("GET", docPath, nil, &status)
+		if err != nil {
+			return err
+		}
+
+		finished := status.ProcessingState == nil ||
+			*status.ProcessingState == et.FinishedSuccessfully ||
+			*status.ProcessingState == et.Failed
+
+		if !finished && watch {
+			if lastState == nil || *lastState != *status.ProcessingState {
+				out.progress("%v %v is %v", docType, docId, *status.ProcessingState)
+			}
+			lastState = status.ProcessingState
+			time.Sleep(poll)
+			continue
+		}
+
+		out.print(raw, func() {
+			if status.ProcessingState == nil {
+				fmt.Printf("%v %v\n", docType, docId)
+			} else {
+				fmt.Printf("%v %v is %v\n", docType, docId, *status.ProcessingState)
+			}
+			for image, result := range status.Results {
+				fmt.Printf("  %v: %v\n", image, result)
+			}
+		})
+
+		if status.ProcessingState != nil && *status.ProcessingState == et.Failed {
+			return fmt.Errorf("%v %v failed: %v", docType, docId, status.ProcessingLog)
+		}
+		return nil
+
+	}
+
+}
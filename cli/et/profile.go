@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The environment variable which overrides where profiles are saved
+const PROFILES_ENV_VAR = "ET_PROFILES"
+
+// The REST API server to talk to and the credentials to use
+type profile struct {
+	Url      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Profiles are saved in ~/.et-profiles.json (or $ET_PROFILES), which is
+// only readable by the user since it holds their passwords
+func profilesPath() string {
+	if path := os.Getenv(PROFILES_ENV_VAR); len(path) > 0 {
+		return path
+	}
+	return filepath.Join(os.Getenv("HOME"), ".et-profiles.json")
+}
+
+func loadProfiles() (map[string]profile, error) {
+
+	profiles := map[string]profile{}
+
+	data, err := ioutil.ReadFile(profilesPath())
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("Error reading profiles: %v.  Err: %v", profilesPath(), err)
+	}
+	return profiles, nil
+
+}
+
+func loadProfile(name string) (profile, error) {
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		return profile{}, err
+	}
+
+	p, ok := profiles[name]
+	if !ok {
+		return profile{}, fmt.Errorf("No profile named %v in %v, run et login first", name, profilesPath())
+	}
+	return p, nil
+
+}
+
+// Add or replace the named profile, keeping any others
+func saveProfile(name string, p profile) error {
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	profiles[name] = p
+
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(profilesPath(), data, 0600)
+
+}
@@ -0,0 +1,68 @@
+// Command line utility to garbage collect orphaned blobs and work directories.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+	"github.com/docopt/docopt-go"
+	et "github.com/tleyden/elastic-thought"
+)
+
+func init() {
+	et.EnableAllLogKeys()
+}
+
+func main() {
+
+	usage := `ElasticThought garbage collector.
+
+Usage:
+  gc [--sync-gw-url=<sgu>] [--blob-store-url=<bsu>] [--grace-period=<gp>] [--dry-run] [--clean-work-dirs]
+
+Options:
+  -h --help     Show this screen.
+  --sync-gw-url=<sgu>  Sync Gateway DB URL.  Env: ELASTIC_THOUGHT_SYNC_GW_URL.  Default: http://localhost:4985/elastic-thought
+  --blob-store-url=<bsu>  Blob store URL.  Env: ELASTIC_THOUGHT_BLOB_STORE_URL.  Default: file:///tmp
+  --grace-period=<gp>  Only delete things older than this [default: 24h].
+  --dry-run  Report what would be deleted without deleting anything.
+  --clean-work-dirs  Also delete work directories of finished jobs.`
+
+	parsedDocOptArgs, _ := docopt.Parse(usage, nil, true, "ElasticThought alpha", false)
+
+	config := *(et.NewDefaultConfiguration())
+
+	config, err := config.Merge(parsedDocOptArgs)
+	if err != nil {
+		logg.LogFatal("Error processing cmd line args: %v", err)
+		return
+	}
+
+	gracePeriod, err := time.ParseDuration(parsedDocOptArgs["--grace-period"].(string))
+	if err != nil {
+		logg.LogFatal("Invalid --grace-period: %v", err)
+		return
+	}
+
+	gc := et.NewGarbageCollector(config)
+	gc.GracePeriod = gracePeriod
+	gc.DryRun = parsedDocOptArgs["--dry-run"].(bool)
+	gc.CleanWorkDirectories = parsedDocOptArgs["--clean-work-dirs"].(bool)
+
+	report, err := gc.Run()
+	if err != nil {
+		logg.LogFatal("Garbage collection failed: %v", err)
+		return
+	}
+
+	reportJson, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		logg.LogFatal("Error marshalling report: %v", err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(reportJson))
+
+}
@@ -1,4 +1,6 @@
-// Command line utility to launch an ElasticThought worker
+// Command line utility to launch an ElasticThought nsq worker, configured
+// from the ELASTIC_THOUGHT_* environment variables.  See also
+// "elastic-thought worker", which takes flags as well.
 package main
 
 import (
@@ -12,16 +14,21 @@ func init() {
 
 func main() {
 
-	config := *(et.NewDefaultConfiguration()) // TODO: get these vals from cmd line args
+	config, err := et.NewDefaultConfiguration().Merge(nil)
+	if err != nil {
+		logg.LogFatal("Error processing environment: %v", err)
+		return
+	}
 
 	if err := et.EnvironmentSanityCheck(config); err != nil {
 		logg.LogFatal("Failed environment sanity check: %v", err)
 		return
 	}
 
+	// runs until SIGINT or SIGTERM, then waits for running jobs to finish
 	worker := et.NewNsqWorker(config)
-	go worker.HandleEvents()
-
-	select {} // block forever
+	if err := worker.RunUntilSignalled(); err != nil {
+		logg.LogFatal("Error running worker: %v", err)
+	}
 
 }
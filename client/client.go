@@ -0,0 +1,480 @@
+// Package client is a Go client for the ElasticThought REST API, returning
+// the same structs the server stores.
+//
+//	c := client.New("http://localhost:8080", "foo", "bar")
+//	trainingJob, err := c.CreateTrainingJob(ctx, solver.Id, 0)
+//	trainingJob, err = c.WaitForTrainingJob(ctx, trainingJob.Id)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	et "github.com/tleyden/elastic-thought"
+)
+
+// How often the WaitFor methods check on a job by default
+const DEFAULT_POLL_INTERVAL = 5 * time.Second
+
+// A client for the REST API server at Url, authenticating as Username
+type Client struct {
+	Url          string
+	Username     string
+	Password     string
+	HTTPClient   *http.Client
+	PollInterval time.Duration
+}
+
+// Create a new client.  If you don't use this, you must set the HTTPClient
+// and PollInterval.
+func New(serverUrl, username, password string) *Client {
+	return &Client{
+		Url:          strings.TrimSuffix(serverUrl, "/"),
+		Username:     username,
+		Password:     password,
+		HTTPClient:   &http.Client{},
+		PollInterval: DEFAULT_POLL_INTERVAL,
+	}
+}
+
+// The server responded with an error status.  Code, Details and RequestID
+// are from the server's error body (see et.APIError).
+type APIError struct {
+	StatusCode int
+	Method     string
+	Path       string
+	Code       string
+	Message    string
+	Details    interface{}
+	RequestID  string
+}
+
+func (e APIError) Error() string {
+	return fmt.Sprintf("%v %v failed with status %v: %v", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+// Is this error a 404 from the server?
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(APIError)
+	return ok && apiErr.StatusCode == 404
+}
+
+// A job the client was waiting for failed
+type JobFailedError struct {
+	DocType       string
+	Id            string
+	ProcessingLog string
+}
+
+func (e JobFailedError) Error() string {
+	return fmt.Sprintf("%v %v failed: %v", e.DocType, e.Id, e.ProcessingLog)
+}
+
+// How much of the cluster the user is using, along with their quota.  A
+// limit of 0 means unlimited.
+type UsageReport struct {
+	Usage et.Usage `json:"usage"`
+	Quota et.Quota `json:"quota"`
+}
+
+// An image to classify: either a url for the server to fetch, or a file to
+// upload with the given filename
+type Image struct {
+	Url      string
+	Filename string
+	Body     io.Reader
+}
+
+// Create a user.  This doesn't need the client's credentials, so they can be
+// those of the new user.
+func (c *Client) CreateUser(ctx context.Context, username, password, email string) error {
+	user := map[string]string{
+		"username": username,
+		"password": password,
+		"email":    email,
+	}
+	return c.sendJson(ctx, "POST", "/users", user, nil)
+}
+
+// Get the user's usage and quota
+func (c *Client) Usage(ctx context.Context) (*UsageReport, error) {
+	report := &UsageReport{}
+	if err := c.sendJson(ctx, "GET", "/users/me/usage", nil, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Create a datafile which the server downloads from the url of a .tar.gz
+func (c *Client) CreateDatafile(ctx context.Context, datafileUrl string) (*et.Datafile, error) {
+	created := struct {
+		Id string `json:"id"`
+	}{}
+	request := map[string]string{"url": datafileUrl}
+	if err := c.sendJson(ctx, "POST", "/datafiles", request, &created); err != nil {
+		return nil, err
+	}
+	return c.GetDatafile(ctx, created.Id)
+}
+
+// Create a datafile by uploading a .tar.gz, which is read from r
+func (c *Client) UploadDatafile(ctx context.Context, filename string, r io.Reader) (*et.Datafile, error) {
+	created := struct {
+		Id string `json:"id"`
+	}{}
+	uploadPath := fmt.Sprintf("/datafiles?filename=%v", url.QueryEscape(path.Base(filename)))
+	if err := c.send(ctx, "POST", uploadPath, "application/x-gzip", r, &created); err != nil {
+		return nil, err
+	}
+	return c.GetDatafile(ctx, created.Id)
+}
+
+func (c *Client) GetDatafile(ctx context.Context, id string) (*et.Datafile, error) {
+	datafile := &et.Datafile{}
+	if err := c.getDoc(ctx, et.DOC_TYPE_DATAFILE, id, datafile); err != nil {
+		return nil, err
+	}
+	return datafile, nil
+}
+
+// Wait for a datafile to be downloaded.  See waitFor.
+func (c *Client) WaitForDatafile(ctx context.Context, id string) (*et.Datafile, error) {
+	datafile := &et.Datafile{}
+	err := c.waitFor(ctx, et.DOC_TYPE_DATAFILE, id, datafile)
+	if _, failed := err.(JobFailedError); err != nil && !failed {
+		return nil, err
+	}
+	return datafile, err
+}
+
+// Create a dataset from the training and testing datafiles, which are split
+// by the given percentages if they are the same datafile
+func (c *Client) CreateDataset(ctx context.Context, training et.TrainingDataset, test et.TestDataset) (*et.Dataset, error) {
+	request := map[string]interface{}{
+		"training": training,
+		"test":     test,
+	}
+	dataset := &et.Dataset{}
+	if err := c.sendJson(ctx, "POST", "/datasets", request, dataset); err != nil {
+		return nil, err
+	}
+	return dataset, nil
+}
+
+func (c *Client) GetDataset(ctx context.Context, id string) (*et.Dataset, error) {
+	dataset := &et.Dataset{}
+	if err := c.getDoc(ctx, et.DOC_TYPE_DATASET, id, dataset); err != nil {
+		return nil, err
+	}
+	return dataset, nil
+}
+
+// Wait for a dataset to be split.  See waitFor.
+func (c *Client) WaitForDataset(ctx context.Context, id string) (*et.Dataset, error) {
+	dataset := &et.Dataset{}
+	err := c.waitFor(ctx, et.DOC_TYPE_DATASET, id, dataset)
+	if _, failed := err.(JobFailedError); err != nil && !failed {
+		return nil, err
+	}
+	return dataset, err
+}
+
+// Create a solver from the urls of its solver and net prototxt specs, which
+// the server downloads
+func (c *Client) CreateSolver(ctx context.Context, datasetId, specUrl, netSpecUrl string) (*et.Solver, error) {
+	request := map[string]string{
+		"dataset-id":            datasetId,
+		"specification-url":     specUrl,
+		"specification-net-url": netSpecUrl,
+	}
+	solver := &et.Solver{}
+	if err := c.sendJson(ctx, "POST", "/solvers", request, solver); err != nil {
+		return nil, err
+	}
+	return solver, nil
+}
+
+func (c *Client) GetSolver(ctx context.Context, id string) (*et.Solver, error) {
+	solver := &et.Solver{}
+	if err := c.getDoc(ctx, et.DOC_TYPE_SOLVER, id, solver); err != nil {
+		return nil, err
+	}
+	return solver, nil
+}
+
+// Start training with a solver.  Jobs with a higher priority are run first.
+func (c *Client) CreateTrainingJob(ctx context.Context, solverId string, priority int) (*et.TrainingJob, error) {
+	request := map[string]interface{}{
+		"solver-id": solverId,
+		"priority":  priority,
+	}
+	trainingJob := &et.TrainingJob{}
+	if err := c.sendJson(ctx, "POST", "/training-jobs", request, trainingJob); err != nil {
+		return nil, err
+	}
+	return trainingJob, nil
+}
+
+func (c *Client) GetTrainingJob(ctx context.Context, id string) (*et.TrainingJob, error) {
+	trainingJob := &et.TrainingJob{}
+	if err := c.getDoc(ctx, et.DOC_TYPE_TRAINING_JOB, id, trainingJob); err != nil {
+		return nil, err
+	}
+	return trainingJob, nil
+}
+
+// Wait for training to finish.  See waitFor.
+func (c *Client) WaitForTrainingJob(ctx context.Context, id string) (*et.TrainingJob, error) {
+	trainingJob := &et.TrainingJob{}
+	err := c.waitFor(ctx, et.DOC_TYPE_TRAINING_JOB, id, trainingJob)
+	if _, failed := err.(JobFailedError); err != nil && !failed {
+		return nil, err
+	}
+	return trainingJob, err
+}
+
+// List the blobs stored for a training job, such as the trained model and
+// the stdout/stderr logs
+func (c *Client) Artifacts(ctx context.Context, trainingJobId string) ([]et.BlobInfo, error) {
+	response := struct {
+		Artifacts []et.BlobInfo `json:"artifacts"`
+	}{}
+	artifactsPath := fmt.Sprintf("/training-jobs/%v/artifacts", url.QueryEscape(trainingJobId))
+	if err := c.sendJson(ctx, "GET", artifactsPath, nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Artifacts, nil
+}
+
+// Stream a blob, given its path (eg, from Artifacts) or its cbfs:// url (eg,
+// TrainingJob.TrainedModelUrl).  The caller must close it.
+func (c *Client) GetBlob(ctx context.Context, blobPath string) (io.ReadCloser, error) {
+	blobPath = strings.TrimPrefix(strings.TrimPrefix(blobPath, et.CBFS_URI_PREFIX), "/")
+	resp, err := c.do(ctx, "GET", "/blobs/"+blobPath, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Create a classifier from a finished training job.  Only the fields which
+// can be given when creating a classifier are sent.
+func (c *Client) CreateClassifier(ctx context.Context, classifier et.Classifier) (*et.Classifier, error) {
+	request := map[string]interface{}{
+		"specification-url": classifier.SpecificationUrl,
+		"training-job-id":   classifier.TrainingJobID,
+		"scale":             classifier.Scale,
+		"image-width":       classifier.ImageWidth,
+		"image-height":      classifier.ImageHeight,
+		"color":             classifier.Color,
+		"gpu":               classifier.Gpu,
+		"caffe-image":       classifier.CaffeImage,
+	}
+	created := &et.Classifier{}
+	if err := c.sendJson(ctx, "POST", "/classifiers", request, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *Client) GetClassifier(ctx context.Context, id string) (*et.Classifier, error) {
+	classifier := &et.Classifier{}
+	if err := c.getDoc(ctx, et.DOC_TYPE_CLASSIFIER, id, classifier); err != nil {
+		return nil, err
+	}
+	return classifier, nil
+}
+
+// Start classifying images with a classifier.  The results are in the
+// finished classify job, see WaitForClassifyJob.
+func (c *Client) Classify(ctx context.Context, classifierId string, images []Image) (*et.ClassifyJob, error) {
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for _, image := range images {
+		if len(image.Url) > 0 {
+			if err := form.WriteField("urls", image.Url); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		part, err := form.CreateFormFile("files", path.Base(image.Filename))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(part, image.Body); err != nil {
+			return nil, err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	classifyPath := fmt.Sprintf("/classifiers/%v/classify", url.QueryEscape(classifierId))
+	classifyJob := &et.ClassifyJob{}
+	if err := c.send(ctx, "POST", classifyPath, form.FormDataContentType(), body, classifyJob); err != nil {
+		return nil, err
+	}
+	return classifyJob, nil
+
+}
+
+func (c *Client) GetClassifyJob(ctx context.Context, id string) (*et.ClassifyJob, error) {
+	classifyJob := &et.ClassifyJob{}
+	if err := c.getDoc(ctx, et.DOC_TYPE_CLASSIFY_JOB, id, classifyJob); err != nil {
+		return nil, err
+	}
+	return classifyJob, nil
+}
+
+// Wait for images to be classified.  See waitFor.
+func (c *Client) WaitForClassifyJob(ctx context.Context, id string) (*et.ClassifyJob, error) {
+	classifyJob := &et.ClassifyJob{}
+	err := c.waitFor(ctx, et.DOC_TYPE_CLASSIFY_JOB, id, classifyJob)
+	if _, failed := err.(JobFailedError); err != nil && !failed {
+		return nil, err
+	}
+	return classifyJob, err
+}
+
+// Get the doc of the given type, which is served at /<doc type>s/<id>
+func (c *Client) getDoc(ctx context.Context, docType, id string, doc interface{}) error {
+	docPath := fmt.Sprintf("/%vs/%v", docType, url.QueryEscape(id))
+	return c.sendJson(ctx, "GET", docPath, nil, doc)
+}
+
+// Poll a job doc every PollInterval until it has finished processing, or ctx
+// is done.  If the job failed, job holds the failed doc and a JobFailedError
+// is returned.
+func (c *Client) waitFor(ctx context.Context, docType, id string, job interface{}) error {
+
+	for {
+
+		raw := json.RawMessage{}
+		if err := c.getDoc(ctx, docType, id, &raw); err != nil {
+			return err
+		}
+		status := struct {
+			ProcessingState et.ProcessingState `json:"processing-state"`
+			ProcessingLog   string             `json:"processing-log"`
+		}{}
+		if err := json.Unmarshal(raw, &status); err != nil {
+			return err
+		}
+
+		switch status.ProcessingState {
+		case et.FinishedSuccessfully:
+			return json.Unmarshal(raw, job)
+		case et.Failed:
+			if err := json.Unmarshal(raw, job); err != nil {
+				return err
+			}
+			return JobFailedError{DocType: docType, Id: id, ProcessingLog: status.ProcessingLog}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.PollInterval):
+		}
+
+	}
+
+}
+
+// Send request (unless it's nil) as JSON.  See send.
+func (c *Client) sendJson(ctx context.Context, method, requestPath string, request, response interface{}) error {
+
+	if request == nil {
+		return c.send(ctx, method, requestPath, "", nil, response)
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, method, requestPath, "application/json", bytes.NewReader(body), response)
+
+}
+
+// Send a request and unmarshal the JSON response into response, unless it's
+// nil or the response is empty
+func (c *Client) send(ctx context.Context, method, requestPath, contentType string, body io.Reader, response interface{}) error {
+
+	resp, err := c.do(ctx, method, requestPath, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if response == nil || len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, response); err != nil {
+		return fmt.Errorf("Unexpected response to %v %v: %v.  Err: %v", method, requestPath, string(raw), err)
+	}
+	return nil
+
+}
+
+// Send a request with the client's credentials, returning an APIError
+// unless the server responds with a 2xx status
+func (c *Client) do(ctx context.Context, method, requestPath, contentType string, body io.Reader) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, c.Url+requestPath, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		// report a request cut off by the context as cancelled, rather
+		// than as a failed request
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		apiErr := APIError{
+			StatusCode: resp.StatusCode,
+			Method:     method,
+			Path:       requestPath,
+			Message:    strings.TrimSpace(string(body)),
+		}
+		// the body is an et.APIError, unless a proxy in front of the
+		// server failed the request
+		serverErr := et.APIError{}
+		if err := json.Unmarshal(body, &serverErr); err == nil && len(serverErr.Code) > 0 {
+			apiErr.Code = serverErr.Code
+			apiErr.Message = serverErr.Message
+			apiErr.Details = serverErr.Details
+			apiErr.RequestID = serverErr.RequestID
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+	et "github.com/tleyden/elastic-thought"
+)
+
+// Serve the REST API from a fresh embedded db and blob store, without
+// running any jobs, and return a client for a new user
+func newTestClient(t *testing.T) (*Client, et.Configuration, func()) {
+
+	config := *et.NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://client_test_%v", et.NewUuid())
+	config.CbfsUrl = fmt.Sprintf("file://%v", filepath.Join(et.TempDir(), et.NewUuid()))
+
+	server := httptest.NewServer(et.NewRouter(config, &et.EndpointContext{Configuration: config}))
+
+	c := New(server.URL, "foo", "bar")
+	c.PollInterval = time.Millisecond
+	assert.True(t, c.CreateUser(context.Background(), "foo", "bar", "foo@bar.com") == nil)
+
+	// a solver for the training jobs, which have to be created from the
+	// user's own solver
+	solver := map[string]interface{}{"type": et.DOC_TYPE_SOLVER, "user-id": "user:foo"}
+	_, _, err := config.DbConnection().InsertWith(solver, "solver")
+	assert.True(t, err == nil)
+
+	return c, config, server.Close
+
+}
+
+func TestClientDatafilesAndDatasets(t *testing.T) {
+
+	c, _, closeServer := newTestClient(t)
+	defer closeServer()
+	ctx := context.Background()
+
+	datafile, err := c.UploadDatafile(ctx, "mnist.tar.gz", bytes.NewBufferString("tar.gz contents"))
+	assert.True(t, err == nil)
+	assert.Equals(t, datafile.UserID, "user:foo")
+
+	// uploaded datafiles don't need to be downloaded, so are already finished
+	datafile, err = c.WaitForDatafile(ctx, datafile.Id)
+	assert.True(t, err == nil)
+	assert.Equals(t, datafile.ProcessingState, et.FinishedSuccessfully)
+
+	dataset, err := c.CreateDataset(
+		ctx,
+		et.TrainingDataset{DatafileID: datafile.Id, SplitPercentage: 0.7},
+		et.TestDataset{DatafileID: datafile.Id, SplitPercentage: 0.3},
+	)
+	assert.True(t, err == nil)
+	assert.Equals(t, dataset.ProcessingState, et.Pending)
+
+	dataset, err = c.GetDataset(ctx, dataset.Id)
+	assert.True(t, err == nil)
+	assert.Equals(t, dataset.TrainingDataset.DatafileID, datafile.Id)
+	assert.Equals(t, dataset.TestDataset.SplitPercentage, 0.3)
+
+	_, err = c.GetDatafile(ctx, "missing")
+	assert.True(t, IsNotFound(err))
+	assert.Equals(t, err.(APIError).Code, et.ERROR_CODE_NOT_FOUND)
+	assert.True(t, len(err.(APIError).RequestID) > 0)
+
+	// other users can't see the datafile
+	assert.True(t, c.CreateUser(ctx, "baz", "bar", "") == nil)
+	other := New(c.Url, "baz", "bar")
+	_, err = other.GetDatafile(ctx, datafile.Id)
+	assert.Equals(t, err.(APIError).StatusCode, 403)
+
+	report, err := c.Usage(ctx)
+	assert.True(t, err == nil)
+	assert.True(t, report.Usage.BlobBytes > 0)
+
+}
+
+func TestClientWaitForTrainingJob(t *testing.T) {
+
+	c, config, closeServer := newTestClient(t)
+	defer closeServer()
+
+	trainingJob, err := c.CreateTrainingJob(context.Background(), "solver", 1)
+	assert.True(t, err == nil)
+	assert.Equals(t, trainingJob.ProcessingState, et.Pending)
+
+	// nothing is running the job, so waiting for it only stops when the
+	// context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = c.WaitForTrainingJob(ctx, trainingJob.Id)
+	assert.Equals(t, err, context.DeadlineExceeded)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = c.WaitForTrainingJob(ctx, trainingJob.Id)
+	assert.Equals(t, err, context.Canceled)
+
+	// a failed job is returned along with the error
+	stored := et.NewTrainingJob(config)
+	assert.True(t, stored.Find(trainingJob.Id) == nil)
+	_, err = stored.UpdateProcessingState(et.Failed)
+	assert.True(t, err == nil)
+
+	failed, err := c.WaitForTrainingJob(context.Background(), trainingJob.Id)
+	_, isJobFailed := err.(JobFailedError)
+	assert.True(t, isJobFailed)
+	assert.Equals(t, failed.Id, trainingJob.Id)
+	assert.Equals(t, failed.ProcessingState, et.Failed)
+
+}
+
+func TestClientArtifacts(t *testing.T) {
+
+	c, config, closeServer := newTestClient(t)
+	defer closeServer()
+	ctx := context.Background()
+
+	trainingJob, err := c.CreateTrainingJob(ctx, "solver", 0)
+	assert.True(t, err == nil)
+
+	blobStore, err := config.NewBlobStoreClient()
+	assert.True(t, err == nil)
+	modelPath := fmt.Sprintf("%v/trained.caffemodel", trainingJob.Id)
+	err = blobStore.Put("", modelPath, bytes.NewBufferString("weights"), et.BlobPutOptions{})
+	assert.True(t, err == nil)
+
+	artifacts, err := c.Artifacts(ctx, trainingJob.Id)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(artifacts), 1)
+	assert.Equals(t, artifacts[0].Path, modelPath)
+
+	// blobs can be streamed by path or by cbfs:// url
+	for _, blobPath := range []string{modelPath, et.CBFS_URI_PREFIX + modelPath} {
+		reader, err := c.GetBlob(ctx, blobPath)
+		assert.True(t, err == nil)
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		assert.True(t, err == nil)
+		assert.Equals(t, string(content), "weights")
+	}
+
+	_, err = c.GetBlob(ctx, trainingJob.Id+"/missing")
+	assert.True(t, IsNotFound(err))
+
+}
@@ -0,0 +1,79 @@
+package elasticthought
+
+import (
+	"sync"
+	"time"
+)
+
+// A source of time, which can be swapped out in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// The real clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// A clock that only moves when Advance is called
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	deadline time.Time
+	channel  chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	waiter := fakeClockWaiter{
+		deadline: f.now.Add(d),
+		channel:  make(chan time.Time, 1),
+	}
+	f.waiters = append(f.waiters, waiter)
+	return waiter.channel
+}
+
+// The number of callers currently blocked in After
+func (f *FakeClock) NumWaiters() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.waiters)
+}
+
+// Move the clock forward, firing any After channels whose time has come
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+	remaining := []fakeClockWaiter{}
+	for _, waiter := range f.waiters {
+		if waiter.deadline.After(f.now) {
+			remaining = append(remaining, waiter)
+			continue
+		}
+		waiter.channel <- f.now
+	}
+	f.waiters = remaining
+}
@@ -3,9 +3,11 @@ package elasticthought
 import (
 	"errors"
 	"fmt"
+	"os"
+	"runtime"
+	"strings"
 
 	"github.com/couchbaselabs/logg"
-	"github.com/tleyden/go-couch"
 )
 
 type QueueType int
@@ -13,11 +15,35 @@ type QueueType int
 const (
 	Nsq QueueType = iota
 	Goroutine
+	Durable // a DocumentStoreQueue, leased from directly or via the REST server
 )
 
+var queueTypeNames = map[QueueType]string{
+	Nsq:       "nsq",
+	Goroutine: "goroutine",
+	Durable:   "durable",
+}
+
+func (q QueueType) String() string {
+	if name, ok := queueTypeNames[q]; ok {
+		return name
+	}
+	return fmt.Sprintf("QueueType(%d)", int(q))
+}
+
+// Parse the name of a queue type, as given on the command line
+func ParseQueueType(name string) (QueueType, error) {
+	for queueType, queueTypeName := range queueTypeNames {
+		if queueTypeName == name {
+			return queueType, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown queue type: %v", name)
+}
+
 // Holds configuration values that are used throughout the application
 type Configuration struct {
-	DbUrl               string
+	DbUrl               string // Sync Gateway db, or file:// for embedded (see NewDocumentStore)
 	CbfsUrl             string
 	NsqLookupdUrl       string
 	NsqdUrl             string
@@ -25,6 +51,47 @@ type Configuration struct {
 	WorkDirectory       string
 	QueueType           QueueType
 	NumCbfsClusterNodes int // needed to validate cbfs cluster health
+
+	// Only used with the durable queue type.  Workers lease jobs from the
+	// REST server at QueueUrl if it's set, otherwise straight from the
+	// document store.  The REST server only serves its /queue endpoints if
+	// QueueToken is set, and workers must present the same token.
+	QueueUrl   string
+	QueueToken string
+
+	// Where the REST API server listens, eg :8080
+	ListenAddress string
+
+	// Only used when the blob store url is s3://bucket/prefix
+	S3Endpoint  string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+
+	// How many jobs of each type a worker will run at once
+	WorkerConcurrency map[string]int
+
+	// How many jobs of each type the scheduler hands off and has running at
+	// once, across all workers.  Job types without a limit are handed off as
+	// soon as they're queued.
+	SchedulerInFlightLimits map[string]int
+
+	// The resources available to a worker (zero means not tracked), and the
+	// resources needed by each type of job
+	WorkerSlots  ResourceSlots
+	JobResources map[string]ResourceSlots
+
+	// Usage limits for users who don't have their own quota in UserQuotas,
+	// which is keyed by user doc id (eg, "user:foo")
+	DefaultQuota Quota
+	UserQuotas   map[string]Quota
+
+	// How job commands such as caffe are run: EXECUTOR_LOCAL or EXECUTOR_DOCKER.
+	// If Executor is set, it's used instead (eg, a FakeExecutor in tests).
+	ExecutorType   string
+	Executor       Executor `json:"-"`
+	DockerImage    string
+	DockerGpuFlags []string
 }
 
 func NewDefaultConfiguration() *Configuration {
@@ -37,15 +104,46 @@ func NewDefaultConfiguration() *Configuration {
 		NsqdTopic:           "elastic-thought",
 		WorkDirectory:       "/tmp/elastic-thought",
 		QueueType:           Goroutine,
+		ListenAddress:       ":8080",
 		NumCbfsClusterNodes: 1,
+		S3Endpoint:          "https://s3.amazonaws.com",
+		S3Region:            "us-east-1",
+		WorkerConcurrency: map[string]int{
+			DOC_TYPE_DATAFILE:     4,
+			DOC_TYPE_DATASET:      4,
+			DOC_TYPE_TRAINING_JOB: 1,
+			DOC_TYPE_CLASSIFY_JOB: 8,
+		},
+		SchedulerInFlightLimits: map[string]int{
+			DOC_TYPE_DATAFILE:     4,
+			DOC_TYPE_DATASET:      4,
+			DOC_TYPE_TRAINING_JOB: 1,
+			DOC_TYPE_CLASSIFY_JOB: 8,
+		},
+		WorkerSlots: ResourceSlots{
+			CPUCores: runtime.NumCPU(),
+		},
+		JobResources: map[string]ResourceSlots{
+			DOC_TYPE_DATASET:      ResourceSlots{CPUCores: 1},
+			DOC_TYPE_TRAINING_JOB: ResourceSlots{GPUs: 1, CPUCores: 1},
+		},
+		ExecutorType: EXECUTOR_LOCAL,
+		DockerImage:  DEFAULT_CAFFE_IMAGE,
+		DockerGpuFlags: []string{
+			"--device=/dev/nvidia0",
+			"--device=/dev/nvidiactl",
+			"--device=/dev/nvidia-uvm",
+		},
 	}
 	return config
 
 }
 
-// Connect to db based on url stored in config, or panic if not able to connect
-func (c Configuration) DbConnection() couch.Database {
-	db, err := couch.Connect(c.DbUrl)
+// Get the document store for the url stored in config.  Connecting to Sync
+// Gateway is deferred until the first request, so this only panics if the url
+// is invalid or the embedded store can't be opened.
+func (c Configuration) DbConnection() DocumentStore {
+	db, err := NewDocumentStore(c.DbUrl)
 	if err != nil {
 		err = errors.New(fmt.Sprintf("Error %v | dbUrl: %v", err, c.DbUrl))
 		logg.LogPanic("%v", err)
@@ -55,28 +153,81 @@ func (c Configuration) DbConnection() couch.Database {
 
 // Create a new cbfs client based on url stored in config
 func (c Configuration) NewBlobStoreClient() (BlobStore, error) {
+	if strings.HasPrefix(c.CbfsUrl, "s3://") {
+		return NewS3BlobStore(c.CbfsUrl, c)
+	}
 	return NewBlobStore(c.CbfsUrl)
 }
 
-// Add values from parsedDocOpts into Configuration and return a new instance
+// Create the executor which runs job commands such as caffe
+func (c Configuration) NewExecutor() (Executor, error) {
+	if c.Executor != nil {
+		return c.Executor, nil
+	}
+	switch c.ExecutorType {
+	case EXECUTOR_LOCAL, "":
+		return LocalExecutor{}, nil
+	case EXECUTOR_DOCKER:
+		return DockerExecutor{
+			DefaultImage: c.DockerImage,
+			GpuFlags:     c.DockerGpuFlags,
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown executor type: %v", c.ExecutorType)
+}
+
+// The quota of the given user
+func (c Configuration) QuotaFor(userID string) Quota {
+	if quota, ok := c.UserQuotas[userID]; ok {
+		return quota
+	}
+	return c.DefaultQuota
+}
+
+// Layer the configuration file (given by --config or ELASTIC_THOUGHT_CONFIG),
+// then the ELASTIC_THOUGHT_* environment variables, and then the flags in
+// parsedDocOpts, on top of Configuration, validate the result and return it
+// as a new instance.  Flags which weren't given (nil in parsedDocOpts) leave
+// the value be.
 // Example map:
 //     map[--help:false --blob-store-url:file:///tmp --sync-gw-url:http://blah.com:4985/et]
 func (c Configuration) Merge(parsedDocOpts map[string]interface{}) (Configuration, error) {
+	return c.merge(os.LookupEnv, parsedDocOpts)
+}
+
+func (c Configuration) merge(lookupEnv func(string) (string, bool), parsedDocOpts map[string]interface{}) (Configuration, error) {
+
+	configFile, _ := lookupEnv(CONFIG_FILE_ENV_VAR)
+	if flag, ok := parsedDocOpts[CONFIG_FILE_FLAG].(string); ok {
+		configFile = flag
+	}
+	if len(configFile) > 0 {
+		var err error
+		if c, err = c.MergeFile(configFile); err != nil {
+			return c, err
+		}
+	}
 
-	// Sync Gateway URL
-	syncGwUrl, ok := parsedDocOpts["--sync-gw-url"].(string)
-	if !ok {
-		return c, fmt.Errorf("Expected string arg in --sync-gw-url, got %T", syncGwUrl)
+	for _, option := range ConfigOptions {
+		if value, ok := lookupEnv(option.EnvVar()); ok {
+			if err := option.Set(&c, value); err != nil {
+				return c, fmt.Errorf("%v (from %v)", err, option.EnvVar())
+			}
+		}
 	}
-	c.DbUrl = syncGwUrl
 
-	// Blob Store URL
-	blobStoreUrl, ok := parsedDocOpts["--blob-store-url"].(string)
-	if !ok {
-		return c, fmt.Errorf("Expected string arg in --blob-store-url, got %T", blobStoreUrl)
+	for _, option := range ConfigOptions {
+		switch value := parsedDocOpts[option.Flag()].(type) {
+		case nil:
+		case string:
+			if err := option.Set(&c, value); err != nil {
+				return c, err
+			}
+		default:
+			return c, fmt.Errorf("Expected string arg in %v, got %T", option.Flag(), value)
+		}
 	}
-	c.CbfsUrl = blobStoreUrl
 
-	return c, nil
+	return c, c.Validate()
 
 }
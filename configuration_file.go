@@ -0,0 +1,217 @@
+package elasticthought
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The environment variable and flag giving the configuration file
+const (
+	CONFIG_FILE_ENV_VAR = CONFIG_ENV_PREFIX + "CONFIG"
+	CONFIG_FILE_FLAG    = "--config"
+)
+
+// What secret values are replaced with when the configuration is printed
+const REDACTED = "<redacted>"
+
+// Read the configuration file at path into Configuration and return a new
+// instance.  The file is keyed by option name, the same as the flags without
+// the leading dashes, and is json if its name ends in .json and yaml
+// otherwise, eg:
+//
+//     sync-gw-url: file:///var/lib/elastic-thought/et.db
+//     queue-type: durable
+//     worker-concurrency: {"training-job": 1, "classify-job": 8}
+//
+// Maps and lists can also be written in block style, eg:
+//
+//     worker-concurrency:
+//       training-job: 1
+//
+// Unknown options are an error, to catch typos.
+func (c Configuration) MergeFile(path string) (Configuration, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("Error reading config file: %v.  Err: %v", path, err)
+	}
+
+	var values map[string]string
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		values, err = parseJsonConfig(data)
+	} else {
+		values, err = parseYamlConfig(data)
+	}
+	if err != nil {
+		return c, fmt.Errorf("Error parsing config file: %v.  Err: %v", path, err)
+	}
+
+	for name, value := range values {
+		option, ok := FindConfigOption(name)
+		if !ok {
+			return c, fmt.Errorf("Unknown option in config file: %v: %v", path, name)
+		}
+		if err := option.Set(&c, value); err != nil {
+			return c, fmt.Errorf("%v (in %v)", err, path)
+		}
+	}
+
+	return c, nil
+
+}
+
+// Write the configuration as a yaml config file, which MergeFile can read
+// back.  If redact is set, secrets and passwords in urls are left out, eg
+// for logging the configuration at startup.
+func (c Configuration) WriteYaml(w io.Writer, redact bool) error {
+
+	for _, option := range ConfigOptions {
+		value := option.Get(c)
+		if redact {
+			value = redactConfigValue(option, value)
+		}
+		if _, err := fmt.Fprintf(w, "%v: %v\n", option.Name, yamlScalar(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// The configuration as yaml with secrets redacted
+func (c Configuration) Redacted() string {
+	buffer := &bytes.Buffer{}
+	c.WriteYaml(buffer, true)
+	return buffer.String()
+}
+
+func redactConfigValue(option ConfigOption, value string) string {
+
+	if len(value) == 0 {
+		return value
+	}
+	if option.Secret {
+		return REDACTED
+	}
+
+	// eg, Sync Gateway urls with basic auth credentials
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.User == nil {
+		return value
+	}
+	if _, hasPassword := parsed.User.Password(); hasPassword {
+		parsed.User = url.UserPassword(parsed.User.Username(), REDACTED)
+		return strings.Replace(parsed.String(), url.QueryEscape(REDACTED), REDACTED, 1)
+	}
+	return value
+
+}
+
+// A json config file is an object keyed by option name, where maps and lists
+// can be given as json, and everything else as strings or numbers
+func parseJsonConfig(data []byte) (map[string]string, error) {
+
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for name, rawValue := range raw {
+		value := strings.TrimSpace(string(rawValue))
+		if strings.HasPrefix(value, `"`) {
+			if err := json.Unmarshal(rawValue, &value); err != nil {
+				return nil, err
+			}
+		}
+		values[name] = value
+	}
+	return values, nil
+
+}
+
+// A yaml config file is a mapping keyed by option name.  Maps and lists are
+// passed on as json, the same as in a json config file.
+func parseYamlConfig(data []byte) (map[string]string, error) {
+
+	raw := map[string]yamlConfigValue{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for name, value := range raw {
+		values[name] = string(value)
+	}
+	return values, nil
+
+}
+
+// A value in a yaml config file, as the string the option is set from.
+// Scalars are kept as written, so that eg a version of 1.10 isn't read as the
+// number 1.1, and maps and lists are encoded as json.
+type yamlConfigValue string
+
+func (v *yamlConfigValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	scalar := ""
+	if err := unmarshal(&scalar); err == nil {
+		*v = yamlConfigValue(scalar)
+		return nil
+	}
+
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(jsonCompatible(value))
+	if err != nil {
+		return err
+	}
+	*v = yamlConfigValue(encoded)
+	return nil
+
+}
+
+// Yaml maps are decoded with interface{} keys, which json can't encode
+func jsonCompatible(value interface{}) interface{} {
+
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+	}
+	return value
+
+}
+
+// Quote a value for yaml if it would otherwise be read back differently
+func yamlScalar(value string) string {
+
+	if strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[") {
+		return value
+	}
+	if len(value) == 0 || strings.ContainsAny(value[:1], `-?:,&*#!|>'"%@`+"`") ||
+		strings.Contains(value, ": ") || strings.Contains(value, " #") ||
+		value != strings.TrimSpace(value) || value == "~" || value == "null" {
+		quoted, _ := json.Marshal(value)
+		return string(quoted)
+	}
+	return value
+
+}
@@ -0,0 +1,197 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The prefix of the environment variables which set configuration options
+const CONFIG_ENV_PREFIX = "ELASTIC_THOUGHT_"
+
+// A Configuration field which can be set with a command line flag or an
+// environment variable.  Maps and structs are given as json, and lists as
+// comma separated values or json arrays.
+type ConfigOption struct {
+	Name   string // the flag is --<name>
+	Help   string
+	Secret bool // redacted when the configuration is printed
+	set    func(c *Configuration, value string) error
+	get    func(c Configuration) string
+}
+
+// The command line flag, eg --sync-gw-url
+func (o ConfigOption) Flag() string {
+	return "--" + o.Name
+}
+
+// The environment variable, eg ELASTIC_THOUGHT_SYNC_GW_URL
+func (o ConfigOption) EnvVar() string {
+	return CONFIG_ENV_PREFIX + strings.ToUpper(strings.Replace(o.Name, "-", "_", -1))
+}
+
+// Set the option on the configuration from its string form
+func (o ConfigOption) Set(c *Configuration, value string) error {
+	if err := o.set(c, value); err != nil {
+		return fmt.Errorf("Invalid value for %v: %v.  Err: %v", o.Flag(), value, err)
+	}
+	return nil
+}
+
+// The string form of the option's value in the configuration
+func (o ConfigOption) Get(c Configuration) string {
+	return o.get(c)
+}
+
+// Every configuration option.  Configuration.Executor isn't here since it's
+// only set by code, eg to a FakeExecutor in tests.
+var ConfigOptions = []ConfigOption{
+	stringOption("sync-gw-url", "Sync Gateway DB URL, or file:///path/to/et.db for the embedded document store.", func(c *Configuration) *string { return &c.DbUrl }),
+	stringOption("blob-store-url", "Blob store URL: cbfs, file:// or s3://bucket/prefix.", func(c *Configuration) *string { return &c.CbfsUrl }),
+	intOption("num-cbfs-nodes", "Number of cbfs nodes expected by the environment check.", func(c *Configuration) *int { return &c.NumCbfsClusterNodes }),
+	stringOption("work-dir", "Directory where jobs keep their working files.", func(c *Configuration) *string { return &c.WorkDirectory }),
+	stringOption("listen-address", "Address the REST API server listens on, eg :8080.", func(c *Configuration) *string { return &c.ListenAddress }),
+	{
+		Name: "queue-type",
+		Help: "Where jobs are queued: goroutine (run inside the scheduler), nsq or durable (kept in the document store, for up to tens of workers).",
+		set: func(c *Configuration, value string) (err error) {
+			c.QueueType, err = ParseQueueType(value)
+			return err
+		},
+		get: func(c Configuration) string { return c.QueueType.String() },
+	},
+	stringOption("nsq-lookupd-url", "nsqlookupd address that nsq workers find nsqd with.", func(c *Configuration) *string { return &c.NsqLookupdUrl }),
+	stringOption("nsqd-url", "nsqd address that jobs are published to.", func(c *Configuration) *string { return &c.NsqdUrl }),
+	stringOption("nsqd-topic", "nsq topic for jobs.", func(c *Configuration) *string { return &c.NsqdTopic }),
+	stringOption("queue-url", "REST server a durable queue worker leases jobs from, eg http://host:8080.  Without it, jobs are leased straight from the document store.", func(c *Configuration) *string { return &c.QueueUrl }),
+	secret(stringOption("queue-token", "Shared secret for the REST server's /queue endpoints, which are disabled without it.", func(c *Configuration) *string { return &c.QueueToken })),
+	stringOption("s3-endpoint", "S3 endpoint, for s3:// blob store URLs.", func(c *Configuration) *string { return &c.S3Endpoint }),
+	stringOption("s3-region", "S3 region.", func(c *Configuration) *string { return &c.S3Region }),
+	stringOption("s3-access-key", "S3 access key.", func(c *Configuration) *string { return &c.S3AccessKey }),
+	secret(stringOption("s3-secret-key", "S3 secret key.", func(c *Configuration) *string { return &c.S3SecretKey })),
+	jsonOption("worker-concurrency", `How many jobs of each type a worker runs at once, eg {"training-job": 1}.`, func(c *Configuration) interface{} { return &c.WorkerConcurrency }),
+	jsonOption("scheduler-in-flight", `How many jobs of each type the scheduler has running at once across all workers, eg {"training-job": 4}.`, func(c *Configuration) interface{} { return &c.SchedulerInFlightLimits }),
+	jsonOption("worker-slots", `Resources available to a worker, eg {"gpus": 1, "cpu-cores": 8, "memory-mb": 0}.`, func(c *Configuration) interface{} { return &c.WorkerSlots }),
+	jsonOption("job-resources", `Resources needed by each type of job, eg {"training-job": {"gpus": 1}}.`, func(c *Configuration) interface{} { return &c.JobResources }),
+	jsonOption("default-quota", "Usage limits for users without their own quota.", func(c *Configuration) interface{} { return &c.DefaultQuota }),
+	jsonOption("user-quotas", `Usage limits keyed by user doc id, eg {"user:foo": {"max-concurrent-training-jobs": 2}}.`, func(c *Configuration) interface{} { return &c.UserQuotas }),
+	stringOption("executor", "How job commands such as caffe are run: local or docker.", func(c *Configuration) *string { return &c.ExecutorType }),
+	stringOption("docker-image", "Image that the docker executor runs caffe in.", func(c *Configuration) *string { return &c.DockerImage }),
+	listOption("docker-gpu-flags", "Comma separated flags which give docker containers the GPUs.", func(c *Configuration) *[]string { return &c.DockerGpuFlags }),
+}
+
+// Find a configuration option by name
+func FindConfigOption(name string) (ConfigOption, bool) {
+	for _, option := range ConfigOptions {
+		if option.Name == name {
+			return option, true
+		}
+	}
+	return ConfigOption{}, false
+}
+
+// The options section of a docopt usage string, listing the config file and
+// every configuration option along with its environment variable and default
+// value
+func ConfigOptionsUsage() string {
+
+	defaults := *NewDefaultConfiguration()
+
+	lines := []string{
+		fmt.Sprintf("  %v=<file>  Config file, yaml or json (see Configuration.MergeFile).  Env: %v.", CONFIG_FILE_FLAG, CONFIG_FILE_ENV_VAR),
+	}
+	for _, option := range ConfigOptions {
+		line := fmt.Sprintf("  %v=<value>  %v  Env: %v.", option.Flag(), option.Help, option.EnvVar())
+		if value := option.Get(defaults); len(value) > 0 {
+			line = fmt.Sprintf("%v  Default: %v", line, value)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+
+}
+
+func secret(option ConfigOption) ConfigOption {
+	option.Secret = true
+	return option
+}
+
+func stringOption(name, help string, field func(c *Configuration) *string) ConfigOption {
+	return ConfigOption{
+		Name: name,
+		Help: help,
+		set: func(c *Configuration, value string) error {
+			*field(c) = value
+			return nil
+		},
+		get: func(c Configuration) string { return *field(&c) },
+	}
+}
+
+func intOption(name, help string, field func(c *Configuration) *int) ConfigOption {
+	return ConfigOption{
+		Name: name,
+		Help: help,
+		set: func(c *Configuration, value string) error {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			*field(c) = parsed
+			return nil
+		},
+		get: func(c Configuration) string { return strconv.Itoa(*field(&c)) },
+	}
+}
+
+func listOption(name, help string, field func(c *Configuration) *[]string) ConfigOption {
+	return ConfigOption{
+		Name: name,
+		Help: help,
+		set: func(c *Configuration, value string) error {
+			list := []string{}
+			if strings.HasPrefix(strings.TrimSpace(value), "[") {
+				if err := json.Unmarshal([]byte(value), &list); err != nil {
+					return err
+				}
+				*field(c) = list
+				return nil
+			}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); len(item) > 0 {
+					list = append(list, item)
+				}
+			}
+			*field(c) = list
+			return nil
+		},
+		get: func(c Configuration) string { return strings.Join(*field(&c), ",") },
+	}
+}
+
+// An option for a map or struct field, given as json.  The field is
+// replaced rather than merged into, so that a map can be emptied.
+func jsonOption(name, help string, field func(c *Configuration) interface{}) ConfigOption {
+	return ConfigOption{
+		Name: name,
+		Help: help,
+		set: func(c *Configuration, value string) error {
+			target := reflect.ValueOf(field(c)).Elem()
+			parsed := reflect.New(target.Type())
+			if err := json.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+				return err
+			}
+			target.Set(parsed.Elem())
+			return nil
+		},
+		get: func(c Configuration) string {
+			data, err := json.Marshal(field(&c))
+			if err != nil || string(data) == "null" {
+				return ""
+			}
+			return string(data)
+		},
+	}
+}
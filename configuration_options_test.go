@@ -0,0 +1,80 @@
+package elasticthought
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestConfigurationMerge(t *testing.T) {
+
+	env := map[string]string{
+		"ELASTIC_THOUGHT_SYNC_GW_URL":        "http://env:4985/et",
+		"ELASTIC_THOUGHT_WORK_DIR":           "/env/work",
+		"ELASTIC_THOUGHT_QUEUE_TYPE":         "nsq",
+		"ELASTIC_THOUGHT_WORKER_CONCURRENCY": `{"training-job": 2}`,
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	parsedDocOpts := map[string]interface{}{
+		"--help":             false,
+		"serve":              true,
+		"--sync-gw-url":      "http://flag:4985/et",
+		"--listen-address":   ":9090",
+		"--docker-gpu-flags": "--device=/dev/nvidia0, --device=/dev/nvidiactl",
+		"--blob-store-url":   nil,
+	}
+
+	config, err := NewDefaultConfiguration().merge(lookupEnv, parsedDocOpts)
+	assert.True(t, err == nil)
+
+	// flags take precedence over the environment, which takes precedence
+	// over the defaults
+	assert.Equals(t, config.DbUrl, "http://flag:4985/et")
+	assert.Equals(t, config.WorkDirectory, "/env/work")
+	assert.Equals(t, config.CbfsUrl, "file:///tmp")
+	assert.Equals(t, config.ListenAddress, ":9090")
+	assert.Equals(t, config.QueueType, Nsq)
+	assert.DeepEquals(t, config.WorkerConcurrency, map[string]int{DOC_TYPE_TRAINING_JOB: 2})
+	assert.DeepEquals(t, config.DockerGpuFlags, []string{"--device=/dev/nvidia0", "--device=/dev/nvidiactl"})
+
+	_, err = NewDefaultConfiguration().merge(lookupEnv, map[string]interface{}{"--queue-type": "carrier-pigeon"})
+	assert.True(t, err != nil)
+
+	_, err = NewDefaultConfiguration().merge(lookupEnv, map[string]interface{}{"--num-cbfs-nodes": "three"})
+	assert.True(t, err != nil)
+
+}
+
+// Every field except the Executor should be settable by some option, so
+// setting each option from its string form in a configuration with every
+// field set should give back the same configuration
+func TestConfigOptionsCoverConfiguration(t *testing.T) {
+
+	full := *NewDefaultConfiguration()
+	full.QueueUrl = "http://host:8080"
+	full.QueueToken = "token"
+	full.S3AccessKey = "access"
+	full.S3SecretKey = "secret"
+	full.DefaultQuota = Quota{MaxBlobBytes: 1 << 30}
+	full.UserQuotas = map[string]Quota{"user:foo": Quota{MaxConcurrentTrainingJobs: 2}}
+
+	fields := reflect.ValueOf(full)
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Type().Field(i).Name
+		zero := reflect.Zero(fields.Field(i).Type()).Interface()
+		if name != "Executor" && reflect.DeepEqual(fields.Field(i).Interface(), zero) {
+			t.Fatalf("Test configuration should set %v", name)
+		}
+	}
+
+	config := Configuration{}
+	for _, option := range ConfigOptions {
+		assert.True(t, option.Set(&config, option.Get(full)) == nil)
+	}
+	assert.DeepEquals(t, config, full)
+
+}
@@ -0,0 +1,214 @@
+package elasticthought
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The job types which can have concurrency limits and resource needs
+var configurableJobTypes = []string{
+	DOC_TYPE_DATAFILE,
+	DOC_TYPE_DATASET,
+	DOC_TYPE_TRAINING_JOB,
+	DOC_TYPE_CLASSIFY_JOB,
+}
+
+// nsq's rule for topic names
+var nsqTopicPattern = regexp.MustCompile(`^[\.a-zA-Z0-9_-]{1,64}(#ephemeral)?$`)
+
+// All of the problems found by Configuration.Validate
+type ConfigurationError struct {
+	Problems []string
+}
+
+func (e ConfigurationError) Error() string {
+	return fmt.Sprintf("Invalid configuration:\n  %v", strings.Join(e.Problems, "\n  "))
+}
+
+// Check every field of the configuration, returning a ConfigurationError
+// listing everything that's wrong rather than stopping at the first problem
+func (c Configuration) Validate() error {
+
+	problems := []string{}
+	problem := func(option, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("--%v: %v", option, fmt.Sprintf(format, args...)))
+	}
+
+	if _, err := validateDocumentStoreUrl(c.DbUrl); err != nil {
+		problem("sync-gw-url", "%v", err)
+	}
+
+	blobStoreUrl, err := url.Parse(c.CbfsUrl)
+	switch {
+	case err != nil:
+		problem("blob-store-url", "%v", err)
+	case blobStoreUrl.Scheme == "s3":
+		if len(blobStoreUrl.Host) == 0 {
+			problem("blob-store-url", "s3 urls need a bucket, eg s3://bucket/prefix")
+		}
+		if _, err := validateHttpUrl(c.S3Endpoint); err != nil {
+			problem("s3-endpoint", "%v", err)
+		}
+		if len(c.S3Region) == 0 {
+			problem("s3-region", "required for s3 blob stores")
+		}
+		if (len(c.S3AccessKey) == 0) != (len(c.S3SecretKey) == 0) {
+			problem("s3-access-key", "the access key and secret key must be given together")
+		}
+	case blobStoreUrl.Scheme == "file":
+		if !filepath.IsAbs(blobStoreUrl.Path) {
+			problem("blob-store-url", "file urls need an absolute path, eg file:///tmp")
+		}
+	case blobStoreUrl.Scheme != "http" && blobStoreUrl.Scheme != "mock":
+		problem("blob-store-url", "expected an http (cbfs), file, s3 or mock url, got %v", c.CbfsUrl)
+	}
+
+	if c.NumCbfsClusterNodes < 1 {
+		problem("num-cbfs-nodes", "must be at least 1, got %v", c.NumCbfsClusterNodes)
+	}
+
+	if !filepath.IsAbs(c.WorkDirectory) {
+		problem("work-dir", "must be an absolute path, got %q", c.WorkDirectory)
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		problem("listen-address", "expected host:port or :port, got %q", c.ListenAddress)
+	}
+
+	switch c.QueueType {
+	case Nsq:
+		if _, _, err := net.SplitHostPort(c.NsqLookupdUrl); err != nil {
+			problem("nsq-lookupd-url", "expected host:port, got %q", c.NsqLookupdUrl)
+		}
+		if _, _, err := net.SplitHostPort(c.NsqdUrl); err != nil {
+			problem("nsqd-url", "expected host:port, got %q", c.NsqdUrl)
+		}
+		if !nsqTopicPattern.MatchString(c.NsqdTopic) {
+			problem("nsqd-topic", "not a valid nsq topic name: %q", c.NsqdTopic)
+		}
+	case Goroutine:
+	case Durable:
+		if len(c.QueueUrl) > 0 {
+			if _, err := validateHttpUrl(c.QueueUrl); err != nil {
+				problem("queue-url", "%v", err)
+			}
+			if len(c.QueueToken) == 0 {
+				problem("queue-token", "required to lease jobs from --queue-url")
+			}
+		}
+	default:
+		problem("queue-type", "unknown queue type %v", c.QueueType)
+	}
+
+	for jobType, limit := range c.WorkerConcurrency {
+		if !isConfigurableJobType(jobType) {
+			problem("worker-concurrency", "unknown job type %q, expected one of %v", jobType, configurableJobTypes)
+		}
+		if limit < 0 {
+			problem("worker-concurrency", "%v can't be negative", jobType)
+		}
+	}
+
+	for jobType, limit := range c.SchedulerInFlightLimits {
+		if !isConfigurableJobType(jobType) {
+			problem("scheduler-in-flight", "unknown job type %q, expected one of %v", jobType, configurableJobTypes)
+		}
+		if limit < 0 {
+			problem("scheduler-in-flight", "%v can't be negative", jobType)
+		}
+	}
+
+	if c.WorkerSlots.hasNegative() {
+		problem("worker-slots", "can't be negative")
+	}
+
+	for jobType, resources := range c.JobResources {
+		if !isConfigurableJobType(jobType) {
+			problem("job-resources", "unknown job type %q, expected one of %v", jobType, configurableJobTypes)
+		}
+		if resources.hasNegative() {
+			problem("job-resources", "%v can't be negative", jobType)
+		}
+	}
+
+	if err := c.DefaultQuota.validate(); err != nil {
+		problem("default-quota", "%v", err)
+	}
+	for userID, quota := range c.UserQuotas {
+		if !strings.HasPrefix(userID, DOC_TYPE_USER+":") {
+			problem("user-quotas", "expected user doc ids such as user:foo, got %q", userID)
+		}
+		if err := quota.validate(); err != nil {
+			problem("user-quotas", "%v: %v", userID, err)
+		}
+	}
+
+	switch c.ExecutorType {
+	case EXECUTOR_LOCAL, "":
+	case EXECUTOR_DOCKER:
+		if len(c.DockerImage) == 0 {
+			problem("docker-image", "required by the docker executor")
+		}
+	default:
+		problem("executor", "expected %v or %v, got %q", EXECUTOR_LOCAL, EXECUTOR_DOCKER, c.ExecutorType)
+	}
+
+	for _, flag := range c.DockerGpuFlags {
+		if !strings.HasPrefix(flag, "-") {
+			problem("docker-gpu-flags", "expected docker flags such as --device=/dev/nvidia0, got %q", flag)
+		}
+	}
+
+	if len(problems) > 0 {
+		return ConfigurationError{Problems: problems}
+	}
+	return nil
+
+}
+
+func isConfigurableJobType(jobType string) bool {
+	for _, configurable := range configurableJobTypes {
+		if jobType == configurable {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a url which NewDocumentStore should accept, without opening it
+func validateDocumentStoreUrl(rawurl string) (*url.URL, error) {
+	parsed, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		if strings.HasSuffix(rawurl, "/") {
+			return nil, fmt.Errorf("Sync Gateway urls can't end in a slash: %v", rawurl)
+		}
+		return parsed, nil
+	case "file":
+		if !filepath.IsAbs(parsed.Path) {
+			return nil, fmt.Errorf("file urls need an absolute path, eg file:///var/lib/elastic-thought/et.db")
+		}
+		return parsed, nil
+	case "mem":
+		return parsed, nil
+	}
+	return nil, fmt.Errorf("expected an http(s), file or mem url, got %v", rawurl)
+}
+
+func validateHttpUrl(rawurl string) (*url.URL, error) {
+	parsed, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return nil, fmt.Errorf("expected an http(s) url, got %q", rawurl)
+	}
+	return parsed, nil
+}
@@ -8,4 +8,30 @@ const (
 	TRAINING_DIR      = "training-data"
 	TESTING_DIR       = "test-data"
 	CBFS_URI_PREFIX   = "cbfs://"
+
+	// The doc where the changes listener records how far it's gotten
+	CHANGES_CHECKPOINT_DOC_ID = "changes-listener-checkpoint"
+
+	// The doc which records which REST server is the changes listener leader
+	LEADER_LEASE_DOC_ID = "changes-listener-leader"
+
+	// The doc holding the jobs queued by a DocumentStoreQueue
+	JOB_QUEUE_DOC_ID = "job-queue"
+)
+
+// The largest classifier bundle which can be imported, both as uploaded and
+// once it's extracted
+const MAX_CLASSIFIER_BUNDLE_BYTES = 2 << 30
+
+// The largest .tar.gz which can be uploaded as a datafile
+const MAX_DATAFILE_UPLOAD_BYTES = 4 << 30
+
+// Files contained in a classifier bundle
+const (
+	BUNDLE_MANIFEST        = "manifest.json"
+	BUNDLE_CAFFE_MODEL     = "trained.caffemodel"
+	BUNDLE_CLASSIFIER_SPEC = "classifier.prototxt"
+	BUNDLE_LABELS          = "labels.txt"
+	BUNDLE_SOLVER_SPEC     = "solver.prototxt"
+	BUNDLE_SOLVER_NET_SPEC = "solver-net.prototxt"
 )
@@ -2,12 +2,13 @@ package elasticthought
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 
 	"github.com/couchbaselabs/logg"
-	"github.com/tleyden/go-couch"
 )
 
 // A Datafile is a raw "bundle" of data, typically a zip or .tar.gz file.
@@ -18,13 +19,17 @@ type Datafile struct {
 	ElasticThoughtDoc
 	ProcessingState ProcessingState `json:"processing-state"`
 	ProcessingLog   string          `json:"processing-log"`
+	Lease           JobLease        `json:"lease"`
+	Attempts        []JobAttempt    `json:"attempts"`
 	UserID          string          `json:"user-id"`
+	Priority        int             `json:"priority"`
 	Url             string          `json:"url" binding:"required"`
 
 	// had to make exported, due to https://github.com/gin-gonic/gin/pull/123
 	// waiting for this to get merged into master branch, since go get
-	// pulls from master branch.
-	Configuration Configuration
+	// pulls from master branch.  It's never saved in the doc or sent to
+	// clients, since it holds credentials such as S3 keys and the queue token.
+	Configuration Configuration `json:"-"`
 }
 
 // Create a new datafile
@@ -36,7 +41,7 @@ func NewDatafile(c Configuration) *Datafile {
 }
 
 // Find Datafile by Id from the db
-func FindDatafile(db couch.Database, datafileId string) (*Datafile, error) {
+func FindDatafile(db DocumentStore, datafileId string) (*Datafile, error) {
 
 	datafile := &Datafile{}
 	if err := db.Retrieve(datafileId, datafile); err != nil {
@@ -46,8 +51,51 @@ func FindDatafile(db couch.Database, datafileId string) (*Datafile, error) {
 
 }
 
+// Create a datafile from a .tar.gz read from r, rather than downloading it
+// from a url.  It's inserted as already finished so that the changes listener
+// won't try to download it, and its url points at the copy in the blob
+// store, the same as the url of a downloaded datafile.
+func UploadDatafile(config Configuration, userID, filename string, r io.Reader) (*Datafile, error) {
+
+	filename = path.Base(filename)
+	if filename == "." || filename == "/" {
+		filename = "datafile.tar.gz"
+	}
+
+	db := config.DbConnection()
+
+	blobStore, err := config.NewBlobStoreClient()
+	if err != nil {
+		return nil, err
+	}
+
+	datafile := NewDatafile(config)
+	datafile.UserID = userID
+	datafile.ProcessingState = FinishedSuccessfully
+	datafile, err = datafile.Save(db)
+	if err != nil {
+		return nil, err
+	}
+	datafile.Configuration = config
+
+	destPath := path.Join(datafile.Id, filename)
+	options := BlobPutOptions{}
+	options.ContentType = "application/x-gzip"
+	if err := blobStore.Put("", destPath, r, options); err != nil {
+		errMsg := wrapError(err, "Error writing %v to blobStore: %v", destPath, err)
+		if err := datafile.Failed(db, errMsg); err != nil {
+			logg.LogError(err)
+		}
+		return nil, errMsg
+	}
+
+	datafile.Url = fmt.Sprintf("%v%v", CBFS_URI_PREFIX, destPath)
+	return datafile.Save(db)
+
+}
+
 // Save a new version of Datafile to the db
-func (d Datafile) Save(db couch.Database) (*Datafile, error) {
+func (d Datafile) Save(db DocumentStore) (*Datafile, error) {
 
 	idToRetrieve := ""
 
@@ -74,13 +122,14 @@ func (d Datafile) Save(db couch.Database) (*Datafile, error) {
 	if err != nil {
 		return nil, err
 	}
+	datafile.Configuration = d.Configuration
 
 	return datafile, nil
 
 }
 
 // Mark this datafile as having finished processing succesfully
-func (d Datafile) FinishedSuccessfully(db couch.Database) error {
+func (d Datafile) FinishedSuccessfully(db DocumentStore) error {
 
 	_, err := d.UpdateProcessingState(FinishedSuccessfully)
 	if err != nil {
@@ -91,9 +140,27 @@ func (d Datafile) FinishedSuccessfully(db couch.Database) error {
 
 }
 
+// Record that the datafile has been copied to the blob store, and that url
+// is where it's read from now
+func (d Datafile) FinishedCopying(url string) error {
+
+	updater := func(datafile *Datafile) {
+		datafile.Url = url
+		datafile.ProcessingState = FinishedSuccessfully
+	}
+
+	doneMetric := func(datafile Datafile) bool {
+		return datafile.Url == url && datafile.ProcessingState == FinishedSuccessfully
+	}
+
+	_, err := d.casUpdate(updater, doneMetric)
+	return err
+
+}
+
 // Update the dataset state to record that it failed
 // Codereview: datafile.go has same method
-func (d Datafile) Failed(db couch.Database, processingErr error) error {
+func (d Datafile) Failed(db DocumentStore, processingErr error) error {
 
 	_, err := d.UpdateProcessingState(Failed)
 	if err != nil {
@@ -125,7 +192,7 @@ func (d Datafile) HasValidId() bool {
 }
 
 // Copy the contents of Datafile.Url to CBFS and return the cbfs dest path
-func (d Datafile) CopyToBlobStore(db couch.Database, blobStore BlobStore) (string, error) {
+func (d Datafile) CopyToBlobStore(db DocumentStore, blobStore BlobStore) (string, error) {
 
 	if !d.HasValidId() {
 		errMsg := fmt.Errorf("Datafile: %+v must have an id", d)
@@ -155,17 +222,26 @@ func (d Datafile) CopyToBlobStore(db couch.Database, blobStore BlobStore) (strin
 	// open input stream to url
 	resp, err := http.Get(d.Url)
 	if err != nil {
-		errMsg := fmt.Errorf("Error opening: %v. Err %v", d.Url, err)
+		errMsg := NewTransientError(fmt.Errorf("Error opening: %v. Err %v", d.Url, err))
 		logg.LogError(errMsg)
 		return "", errMsg
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != 200 {
+		errMsg := fmt.Errorf("%v response to GET on: %v", resp.StatusCode, d.Url)
+		logg.LogError(errMsg)
+		if isTransientHTTPStatus(resp.StatusCode) {
+			return "", NewTransientError(errMsg)
+		}
+		return "", errMsg
+	}
+
 	// write to blobStore
 	options := BlobPutOptions{}
 	options.ContentType = resp.Header.Get("Content-Type")
 	if err := blobStore.Put("", destPath, resp.Body, options); err != nil {
-		errMsg := fmt.Errorf("Error writing %v to blobStore: %v", destPath, err)
+		errMsg := wrapError(err, "Error writing %v to blobStore: %v", destPath, err)
 		logg.LogError(errMsg)
 		return "", errMsg
 	}
@@ -176,6 +252,25 @@ func (d Datafile) CopyToBlobStore(db couch.Database, blobStore BlobStore) (strin
 
 }
 
+// Open the content of the datafile.  Once it's been uploaded or copied to
+// the blob store its url is a cbfs:// url, which is read from the blob store
+// whatever kind it is, and otherwise it's fetched from the url.
+func (d Datafile) Open(blobStore BlobStore) (io.ReadCloser, error) {
+
+	if !strings.HasPrefix(d.Url, CBFS_URI_PREFIX) {
+		return openUrl(d.Url)
+	}
+
+	// only the datafile's own blobs can be read, since the url could have
+	// been set by the user who created it
+	blobPath := path.Clean(strings.TrimPrefix(d.Url, CBFS_URI_PREFIX))
+	if !strings.HasPrefix(blobPath, d.Id+"/") {
+		return nil, fmt.Errorf("Datafile: %v has url %v outside of its blobs", d.Id, d.Url)
+	}
+	return blobStore.Get(blobPath)
+
+}
+
 func (d *Datafile) casUpdate(updater func(*Datafile), doneMetric func(Datafile) bool) (bool, error) {
 
 	db := d.Configuration.DbConnection()
@@ -207,13 +302,14 @@ func (d *Datafile) SetProcessingState(newState ProcessingState) {
 	d.ProcessingState = newState
 }
 
-func (d *Datafile) RefreshFromDB(db couch.Database) error {
+func (d *Datafile) RefreshFromDB(db DocumentStore) error {
 	datafile := Datafile{}
 	err := db.Retrieve(d.Id, &datafile)
 	if err != nil {
 		logg.LogTo("MODEL", "Error getting latest: %v", err)
 		return err
 	}
+	datafile.Configuration = d.Configuration
 	*d = datafile
 	return nil
 }
@@ -13,6 +13,10 @@ type DatafileDownloader struct {
 	Datafile      Datafile
 }
 
+func (d DatafileDownloader) JobType() string {
+	return DOC_TYPE_DATAFILE
+}
+
 // Run this job
 func (d DatafileDownloader) Run(wg *sync.WaitGroup) {
 
@@ -22,7 +26,7 @@ func (d DatafileDownloader) Run(wg *sync.WaitGroup) {
 
 	db := d.Configuration.DbConnection()
 	datafile := &d.Datafile
-	updatedState, err := datafile.UpdateProcessingState(Processing)
+	updatedState, stopLease, err := startJobLease(d.Configuration, datafile, datafile.Id)
 	if err != nil {
 		d.recordProcessingError(err)
 		return
@@ -31,6 +35,7 @@ func (d DatafileDownloader) Run(wg *sync.WaitGroup) {
 		logg.LogTo("DATAFILE_DOWNLOADER", "%+v already processed.  Ignoring.", d)
 		return
 	}
+	defer stopLease()
 
 	// create a new cbfs client
 	cbfs, err := d.Configuration.NewBlobStoreClient()
@@ -49,11 +54,11 @@ func (d DatafileDownloader) Run(wg *sync.WaitGroup) {
 	}
 
 	// build a url to the cbfs file
-	cbfsUrl := fmt.Sprintf("%v/%v", d.Configuration.CbfsUrl, cbfsDestPath)
-	d.Datafile.Url = cbfsUrl
+	cbfsUrl := fmt.Sprintf("%v%v", CBFS_URI_PREFIX, cbfsDestPath)
 
-	// Update the state of the dataset to be finished
-	if err := d.Datafile.FinishedSuccessfully(db); err != nil {
+	// Update the url and state of the datafile in one go, so the url isn't
+	// lost if the doc has changed since the job started
+	if err := d.Datafile.FinishedCopying(cbfsUrl); err != nil {
 		errMsg := fmt.Errorf("Error marking datafile %+v finished: %v", d, err)
 		d.recordProcessingError(errMsg)
 		return
@@ -63,9 +68,7 @@ func (d DatafileDownloader) Run(wg *sync.WaitGroup) {
 
 // Codereview: de-dupe -- dataset_splitter has same method
 func (d DatafileDownloader) recordProcessingError(err error) {
-	logg.LogError(err)
-	db := d.Configuration.DbConnection()
-	if err := d.Datafile.Failed(db, err); err != nil {
+	if err := recordJobFailure(d.Configuration, &d.Datafile, err, systemClock{}); err != nil {
 		errMsg := fmt.Errorf("Error setting datafile as failed: %v", err)
 		logg.LogError(errMsg)
 	}
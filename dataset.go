@@ -4,7 +4,6 @@ import (
 	"fmt"
 
 	"github.com/couchbaselabs/logg"
-	"github.com/tleyden/go-couch"
 )
 
 /*
@@ -18,13 +17,18 @@ type Dataset struct {
 	ElasticThoughtDoc
 	ProcessingState ProcessingState `json:"processing-state"`
 	ProcessingLog   string          `json:"processing-log"`
+	Lease           JobLease        `json:"lease"`
+	Attempts        []JobAttempt    `json:"attempts"`
+	UserID          string          `json:"user-id"`
+	Priority        int             `json:"priority"`
 	TrainingDataset TrainingDataset `json:"training" binding:"required"`
 	TestDataset     TestDataset     `json:"test" binding:"required"`
 
 	// had to make exported, due to https://github.com/gin-gonic/gin/pull/123
 	// waiting for this to get merged into master branch, since go get
-	// pulls from master branch.
-	Configuration Configuration
+	// pulls from master branch.  It's never saved in the doc or sent to
+	// clients, since it holds credentials such as S3 keys and the queue token.
+	Configuration Configuration `json:"-"`
 }
 
 type TrainingDataset struct {
@@ -68,7 +72,7 @@ func (d *Dataset) Insert() error {
 }
 
 // Find and return the datafile associated with this dataset
-func (d Dataset) GetSplittableDatafile(db couch.Database) (*Datafile, error) {
+func (d Dataset) GetSplittableDatafile(db DocumentStore) (*Datafile, error) {
 
 	if !d.isSplittable() {
 		return nil, fmt.Errorf("This dataset is not splittable")
@@ -82,17 +86,17 @@ func (d Dataset) GetSplittableDatafile(db couch.Database) (*Datafile, error) {
 }
 
 // Get the training datafile object
-func (d Dataset) GetTrainingDatafile(db couch.Database) (*Datafile, error) {
+func (d Dataset) GetTrainingDatafile(db DocumentStore) (*Datafile, error) {
 	return FindDatafile(db, d.TrainingDataset.DatafileID)
 }
 
 // Get the testing datafile object
-func (d Dataset) GetTestingDatafile(db couch.Database) (*Datafile, error) {
+func (d Dataset) GetTestingDatafile(db DocumentStore) (*Datafile, error) {
 	return FindDatafile(db, d.TestDataset.DatafileID)
 }
 
 // Get the source url associated with the training datafile
-func (d Dataset) GetTrainingDatafileUrl(db couch.Database) string {
+func (d Dataset) GetTrainingDatafileUrl(db DocumentStore) string {
 	datafile, err := d.GetTrainingDatafile(db)
 	if err != nil {
 		return fmt.Sprintf("error getting training datafile url: %v", err)
@@ -101,7 +105,7 @@ func (d Dataset) GetTrainingDatafileUrl(db couch.Database) string {
 }
 
 // Get the source url associated with the testing datafile
-func (d Dataset) GetTestingDatafileUrl(db couch.Database) string {
+func (d Dataset) GetTestingDatafileUrl(db DocumentStore) string {
 	datafile, err := d.GetTestingDatafile(db)
 	if err != nil {
 		return fmt.Sprintf("error getting testing datafile url: %v", err)
@@ -118,7 +122,7 @@ func (d Dataset) isSplittable() bool {
 	}
 
 	// the split percentages should both be non-zero
-	if int(d.TrainingDataset.SplitPercentage) == 0 || int(d.TestDataset.SplitPercentage) == 0 {
+	if d.TrainingDataset.SplitPercentage == 0 || d.TestDataset.SplitPercentage == 0 {
 		return false
 	}
 
@@ -166,7 +170,7 @@ func (d *Dataset) casUpdate(updater func(*Dataset), doneMetric func(Dataset) boo
 
 // Update the dataset state to record that it finished successfully
 // Codereview: de-dupe with datafile FinishedSuccessfully
-func (d Dataset) FinishedSuccessfully(db couch.Database) error {
+func (d Dataset) FinishedSuccessfully(db DocumentStore) error {
 
 	_, err := d.UpdateProcessingState(FinishedSuccessfully)
 	if err != nil {
@@ -179,7 +183,7 @@ func (d Dataset) FinishedSuccessfully(db couch.Database) error {
 
 // Update the dataset state to record that it failed
 // Codereview: datafile.go has same method
-func (d Dataset) Failed(db couch.Database, processingErr error) error {
+func (d Dataset) Failed(db DocumentStore, processingErr error) error {
 
 	_, err := d.UpdateProcessingState(Failed)
 	if err != nil {
@@ -256,13 +260,14 @@ func (d *Dataset) SetProcessingState(newState ProcessingState) {
 	d.ProcessingState = newState
 }
 
-func (d *Dataset) RefreshFromDB(db couch.Database) error {
+func (d *Dataset) RefreshFromDB(db DocumentStore) error {
 	dataset := Dataset{}
 	err := db.Retrieve(d.Id, &dataset)
 	if err != nil {
 		logg.LogTo("TRAINING_JOB", "Error getting latest: %v", err)
 		return err
 	}
+	dataset.Configuration = d.Configuration
 	*d = dataset
 	return nil
 }
@@ -5,7 +5,6 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
-	"net/http"
 	"path"
 	"strings"
 	"sync"
@@ -19,6 +18,10 @@ type DatasetSplitter struct {
 	Dataset       Dataset
 }
 
+func (d DatasetSplitter) JobType() string {
+	return DOC_TYPE_DATASET
+}
+
 // Run this job
 func (d DatasetSplitter) Run(wg *sync.WaitGroup) {
 
@@ -26,7 +29,7 @@ func (d DatasetSplitter) Run(wg *sync.WaitGroup) {
 
 	dataset := &d.Dataset
 
-	updatedState, err := dataset.UpdateProcessingState(Processing)
+	updatedState, stopLease, err := startJobLease(d.Configuration, dataset, dataset.Id)
 	if err != nil {
 		d.recordProcessingError(err)
 		return
@@ -35,6 +38,7 @@ func (d DatasetSplitter) Run(wg *sync.WaitGroup) {
 		logg.LogTo("TRAINING_JOB", "%+v already processed.  Ignoring.", d)
 		return
 	}
+	defer stopLease()
 
 	switch d.Dataset.isSplittable() {
 	case true:
@@ -56,8 +60,26 @@ func (d DatasetSplitter) SplitDatafile() {
 		return
 	}
 
-	// Open the url -- content type should be application/x-gzip
-	tr, err := openTarGzStream(datafile.Url)
+	// Create a cbfs client
+	cbfs, err := d.Configuration.NewBlobStoreClient()
+	options := BlobPutOptions{}
+	options.ContentType = "application/x-gzip"
+	if err != nil {
+		errMsg := fmt.Errorf("Error creating cbfs client: %v", err)
+		d.recordProcessingError(errMsg)
+		return
+	}
+
+	// Open the datafile -- content type should be application/x-gzip
+	source, err := datafile.Open(cbfs)
+	if err != nil {
+		errMsg := wrapError(err, "Error opening datafile %v: %v", datafile.Id, err)
+		d.recordProcessingError(errMsg)
+		return
+	}
+	defer source.Close()
+
+	tr, err := openTarGzStream(source)
 	if err != nil {
 		errMsg := fmt.Errorf("Error opening tar.gz streams: %v", err)
 		d.recordProcessingError(errMsg)
@@ -76,16 +98,6 @@ func (d DatasetSplitter) SplitDatafile() {
 	tarWriterTesting := tar.NewWriter(pwGzTest)
 	tarWriterTraining := tar.NewWriter(pwGzTrain)
 
-	// Create a cbfs client
-	cbfs, err := NewBlobStore(d.Configuration.CbfsUrl)
-	options := BlobPutOptions{}
-	options.ContentType = "application/x-gzip"
-	if err != nil {
-		errMsg := fmt.Errorf("Error creating cbfs client: %v", err)
-		d.recordProcessingError(errMsg)
-		return
-	}
-
 	// Figure out where to store these on cbfs
 	destTraining := d.Dataset.TrainingArtifactPath()
 	destTesting := d.Dataset.TestingArtifactPath()
@@ -121,7 +133,7 @@ func (d DatasetSplitter) SplitDatafile() {
 	cbfsTestDoneChan := make(chan error, 1)
 	go func() {
 		if err := cbfs.Put("", destTesting, prTest, options); err != nil {
-			errMsg := fmt.Errorf("Error writing %v to cbfs: %v", destTesting, err)
+			errMsg := wrapError(err, "Error writing %v to cbfs: %v", destTesting, err)
 			logg.LogError(errMsg)
 			cbfsTestDoneChan <- errMsg
 			return
@@ -132,7 +144,7 @@ func (d DatasetSplitter) SplitDatafile() {
 	}()
 	go func() {
 		if err := cbfs.Put("", destTraining, prTrain, options); err != nil {
-			errMsg := fmt.Errorf("Error writing %v to cbfs: %v", destTraining, err)
+			errMsg := wrapError(err, "Error writing %v to cbfs: %v", destTraining, err)
 			logg.LogError(errMsg)
 			cbfsTrainDoneChan <- errMsg
 			return
@@ -151,7 +163,7 @@ func (d DatasetSplitter) SplitDatafile() {
 	for _, result := range results {
 		if result != nil {
 			logg.LogTo("DATASET_SPLITTER", "Setting dataset to failed: %v", result)
-			d.Dataset.Failed(db, fmt.Errorf("%v", result))
+			d.recordProcessingError(result)
 			return
 		}
 	}
@@ -169,7 +181,7 @@ func (d DatasetSplitter) SplitDatafile() {
 func (d DatasetSplitter) DownloadDatafiles() {
 
 	// Create a cbfs client
-	cbfs, err := NewBlobStore(d.Configuration.CbfsUrl)
+	cbfs, err := d.Configuration.NewBlobStoreClient()
 	options := BlobPutOptions{}
 	options.ContentType = "application/x-gzip"
 	if err != nil {
@@ -181,45 +193,51 @@ func (d DatasetSplitter) DownloadDatafiles() {
 	db := d.Configuration.DbConnection()
 
 	source2destEntries := []struct {
-		Url      string
-		DestPath string
+		GetDatafile func(DocumentStore) (*Datafile, error)
+		DestPath    string
 	}{
 		{
-			Url:      d.Dataset.GetTrainingDatafileUrl(db),
-			DestPath: d.Dataset.TrainingArtifactPath(),
+			GetDatafile: d.Dataset.GetTrainingDatafile,
+			DestPath:    d.Dataset.TrainingArtifactPath(),
 		},
 		{
-			Url:      d.Dataset.GetTestingDatafileUrl(db),
-			DestPath: d.Dataset.TestingArtifactPath(),
+			GetDatafile: d.Dataset.GetTestingDatafile,
+			DestPath:    d.Dataset.TestingArtifactPath(),
 		},
 	}
 
 	for _, source2destEntry := range source2destEntries {
 
 		// open tar.gz stream to source
-		// Open the url -- content type should be application/x-gzip
+		// Open the datafile -- content type should be application/x-gzip
 
-		func() {
+		err := func() error {
 
-			resp, err := http.Get(source2destEntry.Url)
+			datafile, err := source2destEntry.GetDatafile(db)
+			if err != nil {
+				return fmt.Errorf("Error looking up datafile for: %v. Err %v", source2destEntry.DestPath, err)
+			}
 
+			source, err := datafile.Open(cbfs)
 			if err != nil {
-				errMsg := fmt.Errorf("Error opening stream to: %v. Err %v", source2destEntry.Url, err)
-				d.recordProcessingError(errMsg)
-				return
+				return wrapError(err, "Error opening datafile %v: %v", datafile.Id, err)
 			}
-			defer resp.Body.Close()
+			defer source.Close()
 
-			if err := cbfs.Put("", source2destEntry.DestPath, resp.Body, options); err != nil {
-				errMsg := fmt.Errorf("Error writing %v to cbfs: %v", source2destEntry.DestPath, err)
-				d.recordProcessingError(errMsg)
-				return
+			if err := cbfs.Put("", source2destEntry.DestPath, source, options); err != nil {
+				return wrapError(err, "Error writing %v to cbfs: %v", source2destEntry.DestPath, err)
 			}
 
 			logg.LogTo("DATASET_SPLITTER", "Wrote %v to cbfs", source2destEntry.DestPath)
+			return nil
 
 		}()
 
+		if err != nil {
+			d.recordProcessingError(err)
+			return
+		}
+
 	}
 
 	// Update the state of the dataset to be finished
@@ -233,9 +251,7 @@ func (d DatasetSplitter) DownloadDatafiles() {
 
 // Codereview: de-dupe
 func (d DatasetSplitter) recordProcessingError(err error) {
-	logg.LogError(err)
-	db := d.Configuration.DbConnection()
-	if err := d.Dataset.Failed(db, err); err != nil {
+	if err := recordJobFailure(d.Configuration, &d.Dataset, err, systemClock{}); err != nil {
 		errMsg := fmt.Errorf("Error setting dataset as failed: %v", err)
 		logg.LogError(errMsg)
 	}
@@ -61,3 +61,17 @@ func TestJsonEncode(t *testing.T) {
 	assert.Equals(t, dataset2.ProcessingState, FinishedSuccessfully)
 
 }
+
+func TestIsSplittable(t *testing.T) {
+
+	dataset := NewDataset(*NewDefaultConfiguration())
+	dataset.TrainingDataset = TrainingDataset{DatafileID: "dfid", SplitPercentage: 0.7}
+	dataset.TestDataset = TestDataset{DatafileID: "dfid", SplitPercentage: 0.3}
+	assert.True(t, dataset.isSplittable())
+
+	// already split into two datafiles
+	dataset.TestDataset = TestDataset{DatafileID: "dfid2"}
+	dataset.TrainingDataset.SplitPercentage = 0
+	assert.False(t, dataset.isSplittable())
+
+}
@@ -0,0 +1,164 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/couchbaselabs/logg"
+)
+
+// Returned when trying to delete a doc which other docs still depend on
+// (eg, a dataset which is used by a solver) without cascading.
+type DependentsError struct {
+	DocId      string
+	Dependents []string
+}
+
+func (e DependentsError) Error() string {
+	return fmt.Sprintf(
+		"Cannot delete %v since it is used by: %v.  Use cascade=true to delete them too",
+		e.DocId,
+		strings.Join(e.Dependents, ", "),
+	)
+}
+
+// Figure out which docs need to be deleted in order to delete docId.  If
+// cascade is true, this will be docId along with everything that depends on
+// it (directly or indirectly), ordered so that dependents come before the
+// docs they depend on.  If cascade is false and there are dependents, a
+// DependentsError is returned.
+func PlanDelete(db DocumentStore, docId string, cascade bool) ([]string, error) {
+
+	rows, err := allDocs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	dependents, err := dependentsIndex(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dependents[docId]) > 0 && !cascade {
+		return nil, DependentsError{DocId: docId, Dependents: dependents[docId]}
+	}
+
+	return deletionOrder(docId, dependents), nil
+
+}
+
+// Delete the given docs in order, along with their blobs.  Any jobs which
+// are still being processed are cancelled first.
+func DeleteDocuments(config Configuration, docIds []string) error {
+
+	db := config.DbConnection()
+
+	blobStore, err := config.NewBlobStoreClient()
+	if err != nil {
+		return err
+	}
+
+	for _, docId := range docIds {
+		if err := deleteDocument(config, db, blobStore, docId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func deleteDocument(config Configuration, db DocumentStore, blobStore BlobStore, docId string) error {
+
+	doc := struct {
+		ElasticThoughtDoc
+		ProcessingState *ProcessingState `json:"processing-state"`
+	}{}
+	if err := db.Retrieve(docId, &doc); err != nil {
+		return fmt.Errorf("Didn't retrieve: %v - %v", docId, err)
+	}
+
+	if doc.ProcessingState != nil && *doc.ProcessingState == Processing {
+		logg.LogTo("REST", "Cancelling %v before deleting it", docId)
+		if err := CancelJob(config, docId); err != nil {
+			return fmt.Errorf("Error cancelling job: %v.  Err: %v", docId, err)
+		}
+		// cancelling updated the doc, so get the latest revision
+		if err := db.Retrieve(docId, &doc); err != nil {
+			return fmt.Errorf("Didn't retrieve: %v - %v", docId, err)
+		}
+	}
+
+	blobs, err := blobStore.List(fmt.Sprintf("%v/", docId))
+	if err != nil {
+		return fmt.Errorf("Error listing blobs for: %v.  Err: %v", docId, err)
+	}
+	for _, blob := range blobs {
+		logg.LogTo("REST", "Deleting blob: %v", blob.Path)
+		if err := blobStore.Rm(blob.Path); err != nil {
+			return fmt.Errorf("Error deleting blob: %v.  Err: %v", blob.Path, err)
+		}
+	}
+
+	logg.LogTo("REST", "Deleting doc: %v", docId)
+	if err := db.Delete(docId, doc.Revision); err != nil {
+		return fmt.Errorf("Error deleting doc: %v.  Err: %v", docId, err)
+	}
+
+	return nil
+
+}
+
+// Build an index of the docs which directly depend on each doc.
+//
+// Key: doc id
+// Value: sorted ids of the docs which refer to that doc
+func dependentsIndex(rows []allDocsRow) (map[string][]string, error) {
+
+	dependents := map[string][]string{}
+	for _, row := range rows {
+		doc := ownedDoc{}
+		if err := json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, fmt.Errorf("Error decoding doc: %v.  Err: %v", row.Id, err)
+		}
+		for _, parentId := range doc.parentIds() {
+			if len(parentId) == 0 {
+				continue
+			}
+			dependents[parentId] = append(dependents[parentId], row.Id)
+		}
+	}
+
+	for _, docIds := range dependents {
+		sort.Strings(docIds)
+	}
+
+	return dependents, nil
+
+}
+
+// Return docId along with all of its direct and indirect dependents, with
+// every doc appearing after all of the docs that depend on it.
+func deletionOrder(docId string, dependents map[string][]string) []string {
+
+	order := []string{}
+	visited := map[string]bool{}
+
+	var visit func(string)
+	visit = func(id string) {
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+		for _, dependentId := range dependents[id] {
+			visit(dependentId)
+		}
+		order = append(order, id)
+	}
+	visit(docId)
+
+	return order
+
+}
@@ -0,0 +1,38 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestDeletionOrder(t *testing.T) {
+
+	rows := []allDocsRow{
+		{Id: "datafile", Doc: json.RawMessage(`{"type": "datafile"}`)},
+		{Id: "dataset", Doc: json.RawMessage(`{"type": "dataset", "training": {"datafile-id": "datafile"}, "test": {"datafile-id": "datafile"}}`)},
+		{Id: "solver", Doc: json.RawMessage(`{"type": "solver", "dataset-id": "dataset"}`)},
+		{Id: "training-job", Doc: json.RawMessage(`{"type": "training-job", "solver-id": "solver"}`)},
+		{Id: "training-job2", Doc: json.RawMessage(`{"type": "training-job", "solver-id": "solver"}`)},
+		{Id: "classifier", Doc: json.RawMessage(`{"type": "classifier", "training-job-id": "training-job"}`)},
+		{Id: "classify-job", Doc: json.RawMessage(`{"type": "classify-job", "classifier-id": "classifier"}`)},
+	}
+
+	dependents, err := dependentsIndex(rows)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(dependents["datafile"]), 1)
+	assert.Equals(t, len(dependents["solver"]), 2)
+	assert.Equals(t, len(dependents["classify-job"]), 0)
+
+	order := deletionOrder("solver", dependents)
+	expected := []string{"classify-job", "classifier", "training-job", "training-job2", "solver"}
+	assert.DeepEquals(t, order, expected)
+
+	order = deletionOrder("classify-job", dependents)
+	assert.DeepEquals(t, order, []string{"classify-job"})
+
+	err = DependentsError{DocId: "dataset", Dependents: dependents["dataset"]}
+	assert.True(t, len(err.Error()) > 0)
+
+}
@@ -0,0 +1,211 @@
+package elasticthought
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+	"github.com/dustin/httputil"
+	"github.com/tleyden/go-couch"
+)
+
+// Where all of the docs (datafiles, datasets, jobs, users, etc) are stored.
+// This has the same api as a go-couch Database, so that Sync Gateway can be
+// used directly, but there is also an embedded implementation for running
+// without a Couchbase stack.
+type DocumentStore interface {
+
+	// Load the doc with the given id into doc.  Returns a 404 HTTPError if
+	// there is no such doc.
+	Retrieve(id string, doc interface{}) error
+
+	// Store a new doc, using its _id if it has one, and return its id and rev.
+	// If it also has a _rev, this is the same as Edit.
+	Insert(doc interface{}) (string, string, error)
+
+	// Store a new doc with the given id and return its id and rev.  Returns a
+	// 409 HTTPError if there is already a doc with that id.
+	InsertWith(doc interface{}, id string) (string, string, error)
+
+	// Update a doc, which must have the _id and _rev of the current revision,
+	// and return the new rev.  Returns a 409 HTTPError if the doc has been
+	// updated since, so that callers can do a compare-and-swap (see casUpdate).
+	Edit(doc interface{}) (string, error)
+
+	Delete(id, rev string) error
+
+	// Query a view.  Only _all_docs is used by elastic-thought, and it's the
+	// only view that the embedded store supports.
+	Query(view string, options map[string]interface{}, results interface{}) error
+
+	// Follow the changes feed, calling handler with the body of each batch of
+	// changes until it returns nil.  Whatever else it returns is used as the
+	// since option for the next batch.
+	Changes(handler couch.ChangeHandler, options map[string]interface{})
+}
+
+// Open the document store at the given url.  Two kinds are supported:
+//
+//	http://host:4985/db  (Sync Gateway)
+//	file:///path/to/elastic-thought.db  (embedded, see EmbeddedDocumentStore)
+//
+// mem://name is also supported, which is an embedded store that's only kept
+// in memory, for tests.
+func NewDocumentStore(rawurl string) (DocumentStore, error) {
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing document store url: %v.  Err: %v", rawurl, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if strings.HasSuffix(rawurl, "/") {
+			return nil, fmt.Errorf("Sync Gateway url must not have a trailing slash: %v", rawurl)
+		}
+		return NewSyncGatewayDocumentStore(rawurl), nil
+	case "file":
+		path := filepath.Clean(u.Path)
+		store, err := sharedEmbeddedDocumentStore(path, path)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "mem":
+		store, err := sharedEmbeddedDocumentStore(rawurl, "")
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	return nil, fmt.Errorf("Unrecognized document store url: %v.  Expected an http:// "+
+		"Sync Gateway url or a file:// path", rawurl)
+
+}
+
+// Whether the url is for an embedded document store, which lives inside a
+// single process and so can't be shared by separate serve, scheduler and
+// worker processes.
+func IsEmbeddedDocumentStore(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	return err == nil && (u.Scheme == "file" || u.Scheme == "mem")
+}
+
+// A document store backed by a Sync Gateway database.  The connection is made
+// lazily, and retried on the next call if it fails, so that an unreachable
+// Sync Gateway results in errors rather than a panic.
+type SyncGatewayDocumentStore struct {
+	Url string
+
+	mutex     sync.Mutex
+	db        couch.Database
+	connected bool
+}
+
+func NewSyncGatewayDocumentStore(dbUrl string) *SyncGatewayDocumentStore {
+	return &SyncGatewayDocumentStore{Url: dbUrl}
+}
+
+func (s *SyncGatewayDocumentStore) String() string {
+	return s.Url
+}
+
+func (s *SyncGatewayDocumentStore) connect() (couch.Database, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.connected {
+		return s.db, nil
+	}
+
+	db, err := couch.Connect(s.Url)
+	if err != nil {
+		return db, fmt.Errorf("Error connecting to Sync Gateway: %v.  Err: %v", s.Url, err)
+	}
+	s.db = db
+	s.connected = true
+	return db, nil
+
+}
+
+func (s *SyncGatewayDocumentStore) Retrieve(id string, doc interface{}) error {
+	db, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return db.Retrieve(id, doc)
+}
+
+func (s *SyncGatewayDocumentStore) Insert(doc interface{}) (string, string, error) {
+	db, err := s.connect()
+	if err != nil {
+		return "", "", err
+	}
+	return db.Insert(doc)
+}
+
+func (s *SyncGatewayDocumentStore) InsertWith(doc interface{}, id string) (string, string, error) {
+	db, err := s.connect()
+	if err != nil {
+		return "", "", err
+	}
+	return db.InsertWith(doc, id)
+}
+
+func (s *SyncGatewayDocumentStore) Edit(doc interface{}) (string, error) {
+	db, err := s.connect()
+	if err != nil {
+		return "", err
+	}
+	return db.Edit(doc)
+}
+
+func (s *SyncGatewayDocumentStore) Delete(id, rev string) error {
+	db, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return db.Delete(id, rev)
+}
+
+func (s *SyncGatewayDocumentStore) Query(view string, options map[string]interface{}, results interface{}) error {
+	db, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return db.Query(view, options, results)
+}
+
+// Keeps trying to connect until it succeeds, since there is nobody to return
+// an error to
+func (s *SyncGatewayDocumentStore) Changes(handler couch.ChangeHandler, options map[string]interface{}) {
+	for {
+		db, err := s.connect()
+		if err == nil {
+			db.Changes(handler, options)
+			return
+		}
+		logg.LogError(err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// An error with an http status, like the ones Sync Gateway returns, so that
+// callers can check for eg 409 conflicts with httputil.IsHTTPStatus whatever
+// the document store.
+func documentStoreError(status int, format string, args ...interface{}) error {
+	response := &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
+	}
+	return httputil.HTTPErrorf(response, format, args...)
+}
@@ -0,0 +1,630 @@
+package elasticthought
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+	"github.com/tleyden/go-couch"
+)
+
+// How long a longpoll changes request waits for a change, unless the
+// timeout option is passed
+const EMBEDDED_DOCUMENT_STORE_LONGPOLL_TIMEOUT = 5 * time.Minute
+
+// A document store which keeps every doc in memory and persists them to an
+// append-only log file, so that elastic-thought can run as a single binary
+// without Couchbase Server and Sync Gateway.  It mimics the parts of Sync
+// Gateway that elastic-thought depends on: revisions with 409 conflicts on
+// stale updates, _all_docs and a changes feed with its own sequence.
+//
+// Each line of the log is a revision of a doc, and the log is compacted to
+// the latest revision of each doc when it's opened.  Only one process may
+// have the log open at a time, which is enforced with a lock file next to it.
+type EmbeddedDocumentStore struct {
+
+	// The path of the log file, or empty if the docs are only kept in memory
+	Path string
+
+	// The key in embeddedDocumentStores, if it's shared
+	sharedKey string
+
+	mutex   sync.Mutex
+	docs    map[string]*embeddedDoc
+	lastSeq int
+	log     *os.File
+	lock    *os.File
+	changed chan struct{}
+	closed  chan struct{}
+}
+
+// A revision of a doc, which is also a line of the log file
+type embeddedDoc struct {
+	Seq     int             `json:"seq"`
+	Id      string          `json:"id"`
+	Rev     string          `json:"rev"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Body    json.RawMessage `json:"doc,omitempty"`
+}
+
+// The embedded stores that have been opened by NewDocumentStore, so that all
+// of the DbConnection() calls in this process share the same one
+var embeddedDocumentStores = struct {
+	sync.Mutex
+	stores map[string]*EmbeddedDocumentStore
+}{stores: map[string]*EmbeddedDocumentStore{}}
+
+func sharedEmbeddedDocumentStore(key, path string) (*EmbeddedDocumentStore, error) {
+
+	embeddedDocumentStores.Lock()
+	defer embeddedDocumentStores.Unlock()
+
+	if store, ok := embeddedDocumentStores.stores[key]; ok {
+		return store, nil
+	}
+	store, err := OpenEmbeddedDocumentStore(path)
+	if err != nil {
+		return nil, err
+	}
+	store.sharedKey = key
+	embeddedDocumentStores.stores[key] = store
+	return store, nil
+
+}
+
+// Open the embedded store persisted at path, creating it if it doesn't exist.
+// If path is empty, the docs are only kept in memory.
+func OpenEmbeddedDocumentStore(path string) (*EmbeddedDocumentStore, error) {
+
+	s := &EmbeddedDocumentStore{
+		Path:    path,
+		docs:    map[string]*embeddedDoc{},
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	if len(path) == 0 {
+		return s, nil
+	}
+
+	lock, err := lockEmbeddedDocumentStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.replay(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	log, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("Error opening document store: %v.  Err: %v", path, err)
+	}
+	s.log = log
+	s.lock = lock
+
+	logg.LogTo("DOCUMENT_STORE", "Opened %v with %v docs, last seq: %v", path, len(s.docs), s.lastSeq)
+	return s, nil
+
+}
+
+// Take an exclusive lock on <path>.lock, which is held until the store is
+// closed.  Without it, two processes appending to the same log would each
+// lose the other's writes the next time the log is compacted.  The lock is on
+// a separate file because compacting replaces the log file.
+func lockEmbeddedDocumentStore(path string) (*os.File, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Error creating directory for document store: %v.  Err: %v", path, err)
+	}
+
+	lockPath := fmt.Sprintf("%v.lock", path)
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening document store lock: %v.  Err: %v", lockPath, err)
+	}
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("Document store %v is already open in another process.  "+
+				"Only one process may use an embedded document store", path)
+		}
+		return nil, fmt.Errorf("Error locking document store: %v.  Err: %v", lockPath, err)
+	}
+
+	return lock, nil
+
+}
+
+func (s *EmbeddedDocumentStore) String() string {
+	if len(s.Path) == 0 {
+		return "embedded document store (in memory)"
+	}
+	return fmt.Sprintf("embedded document store at %v", s.Path)
+}
+
+// Load the latest revision of each doc from the log
+func (s *EmbeddedDocumentStore) replay() error {
+
+	file, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error opening document store: %v.  Err: %v", s.Path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a partial last line means we crashed while appending it,
+			// and that revision was never acknowledged, so drop it
+			if len(bytes.TrimSpace(line)) > 0 {
+				logg.LogTo("DOCUMENT_STORE", "Ignoring partial revision at end of %v", s.Path)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading document store: %v.  Err: %v", s.Path, err)
+		}
+
+		doc := &embeddedDoc{}
+		if err := json.Unmarshal(line, doc); err != nil {
+			return fmt.Errorf("Error decoding document store: %v.  Err: %v", s.Path, err)
+		}
+		s.docs[doc.Id] = doc
+		if doc.Seq > s.lastSeq {
+			s.lastSeq = doc.Seq
+		}
+	}
+
+}
+
+// Rewrite the log with only the latest revision of each doc.  The new log is
+// written to a temp file and renamed over the old one, so a crash part way
+// through leaves the old log intact.
+func (s *EmbeddedDocumentStore) compact() error {
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return fmt.Errorf("Error creating directory for document store: %v.  Err: %v", s.Path, err)
+	}
+
+	tempPath := fmt.Sprintf("%v.compact", s.Path)
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("Error compacting document store: %v.  Err: %v", s.Path, err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, doc := range s.docsBySeq(0) {
+		if err := writeEmbeddedDoc(writer, doc); err != nil {
+			return fmt.Errorf("Error compacting document store: %v.  Err: %v", s.Path, err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("Error compacting document store: %v.  Err: %v", s.Path, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("Error compacting document store: %v.  Err: %v", s.Path, err)
+	}
+
+	return os.Rename(tempPath, s.Path)
+
+}
+
+// Close the log file, and stop any changes feeds.  The store can't be used
+// after it's closed, and NewDocumentStore opens it again rather than
+// returning the closed one.  Closing it again does nothing.
+func (s *EmbeddedDocumentStore) Close() error {
+
+	embeddedDocumentStores.Lock()
+	if embeddedDocumentStores.stores[s.sharedKey] == s {
+		delete(embeddedDocumentStores.stores, s.sharedKey)
+	}
+	embeddedDocumentStores.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+
+	close(s.closed)
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Close()
+
+	// closing the lock file releases the lock
+	if lockErr := s.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+
+}
+
+func (s *EmbeddedDocumentStore) Retrieve(id string, doc interface{}) error {
+
+	s.mutex.Lock()
+	current, ok := s.docs[id]
+	s.mutex.Unlock()
+
+	if !ok || current.Deleted {
+		return documentStoreError(404, "missing: %v", id)
+	}
+	return json.Unmarshal(current.Body, doc)
+
+}
+
+func (s *EmbeddedDocumentStore) Insert(doc interface{}) (string, string, error) {
+
+	body, err := docToMap(doc)
+	if err != nil {
+		return "", "", err
+	}
+	id, _ := body["_id"].(string)
+	rev, _ := body["_rev"].(string)
+
+	if len(id) == 0 {
+		id = NewUuid()
+	}
+	newRev, err := s.put(id, rev, body)
+	return id, newRev, err
+
+}
+
+func (s *EmbeddedDocumentStore) InsertWith(doc interface{}, id string) (string, string, error) {
+
+	body, err := docToMap(doc)
+	if err != nil {
+		return "", "", err
+	}
+	newRev, err := s.put(id, "", body)
+	return id, newRev, err
+
+}
+
+func (s *EmbeddedDocumentStore) Edit(doc interface{}) (string, error) {
+
+	body, err := docToMap(doc)
+	if err != nil {
+		return "", err
+	}
+	id, _ := body["_id"].(string)
+	rev, _ := body["_rev"].(string)
+	if len(id) == 0 || len(rev) == 0 {
+		return "", fmt.Errorf("Id and/or Rev is empty")
+	}
+	return s.put(id, rev, body)
+
+}
+
+func (s *EmbeddedDocumentStore) Delete(id, rev string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, ok := s.docs[id]
+	if !ok || current.Deleted {
+		return documentStoreError(404, "missing: %v", id)
+	}
+	if rev != current.Rev {
+		return documentStoreError(409, "Document update conflict: %v", id)
+	}
+
+	tombstone := &embeddedDoc{
+		Id:      id,
+		Rev:     fmt.Sprintf("%v-%x", revGeneration(current.Rev)+1, md5.Sum([]byte(id+rev))),
+		Deleted: true,
+	}
+	return s.append(tombstone)
+
+}
+
+// Store a new revision of a doc.  rev must be the current revision, or empty
+// if the doc doesn't exist yet (or has been deleted).
+func (s *EmbeddedDocumentStore) put(id, rev string, body map[string]interface{}) (string, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	generation := 0
+	current, ok := s.docs[id]
+	switch {
+	case !ok && len(rev) > 0:
+		return "", documentStoreError(409, "Document update conflict: %v", id)
+	case ok && !current.Deleted && rev != current.Rev:
+		return "", documentStoreError(409, "Document update conflict: %v", id)
+	case ok && current.Deleted && len(rev) > 0 && rev != current.Rev:
+		return "", documentStoreError(409, "Document update conflict: %v", id)
+	case ok:
+		generation = revGeneration(current.Rev)
+	}
+
+	delete(body, "_rev")
+	body["_id"] = id
+	digestBody, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	newRev := fmt.Sprintf("%v-%x", generation+1, md5.Sum(digestBody))
+
+	body["_rev"] = newRev
+	rawBody, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	doc := &embeddedDoc{Id: id, Rev: newRev, Body: rawBody}
+	if err := s.append(doc); err != nil {
+		return "", err
+	}
+	return newRev, nil
+
+}
+
+// Give the revision the next sequence, write it to the log and make it the
+// current revision.  Must be called with the mutex held.
+func (s *EmbeddedDocumentStore) append(doc *embeddedDoc) error {
+
+	doc.Seq = s.lastSeq + 1
+
+	if s.log != nil {
+		fileInfo, err := s.log.Stat()
+		if err != nil {
+			return documentStoreError(500, "Error writing to document store: %v.  Err: %v", s.Path, err)
+		}
+		if err := writeEmbeddedDoc(s.log, doc); err != nil {
+			s.truncateLog(fileInfo.Size())
+			return documentStoreError(500, "Error writing to document store: %v.  Err: %v", s.Path, err)
+		}
+		if err := s.log.Sync(); err != nil {
+			s.truncateLog(fileInfo.Size())
+			return documentStoreError(500, "Error syncing document store: %v.  Err: %v", s.Path, err)
+		}
+	}
+
+	s.lastSeq = doc.Seq
+	s.docs[doc.Id] = doc
+
+	// wake up any longpoll changes feeds
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	return nil
+
+}
+
+// Drop a revision which failed to be written (or synced) from the end of the
+// log.  Otherwise a partial line would be left for the next revision to be
+// appended to, and the log couldn't be replayed.
+func (s *EmbeddedDocumentStore) truncateLog(size int64) {
+	if err := s.log.Truncate(size); err != nil {
+		logg.LogError(fmt.Errorf("Error truncating document store: %v back to %v bytes.  Err: %v", s.Path, size, err))
+	}
+}
+
+// Only _all_docs is supported, with or without include_docs
+func (s *EmbeddedDocumentStore) Query(view string, options map[string]interface{}, results interface{}) error {
+
+	if view != "_all_docs" {
+		return documentStoreError(404, "The embedded document store doesn't support view: %v", view)
+	}
+	includeDocs := fmt.Sprintf("%v", options["include_docs"]) == "true"
+
+	s.mutex.Lock()
+	ids := []string{}
+	for id, doc := range s.docs {
+		if !doc.Deleted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	rows := []map[string]interface{}{}
+	for _, id := range ids {
+		doc := s.docs[id]
+		row := map[string]interface{}{
+			"id":    id,
+			"key":   id,
+			"value": map[string]interface{}{"rev": doc.Rev},
+		}
+		if includeDocs {
+			row["doc"] = doc.Body
+		}
+		rows = append(rows, row)
+	}
+	s.mutex.Unlock()
+
+	raw, err := json.Marshal(map[string]interface{}{
+		"total_rows": len(rows),
+		"rows":       rows,
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, results)
+
+}
+
+// Supports the since, feed=longpoll and timeout (in milliseconds) options.
+// Returns when the handler returns nil or the store is closed.
+func (s *EmbeddedDocumentStore) Changes(handler couch.ChangeHandler, options map[string]interface{}) {
+
+	for {
+
+		since, err := changesSince(options["since"])
+		if err != nil {
+			logg.LogError(err)
+			return
+		}
+
+		timeout := EMBEDDED_DOCUMENT_STORE_LONGPOLL_TIMEOUT
+		if millis, err := strconv.Atoi(fmt.Sprintf("%v", options["timeout"])); err == nil {
+			timeout = time.Duration(millis) * time.Millisecond
+		}
+
+		body, ok := s.waitForChanges(since, options["feed"] == "longpoll", timeout)
+		if !ok {
+			return
+		}
+
+		next := handler(bytes.NewReader(body))
+		if next == nil {
+			return
+		}
+		options["since"] = next
+
+	}
+
+}
+
+// Get the changes after since, as a _changes response body.  If longpoll is
+// set and there aren't any yet, wait for one until the timeout.  Returns
+// false if the store is closed while waiting.
+func (s *EmbeddedDocumentStore) waitForChanges(since int, longpoll bool, timeout time.Duration) ([]byte, bool) {
+
+	deadline := time.After(timeout)
+
+	for {
+
+		s.mutex.Lock()
+		docs := s.docsBySeq(since)
+		lastSeq := s.lastSeq
+		changed := s.changed
+		s.mutex.Unlock()
+
+		if len(docs) > 0 || !longpoll {
+			return embeddedChangesBody(docs, lastSeq), true
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return embeddedChangesBody(docs, lastSeq), true
+		case <-s.closed:
+			return nil, false
+		}
+
+	}
+
+}
+
+// The current revisions with a sequence after since, in sequence order.  Must
+// be called with the mutex held (or before the store is shared).
+func (s *EmbeddedDocumentStore) docsBySeq(since int) []*embeddedDoc {
+	docs := []*embeddedDoc{}
+	for _, doc := range s.docs {
+		if doc.Seq > since {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Sort(embeddedDocsBySeq(docs))
+	return docs
+}
+
+func embeddedChangesBody(docs []*embeddedDoc, lastSeq int) []byte {
+
+	results := []map[string]interface{}{}
+	for _, doc := range docs {
+		result := map[string]interface{}{
+			"seq":     doc.Seq,
+			"id":      doc.Id,
+			"changes": []map[string]interface{}{{"rev": doc.Rev}},
+		}
+		if doc.Deleted {
+			result["deleted"] = true
+		}
+		results = append(results, result)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"results":  results,
+		"last_seq": lastSeq,
+	})
+	return body
+
+}
+
+// The since option can be whatever a changes handler returned, which is
+// usually a float64 decoded from the last_seq of the previous response
+func changesSince(since interface{}) (int, error) {
+
+	switch since := since.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return since, nil
+	case float64:
+		return int(since), nil
+	}
+
+	sinceString := strings.Trim(fmt.Sprintf("%v", since), `"`)
+	if len(sinceString) == 0 {
+		return 0, nil
+	}
+	sinceFloat, err := strconv.ParseFloat(sinceString, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid since for changes feed: %v.  Err: %v", since, err)
+	}
+	return int(sinceFloat), nil
+
+}
+
+func writeEmbeddedDoc(writer io.Writer, doc *embeddedDoc) error {
+	line, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(line, '\n'))
+	return err
+}
+
+// Convert a doc (usually a struct embedding ElasticThoughtDoc) to a map
+func docToMap(doc interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, fmt.Errorf("Error converting doc to json object: %v", err)
+	}
+	return body, nil
+}
+
+// Eg, 3 for "3-abc"
+func revGeneration(rev string) int {
+	generation, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return generation
+}
+
+type embeddedDocsBySeq []*embeddedDoc
+
+func (d embeddedDocsBySeq) Len() int           { return len(d) }
+func (d embeddedDocsBySeq) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d embeddedDocsBySeq) Less(i, j int) bool { return d[i].Seq < d[j].Seq }
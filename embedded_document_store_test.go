@@ -0,0 +1,237 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+	"github.com/dustin/httputil"
+	"github.com/tleyden/go-couch"
+)
+
+func TestEmbeddedDocumentStoreCas(t *testing.T) {
+
+	store, err := OpenEmbeddedDocumentStore("")
+	assert.True(t, err == nil)
+	defer store.Close()
+
+	datafile := NewDatafile(*NewDefaultConfiguration())
+	datafile.UserID = "user"
+	id, rev, err := store.Insert(datafile)
+	assert.True(t, err == nil)
+	assert.True(t, len(id) > 0)
+	assert.Equals(t, revGeneration(rev), 1)
+
+	loaded := &Datafile{}
+	assert.True(t, store.Retrieve(id, loaded) == nil)
+	assert.Equals(t, loaded.Id, id)
+	assert.Equals(t, loaded.Revision, rev)
+	assert.Equals(t, loaded.UserID, "user")
+
+	// an edit based on the current rev succeeds ..
+	loaded.ProcessingState = Processing
+	newRev, err := store.Edit(loaded)
+	assert.True(t, err == nil)
+	assert.Equals(t, revGeneration(newRev), 2)
+
+	// .. but one based on a stale rev is a conflict, like Sync Gateway
+	_, err = store.Edit(loaded)
+	assert.True(t, httputil.IsHTTPStatus(err, 409))
+	_, _, err = store.InsertWith(loaded, id)
+	assert.True(t, httputil.IsHTTPStatus(err, 409))
+
+	// and casUpdate copes with that by refreshing
+	ok, err := casUpdate(store, loaded, func(doc interface{}) {
+		doc.(*Datafile).ProcessingState = FinishedSuccessfully
+	}, func(doc interface{}) bool {
+		return doc.(*Datafile).ProcessingState == FinishedSuccessfully
+	}, func(doc interface{}) error {
+		return store.Retrieve(id, doc)
+	})
+	assert.True(t, err == nil)
+	assert.True(t, ok)
+
+	assert.True(t, httputil.IsHTTPStatus(store.Delete(id, rev), 409))
+	assert.True(t, store.Retrieve(id, loaded) == nil)
+	assert.True(t, store.Delete(id, loaded.Revision) == nil)
+	assert.True(t, httputil.IsHTTPStatus(store.Retrieve(id, loaded), 404))
+
+	rows, err := allDocs(store)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(rows), 0)
+
+}
+
+func TestEmbeddedDocumentStorePersistence(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "embedded_document_store_test")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "et.db")
+
+	store, err := OpenEmbeddedDocumentStore(path)
+	assert.True(t, err == nil)
+
+	_, _, err = store.InsertWith(map[string]interface{}{"type": "user"}, "user:foo")
+	assert.True(t, err == nil)
+	_, rev, err := store.InsertWith(map[string]interface{}{"type": "datafile"}, "datafile")
+	assert.True(t, err == nil)
+	_, err = store.Edit(map[string]interface{}{"_id": "datafile", "_rev": rev, "type": "datafile", "url": "file:///tmp"})
+	assert.True(t, err == nil)
+	_, rev, err = store.InsertWith(map[string]interface{}{"type": "solver"}, "solver")
+	assert.True(t, err == nil)
+	assert.True(t, store.Delete("solver", rev) == nil)
+	assert.True(t, store.Close() == nil)
+
+	// a crash part way through appending a revision leaves a partial line
+	log, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.True(t, err == nil)
+	_, err = log.WriteString(`{"seq":6,"id":"datafile","rev":"4-`)
+	assert.True(t, err == nil)
+	log.Close()
+
+	reopened, err := OpenEmbeddedDocumentStore(path)
+	assert.True(t, err == nil)
+	defer reopened.Close()
+
+	// while it's open, nothing else can open it
+	_, err = OpenEmbeddedDocumentStore(path)
+	assert.True(t, err != nil)
+	assert.True(t, strings.Contains(err.Error(), "already open"))
+
+	datafile := map[string]interface{}{}
+	assert.True(t, reopened.Retrieve("datafile", &datafile) == nil)
+	assert.Equals(t, datafile["url"], "file:///tmp")
+	assert.Equals(t, revGeneration(datafile["_rev"].(string)), 2)
+	assert.True(t, httputil.IsHTTPStatus(reopened.Retrieve("solver", &datafile), 404))
+
+	// the sequence carries on where it left off
+	options := map[string]interface{}{}
+	changes := embeddedChanges(t, reopened, options)
+	assert.Equals(t, len(changes.Results), 3)
+	assert.Equals(t, changes.Results[0].Id, "user:foo")
+	assert.Equals(t, changes.Results[1].Id, "datafile")
+	assert.Equals(t, changes.Results[2].Id, "solver")
+	assert.True(t, changes.Results[2].Deleted)
+	assert.Equals(t, changes.LastSequence, float64(5))
+
+	_, _, err = reopened.InsertWith(map[string]interface{}{"type": "dataset"}, "dataset")
+	assert.True(t, err == nil)
+	changes = embeddedChanges(t, reopened, map[string]interface{}{"since": changes.LastSequence})
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].Seq, float64(6))
+
+}
+
+func TestEmbeddedDocumentStoreFailedAppend(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "embedded_document_store_test")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "et.db")
+
+	store, err := OpenEmbeddedDocumentStore(path)
+	assert.True(t, err == nil)
+	_, _, err = store.InsertWith(map[string]interface{}{"type": "user"}, "user:foo")
+	assert.True(t, err == nil)
+
+	// a write which fails part way through is dropped from the log, so the
+	// next revision doesn't end up on the same line
+	fileInfo, err := store.log.Stat()
+	assert.True(t, err == nil)
+	_, err = store.log.WriteString(`{"seq":2,"id":"datafile","rev":"1-`)
+	assert.True(t, err == nil)
+	store.truncateLog(fileInfo.Size())
+
+	_, _, err = store.InsertWith(map[string]interface{}{"type": "datafile"}, "datafile")
+	assert.True(t, err == nil)
+	assert.True(t, store.Close() == nil)
+
+	reopened, err := OpenEmbeddedDocumentStore(path)
+	assert.True(t, err == nil)
+	defer reopened.Close()
+	datafile := map[string]interface{}{}
+	assert.True(t, reopened.Retrieve("datafile", &datafile) == nil)
+
+}
+
+func TestEmbeddedDocumentStoreLongpoll(t *testing.T) {
+
+	store, err := OpenEmbeddedDocumentStore("")
+	assert.True(t, err == nil)
+	defer store.Close()
+
+	options := map[string]interface{}{"feed": "longpoll", "since": "0"}
+	received := make(chan couch.Changes)
+	go store.Changes(func(reader io.Reader) interface{} {
+		changes, err := decodeChanges(reader)
+		if err != nil {
+			return nil
+		}
+		received <- changes
+		return changes.LastSequence
+	}, options)
+
+	_, _, err = store.InsertWith(map[string]interface{}{"type": "training-job"}, "job")
+	assert.True(t, err == nil)
+	changes := <-received
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].Id, "job")
+
+	// the next request waits for the next change rather than returning empty
+	_, _, err = store.InsertWith(map[string]interface{}{"type": "classify-job"}, "job2")
+	assert.True(t, err == nil)
+	changes = <-received
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].Id, "job2")
+
+}
+
+func TestNewDocumentStore(t *testing.T) {
+
+	store, err := NewDocumentStore("http://localhost:4985/elastic-thought")
+	assert.True(t, err == nil)
+	assert.Equals(t, store.(*SyncGatewayDocumentStore).Url, "http://localhost:4985/elastic-thought")
+
+	_, err = NewDocumentStore("http://localhost:4985/elastic-thought/")
+	assert.True(t, err != nil)
+	_, err = NewDocumentStore("couchbase://localhost")
+	assert.True(t, err != nil)
+
+	// embedded stores are shared, so that every DbConnection() sees the
+	// same docs and changes feed
+	first, err := NewDocumentStore("mem://new_document_store_test")
+	assert.True(t, err == nil)
+	second, err := NewDocumentStore("mem://new_document_store_test")
+	assert.True(t, err == nil)
+	assert.True(t, first == second)
+
+	// once closed, it's opened afresh rather than shared
+	assert.True(t, first.(*EmbeddedDocumentStore).Close() == nil)
+	assert.True(t, first.(*EmbeddedDocumentStore).Close() == nil)
+	reopened, err := NewDocumentStore("mem://new_document_store_test")
+	assert.True(t, err == nil)
+	assert.True(t, reopened != first)
+	_, _, err = reopened.InsertWith(map[string]interface{}{"type": "user"}, "user:foo")
+	assert.True(t, err == nil)
+
+	assert.True(t, IsEmbeddedDocumentStore("file:///var/lib/elastic-thought.db"))
+	assert.True(t, IsEmbeddedDocumentStore("mem://new_document_store_test"))
+	assert.False(t, IsEmbeddedDocumentStore("http://localhost:4985/elastic-thought"))
+
+}
+
+// Get a single batch of changes
+func embeddedChanges(t *testing.T, store DocumentStore, options map[string]interface{}) couch.Changes {
+	changes := couch.Changes{}
+	store.Changes(func(reader io.Reader) interface{} {
+		assert.True(t, json.NewDecoder(reader).Decode(&changes) == nil)
+		return nil
+	}, options)
+	return changes
+}
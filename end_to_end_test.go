@@ -0,0 +1,415 @@
+package elasticthought
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// How long to wait for a job to finish before giving up on it
+const endToEndJobTimeout = 30 * time.Second
+
+// Runs the whole datafile -> dataset -> solver -> training job -> classifier
+// -> classify job flow in process, with the real ChangesListener, priority
+// queue and in process job scheduler, but without a Sync Gateway, cbfs, caffe
+// or a GPU:
+//
+// - docs are stored in a fakeSyncGateway
+// - blobs are stored in a FileSystemBlobStore in a temp dir
+// - datafiles, prototxt specs and images are served by a fixture server
+// - caffe and classifier.py are faked by a FakeExecutor
+type endToEndHarness struct {
+	t             *testing.T
+	Configuration Configuration
+	SyncGateway   *fakeSyncGateway
+	Fixtures      *httptest.Server
+	Executor      *FakeExecutor
+	BlobStore     BlobStore
+
+	// The label index that the fake classifier.py predicts for every image
+	ClassifierPrediction int
+
+	tempDir   string
+	oldGopath string
+	stopped   int32
+}
+
+// The repo root, which fixtures are served from.  Saved before any tests run,
+// since some of them change the working directory.
+var endToEndFixtureRoot, _ = os.Getwd()
+
+func newEndToEndHarness(t *testing.T) *endToEndHarness {
+
+	tempDir, err := ioutil.TempDir("", "end_to_end_test")
+	assert.True(t, err == nil)
+
+	h := &endToEndHarness{
+		t:                    t,
+		SyncGateway:          newFakeSyncGateway(),
+		ClassifierPrediction: 1,
+		tempDir:              tempDir,
+		oldGopath:            os.Getenv("GOPATH"),
+	}
+	h.Fixtures = httptest.NewServer(http.HandlerFunc(h.serveFixture))
+	h.Executor = NewFakeExecutor(h.fakeCommand)
+
+	blobDir := filepath.Join(tempDir, "blobs")
+	assert.True(t, Mkdir(blobDir) == nil)
+
+	configuration := NewDefaultConfiguration()
+	configuration.DbUrl = h.SyncGateway.DbUrl()
+	configuration.CbfsUrl = fmt.Sprintf("file://%v", blobDir)
+	configuration.WorkDirectory = filepath.Join(tempDir, "work")
+	configuration.Executor = h.Executor
+	h.Configuration = *configuration
+
+	h.BlobStore, err = configuration.NewBlobStoreClient()
+	assert.True(t, err == nil)
+
+	// classify jobs copy classifier.py out of $GOPATH before running it
+	classifierDir := filepath.Join(tempDir, "gopath", "src", "github.com", "tleyden", "elastic-thought", "scripts", "python-classifier")
+	assert.True(t, Mkdir(classifierDir) == nil)
+	fakeClassifier := []byte("# faked out by endToEndHarness.fakeClassifier\n")
+	assert.True(t, ioutil.WriteFile(filepath.Join(classifierDir, "classifier.py"), fakeClassifier, 0644) == nil)
+	os.Setenv("GOPATH", filepath.Join(tempDir, "gopath"))
+
+	return h
+
+}
+
+// Follow the changes feed and run jobs until Close is called
+func (h *endToEndHarness) Start() {
+
+	jobScheduler := NewPriorityJobScheduler(h.Configuration, NewInProcessJobScheduler(h.Configuration))
+
+	changesListener, err := NewChangesListener(h.Configuration, jobScheduler)
+	assert.True(h.t, err == nil)
+	changesListener.IsLeader = func() bool {
+		return atomic.LoadInt32(&h.stopped) == 0
+	}
+
+	go changesListener.FollowChangesFeed()
+
+}
+
+func (h *endToEndHarness) Close() {
+	atomic.StoreInt32(&h.stopped, 1)
+	h.SyncGateway.Close()
+	h.Fixtures.Close()
+	os.Setenv("GOPATH", h.oldGopath)
+	os.RemoveAll(h.tempDir)
+}
+
+// The url of a fixture file, eg data-test/alphabet.tar.gz
+func (h *endToEndHarness) FixtureUrl(relativePath string) string {
+	return fmt.Sprintf("%v/%v", h.Fixtures.URL, relativePath)
+}
+
+// Serves files from the repo, as well as generated images under images/
+func (h *endToEndHarness) serveFixture(w http.ResponseWriter, r *http.Request) {
+
+	if strings.HasPrefix(r.URL.Path, "/images/") {
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, image.NewGray(image.Rect(0, 0, 28, 28)))
+		return
+	}
+
+	http.ServeFile(w, r, filepath.Join(endToEndFixtureRoot, r.URL.Path))
+
+}
+
+// Wait for the job doc to be finished, and decode it into jobDoc.  Fails the
+// test if the job fails or doesn't finish in time.
+func (h *endToEndHarness) WaitForJob(docId string, jobDoc interface{}) {
+
+	deadline := time.Now().Add(endToEndJobTimeout)
+	for time.Now().Before(deadline) {
+
+		doc := h.SyncGateway.Doc(docId)
+		switch doc["processing-state"] {
+		case PROCESSING_STATE_FINISHED_SUCCESSFULLY:
+			raw, err := json.Marshal(doc)
+			assert.True(h.t, err == nil)
+			assert.True(h.t, json.Unmarshal(raw, jobDoc) == nil)
+			return
+		case PROCESSING_STATE_FAILED:
+			h.t.Fatalf("Job %v failed: %v", docId, doc["processing-log"])
+		}
+
+		time.Sleep(50 * time.Millisecond)
+
+	}
+
+	h.t.Fatalf("Timed out waiting for job %v: %+v", docId, h.SyncGateway.Doc(docId))
+
+}
+
+// Read a blob from the blob store, or fail the test
+func (h *endToEndHarness) Blob(blobPath string) []byte {
+	content, err := getContentFromBlobStore(h.BlobStore, strings.TrimPrefix(blobPath, CBFS_URI_PREFIX))
+	if err != nil {
+		h.t.Fatalf("Error getting blob %v: %v", blobPath, err)
+	}
+	return content
+}
+
+// Stands in for every command the jobs run
+func (h *endToEndHarness) fakeCommand(spec ExecSpec, stdout, stderr io.Writer) error {
+	switch {
+	case spec.Command == "caffe" && len(spec.Args) > 0 && spec.Args[0] == "train":
+		return fakeCaffeTrain(spec, stdout, stderr)
+	case spec.Command == "python" && len(spec.Args) > 0 && spec.Args[0] == "classifier.py":
+		return h.fakeClassifier(spec, stdout, stderr)
+	}
+	return fmt.Errorf("Unexpected command: %v %v", spec.Command, spec.Args)
+}
+
+// Pretend to be caffe train --solver=solver.prototxt: check that the solver
+// and its inputs are in the work dir, log like caffe does (to stderr, in
+// glog format), and write snapshots of the model like caffe would.
+func fakeCaffeTrain(spec ExecSpec, stdout, stderr io.Writer) error {
+
+	solverFilename := ""
+	for _, arg := range spec.Args {
+		if strings.HasPrefix(arg, "--solver=") {
+			solverFilename = strings.TrimPrefix(arg, "--solver=")
+		}
+	}
+	solverPrototxt, err := ioutil.ReadFile(filepath.Join(spec.Dir, solverFilename))
+	if err != nil {
+		return fmt.Errorf("Error reading solver: %v.  Err: %v", solverFilename, err)
+	}
+
+	for _, filename := range []string{"solver-net.prototxt", TRAINING_INDEX, TESTING_INDEX} {
+		if _, err := os.Stat(filepath.Join(spec.Dir, filename)); err != nil {
+			return fmt.Errorf("Missing input file: %v.  Err: %v", filename, err)
+		}
+	}
+
+	maxIter, err := prototxtInt(solverPrototxt, "max_iter")
+	if err != nil {
+		return err
+	}
+	snapshot, err := prototxtInt(solverPrototxt, "snapshot")
+	if err != nil {
+		snapshot = maxIter
+	}
+	display, err := prototxtInt(solverPrototxt, "display")
+	if err != nil || display == 0 {
+		display = maxIter
+	}
+	snapshotPrefix := "snapshot"
+	if match := regexp.MustCompile(`snapshot_prefix:\s*"([^"]*)"`).FindSubmatch(solverPrototxt); match != nil {
+		snapshotPrefix = string(match[1])
+	}
+
+	logLine := func(source, format string, args ...interface{}) {
+		fmt.Fprintf(stderr, "I0301 12:00:00.000000  4242 %v] %v\n", source, fmt.Sprintf(format, args...))
+	}
+
+	logLine("caffe.cpp:99", "Use CPU.")
+	logLine("solver.cpp:32", "Initializing solver from parameters:")
+	logLine("solver.cpp:160", "Solving alpha")
+
+	for iter := 0; iter <= maxIter; iter++ {
+
+		if iter%display == 0 {
+			loss := 3.6 / float64(iter+1)
+			logLine("solver.cpp:189", "Iteration %v, loss = %.5f", iter, loss)
+			logLine("solver.cpp:204", "    Train net output #0: loss = %.5f (* 1 = %.5f loss)", loss, loss)
+		}
+
+		if iter > 0 && (iter%snapshot == 0 || iter == maxIter) {
+			modelFilename := fmt.Sprintf("%v_iter_%v.caffemodel", snapshotPrefix, iter)
+			stateFilename := fmt.Sprintf("%v_iter_%v.solverstate", snapshotPrefix, iter)
+			logLine("solver.cpp:334", "Snapshotting to %v", modelFilename)
+			if err := ioutil.WriteFile(filepath.Join(spec.Dir, modelFilename), []byte("fake model"), 0644); err != nil {
+				return err
+			}
+			logLine("solver.cpp:342", "Snapshotting solver state to %v", stateFilename)
+			if err := ioutil.WriteFile(filepath.Join(spec.Dir, stateFilename), []byte("fake state"), 0644); err != nil {
+				return err
+			}
+		}
+
+	}
+
+	logLine("solver.cpp:252", "Optimization Done.")
+	logLine("caffe.cpp:121", "Optimization Done.")
+
+	return nil
+
+}
+
+// Pretend to be classifier.py: check that the model and images are in the
+// work dir, and write a result.json with a prediction for every image.
+func (h *endToEndHarness) fakeClassifier(spec ExecSpec, stdout, stderr io.Writer) error {
+
+	for _, filename := range []string{"caffe.model", "classifier.prototxt", "classifier.py"} {
+		if _, err := os.Stat(filepath.Join(spec.Dir, filename)); err != nil {
+			return fmt.Errorf("Missing input file: %v.  Err: %v", filename, err)
+		}
+	}
+
+	images, err := ioutil.ReadDir(filepath.Join(spec.Dir, "images"))
+	if err != nil {
+		return err
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("no images")
+	}
+
+	result := map[string]string{}
+	for _, imageFile := range images {
+		result[imageFile.Name()] = strconv.Itoa(h.ClassifierPrediction)
+	}
+
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(spec.Dir, "result.json"), resultJson, 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "%v\n", string(resultJson))
+	fmt.Fprintf(stdout, "Output saved to result.json\n")
+
+	return nil
+
+}
+
+// Find an integer field in a prototxt file, eg max_iter: 200
+func prototxtInt(prototxt []byte, field string) (int, error) {
+	pattern := regexp.MustCompile(fmt.Sprintf(`(?m)^\s*%v:\s*(\d+)`, field))
+	match := pattern.FindSubmatch(prototxt)
+	if match == nil {
+		return 0, fmt.Errorf("No %v in prototxt: %v", field, string(prototxt))
+	}
+	return strconv.Atoi(string(match[1]))
+}
+
+func TestEndToEndTrainAndClassify(t *testing.T) {
+
+	h := newEndToEndHarness(t)
+	defer h.Close()
+	h.Start()
+
+	db := h.Configuration.DbConnection()
+	userID := "user:e2e"
+
+	// datafile
+	datafile := NewDatafile(h.Configuration)
+	datafile.UserID = userID
+	datafile.Url = h.FixtureUrl("data-test/alphabet.tar.gz")
+	datafile, err := datafile.Save(db)
+	assert.True(t, err == nil)
+
+	h.WaitForJob(datafile.Id, datafile)
+	assert.Equals(t, datafile.Url, fmt.Sprintf("%v%v/alphabet.tar.gz", CBFS_URI_PREFIX, datafile.Id))
+	assert.True(t, len(h.Blob(path.Join(datafile.Id, "alphabet.tar.gz"))) > 0)
+
+	// dataset
+	dataset := NewDataset(h.Configuration)
+	dataset.UserID = userID
+	dataset.TrainingDataset = TrainingDataset{DatafileID: datafile.Id, SplitPercentage: 0.7}
+	dataset.TestDataset = TestDataset{DatafileID: datafile.Id, SplitPercentage: 0.3}
+	assert.True(t, dataset.Insert() == nil)
+
+	h.WaitForJob(dataset.Id, dataset)
+	assert.True(t, len(h.Blob(dataset.TrainingArtifactPath())) > 0)
+	assert.True(t, len(h.Blob(dataset.TestingArtifactPath())) > 0)
+
+	// solver, created like the solver endpoint does
+	solver := NewSolver(h.Configuration)
+	solver.UserID = userID
+	solver.DatasetId = dataset.Id
+	solver.SpecificationUrl = h.FixtureUrl("example/alphabet/alpha_solver.prototxt")
+	solver.SpecificationNetUrl = h.FixtureUrl("example/alphabet/alpha_net.prototxt")
+	solver, err = solver.Insert(db)
+	assert.True(t, err == nil)
+	solver, err = solver.DownloadSpecToBlobStore(db, h.BlobStore)
+	assert.True(t, err == nil)
+
+	// training job
+	trainingJob := NewTrainingJob(h.Configuration)
+	trainingJob.UserID = userID
+	trainingJob.SolverId = solver.Id
+	trainingJob, err = trainingJob.Insert(db)
+	assert.True(t, err == nil)
+
+	h.WaitForJob(trainingJob.Id, trainingJob)
+	assert.Equals(t, trainingJob.TrainedModelUrl, fmt.Sprintf("%v%v/trained.caffemodel", CBFS_URI_PREFIX, trainingJob.Id))
+	assert.Equals(t, string(h.Blob(trainingJob.TrainedModelUrl)), "fake model")
+	assert.True(t, strings.Contains(string(h.Blob(path.Join(trainingJob.Id, "stderr"))), "Optimization Done."))
+	assert.True(t, len(trainingJob.Labels) > h.ClassifierPrediction)
+	assert.False(t, trainingJob.Lease.Released.IsZero())
+
+	executed := h.Executor.Executed()
+	assert.Equals(t, len(executed), 1)
+	assert.DeepEquals(t, executed[0].Args, []string{"train", "--solver=solver.prototxt"})
+
+	// classifier, created like the classifier endpoint does
+	classifier := NewClassifier(h.Configuration)
+	classifier.UserID = userID
+	classifier.TrainingJobID = trainingJob.Id
+	classifier.SpecificationUrl = h.FixtureUrl("example/alphabet/classifier.prototxt")
+	classifier.Scale = "255"
+	classifier.ImageWidth = "28"
+	classifier.ImageHeight = "28"
+	assert.True(t, classifier.Validate() == nil)
+	assert.True(t, classifier.Insert() == nil)
+	classifierSpecPath := path.Join(classifier.Id, "classifier.prototxt")
+	assert.True(t, saveUrlToBlobStore(classifier.SpecificationUrl, classifierSpecPath, h.BlobStore) == nil)
+	assert.True(t, classifier.SetSpecificationUrl(CBFS_URI_PREFIX+classifierSpecPath) == nil)
+
+	// classify job, created like the classify endpoint does
+	classifyJob := NewClassifyJob(h.Configuration)
+	classifyJob.Id = NewUuid()
+	classifyJob.UserID = userID
+	classifyJob.ClassifierID = classifier.Id
+	classifyJob.CreatedAt = time.Now()
+	imageUrl := h.FixtureUrl("images/letter.png")
+	imageHash := fmt.Sprintf("%x", sha1.Sum([]byte(imageUrl)))
+	imagePath := path.Join(classifyJob.Id, imageHash)
+	assert.True(t, saveUrlToBlobStore(imageUrl, imagePath, h.BlobStore) == nil)
+	classifyJob.Results = map[string]string{CBFS_URI_PREFIX + imagePath: "pending"}
+	assert.True(t, classifyJob.Insert() == nil)
+
+	// decode into a fresh doc, since the pending results would otherwise
+	// be merged into the finished ones
+	classified := &ClassifyJob{}
+	h.WaitForJob(classifyJob.Id, classified)
+	assert.DeepEquals(t, classified.Results, map[string]string{
+		imageHash: trainingJob.Labels[h.ClassifierPrediction],
+	})
+
+	executed = h.Executor.Executed()
+	assert.Equals(t, len(executed), 2)
+	assert.Equals(t, executed[1].Command, "python")
+	assert.Equals(t, executed[1].Dir, filepath.Join(h.Configuration.WorkDirectory, classifyJob.Id))
+
+	// the model and images were really downloaded into the work dir
+	model, err := ioutil.ReadFile(filepath.Join(executed[1].Dir, "caffe.model"))
+	assert.True(t, err == nil)
+	assert.True(t, bytes.Equal(model, []byte("fake model")))
+
+}
@@ -2,42 +2,51 @@ package elasticthought
 
 import (
 	"crypto/sha1"
-	"encoding/json"
-	"errors"
 	"fmt"
+	"net/http"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/couchbaselabs/logg"
+	"github.com/dustin/httputil"
 	"github.com/gin-gonic/gin"
-	"github.com/tleyden/go-couch"
 )
 
 type EndpointContext struct {
 	Configuration Configuration
+
+	// The pool running jobs inside this process, if any (ie, when not using nsq)
+	WorkerPool *WorkerPool
+
+	// The queue deciding the order in which jobs are run
+	JobQueue *PriorityJobScheduler
+
+	// The durable queue served to remote workers by the /queue endpoints, if any
+	QueueBackend QueueBackend
+
+	// The usage that quotas are checked against.  If nil, usage is computed
+	// afresh for every check.
+	UsageCache *UsageCache
 }
 
 // Creates a new user
 func (e EndpointContext) CreateUserEndpoint(c *gin.Context) {
 
-	db := c.MustGet(MIDDLEWARE_KEY_DB).(couch.Database)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
 
 	// parse in a user object from the POST request
-	decoder := json.NewDecoder(c.Request.Body)
 	userToCreate := NewUser()
-	err := decoder.Decode(userToCreate)
-	if err != nil {
-		errMsg := fmt.Sprintf("Unable to parse user params: %v", err)
-		c.Fail(500, errors.New(errMsg))
+	if ok := bindJSON(c, userToCreate); !ok {
 		return
 	}
 
 	// make sure this user isn't already in the db
 	existingUser := NewUser()
-	err = db.Retrieve(userToCreate.DocId(), existingUser)
+	err := db.Retrieve(userToCreate.DocId(), existingUser)
 	if err == nil {
-		errMsg := fmt.Sprintf("User already exists: %+v", *existingUser)
-		c.Fail(500, errors.New(errMsg))
+		failRequest(c, conflictError(fmt.Errorf("User already exists: %v", existingUser.Username)))
 		return
 	}
 
@@ -47,8 +56,7 @@ func (e EndpointContext) CreateUserEndpoint(c *gin.Context) {
 	newUser := NewUserFromUser(*userToCreate)
 	_, _, err = db.InsertWith(newUser, newUser.DocId())
 	if err != nil {
-		errMsg := fmt.Sprintf("Error creating new user: %v", err)
-		c.Fail(500, errors.New(errMsg))
+		failRequest(c, fmt.Errorf("Error creating new user: %v", err))
 		return
 	}
 
@@ -56,34 +64,53 @@ func (e EndpointContext) CreateUserEndpoint(c *gin.Context) {
 
 }
 
-// Creates a datafile
+// Creates a datafile, either from a JSON request with the url to download
+// it from, or from a .tar.gz uploaded as the request body with the
+// application/x-gzip content type (and optionally a ?filename=).
 func (e EndpointContext) CreateDataFileEndpoint(c *gin.Context) {
 
 	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
-	db := c.MustGet(MIDDLEWARE_KEY_DB).(couch.Database)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
+
+	if !e.checkQuota(c, user, QUOTA_ACTION_STORE_BLOBS) {
+		return
+	}
+
+	if c.Request.Header.Get("Content-Type") == "application/x-gzip" {
+		if !limitRequestBody(c, MAX_DATAFILE_UPLOAD_BYTES) {
+			return
+		}
+		filename := c.Request.URL.Query().Get("filename")
+		datafile, err := UploadDatafile(e.Configuration, user.DocId(), filename, c.Request.Body)
+		if err != nil {
+			failRequest(c, err)
+			return
+		}
+		c.JSON(201, CreatedResponse{Id: datafile.Id})
+		return
+	}
 
 	datafile := NewDatafile(e.Configuration)
-	datafile.UserID = user.DocId()
 
 	// bind the Datafile to the JSON request, which will bind the
 	// url field or throw an error.
-	if ok := c.Bind(&datafile); !ok {
-		errMsg := fmt.Sprintf("Invalid datafile")
-		c.Fail(400, errors.New(errMsg))
+	if ok := bindJSON(c, &datafile); !ok {
 		return
 	}
 
+	// after binding, so that the request can't claim to be another user
+	datafile.UserID = user.DocId()
+
 	logg.LogTo("REST", "datafile: %+v", datafile)
 
 	// create a new Datafile object in db
 	datafile, err := datafile.Save(db)
 	if err != nil {
-		errMsg := fmt.Sprintf("Error creating new datafile: %v", err)
-		c.Fail(500, errors.New(errMsg))
+		failRequest(c, fmt.Errorf("Error creating new datafile: %v", err))
 		return
 	}
 
-	c.JSON(201, gin.H{"id": datafile.Id})
+	c.JSON(201, CreatedResponse{Id: datafile.Id})
 
 }
 
@@ -91,15 +118,24 @@ func (e EndpointContext) CreateDataFileEndpoint(c *gin.Context) {
 func (e EndpointContext) CreateDataSetsEndpoint(c *gin.Context) {
 
 	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
-	db := c.MustGet(MIDDLEWARE_KEY_DB).(couch.Database)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
 	logg.LogTo("REST", "user: %v db: %v", user, db)
 
+	if !e.checkQuota(c, user, QUOTA_ACTION_STORE_BLOBS) {
+		return
+	}
+
 	dataset := NewDataset(e.Configuration)
 
 	// bind the input struct to the JSON request
-	if ok := c.Bind(dataset); !ok {
-		errMsg := fmt.Sprintf("Invalid input")
-		c.Fail(400, errors.New(errMsg))
+	if ok := bindJSON(c, dataset); !ok {
+		return
+	}
+
+	dataset.UserID = user.DocId()
+
+	if !requireOwner(c, db, user, dataset.TrainingDataset.DatafileID) ||
+		!requireOwner(c, db, user, dataset.TestDataset.DatafileID) {
 		return
 	}
 
@@ -107,7 +143,7 @@ func (e EndpointContext) CreateDataSetsEndpoint(c *gin.Context) {
 
 	// save dataset in db
 	if err := dataset.Insert(); err != nil {
-		c.Fail(500, err)
+		failRequest(c, err)
 		return
 	}
 
@@ -115,8 +151,7 @@ func (e EndpointContext) CreateDataSetsEndpoint(c *gin.Context) {
 
 	// update with urls of training/testing artifacts (which don't exist yet)
 	if err := dataset.AddArtifactUrls(); err != nil {
-		errMsg := fmt.Sprintf("Error updating dataset: %+v.  Err: %v", dataset, err)
-		c.Fail(500, errors.New(errMsg))
+		failRequest(c, fmt.Errorf("Error updating dataset: %v.  Err: %v", dataset.Id, err))
 		return
 	}
 
@@ -128,15 +163,23 @@ func (e EndpointContext) CreateDataSetsEndpoint(c *gin.Context) {
 func (e EndpointContext) CreateSolverEndpoint(c *gin.Context) {
 
 	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
-	db := c.MustGet(MIDDLEWARE_KEY_DB).(couch.Database)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
 	logg.LogTo("REST", "user: %v db: %v", user, db)
 
+	if !e.checkQuota(c, user, QUOTA_ACTION_STORE_BLOBS) {
+		return
+	}
+
 	solver := NewSolver(e.Configuration)
 
 	// bind the input struct to the JSON request
-	if ok := c.Bind(solver); !ok {
-		errMsg := fmt.Sprintf("Invalid input")
-		c.Fail(400, errors.New(errMsg))
+	if ok := bindJSON(c, solver); !ok {
+		return
+	}
+
+	solver.UserID = user.DocId()
+
+	if len(solver.DatasetId) > 0 && !requireOwner(c, db, user, solver.DatasetId) {
 		return
 	}
 
@@ -145,15 +188,14 @@ func (e EndpointContext) CreateSolverEndpoint(c *gin.Context) {
 	// save solver in db
 	solver, err := solver.Insert(db)
 	if err != nil {
-		c.Fail(500, err)
+		failRequest(c, err)
 		return
 	}
 
 	// Create a cbfs client
-	cbfs, err := NewBlobStore(e.Configuration.CbfsUrl)
+	cbfs, err := e.Configuration.NewBlobStoreClient()
 	if err != nil {
-		errMsg := fmt.Errorf("Error creating cbfs client: %v", err)
-		c.Fail(500, errMsg)
+		failRequest(c, fmt.Errorf("Error creating cbfs client: %v", err))
 		return
 	}
 	logg.LogTo("REST", "cbfs: %+v", cbfs)
@@ -161,9 +203,10 @@ func (e EndpointContext) CreateSolverEndpoint(c *gin.Context) {
 	// download contents of specification-url into cbfs://<solver-id>/spec.prototxt
 	// and update solver object's specification-url with cbfs url.
 	// ditto for specification-net-url
+	// specs which can't be fetched or parsed are failed with a 422
 	solver, err = solver.DownloadSpecToBlobStore(db, cbfs)
 	if err != nil {
-		c.Fail(500, err)
+		failRequest(c, err)
 		return
 	}
 
@@ -177,15 +220,22 @@ func (e EndpointContext) CreateTrainingJob(c *gin.Context) {
 
 	// bind to json
 	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
-	db := c.MustGet(MIDDLEWARE_KEY_DB).(couch.Database)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
+
+	if !e.checkQuota(c, user, QUOTA_ACTION_TRAIN) {
+		return
+	}
 
 	trainingJob := NewTrainingJob(e.Configuration)
-	trainingJob.UserID = user.Id
 
 	// bind the input struct to the JSON request
-	if ok := c.Bind(trainingJob); !ok {
-		errMsg := fmt.Sprintf("Invalid input")
-		c.Fail(400, errors.New(errMsg))
+	if ok := bindJSON(c, trainingJob); !ok {
+		return
+	}
+
+	trainingJob.UserID = user.DocId()
+
+	if !requireOwner(c, db, user, trainingJob.SolverId) {
 		return
 	}
 
@@ -194,7 +244,7 @@ func (e EndpointContext) CreateTrainingJob(c *gin.Context) {
 	// save training job in db
 	trainingJob, err := trainingJob.Insert(db)
 	if err != nil {
-		c.Fail(500, err)
+		failRequest(c, err)
 		return
 	}
 
@@ -209,25 +259,34 @@ func (e EndpointContext) CreateTrainingJob(c *gin.Context) {
 func (e EndpointContext) CreateClassifierEndpoint(c *gin.Context) {
 
 	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
-	db := c.MustGet(MIDDLEWARE_KEY_DB).(couch.Database)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
 	logg.LogTo("REST", "user: %v db: %v", user, db)
 
 	classifier := NewClassifier(e.Configuration)
 
 	// bind the input struct to the JSON request
-	if ok := c.Bind(classifier); !ok {
-		errMsg := fmt.Sprintf("Invalid input")
-		c.Fail(400, errors.New(errMsg))
+	if ok := bindJSON(c, classifier); !ok {
+		return
+	}
+
+	classifier.UserID = user.DocId()
+
+	// the classifier gives access to the training job's trained model
+	if !requireOwner(c, db, user, classifier.TrainingJobID) {
 		return
 	}
 
 	logg.LogTo("REST", "classifier: %+v", classifier)
 
-	// make sure the classifier points to a valid training job
+	// make sure the classifier points to a valid training job, and that its
+	// spec can be parsed (or else it's failed with a 422)
 	logg.LogTo("REST", "Validating classifier")
 	if err := classifier.Validate(); err != nil {
 		logg.LogTo("REST", "Classifier failed validation: %v", err)
-		c.Fail(400, err)
+		if _, ok := err.(InvalidSpecError); !ok {
+			err = validationError(err)
+		}
+		failRequest(c, err)
 		return
 	}
 
@@ -235,15 +294,14 @@ func (e EndpointContext) CreateClassifierEndpoint(c *gin.Context) {
 	logg.LogTo("REST", "Save classifier to db")
 	err := classifier.Insert()
 	if err != nil {
-		c.Fail(500, err)
+		failRequest(c, err)
 		return
 	}
 
 	// Create a cbfs client
-	cbfs, err := NewBlobStore(e.Configuration.CbfsUrl)
+	cbfs, err := e.Configuration.NewBlobStoreClient()
 	if err != nil {
-		errMsg := fmt.Errorf("Error creating cbfs client: %v", err)
-		c.Fail(500, errMsg)
+		failRequest(c, fmt.Errorf("Error creating cbfs client: %v", err))
 		return
 	}
 
@@ -251,7 +309,7 @@ func (e EndpointContext) CreateClassifierEndpoint(c *gin.Context) {
 	logg.LogTo("REST", "Save classifier.prototxt %v to cbfs", classifier.SpecificationUrl)
 	destPath := path.Join(classifier.Id, "classifier.prototxt")
 	if err := saveUrlToBlobStore(classifier.SpecificationUrl, destPath, cbfs); err != nil {
-		c.Fail(500, err)
+		failRequest(c, err)
 		return
 
 	}
@@ -260,7 +318,7 @@ func (e EndpointContext) CreateClassifierEndpoint(c *gin.Context) {
 	logg.LogTo("REST", "update the spec url to point to the classifier.prototxt in cbfs")
 	specUrlCbfs := fmt.Sprintf("%v%v", CBFS_URI_PREFIX, destPath)
 	if err := classifier.SetSpecificationUrl(specUrlCbfs); err != nil {
-		c.Fail(500, err)
+		failRequest(c, err)
 		return
 	}
 
@@ -271,40 +329,67 @@ func (e EndpointContext) CreateClassifierEndpoint(c *gin.Context) {
 
 func (e EndpointContext) CreateClassificationJobEndpoint(c *gin.Context) {
 
-	_ = c.MustGet(MIDDLEWARE_KEY_USER).(User)
-	_ = c.MustGet(MIDDLEWARE_KEY_DB).(couch.Database)
+	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
+
+	if !e.checkQuota(c, user, QUOTA_ACTION_CLASSIFY) {
+		return
+	}
 
 	classifierId := c.Params.ByName("classifier-id")
 
 	classifier := NewClassifier(e.Configuration)
 	if err := classifier.Find(classifierId); err != nil {
-		err = fmt.Errorf("Unable to find classifier with id: %v.  Err: %v", classifierId, err)
-		c.Fail(500, err)
+		failRequest(c, lookupError(err, fmt.Errorf("Unable to find classifier with id: %v", classifierId)))
+		return
+	}
+
+	owner, err := FindDocumentOwner(db, classifier.Id)
+	if err != nil && !httputil.IsHTTPStatus(err, 404) {
+		failRequest(c, err)
+		return
+	}
+	if owner != user.DocId() {
+		failRequest(c, forbiddenError(fmt.Errorf("User %v does not own %v", user.Username, classifier.Id)))
 		return
 	}
 
 	// create a new classifier job
 	classifyJob := NewClassifyJob(e.Configuration)
 	classifyJob.ClassifierID = classifier.Id
+	classifyJob.UserID = user.DocId()
+	classifyJob.CreatedAt = time.Now()
 
 	request := c.Request
-	err := request.ParseMultipartForm(100000000) // ~100 MB
+	err = request.ParseMultipartForm(100000000) // ~100 MB
 	if err != nil {
-		c.Fail(500, err)
+		failRequest(c, validationError(fmt.Errorf("Invalid multipart form: %v", err)))
 		return
 	}
 
-	// TODO: currently ignores file upload files
-
 	// get the form values with the image urls
 	multipartForm := request.MultipartForm
 	urls := multipartForm.Value["urls"]
 
+	if priority := multipartForm.Value["priority"]; len(priority) > 0 {
+		classifyJob.Priority, err = strconv.Atoi(priority[0])
+		if err != nil {
+			failRequest(c, validationError(fmt.Errorf("Invalid priority: %v", priority[0])))
+			return
+		}
+	}
+
 	// manually create a new uuid here so we can refer to the id
 	// before persisting the object to the db
 	classifyJobId := NewUuid()
 	classifyJob.Id = classifyJobId
 
+	cbfsclient, err := e.Configuration.NewBlobStoreClient()
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+
 	// add each image to cbfs
 	emptyResults := map[string]string{}
 	for _, url := range urls {
@@ -316,14 +401,23 @@ func (e EndpointContext) CreateClassificationJobEndpoint(c *gin.Context) {
 		// save image url to cbfs
 		dest := path.Join(classifyJob.Id, hashHexString)
 
-		cbfsclient, err := e.Configuration.NewBlobStoreClient()
-		if err != nil {
-			c.Fail(500, err)
+		if err := saveUrlToBlobStore(url, dest, cbfsclient); err != nil {
+			failRequest(c, err)
 			return
 		}
 
-		if err := saveUrlToBlobStore(url, dest, cbfsclient); err != nil {
-			c.Fail(500, err)
+		imageUrlCbfs := fmt.Sprintf("%v%v", CBFS_URI_PREFIX, dest)
+
+		emptyResults[imageUrlCbfs] = "pending"
+
+	}
+
+	// and each uploaded image file, named by the sha1 of its contents
+	for _, fileHeader := range multipartForm.File["files"] {
+
+		dest, err := saveUploadToBlobStore(fileHeader, classifyJob.Id, cbfsclient)
+		if err != nil {
+			failRequest(c, err)
 			return
 		}
 
@@ -336,7 +430,7 @@ func (e EndpointContext) CreateClassificationJobEndpoint(c *gin.Context) {
 	classifyJob.Results = emptyResults
 
 	if err := classifyJob.Insert(); err != nil {
-		c.Fail(500, err)
+		failRequest(c, err)
 		return
 	}
 
@@ -346,3 +440,625 @@ func (e EndpointContext) CreateClassificationJobEndpoint(c *gin.Context) {
 	c.JSON(201, *classifyJob)
 
 }
+
+// Streams a .tar.gz bundle with everything needed to run the classifier
+// outside of elastic-thought: the trained model, prototxt specs, labels
+// and preprocessing parameters.
+func (e EndpointContext) GetClassifierBundleEndpoint(c *gin.Context) {
+
+	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
+
+	classifierId := c.Params.ByName("classifier-id")
+
+	classifier := NewClassifier(e.Configuration)
+	if err := classifier.Find(classifierId); err != nil {
+		failRequest(c, lookupError(err, fmt.Errorf("Unable to find classifier with id: %v", classifierId)))
+		return
+	}
+
+	// the bundle holds the trained model, so only the owner may download it
+	owner, err := FindDocumentOwner(db, classifier.Id)
+	if err != nil && !httputil.IsHTTPStatus(err, 404) {
+		failRequest(c, err)
+		return
+	}
+	if owner != user.DocId() {
+		failRequest(c, forbiddenError(fmt.Errorf("User %v does not own %v", user.Username, classifier.Id)))
+		return
+	}
+
+	filename := fmt.Sprintf("%v.tar.gz", classifier.Id)
+	c.Writer.Header().Set("Content-Type", "application/x-gzip")
+	c.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v", filename))
+
+	if err := classifier.WriteBundle(c.Writer); err != nil {
+		if c.Writer.Written() {
+			// too late to send an error status, the bundle will be truncated
+			logg.LogError(fmt.Errorf("Error streaming bundle for %v: %v", classifier.Id, err))
+			return
+		}
+		failRequest(c, err)
+		return
+	}
+
+}
+
+// Creates a classifier from a bundle previously downloaded from
+// GetClassifierBundleEndpoint.  The request body is the raw .tar.gz bundle.
+func (e EndpointContext) ImportClassifierBundleEndpoint(c *gin.Context) {
+
+	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
+
+	if !e.checkQuota(c, user, QUOTA_ACTION_STORE_BLOBS) {
+		return
+	}
+
+	if !limitRequestBody(c, MAX_CLASSIFIER_BUNDLE_BYTES) {
+		return
+	}
+
+	// bundles which can't be read are failed with a 422
+	classifier, err := ImportClassifierBundle(e.Configuration, user.DocId(), c.Request.Body)
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	c.JSON(201, *classifier)
+
+}
+
+// Streams a blob (eg, a trained model or the stdout of a training job) from
+// the blob store.  A cbfs://<doc-id>/<file> url maps to /blobs/<doc-id>/<file>,
+// and only the user who owns <doc-id> is allowed to fetch it.
+func (e EndpointContext) GetBlobEndpoint(c *gin.Context) {
+
+	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
+
+	blobPath := strings.TrimPrefix(c.Params.ByName("path"), "/")
+
+	docId, err := blobPathDocId(blobPath)
+	if err != nil {
+		failRequest(c, validationError(err))
+		return
+	}
+
+	owner, err := FindDocumentOwner(db, docId)
+	if err != nil {
+		failRequest(c, lookupError(err, fmt.Errorf("No document found for blob: %v", blobPath)))
+		return
+	}
+	if owner != user.DocId() {
+		failRequest(c, forbiddenError(fmt.Errorf("User %v does not own %v", user.Username, blobPath)))
+		return
+	}
+
+	blobStore, err := e.Configuration.NewBlobStoreClient()
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	if err := serveBlob(c.Writer, c.Request, blobStore, blobPath); err != nil {
+		failRequest(c, lookupError(err, fmt.Errorf("Unable to get blob: %v", blobPath)))
+		return
+	}
+
+}
+
+// Lists the blobs stored for a training job, such as the trained model,
+// snapshots and the stdout/stderr logs.
+func (e EndpointContext) GetTrainingJobArtifactsEndpoint(c *gin.Context) {
+
+	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
+
+	trainingJobId := c.Params.ByName("training-job-id")
+
+	trainingJob := NewTrainingJob(e.Configuration)
+	if err := trainingJob.Find(trainingJobId); err != nil {
+		failRequest(c, lookupError(err, fmt.Errorf("Unable to find training job with id: %v", trainingJobId)))
+		return
+	}
+
+	if trainingJob.UserID != user.DocId() {
+		failRequest(c, forbiddenError(fmt.Errorf("User %v does not own %v", user.Username, trainingJobId)))
+		return
+	}
+
+	blobStore, err := e.Configuration.NewBlobStoreClient()
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	artifacts, err := blobStore.List(fmt.Sprintf("%v/", trainingJob.Id))
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	c.JSON(200, ArtifactsResponse{Artifacts: artifacts})
+
+}
+
+// Gets a datafile.  See getDocEndpoint.
+func (e EndpointContext) GetDatafileEndpoint(c *gin.Context) {
+	e.getDocEndpoint(c, DOC_TYPE_DATAFILE, c.Params.ByName("datafile-id"))
+}
+
+// Gets a dataset.  See getDocEndpoint.
+func (e EndpointContext) GetDatasetEndpoint(c *gin.Context) {
+	e.getDocEndpoint(c, DOC_TYPE_DATASET, c.Params.ByName("dataset-id"))
+}
+
+// Gets a solver.  See getDocEndpoint.
+func (e EndpointContext) GetSolverEndpoint(c *gin.Context) {
+	e.getDocEndpoint(c, DOC_TYPE_SOLVER, c.Params.ByName("solver-id"))
+}
+
+// Gets a training job.  See getDocEndpoint.
+func (e EndpointContext) GetTrainingJobEndpoint(c *gin.Context) {
+	e.getDocEndpoint(c, DOC_TYPE_TRAINING_JOB, c.Params.ByName("training-job-id"))
+}
+
+// Gets a classifier.  See getDocEndpoint.
+func (e EndpointContext) GetClassifierEndpoint(c *gin.Context) {
+	e.getDocEndpoint(c, DOC_TYPE_CLASSIFIER, c.Params.ByName("classifier-id"))
+}
+
+// Gets a classify job.  See getDocEndpoint.
+func (e EndpointContext) GetClassifyJobEndpoint(c *gin.Context) {
+	e.getDocEndpoint(c, DOC_TYPE_CLASSIFY_JOB, c.Params.ByName("classify-job-id"))
+}
+
+// Returns the current state of a doc of the given type, eg so that clients
+// can poll a job until it's finished.
+func (e EndpointContext) getDocEndpoint(c *gin.Context, docType, docId string) {
+
+	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
+
+	doc := map[string]interface{}{}
+	if err := db.Retrieve(docId, &doc); err != nil {
+		failRequest(c, lookupError(err, fmt.Errorf("Unable to find %v with id: %v", docType, docId)))
+		return
+	}
+	if doc["type"] != docType {
+		failRequest(c, notFoundError(fmt.Errorf("Unable to find %v with id: %v", docType, docId)))
+		return
+	}
+
+	owner, err := FindDocumentOwner(db, docId)
+	if err != nil && !httputil.IsHTTPStatus(err, 404) {
+		failRequest(c, err)
+		return
+	}
+	if owner != user.DocId() {
+		failRequest(c, forbiddenError(fmt.Errorf("User %v does not own %v", user.Username, docId)))
+		return
+	}
+
+	c.JSON(200, doc)
+
+}
+
+// Deletes a datafile.  See deleteDocEndpoint.
+func (e EndpointContext) DeleteDatafileEndpoint(c *gin.Context) {
+	e.deleteDocEndpoint(c, DOC_TYPE_DATAFILE, c.Params.ByName("datafile-id"))
+}
+
+// Deletes a dataset.  See deleteDocEndpoint.
+func (e EndpointContext) DeleteDatasetEndpoint(c *gin.Context) {
+	e.deleteDocEndpoint(c, DOC_TYPE_DATASET, c.Params.ByName("dataset-id"))
+}
+
+// Deletes a solver.  See deleteDocEndpoint.
+func (e EndpointContext) DeleteSolverEndpoint(c *gin.Context) {
+	e.deleteDocEndpoint(c, DOC_TYPE_SOLVER, c.Params.ByName("solver-id"))
+}
+
+// Deletes a training job.  See deleteDocEndpoint.
+func (e EndpointContext) DeleteTrainingJobEndpoint(c *gin.Context) {
+	e.deleteDocEndpoint(c, DOC_TYPE_TRAINING_JOB, c.Params.ByName("training-job-id"))
+}
+
+// Deletes a classifier.  See deleteDocEndpoint.
+func (e EndpointContext) DeleteClassifierEndpoint(c *gin.Context) {
+	e.deleteDocEndpoint(c, DOC_TYPE_CLASSIFIER, c.Params.ByName("classifier-id"))
+}
+
+// Deletes a classify job.  See deleteDocEndpoint.
+func (e EndpointContext) DeleteClassifyJobEndpoint(c *gin.Context) {
+	e.deleteDocEndpoint(c, DOC_TYPE_CLASSIFY_JOB, c.Params.ByName("classify-job-id"))
+}
+
+// Deletes a doc of the given type along with its blobs.  If other docs depend
+// on it, the delete is refused with a 409 unless ?cascade=true is passed, in
+// which case the dependents (and their blobs) are deleted too.  Jobs that are
+// still being processed are cancelled before being deleted.
+func (e EndpointContext) deleteDocEndpoint(c *gin.Context, docType, docId string) {
+
+	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
+
+	doc := ElasticThoughtDoc{}
+	if err := db.Retrieve(docId, &doc); err != nil {
+		failRequest(c, lookupError(err, fmt.Errorf("Unable to find %v with id: %v", docType, docId)))
+		return
+	}
+	if doc.Type != docType {
+		failRequest(c, notFoundError(fmt.Errorf("Unable to find %v with id: %v", docType, docId)))
+		return
+	}
+
+	cascade := c.Request.URL.Query().Get("cascade") == "true"
+
+	// a DependentsError is failed with a 409
+	docIds, err := PlanDelete(db, docId, cascade)
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	// the user must own everything that will be deleted
+	for _, id := range docIds {
+		owner, err := FindDocumentOwner(db, id)
+		if err != nil && !httputil.IsHTTPStatus(err, 404) {
+			failRequest(c, err)
+			return
+		}
+		if owner != user.DocId() {
+			failRequest(c, forbiddenError(fmt.Errorf("User %v does not own %v", user.Username, id)))
+			return
+		}
+	}
+
+	if err := DeleteDocuments(e.Configuration, docIds); err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	c.JSON(200, DeletedResponse{Deleted: docIds})
+
+}
+
+// Retries a failed datafile download.  See retryJobEndpoint.
+func (e EndpointContext) RetryDatafileEndpoint(c *gin.Context) {
+	e.retryJobEndpoint(c, DOC_TYPE_DATAFILE, c.Params.ByName("datafile-id"))
+}
+
+// Retries a failed dataset split.  See retryJobEndpoint.
+func (e EndpointContext) RetryDatasetEndpoint(c *gin.Context) {
+	e.retryJobEndpoint(c, DOC_TYPE_DATASET, c.Params.ByName("dataset-id"))
+}
+
+// Retries a failed training job.  See retryJobEndpoint.
+func (e EndpointContext) RetryTrainingJobEndpoint(c *gin.Context) {
+	e.retryJobEndpoint(c, DOC_TYPE_TRAINING_JOB, c.Params.ByName("training-job-id"))
+}
+
+// Retries a failed classify job.  See retryJobEndpoint.
+func (e EndpointContext) RetryClassifyJobEndpoint(c *gin.Context) {
+	e.retryJobEndpoint(c, DOC_TYPE_CLASSIFY_JOB, c.Params.ByName("classify-job-id"))
+}
+
+// Puts a failed job of the given type back into the pending state so that
+// it will be rescheduled.  Returns a 409 if the job hasn't failed.
+func (e EndpointContext) retryJobEndpoint(c *gin.Context, docType, docId string) {
+
+	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
+
+	doc := ElasticThoughtDoc{}
+	if err := db.Retrieve(docId, &doc); err != nil {
+		failRequest(c, lookupError(err, fmt.Errorf("Unable to find %v with id: %v", docType, docId)))
+		return
+	}
+	if doc.Type != docType {
+		failRequest(c, notFoundError(fmt.Errorf("Unable to find %v with id: %v", docType, docId)))
+		return
+	}
+
+	owner, err := FindDocumentOwner(db, docId)
+	if err != nil && !httputil.IsHTTPStatus(err, 404) {
+		failRequest(c, err)
+		return
+	}
+	if owner != user.DocId() {
+		failRequest(c, forbiddenError(fmt.Errorf("User %v does not own %v", user.Username, docId)))
+		return
+	}
+
+	job, err := FindJobDoc(e.Configuration, docId)
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	retried, err := RetryJob(e.Configuration, job)
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+	if !retried {
+		failRequest(c, conflictError(fmt.Errorf("Only failed jobs can be retried, %v is %v", docId, job.GetProcessingState())))
+		return
+	}
+
+	c.JSON(200, job)
+
+}
+
+// Shows which jobs are running and queued in the worker pool, along with its
+// resource slot occupancy.  Only available when jobs are run in process.
+func (e EndpointContext) GetWorkerSlotsEndpoint(c *gin.Context) {
+
+	if e.WorkerPool == nil {
+		failRequest(c, notFoundError(fmt.Errorf("No worker pool in this process")))
+		return
+	}
+
+	c.JSON(200, e.WorkerPool.Status())
+
+}
+
+// Shows where the user's jobs are in the queue of jobs waiting to be run, and
+// when they are expected to start.  Jobs of other users count towards the
+// positions, but aren't listed.
+func (e EndpointContext) GetQueueEndpoint(c *gin.Context) {
+
+	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
+
+	if e.JobQueue == nil {
+		failRequest(c, notFoundError(fmt.Errorf("No job queue in this process")))
+		return
+	}
+
+	positions := e.JobQueue.Positions()
+
+	userPositions := []QueuePosition{}
+	for _, position := range positions {
+		if position.UserID == user.DocId() {
+			userPositions = append(userPositions, position)
+		}
+	}
+
+	c.JSON(200, QueueResponse{
+		Length: len(positions),
+		Jobs:   userPositions,
+	})
+
+}
+
+// Reports how much of the cluster the user is using, along with their quota
+func (e EndpointContext) GetUsageEndpoint(c *gin.Context) {
+
+	user := c.MustGet(MIDDLEWARE_KEY_USER).(User)
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
+
+	usage, err := ComputeUsage(e.Configuration, db, user.DocId(), time.Now())
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	c.JSON(200, UsageResponse{
+		Usage: usage,
+		Quota: e.Configuration.QuotaFor(user.DocId()),
+	})
+
+}
+
+// Serves the OpenAPI spec of every endpoint
+func (e EndpointContext) GetOpenAPIEndpoint(c *gin.Context) {
+	c.JSON(200, OpenAPISpec(apiRoutes()))
+}
+
+// Limit the size of the request body.  Requests which say they're bigger than
+// maxBytes are failed with a 413 straight away, and reading a body which turns
+// out to be bigger fails at the limit.
+func limitRequestBody(c *gin.Context, maxBytes int64) bool {
+
+	if c.Request.ContentLength > maxBytes {
+		err := fmt.Errorf("Request body is larger than %v bytes", maxBytes)
+		failRequest(c, NewAPIError(413, ERROR_CODE_TOO_LARGE, err))
+		return false
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+	return true
+
+}
+
+// Check that the user owns the existing doc that a doc they're creating
+// refers to, eg the training job of a classifier, since the new doc gives
+// access to it.  If not, the request is failed with a 403 (or a 400 if there's
+// no such doc) and false is returned.
+func requireOwner(c *gin.Context, db DocumentStore, user User, docId string) bool {
+
+	owner, err := FindDocumentOwner(db, docId)
+	if httputil.IsHTTPStatus(err, 404) {
+		failRequest(c, validationError(fmt.Errorf("Unable to find doc with id: %v", docId)))
+		return false
+	}
+	if err != nil {
+		failRequest(c, err)
+		return false
+	}
+	if owner != user.DocId() {
+		failRequest(c, forbiddenError(fmt.Errorf("User %v does not own %v", user.Username, docId)))
+		return false
+	}
+	return true
+
+}
+
+// Check the user's quota before an action which uses up cluster resources.
+// If the user is over quota, the request is failed with a 403 or 429 (see
+// QuotaError) and false is returned.
+func (e EndpointContext) checkQuota(c *gin.Context, user User, action string) bool {
+
+	quota := e.Configuration.QuotaFor(user.DocId())
+	if quota == (Quota{}) {
+		// no limits, so don't bother computing usage
+		return true
+	}
+
+	db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
+	var usage Usage
+	var err error
+	if e.UsageCache != nil {
+		usage, err = e.UsageCache.Usage(db, user.DocId(), time.Now())
+	} else {
+		usage, err = ComputeUsage(e.Configuration, db, user.DocId(), time.Now())
+	}
+	if err != nil {
+		failRequest(c, err)
+		return false
+	}
+
+	if err := quota.Check(usage, action); err != nil {
+		failRequest(c, err)
+		return false
+	}
+
+	return true
+
+}
+
+// Adds a job to the back of the http pull queue
+func (e EndpointContext) QueueScheduleJobEndpoint(c *gin.Context) {
+
+	if !e.requireQueueBackend(c) {
+		return
+	}
+
+	jobDescriptor := JobDescriptor{}
+	if ok := bindJSON(c, &jobDescriptor); !ok {
+		return
+	}
+
+	if err := e.QueueBackend.ScheduleJob(jobDescriptor); err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	c.String(201, "")
+
+}
+
+// Leases the job at the front of the http pull queue to a worker, or
+// returns 204 if there are no jobs available
+func (e EndpointContext) QueueLeaseEndpoint(c *gin.Context) {
+
+	request, ok := e.bindQueueLeaseRequest(c)
+	if !ok {
+		return
+	}
+
+	entry, err := e.QueueBackend.Lease(request.WorkerID, time.Duration(request.TTLSeconds)*time.Second)
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	if entry == nil {
+		c.String(204, "")
+		return
+	}
+
+	c.JSON(200, entry)
+
+}
+
+// Extends a worker's lease on an entry in the http pull queue
+func (e EndpointContext) QueueRenewEndpoint(c *gin.Context) {
+
+	request, ok := e.bindQueueLeaseRequest(c)
+	if !ok {
+		return
+	}
+
+	err := e.QueueBackend.Renew(c.Params.ByName("entry-id"), request.WorkerID, time.Duration(request.TTLSeconds)*time.Second)
+	e.respondToQueueUpdate(c, err)
+
+}
+
+// Removes an entry from the http pull queue once its job is done with
+func (e EndpointContext) QueueAckEndpoint(c *gin.Context) {
+
+	request, ok := e.bindQueueLeaseRequest(c)
+	if !ok {
+		return
+	}
+
+	err := e.QueueBackend.Ack(c.Params.ByName("entry-id"), request.WorkerID)
+	e.respondToQueueUpdate(c, err)
+
+}
+
+// Gives up a worker's lease on an entry in the http pull queue, so that it
+// can be leased again after the delay
+func (e EndpointContext) QueueNackEndpoint(c *gin.Context) {
+
+	request, ok := e.bindQueueLeaseRequest(c)
+	if !ok {
+		return
+	}
+
+	err := e.QueueBackend.Nack(c.Params.ByName("entry-id"), request.WorkerID, time.Duration(request.DelaySeconds)*time.Second)
+	e.respondToQueueUpdate(c, err)
+
+}
+
+func (e EndpointContext) requireQueueBackend(c *gin.Context) bool {
+	if e.QueueBackend == nil {
+		failRequest(c, notFoundError(fmt.Errorf("No queue backend in this process")))
+		return false
+	}
+	return true
+}
+
+func (e EndpointContext) bindQueueLeaseRequest(c *gin.Context) (queueLeaseRequest, bool) {
+
+	request := queueLeaseRequest{}
+
+	if !e.requireQueueBackend(c) {
+		return request, false
+	}
+
+	if ok := bindJSON(c, &request); !ok {
+		return request, false
+	}
+
+	if len(request.WorkerID) == 0 {
+		failRequest(c, validationError(fmt.Errorf("Missing worker-id")))
+		return request, false
+	}
+
+	if request.TTLSeconds < 0 || request.DelaySeconds < 0 {
+		failRequest(c, validationError(fmt.Errorf("ttl-seconds and delay-seconds can't be negative")))
+		return request, false
+	}
+
+	if request.TTLSeconds == 0 {
+		request.TTLSeconds = int(DEFAULT_QUEUE_LEASE_TTL / time.Second)
+	}
+
+	return request, true
+
+}
+
+// A lost lease is a 409, so that the worker knows another worker has the job
+func (e EndpointContext) respondToQueueUpdate(c *gin.Context, err error) {
+
+	if err != nil {
+		failRequest(c, err)
+		return
+	}
+
+	c.String(200, "")
+
+}
@@ -0,0 +1,225 @@
+package elasticthought
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestUploadAndGetDatafile(t *testing.T) {
+
+	config := *NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://endpoint_context_test_%v", NewUuid())
+	config.CbfsUrl = fmt.Sprintf("file://%v", filepath.Join(TempDir(), NewUuid()))
+	router := NewRouter(config, &EndpointContext{Configuration: config})
+
+	request := func(method, path, username, contentType string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.SetBasicAuth(username, "password")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for _, username := range []string{"foo", "bar"} {
+		user := fmt.Sprintf(`{"username": "%v", "password": "password"}`, username)
+		recorder := request("POST", "/users", username, "application/json", []byte(user))
+		assert.Equals(t, recorder.Code, 201)
+	}
+
+	recorder := request("POST", "/datafiles?filename=mnist.tar.gz", "foo", "application/x-gzip", []byte("not really gzipped"))
+	assert.Equals(t, recorder.Code, 201)
+	created := map[string]string{}
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &created) == nil)
+	datafileId := created["id"]
+
+	// the upload is already finished, and can be read back from its url
+	recorder = request("GET", "/datafiles/"+datafileId, "foo", "", nil)
+	assert.Equals(t, recorder.Code, 200)
+	datafile := Datafile{}
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &datafile) == nil)
+	assert.Equals(t, datafile.ProcessingState, FinishedSuccessfully)
+	assert.Equals(t, datafile.UserID, "user:foo")
+	assert.Equals(t, datafile.Url, fmt.Sprintf("%v%v/mnist.tar.gz", CBFS_URI_PREFIX, datafileId))
+	assert.False(t, bytes.Contains(recorder.Body.Bytes(), []byte("Configuration")))
+
+	// nor is the configuration saved in the doc, since it holds credentials
+	stored := map[string]interface{}{}
+	assert.True(t, config.DbConnection().Retrieve(datafileId, &stored) == nil)
+	_, ok := stored["Configuration"]
+	assert.False(t, ok)
+
+	blobStore, err := config.NewBlobStoreClient()
+	assert.True(t, err == nil)
+	reader, err := datafile.Open(blobStore)
+	assert.True(t, err == nil)
+	content, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	assert.Equals(t, string(content), "not really gzipped")
+
+	// another datafile's url can't point at it
+	other := Datafile{ElasticThoughtDoc: ElasticThoughtDoc{Id: NewUuid()}, Url: datafile.Url}
+	_, err = other.Open(blobStore)
+	assert.True(t, err != nil)
+
+	// uploads which are too big are refused up front
+	req, _ := http.NewRequest("POST", "/datafiles", bytes.NewReader(nil))
+	req.Header.Set("Content-Type", "application/x-gzip")
+	req.SetBasicAuth("foo", "password")
+	req.ContentLength = MAX_DATAFILE_UPLOAD_BYTES + 1
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equals(t, recorder.Code, 413)
+
+	// the owner is always the caller, whatever the request says
+	body := []byte(`{"url": "http://example.com/mnist.tar.gz", "user-id": "user:bar"}`)
+	recorder = request("POST", "/datafiles", "foo", "application/json", body)
+	assert.Equals(t, recorder.Code, 201)
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &created) == nil)
+	claimed := Datafile{}
+	assert.True(t, config.DbConnection().Retrieve(created["id"], &claimed) == nil)
+	assert.Equals(t, claimed.UserID, "user:foo")
+
+	// only the owner can see it, and only as a datafile
+	assert.Equals(t, request("GET", "/datafiles/"+datafileId, "bar", "", nil).Code, 403)
+	assert.Equals(t, request("GET", "/datasets/"+datafileId, "foo", "", nil).Code, 404)
+	assert.Equals(t, request("GET", "/datafiles/missing", "foo", "", nil).Code, 404)
+
+}
+
+// Any user can read back the jobs they create, so the docs mustn't hold the
+// queue token which workers use to lease jobs
+func TestJobsDontExposeQueueToken(t *testing.T) {
+
+	config := *NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://endpoint_context_test_%v", NewUuid())
+	config.QueueType = Durable
+	config.QueueToken = "queue-token-" + NewUuid()
+	config.S3SecretKey = "s3-secret-" + NewUuid()
+
+	router := NewRouter(config, &EndpointContext{Configuration: config})
+
+	request := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+		req.SetBasicAuth("foo", "password")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := request("POST", "/users", []byte(`{"username": "foo", "password": "password"}`))
+	assert.Equals(t, recorder.Code, 201)
+
+	solver := map[string]interface{}{"type": DOC_TYPE_SOLVER, "user-id": "user:foo"}
+	_, _, err := config.DbConnection().InsertWith(solver, "solver")
+	assert.True(t, err == nil)
+
+	recorder = request("POST", "/training-jobs", []byte(`{"solver-id": "solver", "user-id": "user:bar"}`))
+	assert.Equals(t, recorder.Code, 201)
+	trainingJob := TrainingJob{}
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &trainingJob) == nil)
+	assert.Equals(t, trainingJob.UserID, "user:foo")
+
+	doc := map[string]interface{}{}
+	assert.True(t, config.DbConnection().Retrieve(trainingJob.Id, &doc) == nil)
+	stored, err := json.Marshal(doc)
+	assert.True(t, err == nil)
+
+	for _, body := range [][]byte{recorder.Body.Bytes(), stored} {
+		assert.False(t, bytes.Contains(body, []byte(config.QueueToken)))
+		assert.False(t, bytes.Contains(body, []byte(config.S3SecretKey)))
+	}
+
+}
+
+func TestGetClassifierBundleRequiresOwner(t *testing.T) {
+
+	config := *NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://endpoint_context_test_%v", NewUuid())
+
+	router := NewRouter(config, &EndpointContext{Configuration: config})
+
+	request := func(method, path, username string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+		req.SetBasicAuth(username, "password")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for _, username := range []string{"foo", "bar"} {
+		user := fmt.Sprintf(`{"username": "%v", "password": "password"}`, username)
+		assert.Equals(t, request("POST", "/users", username, []byte(user)).Code, 201)
+	}
+
+	classifier := NewClassifier(config)
+	classifier.UserID = "user:foo"
+	assert.True(t, classifier.Insert() == nil)
+
+	recorder := request("GET", "/classifiers/"+classifier.Id+"/bundle", "bar", nil)
+	assert.Equals(t, recorder.Code, 403)
+
+}
+
+// Docs can only be created from the user's own docs, or else eg a classifier
+// on another user's training job would give access to their trained model
+func TestCreateRequiresOwnedParents(t *testing.T) {
+
+	config := *NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://endpoint_context_test_%v", NewUuid())
+
+	router := NewRouter(config, &EndpointContext{Configuration: config})
+
+	request := func(method, path, username string, body []byte) int {
+		req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+		req.SetBasicAuth(username, "password")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	for _, username := range []string{"foo", "bar"} {
+		user := fmt.Sprintf(`{"username": "%v", "password": "password"}`, username)
+		assert.Equals(t, request("POST", "/users", username, []byte(user)), 201)
+	}
+
+	// a chain of docs belonging to bar, where only the first has a user-id
+	db := config.DbConnection()
+	docs := []map[string]interface{}{
+		{"_id": "datafile", "type": DOC_TYPE_DATAFILE, "user-id": "user:bar"},
+		{"_id": "dataset", "type": DOC_TYPE_DATASET, "training": map[string]string{"datafile-id": "datafile"}},
+		{"_id": "solver", "type": DOC_TYPE_SOLVER, "dataset-id": "dataset"},
+		{"_id": "training-job", "type": DOC_TYPE_TRAINING_JOB, "solver-id": "solver"},
+		{"_id": "classifier", "type": DOC_TYPE_CLASSIFIER, "training-job-id": "training-job"},
+	}
+	for _, doc := range docs {
+		_, _, err := db.InsertWith(doc, doc["_id"].(string))
+		assert.True(t, err == nil)
+	}
+
+	dataset := []byte(`{"training": {"datafile-id": "datafile", "split-percentage": 0.7}, "test": {"datafile-id": "datafile", "split-percentage": 0.3}}`)
+	solver := []byte(`{"dataset-id": "dataset", "specification-url": "http://foo/solver.prototxt", "specification-net-url": "http://foo/net.prototxt"}`)
+	trainingJob := []byte(`{"solver-id": "solver"}`)
+	classifier := []byte(`{"training-job-id": "training-job", "specification-url": "http://foo/classifier.prototxt", "scale": "1", "image-width": "28", "image-height": "28"}`)
+
+	assert.Equals(t, request("POST", "/datasets", "foo", dataset), 403)
+	assert.Equals(t, request("POST", "/solvers", "foo", solver), 403)
+	assert.Equals(t, request("POST", "/training-jobs", "foo", trainingJob), 403)
+	assert.Equals(t, request("POST", "/classifiers", "foo", classifier), 403)
+	assert.Equals(t, request("POST", "/classifiers/classifier/classify", "foo", nil), 403)
+
+	// docs that don't exist can't be used either
+	assert.Equals(t, request("POST", "/training-jobs", "foo", []byte(`{"solver-id": "missing"}`)), 400)
+
+	// but the owner can use them
+	assert.Equals(t, request("POST", "/training-jobs", "bar", trainingJob), 201)
+
+}
@@ -25,7 +25,7 @@ func CbfsReadWriteFile(config Configuration, destPath, content string) error {
 
 	// get cbfs client
 	// Create a cbfs client
-	cbfs, err := NewBlobStore(config.CbfsUrl)
+	cbfs, err := config.NewBlobStoreClient()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,205 @@
+package elasticthought
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/couchbaselabs/logg"
+)
+
+// The kinds of executors which can be chosen via Configuration.ExecutorType
+const (
+	EXECUTOR_LOCAL  = "local"
+	EXECUTOR_DOCKER = "docker"
+)
+
+// The docker image used to run caffe, unless the solver or classifier pins
+// an image of its own
+const DEFAULT_CAFFE_IMAGE = "tleyden5iwx/caffe-cpu-master"
+
+// A command to run on behalf of a job, eg caffe train
+type ExecSpec struct {
+
+	// The doc id of the job, so that the command can be killed if the job
+	// is cancelled
+	JobId string
+
+	Command string
+	Args    []string
+
+	// The work directory of the job, which the command is run in.  Paths in
+	// the args are relative to this.
+	Dir string
+
+	// Where to save the stdout and stderr of the command
+	StdOutPath string
+	StdErrPath string
+
+	// The docker image to run the command in, for executors which use docker
+	Image string
+
+	// Whether the command needs access to a GPU
+	Gpu bool
+}
+
+// Runs the commands (caffe, python) that jobs need, so that they can be run
+// directly on the host, inside a docker container, or faked out in tests.
+type Executor interface {
+
+	// Run the command to completion, saving its stdout and stderr
+	Execute(spec ExecSpec) error
+
+	// Kill the command being run for the given job, if it's running in this
+	// process.  Returns true if a command was killed.
+	Kill(jobId string) bool
+}
+
+// Runs commands as processes on the host, which must have them on its PATH
+type LocalExecutor struct{}
+
+func (e LocalExecutor) Execute(spec ExecSpec) error {
+
+	logg.LogTo("JOB_SCHEDULER", "Running %v with args %v in %v", spec.Command, spec.Args, spec.Dir)
+
+	cmd := exec.Command(spec.Command, spec.Args...)
+
+	// set the directory where the command will be run in (important
+	// because we depend on relative file paths to work)
+	cmd.Dir = spec.Dir
+
+	return runJobCmdTeeStdio(spec.JobId, cmd, spec.StdOutPath, spec.StdErrPath)
+
+}
+
+func (e LocalExecutor) Kill(jobId string) bool {
+	return killJobCmd(jobId)
+}
+
+// Runs commands inside a docker container via the docker cli.  The job's work
+// directory is mounted into the container at the same path.
+type DockerExecutor struct {
+
+	// The image to use for specs which don't have one
+	DefaultImage string
+
+	// Extra flags passed to docker run for specs that need a GPU, eg
+	// --device=/dev/nvidia0
+	GpuFlags []string
+}
+
+func (e DockerExecutor) Execute(spec ExecSpec) error {
+
+	args := e.dockerRunArgs(spec)
+	logg.LogTo("JOB_SCHEDULER", "Running docker with args %v", args)
+
+	cmd := exec.Command("docker", args...)
+
+	return runJobCmdTeeStdio(spec.JobId, cmd, spec.StdOutPath, spec.StdErrPath)
+
+}
+
+func (e DockerExecutor) dockerRunArgs(spec ExecSpec) []string {
+
+	image := spec.Image
+	if len(image) == 0 {
+		image = e.DefaultImage
+	}
+
+	args := []string{
+		"run",
+		"--rm",
+		fmt.Sprintf("--name=%v", dockerContainerName(spec.JobId)),
+		fmt.Sprintf("--volume=%v:%v", spec.Dir, spec.Dir),
+		fmt.Sprintf("--workdir=%v", spec.Dir),
+	}
+	if spec.Gpu {
+		args = append(args, e.GpuFlags...)
+	}
+	args = append(args, image, spec.Command)
+	args = append(args, spec.Args...)
+
+	return args
+
+}
+
+// Killing the docker cli doesn't stop the container, so it's killed by name
+func (e DockerExecutor) Kill(jobId string) bool {
+
+	killed := killJobCmd(jobId)
+
+	out, err := exec.Command("docker", "kill", dockerContainerName(jobId)).CombinedOutput()
+	if err != nil {
+		logg.LogTo("JOB_SCHEDULER", "Error killing container for job %v: %v %v", jobId, err, string(out))
+		return killed
+	}
+	return true
+
+}
+
+func dockerContainerName(jobId string) string {
+	return fmt.Sprintf("elastic-thought-%v", jobId)
+}
+
+// An executor for tests, which calls Script instead of actually running
+// anything.  Script can write the command's output to stdout and stderr,
+// and create any files the command would have created in spec.Dir.
+type FakeExecutor struct {
+	Script func(spec ExecSpec, stdout, stderr io.Writer) error
+
+	mutex    sync.Mutex
+	executed []ExecSpec
+	killed   []string
+}
+
+func NewFakeExecutor(script func(spec ExecSpec, stdout, stderr io.Writer) error) *FakeExecutor {
+	return &FakeExecutor{Script: script}
+}
+
+func (e *FakeExecutor) Execute(spec ExecSpec) error {
+
+	e.mutex.Lock()
+	e.executed = append(e.executed, spec)
+	e.mutex.Unlock()
+
+	stdout, err := os.Create(spec.StdOutPath)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+
+	stderr, err := os.Create(spec.StdErrPath)
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+
+	if e.Script == nil {
+		return nil
+	}
+	return e.Script(spec, stdout, stderr)
+
+}
+
+func (e *FakeExecutor) Kill(jobId string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.killed = append(e.killed, jobId)
+	return false
+}
+
+// The specs that have been executed so far
+func (e *FakeExecutor) Executed() []ExecSpec {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]ExecSpec{}, e.executed...)
+}
+
+// The ids of the jobs that Kill has been called for
+func (e *FakeExecutor) Killed() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]string{}, e.killed...)
+}
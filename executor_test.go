@@ -0,0 +1,159 @@
+package elasticthought
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestDockerRunArgs(t *testing.T) {
+
+	executor := DockerExecutor{
+		DefaultImage: DEFAULT_CAFFE_IMAGE,
+		GpuFlags:     []string{"--device=/dev/nvidia0"},
+	}
+
+	spec := ExecSpec{
+		JobId:   "job",
+		Command: "caffe",
+		Args:    []string{"train", "--solver=solver.prototxt"},
+		Dir:     "/work/job",
+	}
+	assert.DeepEquals(t, executor.dockerRunArgs(spec), []string{
+		"run",
+		"--rm",
+		"--name=elastic-thought-job",
+		"--volume=/work/job:/work/job",
+		"--workdir=/work/job",
+		DEFAULT_CAFFE_IMAGE,
+		"caffe",
+		"train",
+		"--solver=solver.prototxt",
+	})
+
+	// a pinned image, with a gpu
+	spec.Image = "caffe:gpu"
+	spec.Gpu = true
+	args := executor.dockerRunArgs(spec)
+	assert.DeepEquals(t, args[5:8], []string{"--device=/dev/nvidia0", "caffe:gpu", "caffe"})
+
+}
+
+func TestLocalExecutor(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "executor_test")
+	assert.True(t, err == nil)
+
+	spec := ExecSpec{
+		JobId:      "job",
+		Command:    "sh",
+		Args:       []string{"-c", "pwd; echo oops >&2"},
+		Dir:        tempDir,
+		StdOutPath: filepath.Join(tempDir, "stdout"),
+		StdErrPath: filepath.Join(tempDir, "stderr"),
+	}
+	assert.True(t, LocalExecutor{}.Execute(spec) == nil)
+
+	stdout, err := ioutil.ReadFile(spec.StdOutPath)
+	assert.True(t, err == nil)
+	resolvedDir, _ := filepath.EvalSymlinks(tempDir)
+	assert.Equals(t, string(stdout), resolvedDir+"\n")
+
+	stderr, err := ioutil.ReadFile(spec.StdErrPath)
+	assert.True(t, err == nil)
+	assert.Equals(t, string(stderr), "oops\n")
+
+	// nothing running any more, so nothing to kill
+	assert.False(t, LocalExecutor{}.Kill("job"))
+
+}
+
+func TestInvokeCaffeFakeExecutor(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "executor_test")
+	assert.True(t, err == nil)
+
+	// pretend to be classifier.py
+	executor := NewFakeExecutor(func(spec ExecSpec, stdout, stderr io.Writer) error {
+		fmt.Fprintf(stdout, "classifying\n")
+		result := []byte(`{"image4434": "5"}`)
+		return ioutil.WriteFile(filepath.Join(spec.Dir, "result.json"), result, 0644)
+	})
+
+	configuration := NewDefaultConfiguration()
+	configuration.WorkDirectory = tempDir
+	configuration.Executor = executor
+
+	classifyJob := NewClassifyJob(*configuration)
+	classifyJob.Id = "classify-job"
+	assert.True(t, Mkdir(classifyJob.getWorkDirectory()) == nil)
+
+	classifier := NewClassifier(*configuration)
+	classifier.Scale = "255"
+	classifier.ImageHeight = "28"
+	classifier.ImageWidth = "28"
+	classifier.Gpu = true
+	classifier.CaffeImage = "caffe:gpu"
+
+	results, err := classifyJob.invokeCaffe(false, *classifier)
+	assert.True(t, err == nil)
+	assert.Equals(t, results["image4434"], "5")
+
+	executed := executor.Executed()
+	assert.Equals(t, len(executed), 1)
+	assert.Equals(t, executed[0].Command, "python")
+	assert.Equals(t, executed[0].Args[0], "classifier.py")
+	assert.Equals(t, executed[0].Image, "caffe:gpu")
+	assert.True(t, executed[0].Gpu)
+	assert.Equals(t, executed[0].Dir, classifyJob.getWorkDirectory())
+
+	stdout, err := ioutil.ReadFile(classifyJob.getStdOutPath())
+	assert.True(t, err == nil)
+	assert.Equals(t, string(stdout), "classifying\n")
+
+}
+
+func TestTrainingJobGpuFromSolver(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "executor_test")
+	assert.True(t, err == nil)
+
+	executor := NewFakeExecutor(nil)
+	configuration := NewDefaultConfiguration()
+	configuration.DbUrl = fmt.Sprintf("mem://executor_test_%v", NewUuid())
+	configuration.CbfsUrl = fmt.Sprintf("file://%v", filepath.Join(tempDir, "blobs"))
+	configuration.WorkDirectory = tempDir
+	configuration.Executor = executor
+
+	// whether the worker has a gpu doesn't matter, only the solver does
+	configuration.WorkerSlots = ResourceSlots{GPUs: 1}
+
+	db := configuration.DbConnection()
+	for _, gpu := range []bool{false, true} {
+
+		solver := NewSolver(*configuration)
+		solver.Gpu = gpu
+		inserted, err := solver.Insert(db)
+		assert.True(t, err == nil)
+
+		trainingJob := NewTrainingJob(*configuration)
+		trainingJob.Id = NewUuid()
+		trainingJob.SolverId = inserted.Id
+		assert.True(t, Mkdir(trainingJob.getWorkDirectory()) == nil)
+
+		// finding the trained model fails, which doesn't matter here
+		trainingJob.runCaffe()
+
+	}
+
+	executed := executor.Executed()
+	assert.Equals(t, len(executed), 2)
+	assert.Equals(t, executed[0].Command, "caffe")
+	assert.False(t, executed[0].Gpu)
+	assert.True(t, executed[1].Gpu)
+
+}
@@ -0,0 +1,349 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a longpoll _changes request waits for a change when the client
+// doesn't pass a timeout
+const fakeSyncGatewayLongpollTimeout = 2 * time.Second
+
+// A minimal in-memory Sync Gateway stand-in which supports enough of the
+// REST api (doc get/put/post/delete, _all_docs and longpoll _changes) to run
+// the real models, ChangesListener and job schedulers against it.
+type fakeSyncGateway struct {
+	DbName string
+
+	mutex   sync.Mutex
+	docs    map[string]*fakeSyncGatewayDoc
+	lastSeq int
+	changed chan struct{}
+	closed  chan struct{}
+	server  *httptest.Server
+}
+
+type fakeSyncGatewayDoc struct {
+	Rev     string
+	Seq     int
+	Deleted bool
+	Body    map[string]interface{}
+}
+
+func newFakeSyncGateway() *fakeSyncGateway {
+	f := &fakeSyncGateway{
+		DbName:  "db",
+		docs:    map[string]*fakeSyncGatewayDoc{},
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+// The url to use as Configuration.DbUrl
+func (f *fakeSyncGateway) DbUrl() string {
+	return fmt.Sprintf("%v/%v", f.server.URL, f.DbName)
+}
+
+// Shut down the server, waking up any longpoll requests first
+func (f *fakeSyncGateway) Close() {
+	close(f.closed)
+	f.server.Close()
+}
+
+// Get a copy of the current body of a doc, or nil if it doesn't exist
+func (f *fakeSyncGateway) Doc(docId string) map[string]interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	doc, ok := f.docs[docId]
+	if !ok || doc.Deleted {
+		return nil
+	}
+	return copyDocBody(doc.Body)
+}
+
+func (f *fakeSyncGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		writeFakeSyncGatewayJSON(w, 200, map[string]interface{}{"couchdb": "Welcome", "version": "fake"})
+		return
+	}
+
+	components := strings.SplitN(path, "/", 2)
+	if components[0] != f.DbName {
+		writeFakeSyncGatewayError(w, 404, "not_found", "no such database")
+		return
+	}
+	if len(components) == 1 {
+		switch r.Method {
+		case "GET":
+			f.mutex.Lock()
+			updateSeq := f.lastSeq
+			f.mutex.Unlock()
+			writeFakeSyncGatewayJSON(w, 200, map[string]interface{}{"db_name": f.DbName, "update_seq": updateSeq})
+		case "POST":
+			f.putDoc(w, r, "")
+		default:
+			writeFakeSyncGatewayError(w, 405, "method_not_allowed", r.Method)
+		}
+		return
+	}
+
+	docId := components[1]
+	switch {
+	case docId == "_changes":
+		f.changes(w, r)
+	case docId == "_all_docs":
+		f.allDocs(w, r)
+	case r.Method == "GET":
+		f.getDoc(w, docId)
+	case r.Method == "PUT":
+		f.putDoc(w, r, docId)
+	case r.Method == "DELETE":
+		f.deleteDoc(w, docId, r.URL.Query().Get("rev"))
+	default:
+		writeFakeSyncGatewayError(w, 405, "method_not_allowed", r.Method)
+	}
+
+}
+
+func (f *fakeSyncGateway) getDoc(w http.ResponseWriter, docId string) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	doc, ok := f.docs[docId]
+	if !ok || doc.Deleted {
+		writeFakeSyncGatewayError(w, 404, "not_found", "missing")
+		return
+	}
+	writeFakeSyncGatewayJSON(w, 200, doc.Body)
+
+}
+
+// Create or update a doc.  Updates must carry the current _rev, or else
+// they are rejected with a 409 just like the real thing.
+func (f *fakeSyncGateway) putDoc(w http.ResponseWriter, r *http.Request, docId string) {
+
+	body := map[string]interface{}{}
+	raw, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(raw, &body)
+	}
+	if err != nil {
+		writeFakeSyncGatewayError(w, 400, "bad_request", err.Error())
+		return
+	}
+
+	if len(docId) == 0 {
+		docId, _ = body["_id"].(string)
+	}
+	if len(docId) == 0 {
+		docId = NewUuid()
+	}
+	rev, _ := body["_rev"].(string)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	existing, ok := f.docs[docId]
+	generation := 0
+	if ok && !existing.Deleted {
+		if rev != existing.Rev {
+			writeFakeSyncGatewayError(w, 409, "conflict", "Document update conflict")
+			return
+		}
+		generation = revGeneration(existing.Rev)
+	} else if ok {
+		generation = revGeneration(existing.Rev)
+	}
+
+	f.lastSeq += 1
+	newRev := fmt.Sprintf("%v-%x", generation+1, f.lastSeq)
+	body["_id"] = docId
+	body["_rev"] = newRev
+	f.docs[docId] = &fakeSyncGatewayDoc{
+		Rev:  newRev,
+		Seq:  f.lastSeq,
+		Body: body,
+	}
+	f.notifyChanged()
+
+	writeFakeSyncGatewayJSON(w, 201, map[string]interface{}{"ok": true, "id": docId, "rev": newRev})
+
+}
+
+func (f *fakeSyncGateway) deleteDoc(w http.ResponseWriter, docId, rev string) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	existing, ok := f.docs[docId]
+	if !ok || existing.Deleted {
+		writeFakeSyncGatewayError(w, 404, "not_found", "missing")
+		return
+	}
+	if rev != existing.Rev {
+		writeFakeSyncGatewayError(w, 409, "conflict", "Document update conflict")
+		return
+	}
+
+	f.lastSeq += 1
+	newRev := fmt.Sprintf("%v-%x", revGeneration(existing.Rev)+1, f.lastSeq)
+	f.docs[docId] = &fakeSyncGatewayDoc{
+		Rev:     newRev,
+		Seq:     f.lastSeq,
+		Deleted: true,
+	}
+	f.notifyChanged()
+
+	writeFakeSyncGatewayJSON(w, 200, map[string]interface{}{"ok": true, "id": docId, "rev": newRev})
+
+}
+
+func (f *fakeSyncGateway) allDocs(w http.ResponseWriter, r *http.Request) {
+
+	includeDocs := r.URL.Query().Get("include_docs") == "true"
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	docIds := []string{}
+	for docId, doc := range f.docs {
+		if !doc.Deleted {
+			docIds = append(docIds, docId)
+		}
+	}
+	sort.Strings(docIds)
+
+	rows := []map[string]interface{}{}
+	for _, docId := range docIds {
+		doc := f.docs[docId]
+		row := map[string]interface{}{
+			"id":    docId,
+			"key":   docId,
+			"value": map[string]interface{}{"rev": doc.Rev},
+		}
+		if includeDocs {
+			row["doc"] = doc.Body
+		}
+		rows = append(rows, row)
+	}
+
+	writeFakeSyncGatewayJSON(w, 200, map[string]interface{}{
+		"total_rows": len(rows),
+		"rows":       rows,
+	})
+
+}
+
+// Return every doc changed after the since parameter, ordered by sequence.
+// With feed=longpoll, wait until there is at least one change or the
+// timeout expires.
+func (f *fakeSyncGateway) changes(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	since := 0
+	if len(query.Get("since")) > 0 {
+		sinceFloat, err := strconv.ParseFloat(strings.Trim(query.Get("since"), `"`), 64)
+		if err != nil {
+			writeFakeSyncGatewayError(w, 400, "bad_request", err.Error())
+			return
+		}
+		since = int(sinceFloat)
+	}
+
+	timeout := fakeSyncGatewayLongpollTimeout
+	if len(query.Get("timeout")) > 0 {
+		if millis, err := strconv.Atoi(query.Get("timeout")); err == nil {
+			timeout = time.Duration(millis) * time.Millisecond
+		}
+	}
+	deadline := time.After(timeout)
+
+	for {
+
+		f.mutex.Lock()
+		results := []map[string]interface{}{}
+		for docId, doc := range f.docs {
+			if doc.Seq <= since {
+				continue
+			}
+			result := map[string]interface{}{
+				"seq":     doc.Seq,
+				"id":      docId,
+				"changes": []map[string]interface{}{{"rev": doc.Rev}},
+			}
+			if doc.Deleted {
+				result["deleted"] = true
+			}
+			results = append(results, result)
+		}
+		lastSeq := f.lastSeq
+		changed := f.changed
+		f.mutex.Unlock()
+
+		if len(results) > 0 || query.Get("feed") != "longpoll" {
+			sort.Sort(bySeq(results))
+			writeFakeSyncGatewayJSON(w, 200, map[string]interface{}{
+				"results":  results,
+				"last_seq": lastSeq,
+			})
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			writeFakeSyncGatewayJSON(w, 200, map[string]interface{}{
+				"results":  results,
+				"last_seq": lastSeq,
+			})
+			return
+		case <-f.closed:
+			return
+		}
+
+	}
+
+}
+
+// Wake up any longpoll requests.  Must be called with the mutex held.
+func (f *fakeSyncGateway) notifyChanged() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+type bySeq []map[string]interface{}
+
+func (s bySeq) Len() int           { return len(s) }
+func (s bySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySeq) Less(i, j int) bool { return s[i]["seq"].(int) < s[j]["seq"].(int) }
+
+func copyDocBody(body map[string]interface{}) map[string]interface{} {
+	raw, _ := json.Marshal(body)
+	copied := map[string]interface{}{}
+	json.Unmarshal(raw, &copied)
+	return copied
+}
+
+func writeFakeSyncGatewayJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeFakeSyncGatewayError(w http.ResponseWriter, status int, error, reason string) {
+	writeFakeSyncGatewayJSON(w, status, map[string]interface{}{"error": error, "reason": reason})
+}
@@ -2,8 +2,10 @@ package elasticthought
 
 import (
 	"io"
+	"mime"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/couchbaselabs/logg"
@@ -86,6 +88,100 @@ func (f FileSystemBlobStore) OpenFile(path string) (BlobHandle, error) {
 	return FileSystemBlobHandle{}, nil
 }
 
+func (f FileSystemBlobStore) List(prefix string) ([]BlobInfo, error) {
+
+	blobInfos := []BlobInfo{}
+
+	// walk the deepest directory that contains the prefix, and filter
+	// out any files that don't match the prefix
+	walkRoot := f.absolutePath(prefix)
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, "/") {
+		walkRoot = filepath.Dir(walkRoot)
+	}
+
+	walkFn := func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if path == walkRoot {
+				return err
+			}
+			// the root can be shared with other files (eg, /tmp), so skip
+			// anything that can't be read rather than failing the listing
+			logg.LogTo("ELASTIC_THOUGHT", "Skipping unreadable path: %v.  Err: %v", path, err)
+			if fileInfo != nil && fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fileInfo.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(f.rootPath, path)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if !strings.HasPrefix(relativePath, strings.TrimPrefix(prefix, "/")) {
+			return nil
+		}
+		blobInfo, err := f.statWithoutChecksum(relativePath)
+		if err != nil {
+			logg.LogTo("ELASTIC_THOUGHT", "Skipping unreadable blob: %v.  Err: %v", relativePath, err)
+			return nil
+		}
+		blobInfos = append(blobInfos, blobInfo)
+		return nil
+	}
+
+	if err := filepath.Walk(walkRoot, walkFn); err != nil {
+		return nil, err
+	}
+
+	return blobInfos, nil
+
+}
+
+func (f FileSystemBlobStore) Stat(path string) (BlobInfo, error) {
+
+	blobInfo, err := f.statWithoutChecksum(path)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	checksum, err := sha1File(f.absolutePath(path))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	blobInfo.Checksum = checksum
+
+	return blobInfo, nil
+
+}
+
+// The metadata for a blob without its checksum, which would mean reading the
+// whole file.  Listings use this, since eg gc lists every blob in the store.
+func (f FileSystemBlobStore) statWithoutChecksum(path string) (BlobInfo, error) {
+
+	// stat rather than lstat, so that symlinks are followed, and dangling
+	// ones are an error
+	fileInfo, err := os.Stat(f.absolutePath(path))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	blobInfo := BlobInfo{
+		Path:        strings.TrimPrefix(path, "/"),
+		Size:        fileInfo.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(path)),
+		ModTime:     fileInfo.ModTime(),
+	}
+
+	return blobInfo, nil
+
+}
+
 func (f FileSystemBlobStore) absolutePath(relativePath string) string {
 	return filepath.Join(f.rootPath, relativePath)
 }
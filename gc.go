@@ -0,0 +1,289 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+)
+
+// Blobs and work directories must be at least this old before the garbage
+// collector will delete them, so that it doesn't race with jobs which have
+// uploaded a blob but not yet saved the doc that refers to it.
+const DEFAULT_GC_GRACE_PERIOD = 24 * time.Hour
+
+// Only blobs and work directories named after a doc id that looks like it
+// was generated by Sync Gateway (32 hex digits) or by NewUuid (a dashed
+// uuid) are considered for garbage collection.  This keeps the garbage
+// collector away from unrelated files, since by default the blob store is
+// rooted at /tmp.
+var gcDocIdPattern = regexp.MustCompile(`^([0-9a-f]{32}|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$`)
+
+// The garbage collector deletes blobs that are no longer referenced by any
+// live document, and optionally the local work directories of finished jobs.
+//
+// A blob is considered live if either its cbfs:// url appears anywhere in a
+// live document, or the doc id it's stored under (<doc-id>/<file>) belongs to
+// a live document.
+type GarbageCollector struct {
+	Configuration Configuration
+	GracePeriod   time.Duration
+
+	// Only report what would be deleted, don't actually delete anything
+	DryRun bool
+
+	// Also delete the work directories of jobs that have finished (or
+	// whose docs no longer exist)
+	CleanWorkDirectories bool
+}
+
+// The result of a garbage collection run
+type GCReport struct {
+	DryRun          bool       `json:"dry-run"`
+	OrphanedBlobs   []BlobInfo `json:"orphaned-blobs"`
+	BytesReclaimed  int64      `json:"bytes-reclaimed"`
+	WorkDirectories []string   `json:"work-directories"`
+}
+
+// The fields of a document that the garbage collector cares about
+type gcDoc struct {
+	Id              string
+	ProcessingState *ProcessingState
+
+	// Blob paths (without the cbfs:// prefix) referenced by the doc
+	BlobPaths []string
+}
+
+// Create a new GarbageCollector with the default grace period
+func NewGarbageCollector(c Configuration) *GarbageCollector {
+	return &GarbageCollector{
+		Configuration: c,
+		GracePeriod:   DEFAULT_GC_GRACE_PERIOD,
+	}
+}
+
+// Run a single garbage collection pass
+func (g GarbageCollector) Run() (*GCReport, error) {
+
+	now := time.Now()
+
+	docs, err := g.liveDocs()
+	if err != nil {
+		return nil, err
+	}
+
+	blobStore, err := g.Configuration.NewBlobStoreClient()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := blobStore.List("")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing blobs.  Err: %v", err)
+	}
+
+	report := &GCReport{
+		DryRun:        g.DryRun,
+		OrphanedBlobs: findOrphanedBlobs(docs, blobs, now.Add(-g.GracePeriod)),
+	}
+
+	for _, blob := range report.OrphanedBlobs {
+		report.BytesReclaimed += blob.Size
+		if g.DryRun {
+			logg.LogTo("GC", "Would delete orphaned blob: %v", blob.Path)
+			continue
+		}
+		logg.LogTo("GC", "Deleting orphaned blob: %v", blob.Path)
+		if err := blobStore.Rm(blob.Path); err != nil {
+			return nil, fmt.Errorf("Error deleting blob: %v.  Err: %v", blob.Path, err)
+		}
+	}
+
+	if g.CleanWorkDirectories {
+		workDirs, err := findStaleWorkDirectories(
+			g.Configuration.WorkDirectory,
+			docs,
+			now.Add(-g.GracePeriod),
+		)
+		if err != nil {
+			return nil, err
+		}
+		report.WorkDirectories = workDirs
+		for _, workDir := range workDirs {
+			if g.DryRun {
+				logg.LogTo("GC", "Would delete work directory: %v", workDir)
+				continue
+			}
+			logg.LogTo("GC", "Deleting work directory: %v", workDir)
+			if err := os.RemoveAll(workDir); err != nil {
+				return nil, fmt.Errorf("Error deleting work dir: %v.  Err: %v", workDir, err)
+			}
+		}
+	}
+
+	return report, nil
+
+}
+
+// Get all of the documents in the database
+func (g GarbageCollector) liveDocs() ([]gcDoc, error) {
+
+	rows, err := allDocs(g.Configuration.DbConnection())
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []gcDoc{}
+	for _, row := range rows {
+		doc, err := newGCDoc(row.Id, row.Doc)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding doc: %v.  Err: %v", row.Id, err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+
+}
+
+// Extract the fields the garbage collector needs from a raw json doc
+func newGCDoc(docId string, raw json.RawMessage) (gcDoc, error) {
+
+	doc := gcDoc{Id: docId}
+
+	processable := struct {
+		ProcessingState *ProcessingState `json:"processing-state"`
+	}{}
+	if err := json.Unmarshal(raw, &processable); err != nil {
+		return doc, err
+	}
+	doc.ProcessingState = processable.ProcessingState
+
+	var body interface{}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return doc, err
+	}
+	doc.BlobPaths = findBlobUrls(body)
+
+	return doc, nil
+
+}
+
+// Recursively find all cbfs:// urls in a decoded json value, and return
+// them as blob paths.
+func findBlobUrls(value interface{}) []string {
+
+	blobPaths := []string{}
+
+	switch v := value.(type) {
+	case string:
+		if strings.HasPrefix(v, CBFS_URI_PREFIX) {
+			blobPaths = append(blobPaths, strings.TrimPrefix(v, CBFS_URI_PREFIX))
+		}
+	case []interface{}:
+		for _, item := range v {
+			blobPaths = append(blobPaths, findBlobUrls(item)...)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			blobPaths = append(blobPaths, findBlobUrls(item)...)
+		}
+	}
+
+	return blobPaths
+
+}
+
+// Find the blobs that aren't referenced by any of the given docs and were
+// last modified before the cutoff time.
+func findOrphanedBlobs(docs []gcDoc, blobs []BlobInfo, cutoff time.Time) []BlobInfo {
+
+	liveDocIds := map[string]bool{}
+	referencedPaths := map[string]bool{}
+	for _, doc := range docs {
+		liveDocIds[doc.Id] = true
+		for _, blobPath := range doc.BlobPaths {
+			referencedPaths[blobPath] = true
+		}
+	}
+
+	orphans := []BlobInfo{}
+	for _, blob := range blobs {
+
+		docId, err := blobPathDocId(blob.Path)
+		if err != nil || !gcDocIdPattern.MatchString(docId) {
+			continue
+		}
+
+		if liveDocIds[docId] || referencedPaths[strings.TrimPrefix(blob.Path, "/")] {
+			continue
+		}
+
+		// skip blobs with unknown modification times to be safe
+		if blob.ModTime.IsZero() || blob.ModTime.After(cutoff) {
+			logg.LogTo("GC", "Orphaned blob %v is within grace period", blob.Path)
+			continue
+		}
+
+		orphans = append(orphans, blob)
+
+	}
+
+	sort.Sort(blobInfosByPath(orphans))
+	return orphans
+
+}
+
+// Find the work directories under workDirectory whose job has finished
+// (successfully or not), or whose doc no longer exists.
+func findStaleWorkDirectories(workDirectory string, docs []gcDoc, cutoff time.Time) ([]string, error) {
+
+	docsById := map[string]gcDoc{}
+	for _, doc := range docs {
+		docsById[doc.Id] = doc
+	}
+
+	fileInfos, err := ioutil.ReadDir(workDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("Error reading work dir: %v.  Err: %v", workDirectory, err)
+	}
+
+	staleDirs := []string{}
+	for _, fileInfo := range fileInfos {
+
+		if !fileInfo.IsDir() || !gcDocIdPattern.MatchString(fileInfo.Name()) {
+			continue
+		}
+
+		if fileInfo.ModTime().After(cutoff) {
+			continue
+		}
+
+		doc, ok := docsById[fileInfo.Name()]
+		if ok {
+			if doc.ProcessingState == nil {
+				continue
+			}
+			switch *doc.ProcessingState {
+			case FinishedSuccessfully, Failed:
+			default:
+				continue
+			}
+		}
+
+		staleDirs = append(staleDirs, filepath.Join(workDirectory, fileInfo.Name()))
+
+	}
+
+	return staleDirs, nil
+
+}
@@ -0,0 +1,81 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestFindOrphanedBlobs(t *testing.T) {
+
+	liveDocId := "0b6e1d2b8a4f43b1a5e3e5f1f1e5a001"
+	deletedDocId := "0b6e1d2b8a4f43b1a5e3e5f1f1e5a002"
+	referencedDocId := "0b6e1d2b8a4f43b1a5e3e5f1f1e5a003"
+	uuidDocId := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+	raw := json.RawMessage(`{
+            "_id": "` + liveDocId + `",
+            "type": "dataset",
+            "processing-state": "finished_successfully",
+            "training": {"url": "cbfs://` + referencedDocId + `/training.tar.gz"}
+        }`)
+	doc, err := newGCDoc(liveDocId, raw)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(doc.BlobPaths), 1)
+	assert.Equals(t, *doc.ProcessingState, FinishedSuccessfully)
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	blobs := []BlobInfo{
+		{Path: liveDocId + "/testing.tar.gz", ModTime: old},
+		{Path: referencedDocId + "/training.tar.gz", ModTime: old},
+		{Path: referencedDocId + "/testing.tar.gz", ModTime: old, Size: 10},
+		{Path: deletedDocId + "/stdout", ModTime: old, Size: 5},
+		{Path: deletedDocId + "/stderr", ModTime: now},
+		{Path: uuidDocId + "/trained.caffemodel", ModTime: old},
+		{Path: "not-a-doc-id/stdout", ModTime: old},
+	}
+
+	orphans := findOrphanedBlobs([]gcDoc{doc}, blobs, now.Add(-DEFAULT_GC_GRACE_PERIOD))
+	assert.Equals(t, len(orphans), 3)
+	assert.Equals(t, orphans[0].Path, deletedDocId+"/stdout")
+	assert.Equals(t, orphans[1].Path, referencedDocId+"/testing.tar.gz")
+	assert.Equals(t, orphans[2].Path, uuidDocId+"/trained.caffemodel")
+
+}
+
+func TestFindStaleWorkDirectories(t *testing.T) {
+
+	workDir := filepath.Join(TempDir(), "gc-test")
+	os.RemoveAll(workDir)
+
+	finishedJobId := "0b6e1d2b8a4f43b1a5e3e5f1f1e5a001"
+	processingJobId := "0b6e1d2b8a4f43b1a5e3e5f1f1e5a002"
+	deletedJobId := "0b6e1d2b8a4f43b1a5e3e5f1f1e5a003"
+	for _, dir := range []string{finishedJobId, processingJobId, deletedJobId, "blobs"} {
+		assert.True(t, Mkdir(filepath.Join(workDir, dir)) == nil)
+	}
+
+	finished := FinishedSuccessfully
+	processing := Processing
+	docs := []gcDoc{
+		{Id: finishedJobId, ProcessingState: &finished},
+		{Id: processingJobId, ProcessingState: &processing},
+	}
+
+	staleDirs, err := findStaleWorkDirectories(workDir, docs, time.Now().Add(time.Hour))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(staleDirs), 2)
+	assert.Equals(t, staleDirs[0], filepath.Join(workDir, finishedJobId))
+	assert.Equals(t, staleDirs[1], filepath.Join(workDir, deletedJobId))
+
+	// nothing is old enough with the cutoff in the past
+	staleDirs, err = findStaleWorkDirectories(workDir, docs, time.Now().Add(-time.Hour))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(staleDirs), 0)
+
+}
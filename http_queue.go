@@ -0,0 +1,130 @@
+package elasticthought
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The body of the lease, renew, ack and nack requests of the http pull queue
+type queueLeaseRequest struct {
+	WorkerID     string `json:"worker-id"`
+	TTLSeconds   int    `json:"ttl-seconds,omitempty"`
+	DelaySeconds int    `json:"delay-seconds,omitempty"`
+}
+
+// A QueueBackend on the other end of the REST server's /queue endpoints, so
+// that workers on other machines can lease jobs without running nsq.  The
+// server keeps the jobs in its own QueueBackend, normally a
+// DocumentStoreQueue.  Only the queue goes through the REST server: workers
+// still need access to the document store and blob store to run the jobs.
+type HttpQueue struct {
+	Url    string // the REST server, eg http://host:8080
+	Token  string // must match the server's QueueToken
+	Client *http.Client
+}
+
+func NewHttpQueue(c Configuration) *HttpQueue {
+	return &HttpQueue{
+		Url:    strings.TrimRight(c.QueueUrl, "/"),
+		Token:  c.QueueToken,
+		Client: &http.Client{},
+	}
+}
+
+func (q *HttpQueue) String() string {
+	return q.Url
+}
+
+func (q *HttpQueue) ScheduleJob(jobDescriptor JobDescriptor) error {
+	_, err := q.post("/queue/jobs", jobDescriptor, nil)
+	return err
+}
+
+func (q *HttpQueue) Lease(workerID string, ttl time.Duration) (*QueueEntry, error) {
+	entry := &QueueEntry{}
+	status, err := q.post("/queue/leases", queueLeaseRequest{
+		WorkerID:   workerID,
+		TTLSeconds: durationSeconds(ttl),
+	}, entry)
+	if err != nil || status == 204 {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (q *HttpQueue) Renew(entryID, workerID string, ttl time.Duration) error {
+	_, err := q.post(fmt.Sprintf("/queue/leases/%v/renew", entryID), queueLeaseRequest{
+		WorkerID:   workerID,
+		TTLSeconds: durationSeconds(ttl),
+	}, nil)
+	return err
+}
+
+func (q *HttpQueue) Ack(entryID, workerID string) error {
+	_, err := q.post(fmt.Sprintf("/queue/leases/%v/ack", entryID), queueLeaseRequest{
+		WorkerID: workerID,
+	}, nil)
+	return err
+}
+
+func (q *HttpQueue) Nack(entryID, workerID string, delay time.Duration) error {
+	_, err := q.post(fmt.Sprintf("/queue/leases/%v/nack", entryID), queueLeaseRequest{
+		WorkerID:     workerID,
+		DelaySeconds: durationSeconds(delay),
+	}, nil)
+	return err
+}
+
+// POST body as json to the path, and decode the response into result if it
+// isn't nil.  A 409 means the lease was lost, and is returned as
+// ErrQueueLeaseLost.  Any other non-2xx response is an error.
+func (q *HttpQueue) post(path string, body interface{}, result interface{}) (int, error) {
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", q.Url+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+q.Token)
+
+	resp, err := q.Client.Do(req)
+	if err != nil {
+		return 0, NewTransientError(fmt.Errorf("Error posting to queue: %v.  Err: %v", q.Url+path, err))
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	switch {
+	case resp.StatusCode == 409:
+		return resp.StatusCode, ErrQueueLeaseLost
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return resp.StatusCode, fmt.Errorf("Error posting to queue: %v.  Status: %v Body: %v", q.Url+path, resp.StatusCode, string(respBody))
+	case result != nil && resp.StatusCode != 204:
+		if err := json.Unmarshal(respBody, result); err != nil {
+			return resp.StatusCode, fmt.Errorf("Error decoding queue response: %v.  Err: %v", string(respBody), err)
+		}
+	}
+
+	return resp.StatusCode, nil
+
+}
+
+// Durations are sent over the wire in whole seconds, rounded up so that a
+// short lease doesn't become no lease at all
+func durationSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,91 @@
+package elasticthought
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+
+	"github.com/couchbaselabs/logg"
+)
+
+// The commands (eg, caffe) currently being run by jobs in this process,
+// keyed by the job doc id, so that they can be killed if the job is cancelled.
+var runningJobCmds = struct {
+	sync.Mutex
+	cmds map[string]*exec.Cmd
+}{cmds: map[string]*exec.Cmd{}}
+
+// Run a command on behalf of a job via runCmdTeeStdio, and keep track of it
+// while it's running so that CancelJob can kill it.
+func runJobCmdTeeStdio(jobId string, cmd *exec.Cmd, stdOutPath, stdErrPath string) error {
+
+	runningJobCmds.Lock()
+	runningJobCmds.cmds[jobId] = cmd
+	runningJobCmds.Unlock()
+
+	defer func() {
+		runningJobCmds.Lock()
+		delete(runningJobCmds.cmds, jobId)
+		runningJobCmds.Unlock()
+	}()
+
+	return runCmdTeeStdio(cmd, stdOutPath, stdErrPath)
+
+}
+
+// Kill the command being run by the given job, if the job is running in
+// this process.  Returns true if a command was killed.
+func killJobCmd(jobId string) bool {
+
+	runningJobCmds.Lock()
+	defer runningJobCmds.Unlock()
+
+	cmd, ok := runningJobCmds.cmds[jobId]
+	if !ok || cmd.Process == nil {
+		return false
+	}
+
+	if err := cmd.Process.Kill(); err != nil {
+		logg.LogTo("JOB_SCHEDULER", "Error killing cmd for job %v: %v", jobId, err)
+		return false
+	}
+	return true
+
+}
+
+// Cancel a job which is being processed.  If the job is running in this
+// process its command is killed, and in any case the job doc is marked as
+// failed.  Jobs running in other processes will only notice the
+// cancellation when they try to update their doc.
+func CancelJob(config Configuration, docId string) error {
+
+	job, err := FindJobDoc(config, docId)
+	if err != nil {
+		return err
+	}
+
+	executor, err := config.NewExecutor()
+	if err != nil {
+		return err
+	}
+
+	if executor.Kill(docId) {
+		logg.LogTo("JOB_SCHEDULER", "Killed running cmd for job: %v", docId)
+	}
+
+	return job.Failed(config.DbConnection(), fmt.Errorf("Cancelled"))
+
+}
+
+// Kill the command being run by the given job, if it's running in this
+// process, because its worker no longer holds the lease on it
+func killJobWithLostLease(config Configuration, docId string) {
+	executor, err := config.NewExecutor()
+	if err != nil {
+		logg.LogTo("JOB_SCHEDULER", "Error killing job %v after losing its lease: %v", docId, err)
+		return
+	}
+	if executor.Kill(docId) {
+		logg.LogTo("JOB_SCHEDULER", "Killed running cmd for job %v after losing its lease", docId)
+	}
+}
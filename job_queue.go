@@ -0,0 +1,491 @@
+package elasticthought
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+)
+
+// How long a job is assumed to take until a job of the same type has been
+// seen to finish
+const DEFAULT_JOB_DURATION_ESTIMATE = 5 * time.Minute
+
+// How long to wait before handing off a job again after the downstream
+// scheduler failed to take it
+const DEFAULT_HANDOFF_RETRY_INTERVAL = 10 * time.Second
+
+// Schedulers which need to know when jobs change state, eg to know when a
+// job they handed off has finished.  The changes listener calls these for
+// every job doc change it sees.
+type JobStateObserver interface {
+	JobStateChanged(docId string, state ProcessingState)
+	JobDeleted(docId string)
+}
+
+// A priority queue which sits in front of another JobScheduler (in process
+// or nsq), and only hands jobs off to it when there is room for them, so that
+// the order in which jobs run can be decided here.
+//
+// Users are interleaved using weighted fair queueing: the next job handed off
+// belongs to whichever user with queued jobs has had the least jobs handed off
+// relative to their weight.  A user's own jobs are handed off in order of
+// their priority field (highest first), then in the order they were queued.
+type PriorityJobScheduler struct {
+	Configuration Configuration
+	Downstream    JobScheduler
+	Clock         Clock
+
+	// How many jobs of each type can be handed off to the downstream
+	// scheduler and not yet finished.  Job types without a limit are
+	// handed off right away.
+	InFlightLimits map[string]int
+
+	// How many jobs a user gets for every one job of a user with weight 1.
+	// Users without a weight have weight 1.
+	UserWeights map[string]int
+
+	// How long to wait before handing off a job again after the downstream
+	// scheduler failed to take it
+	RetryInterval time.Duration
+
+	mutex    sync.Mutex
+	queued   []*QueuedJob
+	inFlight map[string]*inFlightJob
+	served   map[string]float64
+
+	// Average duration of each job type
+	durations map[string]time.Duration
+}
+
+// A job waiting in the priority queue
+type QueuedJob struct {
+	DocId    string    `json:"doc-id"`
+	Type     string    `json:"type"`
+	UserID   string    `json:"user-id"`
+	Priority int       `json:"priority"`
+	Queued   time.Time `json:"queued"`
+
+	// When the job can next be handed off, if handing it off failed or it's
+	// backing off after a transient failure
+	retryAt time.Time
+}
+
+type inFlightJob struct {
+	QueuedJob
+	started time.Time // zero until the job is seen in the Processing state
+}
+
+// Where a job is in the priority queue, as returned by the queue endpoint
+type QueuePosition struct {
+	QueuedJob
+	Position       int       `json:"position"`
+	EstimatedStart time.Time `json:"estimated-start"`
+}
+
+func NewPriorityJobScheduler(c Configuration, downstream JobScheduler) *PriorityJobScheduler {
+	return &PriorityJobScheduler{
+		Configuration:  c,
+		Downstream:     downstream,
+		Clock:          systemClock{},
+		InFlightLimits: c.SchedulerInFlightLimits,
+		UserWeights:    map[string]int{},
+		RetryInterval:  DEFAULT_HANDOFF_RETRY_INTERVAL,
+	}
+}
+
+// Add a job to the queue.  It will be handed off to the downstream scheduler
+// as soon as it's the job's turn and there is room for it.
+func (p *PriorityJobScheduler) ScheduleJob(jobDescriptor JobDescriptor) error {
+
+	doc := struct {
+		ElasticThoughtDoc
+		UserID   string   `json:"user-id"`
+		Priority int      `json:"priority"`
+		Lease    JobLease `json:"lease"`
+	}{}
+	db := p.Configuration.DbConnection()
+	if err := db.Retrieve(jobDescriptor.DocIdToProcess, &doc); err != nil {
+		return fmt.Errorf("Didn't retrieve: %v - %v", jobDescriptor.DocIdToProcess, err)
+	}
+
+	p.enqueue(QueuedJob{
+		DocId:    doc.Id,
+		Type:     doc.Type,
+		UserID:   doc.UserID,
+		Priority: doc.Priority,
+		Queued:   p.Clock.Now(),
+		retryAt:  doc.Lease.NotBefore,
+	})
+
+	return nil
+
+}
+
+func (p *PriorityJobScheduler) enqueue(job QueuedJob) {
+
+	defer p.dispatch()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.init()
+
+	// the same pending doc can be seen more than once, eg on the changes
+	// feed and by the startup sweep
+	if _, ok := p.inFlight[job.DocId]; ok {
+		return
+	}
+	for _, queuedJob := range p.queued {
+		if queuedJob.DocId == job.DocId {
+			return
+		}
+	}
+
+	// a user who had nothing queued starts level with the other users,
+	// rather than getting credit for the time they were idle
+	if !p.hasQueuedJobs(job.UserID) {
+		if least, ok := p.leastServed(); ok && least > p.served[job.UserID] {
+			p.served[job.UserID] = least
+		}
+	}
+
+	p.queued = append(p.queued, &job)
+	logg.LogTo("JOB_SCHEDULER", "Queued %v %v for user %v", job.Type, job.DocId, job.UserID)
+
+	if wait := job.retryAt.Sub(p.Clock.Now()); wait > 0 {
+		p.dispatchAfter(wait)
+	}
+
+}
+
+// Keep track of jobs which have been handed off, and free up their slot once
+// they have finished (successfully or not).  If a job goes back to Pending,
+// eg because it's being retried, it will be queued again by ScheduleJob.
+func (p *PriorityJobScheduler) JobStateChanged(docId string, state ProcessingState) {
+
+	defer p.dispatch()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.init()
+
+	job, ok := p.inFlight[docId]
+	if !ok {
+		return
+	}
+
+	switch state {
+	case Processing:
+		if job.started.IsZero() {
+			job.started = p.Clock.Now()
+		}
+		return
+	case Pending:
+		// not picked up by a worker yet
+		if job.started.IsZero() {
+			return
+		}
+	}
+
+	p.finished(job)
+
+}
+
+func (p *PriorityJobScheduler) JobDeleted(docId string) {
+
+	defer p.dispatch()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.init()
+
+	if job, ok := p.inFlight[docId]; ok {
+		p.finished(job)
+		return
+	}
+
+	for i, queuedJob := range p.queued {
+		if queuedJob.DocId == docId {
+			p.queued = append(p.queued[:i], p.queued[i+1:]...)
+			return
+		}
+	}
+
+}
+
+// The queued jobs in the order they will be handed off, assuming no more
+// jobs are queued, along with estimated start times.
+func (p *PriorityJobScheduler) Positions() []QueuePosition {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.init()
+
+	now := p.Clock.Now()
+
+	// when each in flight slot of each job type is expected to free up
+	slotsFree := map[string][]time.Time{}
+	for _, job := range p.inFlight {
+		started := job.started
+		if started.IsZero() {
+			started = now
+		}
+		finish := started.Add(p.estimatedDuration(job.Type))
+		if finish.Before(now) {
+			finish = now
+		}
+		slotsFree[job.Type] = append(slotsFree[job.Type], finish)
+	}
+
+	queued := append([]*QueuedJob{}, p.queued...)
+	served := map[string]float64{}
+	for userID, userServed := range p.served {
+		served[userID] = userServed
+	}
+
+	positions := []QueuePosition{}
+	for len(queued) > 0 {
+
+		i := p.pick(queued, served, func(*QueuedJob) bool { return true })
+		job := queued[i]
+		queued = append(queued[:i], queued[i+1:]...)
+		served[job.UserID] += 1 / float64(p.weight(job.UserID))
+
+		// start in the earliest free slot, or straight away if there is
+		// still an unused slot
+		start := now
+		if limit := p.InFlightLimits[job.Type]; limit > 0 {
+			slots := slotsFree[job.Type]
+			if len(slots) >= limit {
+				earliest := 0
+				for j, slotFree := range slots {
+					if slotFree.Before(slots[earliest]) {
+						earliest = j
+					}
+				}
+				start = slots[earliest]
+				slots = append(slots[:earliest], slots[earliest+1:]...)
+			}
+			slotsFree[job.Type] = append(slots, start.Add(p.estimatedDuration(job.Type)))
+		}
+
+		positions = append(positions, QueuePosition{
+			QueuedJob:      *job,
+			Position:       len(positions) + 1,
+			EstimatedStart: start,
+		})
+
+	}
+
+	return positions
+
+}
+
+// Must be called with the mutex held
+func (p *PriorityJobScheduler) init() {
+	if p.inFlight == nil {
+		p.inFlight = map[string]*inFlightJob{}
+		p.served = map[string]float64{}
+		p.durations = map[string]time.Duration{}
+	}
+}
+
+// Hand off as many queued jobs as there is room for.  Must be called
+// without the mutex held, since the downstream scheduler can block (eg, on a
+// slow nsqd).  Jobs it fails to take are queued again and retried after
+// RetryInterval, rather than waiting for the next startup sweep.
+func (p *PriorityJobScheduler) dispatch() {
+
+	for _, job := range p.takeDispatchable() {
+
+		logg.LogTo("JOB_SCHEDULER", "Handing off %v %v for user %v", job.Type, job.DocId, job.UserID)
+
+		if err := p.Downstream.ScheduleJob(*NewJobDescriptor(job.DocId)); err != nil {
+			logg.LogTo("JOB_SCHEDULER", "Error scheduling %v, retrying in %v: %v", job.DocId, p.RetryInterval, err)
+			p.requeue(job)
+		}
+
+	}
+
+}
+
+// Move the jobs there is room for from the queue to in flight, in the order
+// they should be handed off
+func (p *PriorityJobScheduler) takeDispatchable() []*inFlightJob {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.init()
+
+	now := p.Clock.Now()
+	dispatchable := func(job *QueuedJob) bool {
+		return !job.retryAt.After(now) && p.hasRoomFor(job)
+	}
+
+	jobs := []*inFlightJob{}
+	for {
+		i := p.pick(p.queued, p.served, dispatchable)
+		if i < 0 {
+			return jobs
+		}
+		job := p.queued[i]
+		p.queued = append(p.queued[:i], p.queued[i+1:]...)
+		p.served[job.UserID] += 1 / float64(p.weight(job.UserID))
+
+		inFlight := &inFlightJob{QueuedJob: *job}
+		p.inFlight[job.DocId] = inFlight
+		jobs = append(jobs, inFlight)
+	}
+
+}
+
+// Put a job that the downstream scheduler failed to take back in the queue,
+// and try again once the retry interval is up
+func (p *PriorityJobScheduler) requeue(job *inFlightJob) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// leave it be if it's been deleted or finished in the meantime
+	if p.inFlight[job.DocId] != job {
+		return
+	}
+	delete(p.inFlight, job.DocId)
+	p.served[job.UserID] -= 1 / float64(p.weight(job.UserID))
+
+	// back in its original place, so that it keeps its turn
+	queuedJob := job.QueuedJob
+	queuedJob.retryAt = p.Clock.Now().Add(p.RetryInterval)
+	i := 0
+	for i < len(p.queued) && !p.queued[i].Queued.After(queuedJob.Queued) {
+		i++
+	}
+	p.queued = append(p.queued[:i], append([]*QueuedJob{&queuedJob}, p.queued[i:]...)...)
+
+	p.dispatchAfter(p.RetryInterval)
+
+}
+
+// Hand off jobs again once the delay is up, for jobs that can't be handed
+// off until then
+func (p *PriorityJobScheduler) dispatchAfter(delay time.Duration) {
+	go func() {
+		<-p.Clock.After(delay)
+		p.dispatch()
+	}()
+}
+
+// Choose the next job to hand off among those that are eligible, returning
+// its index in queued, or -1 if none are eligible.
+func (p *PriorityJobScheduler) pick(queued []*QueuedJob, served map[string]float64, eligible func(*QueuedJob) bool) int {
+
+	// the best job of each user
+	best := map[string]int{}
+	for i, job := range queued {
+		if !eligible(job) {
+			continue
+		}
+		j, ok := best[job.UserID]
+		if !ok || job.Priority > queued[j].Priority {
+			best[job.UserID] = i
+		}
+	}
+
+	// the user who has been served least, breaking ties in favor of the
+	// user whose best job was queued first
+	chosen := -1
+	for _, i := range best {
+		if chosen < 0 {
+			chosen = i
+			continue
+		}
+		job, chosenJob := queued[i], queued[chosen]
+		if served[job.UserID] < served[chosenJob.UserID] ||
+			served[job.UserID] == served[chosenJob.UserID] && i < chosen {
+			chosen = i
+		}
+	}
+
+	return chosen
+
+}
+
+// Must be called with the mutex held
+func (p *PriorityJobScheduler) hasRoomFor(job *QueuedJob) bool {
+
+	inFlight, userInFlight := 0, 0
+	for _, inFlightJob := range p.inFlight {
+		if inFlightJob.Type == job.Type {
+			inFlight += 1
+			if inFlightJob.UserID == job.UserID {
+				userInFlight += 1
+			}
+		}
+	}
+
+	if limit := p.InFlightLimits[job.Type]; limit > 0 && inFlight >= limit {
+		return false
+	}
+
+	// users over their concurrent training job quota have to wait for one
+	// of their running jobs to finish
+	if job.Type == DOC_TYPE_TRAINING_JOB {
+		limit := p.Configuration.QuotaFor(job.UserID).MaxConcurrentTrainingJobs
+		if limit > 0 && userInFlight >= limit {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// Must be called with the mutex held
+func (p *PriorityJobScheduler) finished(job *inFlightJob) {
+
+	delete(p.inFlight, job.DocId)
+
+	if !job.started.IsZero() {
+		duration := p.Clock.Now().Sub(job.started)
+		if average, ok := p.durations[job.Type]; ok {
+			duration = (3*average + duration) / 4
+		}
+		p.durations[job.Type] = duration
+	}
+
+}
+
+func (p *PriorityJobScheduler) estimatedDuration(jobType string) time.Duration {
+	if duration, ok := p.durations[jobType]; ok {
+		return duration
+	}
+	return DEFAULT_JOB_DURATION_ESTIMATE
+}
+
+func (p *PriorityJobScheduler) weight(userID string) int {
+	if weight := p.UserWeights[userID]; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+func (p *PriorityJobScheduler) hasQueuedJobs(userID string) bool {
+	for _, job := range p.queued {
+		if job.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// The least any user with queued jobs has been served
+func (p *PriorityJobScheduler) leastServed() (float64, bool) {
+	least, found := 0.0, false
+	for _, job := range p.queued {
+		if served := p.served[job.UserID]; !found || served < least {
+			least, found = served, true
+		}
+	}
+	return least, found
+}
@@ -0,0 +1,234 @@
+package elasticthought
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// A job scheduler which just records the jobs handed to it, or fails with
+// err if it's set
+type recordingJobScheduler struct {
+	mutex     sync.Mutex
+	scheduled []string
+	err       error
+}
+
+func (r *recordingJobScheduler) ScheduleJob(jobDescriptor JobDescriptor) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.scheduled = append(r.scheduled, jobDescriptor.DocIdToProcess)
+	return nil
+}
+
+func (r *recordingJobScheduler) setErr(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.err = err
+}
+
+func (r *recordingJobScheduler) numScheduled() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.scheduled)
+}
+
+func newTestPriorityJobScheduler(clock Clock) (*PriorityJobScheduler, *recordingJobScheduler) {
+	downstream := &recordingJobScheduler{}
+	scheduler := &PriorityJobScheduler{
+		Downstream:     downstream,
+		Clock:          clock,
+		InFlightLimits: map[string]int{DOC_TYPE_TRAINING_JOB: 1},
+		UserWeights:    map[string]int{},
+		RetryInterval:  DEFAULT_HANDOFF_RETRY_INTERVAL,
+	}
+	return scheduler, downstream
+}
+
+func queueTrainingJob(scheduler *PriorityJobScheduler, docId, userID string, priority int) {
+	scheduler.enqueue(QueuedJob{
+		DocId:    docId,
+		Type:     DOC_TYPE_TRAINING_JOB,
+		UserID:   userID,
+		Priority: priority,
+		Queued:   scheduler.Clock.Now(),
+	})
+}
+
+// Simulate a worker running the job to completion
+func finishJob(scheduler *PriorityJobScheduler, docId string) {
+	scheduler.JobStateChanged(docId, Processing)
+	scheduler.JobStateChanged(docId, FinishedSuccessfully)
+}
+
+func TestPriorityJobSchedulerFairness(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+	scheduler, downstream := newTestPriorityJobScheduler(clock)
+
+	for _, docId := range []string{"a1", "a2", "a3", "a4", "a5"} {
+		queueTrainingJob(scheduler, docId, "user:a", 0)
+	}
+	for _, docId := range []string{"b1", "b2"} {
+		queueTrainingJob(scheduler, docId, "user:b", 0)
+	}
+
+	// only one training job at a time is handed off
+	assert.DeepEquals(t, downstream.scheduled, []string{"a1"})
+
+	for i := 0; i < 6; i++ {
+		finishJob(scheduler, downstream.scheduled[len(downstream.scheduled)-1])
+	}
+
+	// user b doesn't have to wait for all of user a's jobs
+	assert.DeepEquals(t, downstream.scheduled, []string{"a1", "a2", "b1", "a3", "b2", "a4", "a5"})
+
+}
+
+func TestPriorityJobSchedulerPriorityAndWeights(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+	scheduler, downstream := newTestPriorityJobScheduler(clock)
+	scheduler.UserWeights["user:a"] = 2
+
+	queueTrainingJob(scheduler, "running", "user:c", 0)
+	queueTrainingJob(scheduler, "a-low", "user:a", 0)
+	queueTrainingJob(scheduler, "a-high", "user:a", 5)
+	queueTrainingJob(scheduler, "a-mid", "user:a", 1)
+	queueTrainingJob(scheduler, "b1", "user:b", 0)
+	queueTrainingJob(scheduler, "b2", "user:b", 0)
+
+	// a pending doc seen again isn't queued twice
+	queueTrainingJob(scheduler, "b1", "user:b", 0)
+
+	for i := 0; i < 5; i++ {
+		finishJob(scheduler, downstream.scheduled[len(downstream.scheduled)-1])
+	}
+
+	// user a gets two jobs for each of user b's, highest priority first
+	assert.DeepEquals(t, downstream.scheduled, []string{"running", "a-high", "b1", "a-mid", "a-low", "b2"})
+
+}
+
+func TestPriorityJobSchedulerJobStates(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+	scheduler, downstream := newTestPriorityJobScheduler(clock)
+
+	queueTrainingJob(scheduler, "t1", "user:a", 0)
+	queueTrainingJob(scheduler, "t2", "user:a", 0)
+	queueTrainingJob(scheduler, "t3", "user:a", 0)
+
+	// still pending, since no worker has picked it up yet
+	scheduler.JobStateChanged("t1", Pending)
+	assert.DeepEquals(t, downstream.scheduled, []string{"t1"})
+
+	// a job that fails and goes back to pending frees up its slot
+	scheduler.JobStateChanged("t1", Processing)
+	scheduler.JobStateChanged("t1", Pending)
+	assert.DeepEquals(t, downstream.scheduled, []string{"t1", "t2"})
+
+	// deleting a job frees up its slot too
+	scheduler.JobDeleted("t2")
+	assert.DeepEquals(t, downstream.scheduled, []string{"t1", "t2", "t3"})
+
+	// deleted queued jobs are dropped from the queue
+	queueTrainingJob(scheduler, "t4", "user:a", 0)
+	scheduler.JobDeleted("t4")
+	assert.Equals(t, len(scheduler.Positions()), 0)
+
+}
+
+func TestPriorityJobSchedulerRetriesHandOff(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+	scheduler, downstream := newTestPriorityJobScheduler(clock)
+
+	// the job goes back in the queue rather than being dropped, and doesn't
+	// hold up the in flight slot
+	downstream.setErr(errors.New("nsqd is down"))
+	queueTrainingJob(scheduler, "t1", "user:a", 0)
+	assert.Equals(t, downstream.numScheduled(), 0)
+	positions := scheduler.Positions()
+	assert.Equals(t, len(positions), 1)
+	assert.Equals(t, positions[0].DocId, "t1")
+
+	// and it's handed off again once the retry interval is up
+	waitForClockWaiter(t, clock)
+	downstream.setErr(nil)
+	clock.Advance(DEFAULT_HANDOFF_RETRY_INTERVAL)
+	for i := 0; i < 1000 && downstream.numScheduled() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.DeepEquals(t, downstream.scheduled, []string{"t1"})
+	assert.Equals(t, len(scheduler.Positions()), 0)
+
+}
+
+func TestPriorityJobSchedulerBackoff(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+	scheduler, downstream := newTestPriorityJobScheduler(clock)
+
+	// a job backing off after a transient failure waits in the queue,
+	// without holding up the jobs behind it
+	scheduler.enqueue(QueuedJob{
+		DocId:   "retried",
+		Type:    DOC_TYPE_TRAINING_JOB,
+		UserID:  "user:a",
+		Queued:  clock.Now(),
+		retryAt: clock.Now().Add(time.Minute),
+	})
+	queueTrainingJob(scheduler, "t1", "user:a", 0)
+	assert.DeepEquals(t, downstream.scheduled, []string{"t1"})
+	finishJob(scheduler, "t1")
+	assert.Equals(t, downstream.numScheduled(), 1)
+
+	// and it's handed off once the backoff is up
+	waitForClockWaiter(t, clock)
+	clock.Advance(time.Minute)
+	for i := 0; i < 1000 && downstream.numScheduled() == 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.DeepEquals(t, downstream.scheduled, []string{"t1", "retried"})
+
+}
+
+func TestPriorityJobSchedulerPositions(t *testing.T) {
+
+	now := time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	scheduler, _ := newTestPriorityJobScheduler(clock)
+
+	// a previous job took 10 minutes, so that's the estimate from now on
+	queueTrainingJob(scheduler, "t0", "user:a", 0)
+	scheduler.JobStateChanged("t0", Processing)
+	clock.Advance(10 * time.Minute)
+	scheduler.JobStateChanged("t0", FinishedSuccessfully)
+	now = clock.Now()
+
+	queueTrainingJob(scheduler, "a1", "user:a", 0)
+	scheduler.JobStateChanged("a1", Processing)
+	queueTrainingJob(scheduler, "a2", "user:a", 0)
+	queueTrainingJob(scheduler, "b1", "user:b", 0)
+	clock.Advance(4 * time.Minute)
+
+	positions := scheduler.Positions()
+	assert.Equals(t, len(positions), 2)
+
+	// a1 is expected to finish 10 minutes after it started
+	assert.Equals(t, positions[0].DocId, "a2")
+	assert.Equals(t, positions[0].Position, 1)
+	assert.Equals(t, positions[0].EstimatedStart, now.Add(10*time.Minute))
+
+	assert.Equals(t, positions[1].DocId, "b1")
+	assert.Equals(t, positions[1].Position, 2)
+	assert.Equals(t, positions[1].EstimatedStart, now.Add(20*time.Minute))
+
+}
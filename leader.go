@@ -0,0 +1,179 @@
+package elasticthought
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+	"github.com/dustin/httputil"
+)
+
+// How long the leader's lease lasts unless it is renewed
+const DEFAULT_LEADER_LEASE_TTL = 30 * time.Second
+
+// The lease doc which records which REST server is currently the leader,
+// ie, the one following the changes feed and scheduling jobs.
+type LeaderLease struct {
+	ElasticThoughtDoc
+	LeaderID string    `json:"leader-id"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// The subset of DocumentStore needed for leader election, so that it can
+// be run against a stand-in database in tests.
+type LeaseDatabase interface {
+	Retrieve(id string, doc interface{}) error
+	InsertWith(doc interface{}, id string) (string, string, error)
+	Edit(doc interface{}) (string, error)
+}
+
+// Elects a single leader among several REST servers sharing a database.  Each
+// server campaigns periodically, which renews the lease doc if it is already
+// the leader, or takes it over if the current leader has stopped renewing it.
+// Since the lease doc is updated with CAS, only one server can win.
+type LeaderElector struct {
+	Database    LeaseDatabase
+	CandidateID string
+	Clock       Clock
+	TTL         time.Duration
+
+	mutex   sync.Mutex
+	running bool
+
+	// When the lease this candidate last acquired or renewed runs out
+	deadline time.Time
+}
+
+func NewLeaderElector(c Configuration) *LeaderElector {
+	return &LeaderElector{
+		Database:    c.DbConnection(),
+		CandidateID: DefaultWorkerID(),
+		Clock:       systemClock{},
+		TTL:         DEFAULT_LEADER_LEASE_TTL,
+	}
+}
+
+// Is this candidate currently the leader?  This goes by the deadline of the
+// last lease it got, rather than whether its last campaign succeeded, so that
+// a process which stalls stops being the leader once another could take over.
+func (l *LeaderElector) IsLeader() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.Clock.Now().Before(l.deadline)
+}
+
+// Campaign forever, and call run in a new goroutine whenever this candidate
+// becomes the leader.  run should return soon after IsLeader returns false.
+func (l *LeaderElector) RunWhileLeader(run func()) {
+	for {
+		l.campaign(run)
+		<-l.Clock.After(l.TTL / 3)
+	}
+}
+
+func (l *LeaderElector) campaign(run func()) {
+
+	// the lease's deadline is at least this far from when it was acquired
+	deadline := l.Clock.Now().Add(l.TTL)
+
+	held, err := l.TryAcquire()
+	if err != nil {
+		logg.LogTo("CHANGES", "Error campaigning for leader: %v", err)
+		held = false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if wasLeader := l.Clock.Now().Before(l.deadline); held != wasLeader {
+		logg.LogTo("CHANGES", "%v leader: %v", l.CandidateID, held)
+	}
+	if held {
+		l.deadline = deadline
+	} else {
+		l.deadline = time.Time{}
+	}
+
+	if held && !l.running {
+		l.running = true
+		go func() {
+			run()
+			l.mutex.Lock()
+			l.running = false
+			l.mutex.Unlock()
+		}()
+	}
+
+}
+
+// Try to become the leader, or stay the leader.  Returns true if this
+// candidate holds the lease.
+func (l *LeaderElector) TryAcquire() (bool, error) {
+
+	now := l.Clock.Now()
+
+	lease := &LeaderLease{}
+	if err := l.Database.Retrieve(LEADER_LEASE_DOC_ID, lease); err != nil {
+
+		// no lease doc yet, try to create one
+		lease = &LeaderLease{
+			ElasticThoughtDoc: ElasticThoughtDoc{Type: DOC_TYPE_LEADER_LEASE},
+			LeaderID:          l.CandidateID,
+			Deadline:          now.Add(l.TTL),
+		}
+		_, _, err := l.Database.InsertWith(lease, LEADER_LEASE_DOC_ID)
+		if err != nil {
+			if httputil.IsHTTPStatus(err, 409) {
+				// someone else beat us to it
+				return false, nil
+			}
+			return false, fmt.Errorf("Error creating leader lease.  Err: %v", err)
+		}
+		return true, nil
+
+	}
+
+	if lease.LeaderID != l.CandidateID && now.Before(lease.Deadline) {
+		return false, nil
+	}
+
+	if lease.LeaderID != l.CandidateID {
+		logg.LogTo("CHANGES", "Lease held by %v expired at %v, taking over", lease.LeaderID, lease.Deadline)
+	}
+
+	lease.LeaderID = l.CandidateID
+	lease.Deadline = now.Add(l.TTL)
+	if _, err := l.Database.Edit(lease); err != nil {
+		if httputil.IsHTTPStatus(err, 409) {
+			// someone else renewed or took over the lease in the meantime
+			return false, nil
+		}
+		return false, fmt.Errorf("Error updating leader lease.  Err: %v", err)
+	}
+
+	return true, nil
+
+}
+
+// Give up the lease if this candidate holds it, so that another candidate
+// can take over right away rather than waiting for it to expire.
+func (l *LeaderElector) Release() error {
+
+	l.mutex.Lock()
+	l.deadline = time.Time{}
+	l.mutex.Unlock()
+
+	lease := &LeaderLease{}
+	if err := l.Database.Retrieve(LEADER_LEASE_DOC_ID, lease); err != nil {
+		return err
+	}
+	if lease.LeaderID != l.CandidateID {
+		return nil
+	}
+
+	lease.Deadline = time.Time{}
+	_, err := l.Database.Edit(lease)
+	return err
+
+}
@@ -0,0 +1,226 @@
+package elasticthought
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+	"github.com/dustin/httputil"
+)
+
+// An in-memory stand-in for the database which does revision checking like
+// Sync Gateway, so that several electors can compete for the lease.
+type leaseTestDatabase struct {
+	mutex sync.Mutex
+	docs  map[string][]byte
+	revs  map[string]int
+}
+
+func newLeaseTestDatabase() *leaseTestDatabase {
+	return &leaseTestDatabase{
+		docs: map[string][]byte{},
+		revs: map[string]int{},
+	}
+}
+
+func (d *leaseTestDatabase) conflict(id string) error {
+	response := &http.Response{
+		StatusCode: 409,
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
+	}
+	return httputil.HTTPErrorf(response, "Document update conflict: %v", id)
+}
+
+func (d *leaseTestDatabase) Retrieve(id string, doc interface{}) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	raw, ok := d.docs[id]
+	if !ok {
+		return fmt.Errorf("missing: %v", id)
+	}
+	return json.Unmarshal(raw, doc)
+}
+
+func (d *leaseTestDatabase) InsertWith(doc interface{}, id string) (string, string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.docs[id]; ok {
+		return "", "", d.conflict(id)
+	}
+	rev, err := d.store(id, doc)
+	return id, rev, err
+}
+
+func (d *leaseTestDatabase) Edit(doc interface{}) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	meta := ElasticThoughtDoc{}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return "", err
+	}
+	if meta.Revision != fmt.Sprintf("%d", d.revs[meta.Id]) {
+		return "", d.conflict(meta.Id)
+	}
+	return d.store(meta.Id, doc)
+}
+
+func (d *leaseTestDatabase) store(id string, doc interface{}) (string, error) {
+	fields := map[string]interface{}{}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return "", err
+	}
+	d.revs[id] += 1
+	rev := fmt.Sprintf("%d", d.revs[id])
+	fields["_id"] = id
+	fields["_rev"] = rev
+	if d.docs[id], err = json.Marshal(fields); err != nil {
+		return "", err
+	}
+	return rev, nil
+}
+
+func newTestLeaderElector(db LeaseDatabase, clock Clock, candidateID string) *LeaderElector {
+	return &LeaderElector{
+		Database:    db,
+		CandidateID: candidateID,
+		Clock:       clock,
+		TTL:         time.Minute,
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+
+	db := newLeaseTestDatabase()
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+
+	electors := []*LeaderElector{
+		newTestLeaderElector(db, clock, "a"),
+		newTestLeaderElector(db, clock, "b"),
+		newTestLeaderElector(db, clock, "c"),
+	}
+
+	// the first to campaign wins, the others lose
+	for i, elector := range electors {
+		held, err := elector.TryAcquire()
+		assert.True(t, err == nil)
+		assert.Equals(t, held, i == 0)
+	}
+
+	// the leader can renew its lease, and keeps it after the original ttl
+	clock.Advance(45 * time.Second)
+	held, err := electors[0].TryAcquire()
+	assert.True(t, err == nil)
+	assert.True(t, held)
+	clock.Advance(45 * time.Second)
+	held, err = electors[1].TryAcquire()
+	assert.True(t, err == nil)
+	assert.False(t, held)
+
+	// once the leader stops renewing, another candidate takes over
+	clock.Advance(time.Minute)
+	held, err = electors[1].TryAcquire()
+	assert.True(t, err == nil)
+	assert.True(t, held)
+	held, err = electors[0].TryAcquire()
+	assert.True(t, err == nil)
+	assert.False(t, held)
+
+	// after releasing the lease, another candidate can take over right away
+	assert.True(t, electors[1].Release() == nil)
+	held, err = electors[2].TryAcquire()
+	assert.True(t, err == nil)
+	assert.True(t, held)
+
+	lease := LeaderLease{}
+	assert.True(t, db.Retrieve(LEADER_LEASE_DOC_ID, &lease) == nil)
+	assert.Equals(t, lease.LeaderID, "c")
+	assert.Equals(t, lease.Type, DOC_TYPE_LEADER_LEASE)
+
+}
+
+func TestLeaderElectionConcurrent(t *testing.T) {
+
+	db := newLeaseTestDatabase()
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+
+	results := make(chan bool, 10)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			elector := newTestLeaderElector(db, clock, fmt.Sprintf("candidate-%d", i))
+			held, err := elector.TryAcquire()
+			assert.True(t, err == nil)
+			results <- held
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	leaders := 0
+	for held := range results {
+		if held {
+			leaders += 1
+		}
+	}
+	assert.Equals(t, leaders, 1)
+
+}
+
+func TestLeaderElectorCampaign(t *testing.T) {
+
+	db := newLeaseTestDatabase()
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+
+	leader := newTestLeaderElector(db, clock, "a")
+	follower := newTestLeaderElector(db, clock, "b")
+
+	runs := make(chan *LeaderElector, 10)
+	runWhile := func(elector *LeaderElector) func() {
+		return func() {
+			runs <- elector
+			for elector.IsLeader() {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	leader.campaign(runWhile(leader))
+	follower.campaign(runWhile(follower))
+	assert.Equals(t, <-runs, leader)
+	assert.True(t, leader.IsLeader())
+	assert.False(t, follower.IsLeader())
+
+	// campaigning again while still leader doesn't start another run
+	leader.campaign(runWhile(leader))
+	assert.Equals(t, len(runs), 0)
+
+	// the leader goes away, and the follower takes over after the ttl
+	assert.True(t, leader.Release() == nil)
+	clock.Advance(time.Minute)
+	follower.campaign(runWhile(follower))
+	assert.Equals(t, <-runs, follower)
+	assert.True(t, follower.IsLeader())
+	assert.False(t, leader.IsLeader())
+
+	// if it stalls and stops campaigning, it's no longer the leader once its
+	// lease has run out, since another candidate could have taken over
+	clock.Advance(follower.TTL)
+	assert.False(t, follower.IsLeader())
+
+}
@@ -0,0 +1,409 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+)
+
+const (
+	// How long a worker's lease on a job lasts unless it is renewed
+	DEFAULT_JOB_LEASE_TTL = 5 * time.Minute
+
+	// How many times a job will be attempted before the reaper gives up
+	// on it and marks it as failed
+	DEFAULT_JOB_MAX_ATTEMPTS = 3
+)
+
+// A lease held by a worker on a job that it's processing.  The worker
+// renews the lease by heartbeat while the job is running, and if the worker
+// dies, the LeaseReaper will notice the expired lease and put the job back
+// into the Pending state so that another worker can pick it up.
+type JobLease struct {
+	WorkerID string    `json:"worker-id"`
+	Deadline time.Time `json:"deadline"`
+
+	// When the worker started and stopped processing the job, used to
+	// account for how much time the job took
+	Acquired time.Time `json:"acquired"`
+	Released time.Time `json:"released"`
+
+	// The number of times a worker has started processing this job
+	Attempts int `json:"attempts"`
+
+	// When a job that's backing off after a transient failure may be
+	// handed to a worker again
+	NotBefore time.Time `json:"not-before"`
+}
+
+// Has the lease expired as of the given time?  A lease without a deadline
+// counts as expired, since no worker is renewing it (eg, a job left in the
+// Processing state by a worker from before leases existed).
+func (l JobLease) Expired(now time.Time) bool {
+	return l.Deadline.IsZero() || now.After(l.Deadline)
+}
+
+// Is the job still backing off after a transient failure as of the given
+// time, so that it shouldn't be handed to a worker yet?
+func (l JobLease) BackingOff(now time.Time) bool {
+	return now.Before(l.NotBefore)
+}
+
+// An id that identifies this worker process
+func DefaultWorkerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%v-%v", hostname, os.Getpid())
+}
+
+// Move a job from Pending to Processing and take out a lease on it for the
+// given worker.  Returns false if the job was not Pending, eg because
+// another worker already has it, or if it's backing off after a transient
+// failure and its NotBefore time hasn't come yet.
+func acquireJobLease(db DocumentStore, job JobDoc, workerID string, clock Clock, ttl time.Duration) (bool, error) {
+
+	updater := func(jobPtr interface{}) {
+		j := jobPtr.(JobDoc)
+		lease := j.GetLease()
+		lease.WorkerID = workerID
+		lease.Deadline = clock.Now().Add(ttl)
+		lease.Acquired = clock.Now()
+		lease.Released = time.Time{}
+		lease.Attempts += 1
+		j.SetLease(lease)
+		j.SetProcessingState(Processing)
+	}
+
+	doneMetric := func(jobPtr interface{}) bool {
+		j := jobPtr.(JobDoc)
+		return j.GetProcessingState() != Pending || j.GetLease().BackingOff(clock.Now())
+	}
+
+	refresh := func(jobPtr interface{}) error {
+		return jobPtr.(JobDoc).RefreshFromDB(db)
+	}
+
+	return casUpdate(db, job, updater, doneMetric, refresh)
+
+}
+
+// Push back the deadline of the worker's lease on the job.  Returns false if
+// the worker no longer holds the lease, eg because it was reaped.
+func renewJobLease(db DocumentStore, job JobDoc, workerID string, clock Clock, ttl time.Duration) (bool, error) {
+
+	deadline := clock.Now().Add(ttl)
+
+	updater := func(jobPtr interface{}) {
+		j := jobPtr.(JobDoc)
+		lease := j.GetLease()
+		lease.Deadline = deadline
+		j.SetLease(lease)
+	}
+
+	doneMetric := func(jobPtr interface{}) bool {
+		j := jobPtr.(JobDoc)
+		return j.GetProcessingState() != Processing || j.GetLease().WorkerID != workerID
+	}
+
+	refresh := func(jobPtr interface{}) error {
+		return jobPtr.(JobDoc).RefreshFromDB(db)
+	}
+
+	return casUpdate(db, job, updater, doneMetric, refresh)
+
+}
+
+// Record when the worker stopped processing the job.  Does nothing if the
+// worker no longer holds the lease.
+func releaseJobLease(db DocumentStore, job JobDoc, workerID string, clock Clock) (bool, error) {
+
+	released := clock.Now()
+
+	updater := func(jobPtr interface{}) {
+		j := jobPtr.(JobDoc)
+		lease := j.GetLease()
+		lease.Released = released
+		j.SetLease(lease)
+	}
+
+	doneMetric := func(jobPtr interface{}) bool {
+		lease := jobPtr.(JobDoc).GetLease()
+		return lease.WorkerID != workerID || !lease.Released.IsZero()
+	}
+
+	refresh := func(jobPtr interface{}) error {
+		return jobPtr.(JobDoc).RefreshFromDB(db)
+	}
+
+	return casUpdate(db, job, updater, doneMetric, refresh)
+
+}
+
+// Take out a lease on a pending job and keep renewing it in the background
+// until the returned stop function is called, which also records when the
+// lease was released.  If the lease is lost while the job is running (eg,
+// it was reaped), the job's command is killed, since another worker may
+// already be running it again.  If the lease could not be acquired because
+// the job isn't pending, false is returned.
+func startJobLease(config Configuration, job JobDoc, docId string) (bool, func(), error) {
+
+	db := config.DbConnection()
+	workerID := DefaultWorkerID()
+	clock := systemClock{}
+
+	acquired, err := acquireJobLease(db, job, workerID, clock, DEFAULT_JOB_LEASE_TTL)
+	if err != nil || !acquired {
+		return acquired, func() {}, err
+	}
+
+	// renew a fresh copy of the doc so that the heartbeat doesn't race with
+	// the job's own updates to its doc
+	renew := func() (bool, error) {
+		latest, err := FindJobDoc(config, docId)
+		if err != nil {
+			return false, err
+		}
+		if _, err := renewJobLease(db, latest, workerID, clock, DEFAULT_JOB_LEASE_TTL); err != nil {
+			return false, err
+		}
+		return latest.GetLease().WorkerID == workerID && latest.GetProcessingState() == Processing, nil
+	}
+
+	lost := func() {
+		killJobWithLostLease(config, docId)
+	}
+
+	heartbeat := startLeaseHeartbeat(clock, DEFAULT_JOB_LEASE_TTL/3, renew, lost)
+
+	stop := func() {
+		heartbeat.Stop()
+		latest, err := FindJobDoc(config, docId)
+		if err == nil {
+			_, err = releaseJobLease(db, latest, workerID, clock)
+		}
+		if err != nil {
+			logg.LogTo("JOB_SCHEDULER", "Error releasing lease on %v: %v", docId, err)
+		}
+	}
+
+	return true, stop, nil
+
+}
+
+// Periodically renews a lease until stopped, or until the lease is lost
+type leaseHeartbeat struct {
+	stop    chan struct{}
+	stopped chan struct{}
+	lost    chan struct{} // closed if the lease was lost
+}
+
+// Start renewing a lease every interval.  If renew reports that the lease
+// has been lost, the heartbeat stops and calls lost, if it's non-nil.
+func startLeaseHeartbeat(clock Clock, interval time.Duration, renew func() (bool, error), lost func()) *leaseHeartbeat {
+
+	heartbeat := &leaseHeartbeat{
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		lost:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(heartbeat.stopped)
+		for {
+			select {
+			case <-heartbeat.stop:
+				return
+			case <-clock.After(interval):
+				stillHeld, err := renew()
+				if err != nil {
+					logg.LogTo("JOB_SCHEDULER", "Error renewing lease: %v", err)
+					continue
+				}
+				if !stillHeld {
+					logg.LogTo("JOB_SCHEDULER", "Lease lost, no longer renewing")
+					close(heartbeat.lost)
+					if lost != nil {
+						lost()
+					}
+					return
+				}
+			}
+		}
+	}()
+
+	return heartbeat
+
+}
+
+// Has the lease been lost?
+func (h *leaseHeartbeat) Lost() bool {
+	select {
+	case <-h.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop renewing the lease and wait for the heartbeat goroutine to exit
+func (h *leaseHeartbeat) Stop() {
+	select {
+	case <-h.stopped:
+	default:
+		close(h.stop)
+		<-h.stopped
+	}
+}
+
+// The reaper finds jobs whose worker lease has expired (most likely because
+// the worker died), and either puts them back into the Pending state so
+// that the changes listener will reschedule them, or marks them as Failed
+// if they've already been attempted MaxAttempts times.
+type LeaseReaper struct {
+	Configuration Configuration
+	Clock         Clock
+	MaxAttempts   int
+	Interval      time.Duration
+
+	// If set, leases are only reaped while this returns true, so that only
+	// the leader among several schedulers reaps them
+	IsLeader func() bool
+}
+
+func NewLeaseReaper(c Configuration) *LeaseReaper {
+	return &LeaseReaper{
+		Configuration: c,
+		Clock:         systemClock{},
+		MaxAttempts:   DEFAULT_JOB_MAX_ATTEMPTS,
+		Interval:      DEFAULT_JOB_LEASE_TTL,
+	}
+}
+
+// Reap expired leases every Interval, forever.  This will typically be run
+// in its own goroutine.
+func (r LeaseReaper) ReapForever() {
+	for {
+		<-r.Clock.After(r.Interval)
+		if r.IsLeader != nil && !r.IsLeader() {
+			continue
+		}
+		if _, err := r.Reap(); err != nil {
+			logg.LogTo("JOB_SCHEDULER", "Error reaping leases: %v", err)
+		}
+	}
+}
+
+// Do a single pass over all jobs and reap any with expired leases.  Returns
+// the ids of the jobs that were reaped.
+func (r LeaseReaper) Reap() ([]string, error) {
+
+	rows, err := allDocs(r.Configuration.DbConnection())
+	if err != nil {
+		return nil, err
+	}
+
+	now := r.Clock.Now()
+	reaped := []string{}
+
+	for _, row := range rows {
+
+		doc := struct {
+			ProcessingState *ProcessingState `json:"processing-state"`
+			Lease           JobLease         `json:"lease"`
+		}{}
+		if err := json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, fmt.Errorf("Error decoding doc: %v.  Err: %v", row.Id, err)
+		}
+
+		if doc.ProcessingState == nil || *doc.ProcessingState != Processing {
+			continue
+		}
+		if !doc.Lease.Expired(now) {
+			continue
+		}
+
+		job, err := FindJobDoc(r.Configuration, row.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		updated, err := r.reapJob(job)
+		if err != nil {
+			return nil, err
+		}
+		if updated {
+			reaped = append(reaped, row.Id)
+		}
+
+	}
+
+	return reaped, nil
+
+}
+
+func (r LeaseReaper) reapJob(job JobDoc) (bool, error) {
+
+	db := r.Configuration.DbConnection()
+	now := r.Clock.Now()
+
+	updater := func(jobPtr interface{}) {
+		j := jobPtr.(JobDoc)
+		newState, processingLog := expiredLeaseUpdate(j, r.MaxAttempts)
+		logg.LogTo("JOB_SCHEDULER", "Reaping expired lease %+v -> %v", j.GetLease(), newState)
+		// the worker may have kept going until the deadline, but no later
+		j.AddAttempt(JobAttempt{
+			WorkerID: j.GetLease().WorkerID,
+			Started:  j.GetLease().Acquired,
+			Failed:   j.GetLease().Deadline,
+			Error:    processingLog,
+		})
+		j.SetProcessingState(newState)
+		j.SetProcessingLog(processingLog)
+		j.SetLease(JobLease{Attempts: j.GetLease().Attempts})
+	}
+
+	// if the lease was renewed in the meantime, leave the job alone
+	doneMetric := func(jobPtr interface{}) bool {
+		j := jobPtr.(JobDoc)
+		return j.GetProcessingState() != Processing || !j.GetLease().Expired(now)
+	}
+
+	refresh := func(jobPtr interface{}) error {
+		return jobPtr.(JobDoc).RefreshFromDB(db)
+	}
+
+	return casUpdate(db, job, updater, doneMetric, refresh)
+
+}
+
+// Given a job whose lease has expired, figure out which state it should
+// go to next, along with a processing log entry explaining why.
+func expiredLeaseUpdate(job JobDoc, maxAttempts int) (ProcessingState, string) {
+
+	lease := job.GetLease()
+
+	if lease.Attempts >= maxAttempts {
+		processingLog := fmt.Sprintf(
+			"Lease held by worker %v expired at %v, giving up after %v attempts",
+			lease.WorkerID,
+			lease.Deadline,
+			lease.Attempts,
+		)
+		return Failed, processingLog
+	}
+
+	processingLog := fmt.Sprintf(
+		"Lease held by worker %v expired at %v, retrying after %v of %v attempts",
+		lease.WorkerID,
+		lease.Deadline,
+		lease.Attempts,
+		maxAttempts,
+	)
+	return Pending, processingLog
+
+}
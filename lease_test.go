@@ -0,0 +1,123 @@
+package elasticthought
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Wait until something is blocked on the fake clock
+func waitForClockWaiter(t *testing.T, clock *FakeClock) {
+	for i := 0; i < 1000; i++ {
+		if clock.NumWaiters() > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Nothing waiting on fake clock")
+}
+
+func TestLeaseHeartbeat(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+	renewals := make(chan bool, 10)
+	stillHeld := true
+
+	renew := func() (bool, error) {
+		renewals <- true
+		return stillHeld, nil
+	}
+
+	lost := make(chan bool, 1)
+	heartbeat := startLeaseHeartbeat(clock, time.Minute, renew, func() { lost <- true })
+
+	// nothing happens until the interval has passed
+	waitForClockWaiter(t, clock)
+	clock.Advance(30 * time.Second)
+	assert.Equals(t, len(renewals), 0)
+
+	clock.Advance(30 * time.Second)
+	<-renewals
+	assert.False(t, heartbeat.Lost())
+
+	// after losing the lease, the heartbeat stops by itself
+	waitForClockWaiter(t, clock)
+	stillHeld = false
+	clock.Advance(time.Minute)
+	<-renewals
+	<-heartbeat.stopped
+	<-lost
+	assert.True(t, heartbeat.Lost())
+
+	// stopping an already stopped heartbeat is fine
+	heartbeat.Stop()
+
+}
+
+func TestExpiredLeaseUpdate(t *testing.T) {
+
+	now := time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+	trainingJob := NewTrainingJob(*NewDefaultConfiguration())
+	trainingJob.ProcessingState = Processing
+	trainingJob.Lease = JobLease{
+		WorkerID: "worker-1",
+		Deadline: now.Add(-time.Minute),
+		Attempts: 1,
+	}
+
+	assert.True(t, trainingJob.Lease.Expired(now))
+	assert.False(t, trainingJob.Lease.Expired(now.Add(-time.Hour)))
+	// nobody is renewing a lease without a deadline
+	assert.True(t, JobLease{}.Expired(now))
+
+	newState, _ := expiredLeaseUpdate(trainingJob, DEFAULT_JOB_MAX_ATTEMPTS)
+	assert.Equals(t, newState, Pending)
+
+	trainingJob.Lease.Attempts = DEFAULT_JOB_MAX_ATTEMPTS
+	newState, processingLog := expiredLeaseUpdate(trainingJob, DEFAULT_JOB_MAX_ATTEMPTS)
+	assert.Equals(t, newState, Failed)
+	assert.True(t, len(processingLog) > 0)
+
+}
+
+func TestLeaseReaper(t *testing.T) {
+
+	config := *NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://lease_test_%v", NewUuid())
+	db := config.DbConnection()
+
+	now := time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC)
+	reaper := NewLeaseReaper(config)
+	reaper.Clock = NewFakeClock(now)
+
+	insertJob := func(lease JobLease) string {
+		trainingJob := NewTrainingJob(config)
+		trainingJob.ProcessingState = Processing
+		trainingJob.Lease = lease
+		inserted, err := trainingJob.Insert(db)
+		assert.True(t, err == nil)
+		return inserted.Id
+	}
+
+	held := insertJob(JobLease{WorkerID: "worker-1", Deadline: now.Add(time.Minute), Attempts: 1})
+	expired := insertJob(JobLease{WorkerID: "worker-1", Deadline: now.Add(-time.Minute), Attempts: 1})
+	noDeadline := insertJob(JobLease{WorkerID: "worker-0", Attempts: 1})
+
+	reaped, err := reaper.Reap()
+	assert.True(t, err == nil)
+	sort.Strings(reaped)
+	expected := []string{expired, noDeadline}
+	sort.Strings(expected)
+	assert.DeepEquals(t, reaped, expected)
+
+	for docId, state := range map[string]ProcessingState{held: Processing, expired: Pending, noDeadline: Pending} {
+		trainingJob := TrainingJob{}
+		assert.True(t, db.Retrieve(docId, &trainingJob) == nil)
+		assert.Equals(t, trainingJob.ProcessingState, state)
+	}
+
+}
@@ -15,6 +15,7 @@ func init() {
 		"CHANGES",
 		"JOB_SCHEDULER",
 		"NSQ_WORKER",
+		"QUEUE_WORKER",
 		"DATASET_SPLITTER",
 		"DATAFILE_DOWNLOADER",
 		"SOLVER",
@@ -22,6 +23,7 @@ func init() {
 		"CLASSIFY_JOB",
 		"TEST",
 		"CBFS",
+		"GC",
 	}
 }
 
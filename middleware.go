@@ -1,6 +1,7 @@
 package elasticthought
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -8,7 +9,6 @@ import (
 
 	"github.com/couchbaselabs/logg"
 	"github.com/gin-gonic/gin"
-	"github.com/tleyden/go-couch"
 )
 
 const (
@@ -16,29 +16,41 @@ const (
 	MIDDLEWARE_KEY_USER = "user"
 )
 
-// Gin middleware to connnect to the Sync Gw database given in the
-// dbUrl parameter, and set the connection object into the context.
-// This creates a new connection for each request, which is ultra-conservative
-// in case the connection object isn't safe to use among multiple goroutines
-// (and I believe it is).  If it becomes a bottleneck, it's easy to create
-// another middleware that re-uses an existing connection.
-func DbConnector(dbUrl string) gin.HandlerFunc {
+// Gin middleware giving each request an id, which is returned in the
+// X-Request-Id header and in the body of error responses (see APIError) so
+// that failures can be matched up with the server logs.  An id passed in by
+// the client is kept.
+func RequestIdentifier() gin.HandlerFunc {
 
 	return func(c *gin.Context) {
 
-		// make sure the db url does not have a trailing slash
-		if strings.HasSuffix(dbUrl, "/") {
-			err := errors.New(fmt.Sprintf("dbUrl needs trailing slash: %v", dbUrl))
-			logg.LogError(err)
-			c.Fail(500, err)
-			return
+		id := c.Request.Header.Get(REQUEST_ID_HEADER)
+		if len(id) == 0 {
+			id = NewUuid()
+			c.Request.Header.Set(REQUEST_ID_HEADER, id)
 		}
+		c.Writer.Header().Set(REQUEST_ID_HEADER, id)
+
+		c.Next()
+
+	}
+
+}
+
+// Gin middleware to open the document store (Sync Gw database or embedded
+// store) given in the dbUrl parameter, and set it into the context.  Sync Gw
+// connections are made per request, which is ultra-conservative in case the
+// connection object isn't safe to use among multiple goroutines (and I
+// believe it is).  Embedded stores are shared by the whole process.
+func DbConnector(dbUrl string) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
 
-		db, err := couch.Connect(dbUrl)
+		db, err := NewDocumentStore(dbUrl)
 		if err != nil {
 			err = errors.New(fmt.Sprintf("Error %v | dbUrl: %v", err, dbUrl))
 			logg.LogError(err)
-			c.Fail(500, err)
+			failRequest(c, err)
 			return
 		}
 
@@ -58,7 +70,7 @@ func DbAuthRequired() gin.HandlerFunc {
 
 	return func(c *gin.Context) {
 
-		db := c.MustGet(MIDDLEWARE_KEY_DB).(couch.Database)
+		db := c.MustGet(MIDDLEWARE_KEY_DB).(DocumentStore)
 
 		auth := strings.SplitN(c.Request.Header.Get("Authorization"), " ", 2)
 
@@ -66,7 +78,7 @@ func DbAuthRequired() gin.HandlerFunc {
 
 		if len(auth) != 2 || auth[0] != "Basic" {
 			err := errors.New("bad syntax in auth header")
-			c.Fail(401, err)
+			failRequest(c, unauthorizedError(err))
 			return
 		}
 
@@ -75,7 +87,7 @@ func DbAuthRequired() gin.HandlerFunc {
 
 		if len(pair) != 2 {
 			err := errors.New("expected user:pass in auth header")
-			c.Fail(401, err)
+			failRequest(c, unauthorizedError(err))
 			return
 		}
 
@@ -88,7 +100,7 @@ func DbAuthRequired() gin.HandlerFunc {
 		if err != nil {
 			msg := fmt.Sprintf("Failed to authenticate user in DB: %v", err)
 			err := errors.New(msg)
-			c.Fail(401, err)
+			failRequest(c, unauthorizedError(err))
 			return
 		}
 
@@ -99,3 +111,33 @@ func DbAuthRequired() gin.HandlerFunc {
 	}
 
 }
+
+// Gin middleware guarding the http pull queue, which workers authenticate to
+// with the shared token in a "Bearer" Authorization header.  If no token is
+// configured the queue endpoints are disabled altogether, since anyone who
+// can reach them could take jobs off the queue.
+func QueueTokenRequired(token string) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		if len(token) == 0 {
+			failRequest(c, notFoundError(errors.New("http pull queue is disabled")))
+			return
+		}
+
+		auth := strings.SplitN(c.Request.Header.Get("Authorization"), " ", 2)
+		if len(auth) != 2 || auth[0] != "Bearer" {
+			failRequest(c, unauthorizedError(errors.New("bad syntax in auth header")))
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(auth[1]), []byte(token)) != 1 {
+			failRequest(c, unauthorizedError(errors.New("invalid queue token")))
+			return
+		}
+
+		c.Next()
+
+	}
+
+}
@@ -1,9 +1,12 @@
 package elasticthought
 
 import (
+	"crypto/sha1"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"time"
 )
 
 var (
@@ -21,6 +24,10 @@ type MockBlobStore struct {
 	// Queued responses for blob Get requests.  The key is a
 	// regex that should match the path in the Get request.
 	GetResponses map[string]ResponseQueue
+
+	// Metadata of the blobs that have been Put, keyed by path.
+	// This is what List and Stat return.
+	Blobs map[string]BlobInfo
 }
 
 type ResponseQueue []io.Reader
@@ -47,13 +54,51 @@ func (m *MockBlobStore) Get(path string) (io.ReadCloser, error) {
 }
 
 func (m *MockBlobStore) Put(srcname, dest string, r io.Reader, opts BlobPutOptions) error {
+
+	hash := sha1.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return err
+	}
+
+	if m.Blobs == nil {
+		m.Blobs = map[string]BlobInfo{}
+	}
+	m.Blobs[dest] = BlobInfo{
+		Path:        dest,
+		Size:        size,
+		ContentType: opts.ContentType,
+		ModTime:     time.Now(),
+		Checksum:    fmt.Sprintf("%x", hash.Sum(nil)),
+	}
+
 	return nil
 }
 
 func (m *MockBlobStore) Rm(fn string) error {
+	delete(m.Blobs, fn)
 	return nil
 }
 
+func (m *MockBlobStore) List(prefix string) ([]BlobInfo, error) {
+	blobInfos := []BlobInfo{}
+	for blobPath, blobInfo := range m.Blobs {
+		if strings.HasPrefix(blobPath, prefix) {
+			blobInfos = append(blobInfos, blobInfo)
+		}
+	}
+	sort.Sort(blobInfosByPath(blobInfos))
+	return blobInfos, nil
+}
+
+func (m *MockBlobStore) Stat(path string) (BlobInfo, error) {
+	blobInfo, ok := m.Blobs[path]
+	if !ok {
+		return BlobInfo{}, fmt.Errorf("No blob in mock blob store for %v", path)
+	}
+	return blobInfo, nil
+}
+
 func (m *MockBlobStore) OpenFile(path string) (BlobHandle, error) {
 	return nil, nil
 }
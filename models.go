@@ -1,9 +1,11 @@
 package elasticthought
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"github.com/couchbaselabs/logg"
 	"github.com/dustin/httputil"
-	"github.com/tleyden/go-couch"
 )
 
 const (
@@ -14,6 +16,9 @@ const (
 	DOC_TYPE_TRAINING_JOB = "training-job"
 	DOC_TYPE_CLASSIFIER   = "classifier"
 	DOC_TYPE_CLASSIFY_JOB = "classify-job"
+	DOC_TYPE_CHECKPOINT   = "checkpoint"
+	DOC_TYPE_LEADER_LEASE = "leader-lease"
+	DOC_TYPE_JOB_QUEUE    = "job-queue"
 )
 
 // All document structs should embed this struct go get access to
@@ -37,7 +42,7 @@ type casRefresh func(interface{}) error
 //
 // If any errors occur while trying to update, they will be returned in the second
 // return value.
-func casUpdate(db couch.Database, thing2update interface{}, updater casUpdater, doneMetric casDoneMetric, refresh casRefresh) (bool, error) {
+func casUpdate(db DocumentStore, thing2update interface{}, updater casUpdater, doneMetric casDoneMetric, refresh casRefresh) (bool, error) {
 
 	if doneMetric(thing2update) == true {
 		logg.LogTo("ELASTIC_THOUGHT", "No update needed: %+v, ignoring", thing2update)
@@ -83,3 +88,26 @@ func casUpdate(db couch.Database, thing2update interface{}, updater casUpdater,
 	}
 
 }
+
+// A row of the _all_docs view when queried with include_docs=true
+type allDocsRow struct {
+	Id  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+// Get every document in the database.  This is expensive, and is only
+// meant for maintenance tasks like garbage collection and cascading deletes.
+func allDocs(db DocumentStore) ([]allDocsRow, error) {
+
+	result := struct {
+		Rows []allDocsRow `json:"rows"`
+	}{}
+
+	options := map[string]interface{}{"include_docs": true}
+	if err := db.Query("_all_docs", options, &result); err != nil {
+		return nil, fmt.Errorf("Error getting all docs.  Err: %v", err)
+	}
+
+	return result.Rows, nil
+
+}
@@ -2,13 +2,29 @@ package elasticthought
 
 import (
 	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/couchbaselabs/logg"
 )
 
+// How many times to try publishing a job to nsq before giving up, and how
+// long to wait after the first failed attempt (this grows with each attempt)
+const (
+	NSQ_PUBLISH_ATTEMPTS    = 5
+	NSQ_PUBLISH_RETRY_DELAY = 500 * time.Millisecond
+)
+
+// Schedules jobs by publishing them to an nsq topic, for NsqWorkers to pick
+// up.  A single producer is shared by every job, rather than connecting to
+// nsqd for each one.
 type NsqJobScheduler struct {
 	Configuration Configuration
+
+	mutex    sync.Mutex
+	producer *nsq.Producer
 }
 
 func NewNsqJobScheduler(c Configuration) *NsqJobScheduler {
@@ -17,24 +33,70 @@ func NewNsqJobScheduler(c Configuration) *NsqJobScheduler {
 	}
 }
 
-func (j NsqJobScheduler) ScheduleJob(jobDescriptor JobDescriptor) error {
-
-	config := nsq.NewConfig()
-	w, _ := nsq.NewProducer(j.Configuration.NsqdUrl, config)
+// Publish the job, retrying with a backoff if nsqd can't be reached.  A nil
+// error means nsqd has confirmed that the job is on the topic.
+func (j *NsqJobScheduler) ScheduleJob(jobDescriptor JobDescriptor) error {
 
 	data, err := json.Marshal(jobDescriptor)
 	if err != nil {
 		return err
 	}
 
-	err = w.Publish(j.Configuration.NsqdTopic, data)
-	if err != nil {
-		return err
+	for attempt := 1; ; attempt++ {
+
+		err = j.publish(data)
+		if err == nil {
+			logg.LogTo("JOB_SCHEDULER", "Published to nsq: %v", string(data))
+			return nil
+		}
+
+		if attempt >= NSQ_PUBLISH_ATTEMPTS {
+			return fmt.Errorf("Error publishing to nsq after %v attempts: %v.  Err: %v", attempt, string(data), err)
+		}
+
+		logg.LogTo("JOB_SCHEDULER", "Error publishing to nsq (attempt %v), retrying: %v", attempt, err)
+		time.Sleep(time.Duration(attempt) * NSQ_PUBLISH_RETRY_DELAY)
+
 	}
 
-	logg.LogTo("JOB_SCHEDULER", "Published to nsq: %v", string(data))
+}
+
+// Publish on the shared producer, creating it if needed.  go-nsq's Publish
+// waits for nsqd to respond, and reconnects if the connection was dropped
+// since the last publish.  After an error the producer is thrown away anyway,
+// so the next attempt starts from a fresh one.
+func (j *NsqJobScheduler) publish(data []byte) error {
 
-	w.Stop()
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.producer == nil {
+		producer, err := nsq.NewProducer(j.Configuration.NsqdUrl, nsq.NewConfig())
+		if err != nil {
+			return fmt.Errorf("Error creating nsq producer for: %v.  Err: %v", j.Configuration.NsqdUrl, err)
+		}
+		j.producer = producer
+	}
+
+	if err := j.producer.Publish(j.Configuration.NsqdTopic, data); err != nil {
+		j.producer.Stop()
+		j.producer = nil
+		return err
+	}
 
 	return nil
+
+}
+
+// Disconnect from nsqd, eg when shutting down
+func (j *NsqJobScheduler) Stop() {
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.producer != nil {
+		j.producer.Stop()
+		j.producer = nil
+	}
+
 }
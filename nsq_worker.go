@@ -3,23 +3,76 @@ package elasticthought
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/couchbaselabs/logg"
 )
 
+const (
+	// How long a worker that's been told to shut down waits for its running
+	// jobs to finish
+	DEFAULT_WORKER_DRAIN_TIMEOUT = 5 * time.Minute
+
+	// How often to touch the message of a job the worker has taken (queued
+	// or running), so that nsq doesn't time it out and hand it to another
+	// worker.  This needs to be well under nsq's message timeout, which is a
+	// minute by default.
+	NSQ_MESSAGE_TOUCH_INTERVAL = 20 * time.Second
+)
+
 // A worker which pulls jobs off of NSQ and processes them
 type NsqWorker struct {
 	Configuration Configuration
+	WorkerPool    *WorkerPool
+
+	// How long Drain waits for running jobs to finish
+	DrainTimeout time.Duration
+
+	Clock Clock
+
+	mutex    sync.Mutex
+	consumer *nsq.Consumer
+	draining bool
+	running  map[*nsq.Message]bool
+}
+
+// A job along with the nsq message it came from.  The message isn't acked
+// until the job has finished, so that if the worker dies, nsq will hand the
+// job to another worker.  It's touched from the moment it's taken, so that
+// it doesn't time out while the job waits for a slot in the worker pool.
+type nsqJob struct {
+	Runnable
+	worker        *NsqWorker
+	jobDescriptor JobDescriptor
+	message       *nsq.Message
+	heartbeat     *leaseHeartbeat
+}
+
+func (j nsqJob) JobType() string {
+	if typer, ok := j.Runnable.(JobTyper); ok {
+		return typer.JobType()
+	}
+	return ""
+}
+
+func (j nsqJob) Run(wg *sync.WaitGroup) {
+	j.worker.run(j, wg)
 }
 
 func NewNsqWorker(c Configuration) *NsqWorker {
 	return &NsqWorker{
 		Configuration: c,
+		WorkerPool:    NewWorkerPool(c),
+		DrainTimeout:  DEFAULT_WORKER_DRAIN_TIMEOUT,
+		Clock:         systemClock{},
+		running:       map[*nsq.Message]bool{},
 	}
 }
 
-func (n NsqWorker) HandleEvents() {
+// Connect to nsq and start handling messages in the background
+func (n *NsqWorker) HandleEvents() error {
 
 	// not really sure if I need to use channels at all here,
 	// since at the moment there is only one worker
@@ -28,42 +81,196 @@ func (n NsqWorker) HandleEvents() {
 	// pull event off of nsql topic
 
 	config := nsq.NewConfig()
-	q, _ := nsq.NewConsumer(n.Configuration.NsqdTopic, channelName, config)
-	q.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
-
-		logg.LogTo("NSQ_WORKER", "Got a message!: %v", string(message.Body))
-
-		// create jobDescriptor from json
-		jobDescriptor := JobDescriptor{}
-		err := json.Unmarshal(message.Body, &jobDescriptor)
-		if err != nil {
-			bodyStr := string(message.Body)
-			logg.LogTo("NSQ_WORKER", "Error unmarshalling msg: %v", bodyStr)
-			return err
-		}
 
-		logg.LogTo("NSQ_WORKER", "Job descriptor: %+v", jobDescriptor)
+	// messages are held until their job finishes, so take enough of them to
+	// fill the worker pool
+	config.MaxInFlight = n.maxInFlight()
 
-		// create job from job descriptor
-		job, err := CreateJob(n.Configuration, jobDescriptor)
-		if err != nil {
-			logg.LogTo("NSQ_WORKER", "Error creating job from: %+v", jobDescriptor)
-			return err
-		}
+	q, err := nsq.NewConsumer(n.Configuration.NsqdTopic, channelName, config)
+	if err != nil {
+		return fmt.Errorf("Error creating nsq consumer: %v", err)
+	}
+	q.AddHandler(n)
 
-		logg.LogTo("NSQ_WORKER", "Job: %+v", job)
+	n.mutex.Lock()
+	n.consumer = q
+	n.mutex.Unlock()
 
-		// run job
-		go job.Run(nil)
+	if err := q.ConnectToNSQLookupd(n.Configuration.NsqLookupdUrl); err != nil {
+		return fmt.Errorf("Error connecting to nsq: %v", err)
+	}
 
-		return nil
-	}))
-	err := q.ConnectToNSQLookupd(n.Configuration.NsqLookupdUrl)
+	logg.LogTo("NSQ_WORKER", "connected to nsq as a consumer")
+	return nil
+
+}
+
+// Handle a message from nsq.  Returning an error makes nsq requeue it.
+func (n *NsqWorker) HandleMessage(message *nsq.Message) error {
+
+	logg.LogTo("NSQ_WORKER", "Got a message!: %v", string(message.Body))
+
+	// create jobDescriptor from json
+	jobDescriptor := JobDescriptor{}
+	err := json.Unmarshal(message.Body, &jobDescriptor)
 	if err != nil {
-		errMsg := fmt.Errorf("Error connecting to nsq: %v", err)
-		logg.LogError(errMsg)
+		bodyStr := string(message.Body)
+		logg.LogTo("NSQ_WORKER", "Error unmarshalling msg: %v", bodyStr)
+		return err
 	}
 
-	logg.LogTo("NSQ_WORKER", "connected to nsq as a consumer")
+	logg.LogTo("NSQ_WORKER", "Job descriptor: %+v", jobDescriptor)
+
+	// create job from job descriptor
+	job, err := CreateJob(n.Configuration, jobDescriptor)
+	if err != nil {
+		logg.LogTo("NSQ_WORKER", "Error creating job from: %+v", jobDescriptor)
+		return err
+	}
+
+	logg.LogTo("NSQ_WORKER", "Job: %+v", job)
+
+	n.submit(jobDescriptor, message, job)
+	return nil
+
+}
+
+// Run the job once there is a free slot in the worker pool, touching its
+// message in the meantime.  The message is responded to once the job has
+// run, or by Drain.
+func (n *NsqWorker) submit(jobDescriptor JobDescriptor, message *nsq.Message, job Runnable) {
+
+	message.DisableAutoResponse()
+
+	n.mutex.Lock()
+	draining := n.draining
+	n.mutex.Unlock()
+
+	if draining {
+		logg.LogTo("NSQ_WORKER", "Draining, requeueing: %+v", jobDescriptor)
+		message.Requeue(0)
+		return
+	}
+
+	touch := func() (bool, error) {
+		message.Touch()
+		return !message.HasResponded(), nil
+	}
+
+	heartbeat := startLeaseHeartbeat(n.Clock, NSQ_MESSAGE_TOUCH_INTERVAL, touch, nil)
+
+	err := n.WorkerPool.Submit(jobDescriptor, nsqJob{
+		Runnable:      job,
+		worker:        n,
+		jobDescriptor: jobDescriptor,
+		message:       message,
+		heartbeat:     heartbeat,
+	})
+	if err != nil {
+		// Drain started in the meantime
+		logg.LogTo("NSQ_WORKER", "Could not submit %+v, requeueing: %v", jobDescriptor, err)
+		heartbeat.Stop()
+		message.Requeue(0)
+	}
+
+}
+
+// Run the job, and then stop touching its message and respond to it
+// depending on how the job went
+func (n *NsqWorker) run(job nsqJob, wg *sync.WaitGroup) {
+
+	n.mutex.Lock()
+	n.running[job.message] = true
+	n.mutex.Unlock()
+
+	job.Runnable.Run(wg)
+
+	job.heartbeat.Stop()
+	n.respond(job)
+
+	n.mutex.Lock()
+	delete(n.running, job.message)
+	n.mutex.Unlock()
+
+}
+
+// Ack the message if the job is done with, otherwise requeue it with a
+// backoff so that nsq delivers it again.  A message that Drain has already
+// requeued is left be.
+func (n *NsqWorker) respond(job nsqJob) {
+
+	docId := job.jobDescriptor.DocIdToProcess
+
+	done, reason := jobIsDone(n.Configuration, docId)
+	if done {
+		logg.LogTo("NSQ_WORKER", "Job %v %v, acking", docId, reason)
+		job.message.Finish()
+		return
+	}
+
+	backoff := retryBackoff(int(job.message.Attempts))
+	logg.LogTo("NSQ_WORKER", "Job %v %v, requeueing in %v", docId, reason, backoff)
+	job.message.Requeue(backoff)
+
+}
+
+// Shut down gracefully: stop taking messages from nsq, wait up to the
+// DrainTimeout for running jobs to finish, and requeue the jobs that never
+// got started or didn't finish in time so that another worker can run them.
+func (n *NsqWorker) Drain() {
+
+	n.mutex.Lock()
+	n.draining = true
+	consumer := n.consumer
+	n.mutex.Unlock()
+
+	if consumer != nil {
+		consumer.ChangeMaxInFlight(0)
+	}
+
+	unstarted, finishedInTime := n.WorkerPool.Drain(n.DrainTimeout)
+	if !finishedInTime {
+		logg.LogTo("NSQ_WORKER", "Running jobs did not finish within %v, requeueing them", n.DrainTimeout)
+		n.mutex.Lock()
+		for message := range n.running {
+			message.Requeue(0)
+		}
+		n.mutex.Unlock()
+	}
+
+	for _, job := range unstarted {
+		if job, ok := job.(nsqJob); ok {
+			logg.LogTo("NSQ_WORKER", "Requeueing unstarted job: %v", string(job.message.Body))
+			job.heartbeat.Stop()
+			job.message.Requeue(0)
+		}
+	}
+
+	if consumer != nil {
+		consumer.Stop()
+		<-consumer.StopChan
+	}
+
+	logg.LogTo("NSQ_WORKER", "Drained")
+
+}
+
+// Handle messages until the process gets a SIGINT or SIGTERM, then Drain
+func (n *NsqWorker) RunUntilSignalled() error {
+
+	if err := n.HandleEvents(); err != nil {
+		return err
+	}
+
+	received := WaitForShutdownSignal()
+	logg.LogTo("NSQ_WORKER", "Got %v, draining", received)
+
+	n.Drain()
+	return nil
+
+}
 
+// The number of jobs the worker pool can run at once
+func (n *NsqWorker) maxInFlight() int {
+	return n.WorkerPool.concurrencyLimit()
 }
@@ -0,0 +1,234 @@
+package elasticthought
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Records how each nsq message was responded to
+type fakeNsqDelegate struct {
+	mutex     sync.Mutex
+	responses map[string]string
+	delays    map[string]time.Duration
+	touches   int
+}
+
+func newFakeNsqDelegate() *fakeNsqDelegate {
+	return &fakeNsqDelegate{
+		responses: map[string]string{},
+		delays:    map[string]time.Duration{},
+	}
+}
+
+func (d *fakeNsqDelegate) message(body string) *nsq.Message {
+	message := nsq.NewMessage(nsq.MessageID{}, []byte(body))
+	message.Delegate = d
+	return message
+}
+
+func (d *fakeNsqDelegate) record(m *nsq.Message, response string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.responses[string(m.Body)] = response
+}
+
+func (d *fakeNsqDelegate) Response(body string) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.responses[body]
+}
+
+func (d *fakeNsqDelegate) OnFinish(m *nsq.Message) {
+	d.record(m, "finish")
+}
+
+func (d *fakeNsqDelegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	d.record(m, "requeue")
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.delays[string(m.Body)] = delay
+}
+
+func (d *fakeNsqDelegate) OnTouch(m *nsq.Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.touches += 1
+}
+
+func (d *fakeNsqDelegate) Touches() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.touches
+}
+
+// A job which doesn't do anything
+type noopJob struct{}
+
+func (j noopJob) Run(wg *sync.WaitGroup) {
+	wg.Done()
+}
+
+// A worker with its own in-memory document store
+func newTestNsqWorker() *NsqWorker {
+	config := NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://nsq_worker_test_%v", NewUuid())
+	worker := NewNsqWorker(*config)
+	worker.WorkerPool = &WorkerPool{
+		Concurrency: map[string]int{DOC_TYPE_TRAINING_JOB: 1},
+	}
+	worker.DrainTimeout = time.Minute
+	return worker
+}
+
+func TestNsqWorkerDrain(t *testing.T) {
+
+	worker := newTestNsqWorker()
+	delegate := newFakeNsqDelegate()
+	started := make(chan string, 10)
+
+	running := blockingJob{jobType: DOC_TYPE_TRAINING_JOB, started: started, release: make(chan bool), id: "t1"}
+	queued := blockingJob{jobType: DOC_TYPE_TRAINING_JOB, started: started, release: make(chan bool), id: "t2"}
+	worker.submit(*NewJobDescriptor("t1"), delegate.message("t1"), running)
+	worker.submit(*NewJobDescriptor("t2"), delegate.message("t2"), queued)
+
+	// messages aren't acked until their jobs are done
+	assert.Equals(t, <-started, "t1")
+	assert.Equals(t, delegate.Response("t1"), "")
+	assert.Equals(t, delegate.Response("t2"), "")
+
+	drained := make(chan bool)
+	go func() {
+		worker.Drain()
+		drained <- true
+	}()
+
+	// the running job gets to finish, and the queued one goes back to nsq
+	waitUntilDraining(worker.WorkerPool)
+	running.release <- true
+	<-drained
+	assertNothingStarted(t, started)
+	assert.Equals(t, delegate.Response("t1"), "finish")
+	assert.Equals(t, delegate.Response("t2"), "requeue")
+
+	// messages that arrive while draining go straight back
+	worker.submit(*NewJobDescriptor("t3"), delegate.message("t3"), queued)
+	assert.Equals(t, delegate.Response("t3"), "requeue")
+
+}
+
+func TestNsqWorkerTouchesQueuedMessages(t *testing.T) {
+
+	worker := newTestNsqWorker()
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+	worker.Clock = clock
+	delegate := newFakeNsqDelegate()
+	started := make(chan string, 10)
+
+	running := blockingJob{jobType: DOC_TYPE_TRAINING_JOB, started: started, release: make(chan bool), id: "t1"}
+	queued := blockingJob{jobType: DOC_TYPE_TRAINING_JOB, started: started, release: make(chan bool), id: "t2"}
+	worker.submit(*NewJobDescriptor("t1"), delegate.message("t1"), running)
+	worker.submit(*NewJobDescriptor("t2"), delegate.message("t2"), queued)
+	assert.Equals(t, <-started, "t1")
+
+	// the message of the job waiting for a slot is touched too, so that nsq
+	// doesn't time it out and hand it to another worker
+	for i := 0; i < 1000 && clock.NumWaiters() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(NSQ_MESSAGE_TOUCH_INTERVAL)
+	for i := 0; i < 1000 && delegate.Touches() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equals(t, delegate.Touches(), 2)
+
+	running.release <- true
+	assert.Equals(t, <-started, "t2")
+	queued.release <- true
+	worker.WorkerPool.Wait()
+
+}
+
+func TestNsqWorkerDrainTimeout(t *testing.T) {
+
+	worker := newTestNsqWorker()
+	worker.DrainTimeout = 10 * time.Millisecond
+	delegate := newFakeNsqDelegate()
+	started := make(chan string, 10)
+
+	running := blockingJob{jobType: DOC_TYPE_TRAINING_JOB, started: started, release: make(chan bool), id: "t1"}
+	worker.submit(*NewJobDescriptor("t1"), delegate.message("t1"), running)
+	<-started
+
+	// jobs which are still running when the worker gives up on them go back
+	// to nsq, and finishing afterwards doesn't ack them
+	worker.Drain()
+	assert.Equals(t, delegate.Response("t1"), "requeue")
+	running.release <- true
+	worker.WorkerPool.Wait()
+	assert.Equals(t, delegate.Response("t1"), "requeue")
+
+}
+
+func TestNsqWorkerRespond(t *testing.T) {
+
+	worker := newTestNsqWorker()
+	delegate := newFakeNsqDelegate()
+	db := worker.Configuration.DbConnection()
+
+	insert := func(id string, state ProcessingState, workerID string) {
+		trainingJob := NewTrainingJob(worker.Configuration)
+		trainingJob.ProcessingState = state
+		trainingJob.Lease.WorkerID = workerID
+		_, _, err := db.InsertWith(trainingJob, id)
+		assert.True(t, err == nil)
+	}
+	insert("finished", FinishedSuccessfully, DefaultWorkerID())
+	insert("failed", Failed, DefaultWorkerID())
+	insert("retrying", Pending, DefaultWorkerID())
+	insert("elsewhere", Processing, "another-worker")
+	insert("stuck", Processing, DefaultWorkerID())
+
+	respond := func(docId string) string {
+		message := delegate.message(docId)
+		message.Attempts = 1
+		worker.respond(nsqJob{
+			Runnable:      noopJob{},
+			worker:        worker,
+			jobDescriptor: *NewJobDescriptor(docId),
+			message:       message,
+		})
+		return delegate.Response(docId)
+	}
+
+	// terminal states are acked, as are jobs which aren't this worker's
+	// concern any more
+	assert.Equals(t, respond("finished"), "finish")
+	assert.Equals(t, respond("failed"), "finish")
+	assert.Equals(t, respond("retrying"), "finish")
+	assert.Equals(t, respond("elsewhere"), "finish")
+	assert.Equals(t, respond("deleted"), "finish")
+
+	// but a job that stopped without an outcome gets another go later
+	assert.Equals(t, respond("stuck"), "requeue")
+	assert.Equals(t, delegate.delays["stuck"], JOB_RETRY_BASE_BACKOFF)
+
+}
+
+func TestNsqWorkerMaxInFlight(t *testing.T) {
+
+	worker := NewNsqWorker(*NewDefaultConfiguration())
+	worker.WorkerPool.Concurrency = map[string]int{
+		DOC_TYPE_TRAINING_JOB: 1,
+		DOC_TYPE_CLASSIFY_JOB: 8,
+	}
+	assert.Equals(t, worker.maxInFlight(), 9)
+
+	worker.WorkerPool.Concurrency = nil
+	assert.Equals(t, worker.maxInFlight(), 1)
+
+}
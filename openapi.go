@@ -0,0 +1,297 @@
+package elasticthought
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bodies which aren't JSON described by a struct.  See apiRoute.
+type (
+	// An empty body
+	noBody struct{}
+
+	// A raw file, such as a .tar.gz
+	binaryBody struct {
+		ContentType string
+	}
+
+	// A multipart form, with fields named by the json tags of Form
+	formBody struct {
+		Form interface{}
+	}
+
+	// Any one of several bodies, with different content types
+	bodies []interface{}
+)
+
+// Generate the OpenAPI 3 spec of the given routes.  Request and response
+// schemas come from the json tags of their structs, and fields with
+// binding:"required" tags (or listed in responseRequiredFields) are
+// required.  Named structs go in the components section.
+func OpenAPISpec(routes []apiRoute) map[string]interface{} {
+
+	generator := openapiGenerator{schemas: map[string]interface{}{}}
+
+	paths := map[string]interface{}{}
+	for _, route := range routes {
+		openapiPath, parameters := openapiPathParameters(route.Path)
+		operations, ok := paths[openapiPath].(map[string]interface{})
+		if !ok {
+			operations = map[string]interface{}{}
+			paths[openapiPath] = operations
+		}
+		operations[strings.ToLower(route.Method)] = generator.operation(route, parameters)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":       "ElasticThought",
+			"description": "Scalable REST API wrapper for the Caffe deep learning framework",
+			"version":     "alpha",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": generator.schemas,
+			"securitySchemes": map[string]interface{}{
+				"basicAuth":  map[string]interface{}{"type": "http", "scheme": "basic"},
+				"queueToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+
+}
+
+// Convert a gin path such as /blobs/*path or /datafiles/:datafile-id to an
+// OpenAPI path, and describe its parameters
+func openapiPathParameters(ginPath string) (string, []interface{}) {
+
+	parameters := []interface{}{}
+	segments := strings.Split(ginPath, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+			continue
+		}
+		name := segment[1:]
+		segments[i] = fmt.Sprintf("{%v}", name)
+		parameters = append(parameters, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	return strings.Join(segments, "/"), parameters
+
+}
+
+type openapiGenerator struct {
+	schemas map[string]interface{} // the components section
+}
+
+func (g openapiGenerator) operation(route apiRoute, parameters []interface{}) map[string]interface{} {
+
+	names := []string{}
+	for name := range route.Query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parameters = append(parameters, map[string]interface{}{
+			"name":        name,
+			"in":          "query",
+			"description": route.Query[name],
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+
+	response := map[string]interface{}{
+		"description": http.StatusText(route.Status),
+	}
+	if content := g.content(route.Response); len(content) > 0 {
+		response["content"] = content
+	}
+
+	operation := map[string]interface{}{
+		"summary":    route.Summary,
+		"parameters": parameters,
+		"responses": map[string]interface{}{
+			fmt.Sprint(route.Status): response,
+			"default": map[string]interface{}{
+				"description": "An error",
+				"content":     g.content(APIError{}),
+			},
+		},
+	}
+
+	if content := g.content(route.Request); len(content) > 0 {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  content,
+		}
+	}
+
+	switch route.Auth {
+	case routeAuthUser:
+		operation["security"] = []interface{}{map[string]interface{}{"basicAuth": []string{}}}
+	case routeAuthQueueToken:
+		operation["security"] = []interface{}{map[string]interface{}{"queueToken": []string{}}}
+	}
+
+	return operation
+
+}
+
+// The content of a request or response, keyed by content type
+func (g openapiGenerator) content(body interface{}) map[string]interface{} {
+
+	content := map[string]interface{}{}
+
+	switch body := body.(type) {
+	case nil, noBody:
+	case binaryBody:
+		content[body.ContentType] = map[string]interface{}{
+			"schema": map[string]interface{}{"type": "string", "format": "binary"},
+		}
+	case formBody:
+		content["multipart/form-data"] = map[string]interface{}{
+			"schema": g.objectSchema(reflect.TypeOf(body.Form)),
+		}
+	case bodies:
+		for _, alternative := range body {
+			for contentType, media := range g.content(alternative) {
+				content[contentType] = media
+			}
+		}
+	default:
+		content["application/json"] = map[string]interface{}{
+			"schema": g.schema(reflect.TypeOf(body)),
+		}
+	}
+
+	return content
+
+}
+
+// The fields which are always present in types that are only ever sent in
+// responses, and so aren't tagged with binding:"required", which is for
+// validating requests
+var responseRequiredFields = map[reflect.Type][]string{
+	reflect.TypeOf(APIError{}): {"code", "message"},
+}
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	processingStateType = reflect.TypeOf(Pending)
+	binaryBodyType      = reflect.TypeOf(binaryBody{})
+)
+
+// The schema of a value of type t, as it's marshalled to JSON
+func (g openapiGenerator) schema(t reflect.Type) map[string]interface{} {
+
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case processingStateType:
+		return map[string]interface{}{
+			"type": "string",
+			"enum": []string{
+				PROCESSING_STATE_PENDING,
+				PROCESSING_STATE_PROCESSING,
+				PROCESSING_STATE_FINISHED_SUCCESSFULLY,
+				PROCESSING_STATE_FAILED,
+			},
+		}
+	case binaryBodyType:
+		return map[string]interface{}{"type": "string", "format": "binary"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return g.objectSchema(t)
+		}
+		// named structs are described once, in the components section
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := g.schemas[name]; !ok {
+			g.schemas[name] = map[string]interface{}{} // in case it refers to itself
+			g.schemas[name] = g.objectSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+
+	// eg, interface{}
+	return map[string]interface{}{}
+
+}
+
+// The schema of a struct, with a property for each field named by its json
+// tag.  Embedded structs have their fields merged in, as encoding/json does.
+func (g openapiGenerator) objectSchema(t reflect.Type) map[string]interface{} {
+
+	properties := map[string]interface{}{}
+	required := append([]string{}, responseRequiredFields[t]...)
+	g.addProperties(t, properties, &required)
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+
+}
+
+func (g openapiGenerator) addProperties(t reflect.Type, properties map[string]interface{}, required *[]string) {
+
+	for i := 0; i < t.NumField(); i++ {
+
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if field.Anonymous && len(name) == 0 && field.Type.Kind() == reflect.Struct {
+			g.addProperties(field.Type, properties, required)
+			continue
+		}
+
+		if len(name) == 0 {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+		if field.Tag.Get("binding") == "required" {
+			*required = append(*required, name)
+		}
+
+	}
+
+}
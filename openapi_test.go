@@ -0,0 +1,90 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Every route must say what it returns, and what it accepts if it takes a
+// body, or it won't be described by the spec
+func TestAPIRoutesHaveSchemas(t *testing.T) {
+
+	for _, route := range apiRoutes() {
+		if route.Response == nil || route.Status == 0 {
+			t.Errorf("No response schema for %v %v", route.Method, route.Path)
+		}
+		if (route.Method == "POST" || route.Method == "PUT") && route.Request == nil {
+			t.Errorf("No request schema for %v %v", route.Method, route.Path)
+		}
+	}
+
+}
+
+func TestGetOpenAPISpec(t *testing.T) {
+
+	config := *NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://openapi_test_%v", NewUuid())
+
+	router := NewRouter(config, &EndpointContext{Configuration: config})
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equals(t, recorder.Code, 200)
+
+	spec := map[string]interface{}{}
+	err := json.Unmarshal(recorder.Body.Bytes(), &spec)
+	assert.True(t, err == nil)
+	assert.Equals(t, spec["openapi"], "3.0.0")
+
+	paths := spec["paths"].(map[string]interface{})
+	for _, route := range apiRoutes() {
+		openapiPath, _ := openapiPathParameters(route.Path)
+		operations, ok := paths[openapiPath].(map[string]interface{})
+		if !ok {
+			t.Errorf("No path %v in the spec", openapiPath)
+			continue
+		}
+		operation, ok := operations[strings.ToLower(route.Method)].(map[string]interface{})
+		if !ok {
+			t.Errorf("No operation %v %v in the spec", route.Method, openapiPath)
+			continue
+		}
+		responses := operation["responses"].(map[string]interface{})
+		_, ok = responses[fmt.Sprint(route.Status)]
+		assert.True(t, ok)
+	}
+
+	_, ok := paths["/datafiles/{datafile-id}"]
+	assert.True(t, ok)
+	_, ok = paths["/blobs/{path}"]
+	assert.True(t, ok)
+
+	// the datafile schema matches the Datafile struct, which never includes
+	// the server configuration
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	datafile := schemas["Datafile"].(map[string]interface{})
+	properties := datafile["properties"].(map[string]interface{})
+	for _, name := range []string{"_id", "type", "user-id", "url", "processing-state"} {
+		_, ok := properties[name]
+		assert.True(t, ok)
+	}
+	_, ok = properties["layers_type"]
+	assert.False(t, ok)
+	_, ok = properties["Configuration"]
+	assert.False(t, ok)
+	assert.DeepEquals(t, datafile["required"], []interface{}{"url"})
+
+	state := properties["processing-state"].(map[string]interface{})
+	assert.Equals(t, len(state["enum"].([]interface{})), 4)
+
+	// error responses always have a code and message
+	apiError := schemas["APIError"].(map[string]interface{})
+	assert.DeepEquals(t, apiError["required"], []interface{}{"code", "message"})
+
+}
@@ -1,9 +1,126 @@
 package elasticthought
 
-import "github.com/tleyden/go-couch"
+import (
+	"fmt"
+)
 
 type Processable interface {
 	GetProcessingState() ProcessingState
 	SetProcessingState(newState ProcessingState)
-	RefreshFromDB(db couch.Database) error
+	RefreshFromDB(db DocumentStore) error
+}
+
+// A doc which gets processed by a worker job: datafiles, datasets,
+// training jobs and classify jobs.
+type JobDoc interface {
+	Processable
+	GetLease() JobLease
+	SetLease(lease JobLease)
+	SetProcessingLog(val string)
+	AddAttempt(attempt JobAttempt)
+	Failed(db DocumentStore, processingErr error) error
+}
+
+// Find the job doc with the given id, whatever type of job it is
+func FindJobDoc(config Configuration, docId string) (JobDoc, error) {
+
+	db := config.DbConnection()
+
+	doc := ElasticThoughtDoc{}
+	if err := db.Retrieve(docId, &doc); err != nil {
+		return nil, fmt.Errorf("Didn't retrieve: %v - %v", docId, err)
+	}
+
+	var jobDoc JobDoc
+	switch doc.Type {
+	case DOC_TYPE_DATAFILE:
+		jobDoc = NewDatafile(config)
+	case DOC_TYPE_DATASET:
+		jobDoc = NewDataset(config)
+	case DOC_TYPE_TRAINING_JOB:
+		jobDoc = NewTrainingJob(config)
+	case DOC_TYPE_CLASSIFY_JOB:
+		jobDoc = NewClassifyJob(config)
+	default:
+		return nil, fmt.Errorf("Doc %v with type %v is not a job", docId, doc.Type)
+	}
+
+	if err := db.Retrieve(docId, jobDoc); err != nil {
+		return nil, fmt.Errorf("Didn't retrieve: %v - %v", docId, err)
+	}
+
+	return jobDoc, nil
+
+}
+
+func (d *Datafile) GetLease() JobLease {
+	return d.Lease
+}
+
+func (d *Datafile) SetLease(lease JobLease) {
+	d.Lease = lease
+}
+
+func (d *Datafile) SetProcessingLog(val string) {
+	d.ProcessingLog = val
+}
+
+func (d *Datafile) AddAttempt(attempt JobAttempt) {
+	d.Attempts = append(d.Attempts, attempt)
+}
+
+func (d *Dataset) GetLease() JobLease {
+	return d.Lease
+}
+
+func (d *Dataset) SetLease(lease JobLease) {
+	d.Lease = lease
+}
+
+func (d *Dataset) SetProcessingLog(val string) {
+	d.ProcessingLog = val
+}
+
+func (d *Dataset) AddAttempt(attempt JobAttempt) {
+	d.Attempts = append(d.Attempts, attempt)
+}
+
+func (j *TrainingJob) GetLease() JobLease {
+	return j.Lease
+}
+
+func (j *TrainingJob) SetLease(lease JobLease) {
+	j.Lease = lease
+}
+
+func (j *TrainingJob) SetProcessingLog(val string) {
+	j.ProcessingLog = val
+}
+
+func (j *TrainingJob) AddAttempt(attempt JobAttempt) {
+	j.Attempts = append(j.Attempts, attempt)
+}
+
+func (c *ClassifyJob) GetProcessingState() ProcessingState {
+	return c.ProcessingState
+}
+
+func (c *ClassifyJob) SetProcessingState(newState ProcessingState) {
+	c.ProcessingState = newState
+}
+
+func (c *ClassifyJob) GetLease() JobLease {
+	return c.Lease
+}
+
+func (c *ClassifyJob) SetLease(lease JobLease) {
+	c.Lease = lease
+}
+
+func (c *ClassifyJob) SetProcessingLog(val string) {
+	c.ProcessingLog = val
+}
+
+func (c *ClassifyJob) AddAttempt(attempt JobAttempt) {
+	c.Attempts = append(c.Attempts, attempt)
 }
@@ -70,3 +70,17 @@ func (p ProcessingState) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("\"%v\"", stringVal)), nil
 
 }
+
+func (p ProcessingState) String() string {
+	switch p {
+	case Pending:
+		return PROCESSING_STATE_PENDING
+	case Processing:
+		return PROCESSING_STATE_PROCESSING
+	case FinishedSuccessfully:
+		return PROCESSING_STATE_FINISHED_SUCCESSFULLY
+	case Failed:
+		return PROCESSING_STATE_FAILED
+	}
+	return fmt.Sprintf("ProcessingState(%d)", int(p))
+}
@@ -0,0 +1,242 @@
+package elasticthought
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+	"github.com/dustin/httputil"
+)
+
+// How long a worker's lease on a queued job lasts unless it is renewed
+const DEFAULT_QUEUE_LEASE_TTL = time.Minute
+
+// Returned when a worker tries to renew, ack or nack a queue entry that it
+// no longer has a lease on, eg because the lease expired and another worker
+// has taken the job.
+var ErrQueueLeaseLost = errors.New("Lease on queue entry lost")
+
+// A durable queue of jobs, which workers take jobs from by leasing them.  A
+// job stays in the queue until the worker that leased it acks it, and if the
+// worker doesn't renew its lease in time, the job is handed to another
+// worker.  So jobs are delivered at least once, like with nsq.
+//
+// ScheduleJob adds a job to the back of the queue, so every backend can be
+// used as the downstream of a PriorityJobScheduler.
+type QueueBackend interface {
+	JobScheduler
+
+	// Lease the job at the front of the queue for ttl.  Returns nil if there
+	// are no jobs available.
+	Lease(workerID string, ttl time.Duration) (*QueueEntry, error)
+
+	// Extend the lease on an entry for another ttl
+	Renew(entryID, workerID string, ttl time.Duration) error
+
+	// Remove a leased entry from the queue, once its job is done
+	Ack(entryID, workerID string) error
+
+	// Give up the lease on an entry, so that it can be leased again after
+	// the delay
+	Nack(entryID, workerID string, delay time.Duration) error
+}
+
+// A job in a QueueBackend
+type QueueEntry struct {
+	ID            string        `json:"id"`
+	JobDescriptor JobDescriptor `json:"job-descriptor"`
+	Enqueued      time.Time     `json:"enqueued"`
+
+	// The entry can't be leased until this time, either because it's
+	// already leased or because it was nacked with a delay
+	VisibleAt time.Time `json:"visible-at"`
+
+	// The worker with the current or most recent lease
+	WorkerID string `json:"worker-id,omitempty"`
+
+	// How many times the entry has been leased
+	Attempts int `json:"attempts"`
+}
+
+// The doc holding the entries of a DocumentStoreQueue, in queue order
+type JobQueueDoc struct {
+	ElasticThoughtDoc
+	Entries []QueueEntry `json:"entries"`
+}
+
+// A QueueBackend kept in a single doc in the document store, so that it
+// survives restarts without running nsq.  Every operation is a CAS update
+// of the doc, so several REST servers and workers can share the queue.  With
+// the embedded document store, this makes for a durable queue on local disk.
+//
+// Since every lease, renew, ack and nack rewrites the whole doc, and
+// concurrent updates retry until they win, this is meant for a modest
+// number of workers and queued jobs: tens of workers and up to a few
+// thousand entries.  Beyond that, contention on the doc and its size make
+// every operation slow, and nsq is the better choice.  The entries aren't
+// split into a doc each since the document store can only list docs by
+// scanning all of them, which would make every lease slower still.
+type DocumentStoreQueue struct {
+	Configuration Configuration
+	Clock         Clock
+	DocId         string
+}
+
+func NewDocumentStoreQueue(c Configuration) *DocumentStoreQueue {
+	return &DocumentStoreQueue{
+		Configuration: c,
+		Clock:         systemClock{},
+		DocId:         JOB_QUEUE_DOC_ID,
+	}
+}
+
+func (q *DocumentStoreQueue) String() string {
+	return fmt.Sprintf("%v/%v", q.Configuration.DbUrl, q.DocId)
+}
+
+func (q *DocumentStoreQueue) ScheduleJob(jobDescriptor JobDescriptor) error {
+
+	now := q.Clock.Now()
+	entry := QueueEntry{
+		ID:            NewUuid(),
+		JobDescriptor: jobDescriptor,
+		Enqueued:      now,
+		VisibleAt:     now,
+	}
+
+	err := q.update(func(queue *JobQueueDoc) error {
+		queue.Entries = append(queue.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logg.LogTo("JOB_SCHEDULER", "Queued %v as %v", jobDescriptor.DocIdToProcess, entry.ID)
+	return nil
+
+}
+
+func (q *DocumentStoreQueue) Lease(workerID string, ttl time.Duration) (*QueueEntry, error) {
+
+	var leased *QueueEntry
+	err := q.update(func(queue *JobQueueDoc) error {
+		leased = nil
+		now := q.Clock.Now()
+		for i, entry := range queue.Entries {
+			if entry.VisibleAt.After(now) {
+				continue
+			}
+			if len(entry.WorkerID) > 0 && entry.WorkerID != workerID {
+				logg.LogTo("JOB_SCHEDULER", "Lease on %v held by %v expired, releasing", entry.ID, entry.WorkerID)
+			}
+			entry.WorkerID = workerID
+			entry.VisibleAt = now.Add(ttl)
+			entry.Attempts += 1
+			queue.Entries[i] = entry
+			leased = &entry
+			return nil
+		}
+		return errQueueUnchanged
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leased, nil
+
+}
+
+func (q *DocumentStoreQueue) Renew(entryID, workerID string, ttl time.Duration) error {
+	return q.updateEntry(entryID, workerID, func(queue *JobQueueDoc, i int) {
+		queue.Entries[i].VisibleAt = q.Clock.Now().Add(ttl)
+	})
+}
+
+func (q *DocumentStoreQueue) Ack(entryID, workerID string) error {
+	return q.updateEntry(entryID, workerID, func(queue *JobQueueDoc, i int) {
+		queue.Entries = append(queue.Entries[:i], queue.Entries[i+1:]...)
+	})
+}
+
+func (q *DocumentStoreQueue) Nack(entryID, workerID string, delay time.Duration) error {
+	return q.updateEntry(entryID, workerID, func(queue *JobQueueDoc, i int) {
+		queue.Entries[i].WorkerID = ""
+		queue.Entries[i].VisibleAt = q.Clock.Now().Add(delay)
+	})
+}
+
+// The entries currently in the queue, leased or not
+func (q *DocumentStoreQueue) Entries() ([]QueueEntry, error) {
+	queue := &JobQueueDoc{}
+	err := q.Configuration.DbConnection().Retrieve(q.DocId, queue)
+	if httputil.IsHTTPStatus(err, 404) {
+		return []QueueEntry{}, nil
+	}
+	return queue.Entries, err
+}
+
+// Returned by an updater to skip saving the queue doc
+var errQueueUnchanged = errors.New("Queue unchanged")
+
+// Apply the updater to the entry leased by workerID, failing with
+// ErrQueueLeaseLost if there's no such lease
+func (q *DocumentStoreQueue) updateEntry(entryID, workerID string, updater func(queue *JobQueueDoc, i int)) error {
+	return q.update(func(queue *JobQueueDoc) error {
+		for i, entry := range queue.Entries {
+			if entry.ID == entryID && entry.WorkerID == workerID {
+				updater(queue, i)
+				return nil
+			}
+		}
+		return ErrQueueLeaseLost
+	})
+}
+
+// Apply the updater to the latest revision of the queue doc and save it,
+// creating the doc if needed, and starting over if someone else updated it
+// in the meantime.
+func (q *DocumentStoreQueue) update(updater func(queue *JobQueueDoc) error) error {
+
+	db := q.Configuration.DbConnection()
+
+	for {
+
+		queue := &JobQueueDoc{}
+		err := db.Retrieve(q.DocId, queue)
+		exists := err == nil
+		if err != nil && !httputil.IsHTTPStatus(err, 404) {
+			return fmt.Errorf("Error retrieving job queue: %v.  Err: %v", q.DocId, err)
+		}
+		if !exists {
+			queue = &JobQueueDoc{
+				ElasticThoughtDoc: ElasticThoughtDoc{Type: DOC_TYPE_JOB_QUEUE},
+				Entries:           []QueueEntry{},
+			}
+		}
+
+		err = updater(queue)
+		if err == errQueueUnchanged {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			_, err = db.Edit(queue)
+		} else {
+			_, _, err = db.InsertWith(queue, q.DocId)
+		}
+		if httputil.IsHTTPStatus(err, 409) {
+			logg.LogTo("JOB_SCHEDULER", "Job queue updated concurrently, retrying")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Error saving job queue: %v.  Err: %v", q.DocId, err)
+		}
+		return nil
+
+	}
+
+}
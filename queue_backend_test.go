@@ -0,0 +1,112 @@
+package elasticthought
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// A queue in its own in-memory document store
+func newTestDocumentStoreQueue() (*DocumentStoreQueue, *FakeClock) {
+	config := NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://queue_backend_test_%v", NewUuid())
+	clock := NewFakeClock(time.Date(2015, 3, 2, 18, 0, 0, 0, time.UTC))
+	queue := NewDocumentStoreQueue(*config)
+	queue.Clock = clock
+	return queue, clock
+}
+
+// Exercise a queue backend, whose entries become visible again when the
+// clock is advanced
+func testQueueBackend(t *testing.T, queue QueueBackend, clock *FakeClock) {
+
+	entry, err := queue.Lease("worker1", time.Minute)
+	assert.True(t, err == nil)
+	assert.True(t, entry == nil)
+
+	assert.True(t, queue.ScheduleJob(JobDescriptor{DocIdToProcess: "job1"}) == nil)
+	assert.True(t, queue.ScheduleJob(JobDescriptor{DocIdToProcess: "job2"}) == nil)
+
+	// jobs are leased in order, and only to one worker at a time
+	first, err := queue.Lease("worker1", time.Minute)
+	assert.True(t, err == nil)
+	assert.Equals(t, first.JobDescriptor.DocIdToProcess, "job1")
+	assert.Equals(t, first.Attempts, 1)
+
+	second, err := queue.Lease("worker2", time.Minute)
+	assert.True(t, err == nil)
+	assert.Equals(t, second.JobDescriptor.DocIdToProcess, "job2")
+
+	entry, err = queue.Lease("worker3", time.Minute)
+	assert.True(t, err == nil)
+	assert.True(t, entry == nil)
+
+	// a renewed lease outlives the original ttl, but an unrenewed one
+	// expires and goes to another worker
+	clock.Advance(30 * time.Second)
+	assert.True(t, queue.Renew(first.ID, "worker1", time.Minute) == nil)
+	clock.Advance(45 * time.Second)
+
+	entry, err = queue.Lease("worker3", time.Minute)
+	assert.True(t, err == nil)
+	assert.Equals(t, entry.ID, second.ID)
+	assert.Equals(t, entry.Attempts, 2)
+
+	// the worker which lost the lease can't ack it
+	assert.Equals(t, queue.Ack(second.ID, "worker2"), ErrQueueLeaseLost)
+	assert.Equals(t, queue.Renew(second.ID, "worker2", time.Minute), ErrQueueLeaseLost)
+	assert.True(t, queue.Ack(second.ID, "worker3") == nil)
+
+	// a nacked entry can be leased again after the delay
+	assert.True(t, queue.Nack(first.ID, "worker1", time.Minute) == nil)
+	entry, err = queue.Lease("worker2", time.Minute)
+	assert.True(t, err == nil)
+	assert.True(t, entry == nil)
+
+	clock.Advance(time.Minute)
+	entry, err = queue.Lease("worker2", time.Minute)
+	assert.True(t, err == nil)
+	assert.Equals(t, entry.ID, first.ID)
+	assert.Equals(t, entry.Attempts, 2)
+
+	assert.True(t, queue.Ack(first.ID, "worker2") == nil)
+	assert.Equals(t, queue.Ack(first.ID, "worker2"), ErrQueueLeaseLost)
+
+}
+
+func TestDocumentStoreQueue(t *testing.T) {
+
+	queue, clock := newTestDocumentStoreQueue()
+	testQueueBackend(t, queue, clock)
+
+	entries, err := queue.Entries()
+	assert.True(t, err == nil)
+	assert.Equals(t, len(entries), 0)
+
+}
+
+func TestHttpQueue(t *testing.T) {
+
+	backend, clock := newTestDocumentStoreQueue()
+	config := backend.Configuration
+	config.QueueToken = "secret"
+	context := &EndpointContext{
+		Configuration: config,
+		QueueBackend:  backend,
+	}
+
+	server := httptest.NewServer(NewRouter(config, context))
+	defer server.Close()
+
+	config.QueueUrl = server.URL + "/"
+	testQueueBackend(t, NewHttpQueue(config), clock)
+
+	// a worker without the right token can't touch the queue
+	config.QueueToken = "wrong"
+	_, err := NewHttpQueue(config).Lease("worker1", time.Minute)
+	assert.True(t, err != nil)
+
+}
@@ -0,0 +1,319 @@
+package elasticthought
+
+import (
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+)
+
+// How long a QueueWorker waits before asking an empty queue for jobs again
+const DEFAULT_QUEUE_POLL_INTERVAL = 5 * time.Second
+
+// A worker which leases jobs from a QueueBackend and processes them.  Like
+// the NsqWorker, it only takes as many jobs as its worker pool can run, and
+// keeps each job's lease alive until the job is done with.
+type QueueWorker struct {
+	Configuration Configuration
+	Queue         QueueBackend
+	WorkerPool    *WorkerPool
+	WorkerID      string
+	Clock         Clock
+
+	// How long each lease lasts.  Leases are renewed every third of this.
+	LeaseTTL time.Duration
+
+	// How long to wait before polling an empty queue again
+	PollInterval time.Duration
+
+	// How long Drain waits for running jobs to finish
+	DrainTimeout time.Duration
+
+	mutex     sync.Mutex
+	inFlight  int
+	running   map[string]QueueEntry
+	slotFreed chan struct{} // closed when a job finishes, if non-nil
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// A job along with the queue entry it came from, which isn't acked until
+// the job has finished.  Its lease is renewed from the moment it's leased,
+// so that it doesn't expire while the job waits for a slot in the worker
+// pool.
+type queueJob struct {
+	Runnable
+	worker    *QueueWorker
+	entry     QueueEntry
+	heartbeat *leaseHeartbeat
+}
+
+func (j queueJob) JobType() string {
+	if typer, ok := j.Runnable.(JobTyper); ok {
+		return typer.JobType()
+	}
+	return ""
+}
+
+func (j queueJob) Run(wg *sync.WaitGroup) {
+	j.worker.run(j, wg)
+}
+
+func NewQueueWorker(c Configuration, queue QueueBackend) *QueueWorker {
+	return &QueueWorker{
+		Configuration: c,
+		Queue:         queue,
+		WorkerPool:    NewWorkerPool(c),
+		WorkerID:      DefaultWorkerID(),
+		Clock:         systemClock{},
+		LeaseTTL:      DEFAULT_QUEUE_LEASE_TTL,
+		PollInterval:  DEFAULT_QUEUE_POLL_INTERVAL,
+		DrainTimeout:  DEFAULT_WORKER_DRAIN_TIMEOUT,
+		running:       map[string]QueueEntry{},
+	}
+}
+
+// Start leasing jobs from the queue in the background
+func (w *QueueWorker) HandleEvents() {
+
+	w.mutex.Lock()
+	w.stop = make(chan struct{})
+	w.stopped = make(chan struct{})
+	w.mutex.Unlock()
+
+	go w.poll()
+
+	logg.LogTo("QUEUE_WORKER", "Leasing jobs from %v as %v", w.Queue, w.WorkerID)
+
+}
+
+// Lease jobs whenever the worker pool has room for them, until Drain is called
+func (w *QueueWorker) poll() {
+
+	defer close(w.stopped)
+
+	for {
+
+		w.mutex.Lock()
+		full := w.inFlight >= w.WorkerPool.concurrencyLimit()
+		if full && w.slotFreed == nil {
+			w.slotFreed = make(chan struct{})
+		}
+		slotFreed := w.slotFreed
+		w.mutex.Unlock()
+
+		// when the pool is full, wait for a job to finish rather than polling
+		var wait <-chan time.Time
+		if !full {
+			if w.leaseOne() {
+				continue
+			}
+			wait = w.Clock.After(w.PollInterval)
+		}
+
+		select {
+		case <-w.stop:
+			return
+		case <-slotFreed:
+		case <-wait:
+		}
+
+	}
+
+}
+
+// Lease a job and submit it to the worker pool.  Returns false if there
+// were no jobs to lease, or leasing failed.
+func (w *QueueWorker) leaseOne() bool {
+
+	entry, err := w.Queue.Lease(w.WorkerID, w.LeaseTTL)
+	if err != nil {
+		logg.LogTo("QUEUE_WORKER", "Error leasing job: %v", err)
+		return false
+	}
+	if entry == nil {
+		return false
+	}
+
+	logg.LogTo("QUEUE_WORKER", "Leased %v: %+v", entry.ID, entry.JobDescriptor)
+
+	job, err := CreateJob(w.Configuration, entry.JobDescriptor)
+	if err != nil {
+		backoff := retryBackoff(entry.Attempts)
+		logg.LogTo("QUEUE_WORKER", "Error creating job from: %+v, nacking in %v.  Err: %v", entry.JobDescriptor, backoff, err)
+		w.nack(*entry, backoff)
+		return true
+	}
+
+	w.submit(*entry, job)
+	return true
+
+}
+
+// Run the job once there is a free slot in the worker pool, renewing the
+// lease on its entry in the meantime
+func (w *QueueWorker) submit(entry QueueEntry, job Runnable) {
+
+	w.mutex.Lock()
+	w.inFlight += 1
+	w.mutex.Unlock()
+
+	renew := func() (bool, error) {
+		err := w.Queue.Renew(entry.ID, w.WorkerID, w.LeaseTTL)
+		if err == ErrQueueLeaseLost {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	// another worker may lease the entry once it's lost, so a job which is
+	// already running is killed, and one that isn't won't be started
+	lost := func() {
+		killJobWithLostLease(w.Configuration, entry.JobDescriptor.DocIdToProcess)
+	}
+
+	heartbeat := startLeaseHeartbeat(w.Clock, w.LeaseTTL/3, renew, lost)
+
+	err := w.WorkerPool.Submit(entry.JobDescriptor, queueJob{
+		Runnable:  job,
+		worker:    w,
+		entry:     entry,
+		heartbeat: heartbeat,
+	})
+	if err != nil {
+		// Drain started in the meantime, so hand the entry back right away
+		logg.LogTo("QUEUE_WORKER", "Could not submit %+v, nacking: %v", entry.JobDescriptor, err)
+		heartbeat.Stop()
+		w.nack(entry, 0)
+		w.mutex.Lock()
+		w.finished()
+		w.mutex.Unlock()
+	}
+
+}
+
+// Run the job, and then stop renewing its lease and ack or nack the entry
+// depending on how the job went.  If the lease was lost, the entry is left
+// to whichever worker leases it next.
+func (w *QueueWorker) run(job queueJob, wg *sync.WaitGroup) {
+
+	if job.heartbeat.Lost() {
+		logg.LogTo("QUEUE_WORKER", "Lost lease on %v before it started, not running it", job.entry.ID)
+		wg.Done()
+		w.mutex.Lock()
+		w.finished()
+		w.mutex.Unlock()
+		return
+	}
+
+	w.mutex.Lock()
+	w.running[job.entry.ID] = job.entry
+	w.mutex.Unlock()
+
+	job.Runnable.Run(wg)
+
+	job.heartbeat.Stop()
+	if job.heartbeat.Lost() {
+		logg.LogTo("QUEUE_WORKER", "Lost lease on %v while it was running", job.entry.ID)
+	} else {
+		w.respond(job.entry)
+	}
+
+	w.mutex.Lock()
+	delete(w.running, job.entry.ID)
+	w.finished()
+	w.mutex.Unlock()
+
+}
+
+// Ack the entry if the job is done with, otherwise nack it with a backoff
+// so that it's leased again
+func (w *QueueWorker) respond(entry QueueEntry) {
+
+	docId := entry.JobDescriptor.DocIdToProcess
+
+	done, reason := jobIsDone(w.Configuration, docId)
+	if done {
+		logg.LogTo("QUEUE_WORKER", "Job %v %v, acking", docId, reason)
+		if err := w.Queue.Ack(entry.ID, w.WorkerID); err != nil {
+			logg.LogTo("QUEUE_WORKER", "Error acking %v: %v", entry.ID, err)
+		}
+		return
+	}
+
+	backoff := retryBackoff(entry.Attempts)
+	logg.LogTo("QUEUE_WORKER", "Job %v %v, nacking in %v", docId, reason, backoff)
+	w.nack(entry, backoff)
+
+}
+
+func (w *QueueWorker) nack(entry QueueEntry, delay time.Duration) {
+	if err := w.Queue.Nack(entry.ID, w.WorkerID, delay); err != nil {
+		logg.LogTo("QUEUE_WORKER", "Error nacking %v: %v", entry.ID, err)
+	}
+}
+
+// Called with the mutex held when a job has finished running or won't run
+func (w *QueueWorker) finished() {
+	w.inFlight -= 1
+	if w.slotFreed != nil {
+		close(w.slotFreed)
+		w.slotFreed = nil
+	}
+}
+
+// Shut down gracefully: stop leasing jobs, wait up to the DrainTimeout for
+// running jobs to finish, and nack the jobs that never got started or didn't
+// finish in time so that another worker can lease them right away.
+func (w *QueueWorker) Drain() {
+
+	w.mutex.Lock()
+	stop, stopped := w.stop, w.stopped
+	w.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+
+	unstarted, finishedInTime := w.WorkerPool.Drain(w.DrainTimeout)
+	if !finishedInTime {
+		logg.LogTo("QUEUE_WORKER", "Running jobs did not finish within %v, nacking them", w.DrainTimeout)
+		w.mutex.Lock()
+		running := []QueueEntry{}
+		for _, entry := range w.running {
+			running = append(running, entry)
+		}
+		w.mutex.Unlock()
+		for _, entry := range running {
+			w.nack(entry, 0)
+		}
+	}
+
+	for _, job := range unstarted {
+		if job, ok := job.(queueJob); ok {
+			logg.LogTo("QUEUE_WORKER", "Nacking unstarted job: %+v", job.entry.JobDescriptor)
+			job.heartbeat.Stop()
+			w.nack(job.entry, 0)
+			w.mutex.Lock()
+			w.finished()
+			w.mutex.Unlock()
+		}
+	}
+
+	logg.LogTo("QUEUE_WORKER", "Drained")
+
+}
+
+// Lease jobs until the process gets a SIGINT or SIGTERM, then Drain
+func (w *QueueWorker) RunUntilSignalled() error {
+
+	w.HandleEvents()
+
+	received := WaitForShutdownSignal()
+	logg.LogTo("QUEUE_WORKER", "Got %v, draining", received)
+
+	w.Drain()
+	return nil
+
+}
@@ -0,0 +1,165 @@
+package elasticthought
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// A worker for a queue in its own in-memory document store
+func newTestQueueWorker() (*QueueWorker, *DocumentStoreQueue) {
+	queue, clock := newTestDocumentStoreQueue()
+	worker := NewQueueWorker(queue.Configuration, queue)
+	worker.Clock = clock
+	worker.WorkerPool = &WorkerPool{
+		Concurrency: map[string]int{DOC_TYPE_TRAINING_JOB: 1},
+	}
+	worker.DrainTimeout = time.Minute
+	return worker, queue
+}
+
+// Lease the next entry and hand it to the worker along with the given job,
+// the way leaseOne does for jobs it creates itself
+func submitTestQueueJob(t *testing.T, worker *QueueWorker, queue *DocumentStoreQueue, job Runnable) QueueEntry {
+	entry, err := queue.Lease(worker.WorkerID, worker.LeaseTTL)
+	assert.True(t, err == nil)
+	worker.submit(*entry, job)
+	return *entry
+}
+
+func TestQueueWorkerAcksFinishedJobs(t *testing.T) {
+
+	worker, queue := newTestQueueWorker()
+
+	// the job doc doesn't exist, so the job is done with once it has run
+	assert.True(t, queue.ScheduleJob(JobDescriptor{DocIdToProcess: "missing"}) == nil)
+	submitTestQueueJob(t, worker, queue, noopJob{})
+	worker.WorkerPool.Wait()
+
+	entries, err := queue.Entries()
+	assert.True(t, err == nil)
+	assert.Equals(t, len(entries), 0)
+	assert.Equals(t, worker.inFlight, 0)
+
+}
+
+func TestQueueWorkerDrain(t *testing.T) {
+
+	worker, queue := newTestQueueWorker()
+
+	started := make(chan string, 2)
+	release := make(chan bool)
+	job := func(id string) blockingJob {
+		return blockingJob{jobType: DOC_TYPE_TRAINING_JOB, started: started, release: release, id: id}
+	}
+
+	assert.True(t, queue.ScheduleJob(JobDescriptor{DocIdToProcess: "t1"}) == nil)
+	assert.True(t, queue.ScheduleJob(JobDescriptor{DocIdToProcess: "t2"}) == nil)
+	submitTestQueueJob(t, worker, queue, job("t1"))
+	unstarted := submitTestQueueJob(t, worker, queue, job("t2"))
+	assert.Equals(t, <-started, "t1")
+
+	drained := make(chan struct{})
+	go func() {
+		worker.Drain()
+		close(drained)
+	}()
+	waitUntilDraining(worker.WorkerPool)
+	close(release)
+	<-drained
+
+	// the running job was acked, and the unstarted one nacked so that it
+	// can be leased again right away
+	entries, err := queue.Entries()
+	assert.True(t, err == nil)
+	assert.Equals(t, len(entries), 1)
+	assert.Equals(t, entries[0].ID, unstarted.ID)
+	assert.Equals(t, entries[0].WorkerID, "")
+	assert.Equals(t, worker.inFlight, 0)
+
+}
+
+func TestQueueWorkerRenewsQueuedJobs(t *testing.T) {
+
+	worker, queue := newTestQueueWorker()
+	clock := worker.Clock.(*FakeClock)
+
+	started := make(chan string, 2)
+	release := make(chan bool)
+	job := func(id string) blockingJob {
+		return blockingJob{jobType: DOC_TYPE_TRAINING_JOB, started: started, release: release, id: id}
+	}
+
+	assert.True(t, queue.ScheduleJob(JobDescriptor{DocIdToProcess: "t1"}) == nil)
+	assert.True(t, queue.ScheduleJob(JobDescriptor{DocIdToProcess: "t2"}) == nil)
+	submitTestQueueJob(t, worker, queue, job("t1"))
+	queued := submitTestQueueJob(t, worker, queue, job("t2"))
+	assert.Equals(t, <-started, "t1")
+
+	// the lease of the job waiting for a slot is renewed too, so that it
+	// isn't leased by another worker
+	for i := 0; i < 1000 && clock.NumWaiters() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(worker.LeaseTTL / 3)
+	renewed := queued.VisibleAt.Add(worker.LeaseTTL / 3)
+	for i := 0; i < 1000; i++ {
+		entries, err := queue.Entries()
+		assert.True(t, err == nil)
+		if entries[len(entries)-1].VisibleAt.Equal(renewed) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	entries, err := queue.Entries()
+	assert.True(t, err == nil)
+	assert.Equals(t, entries[len(entries)-1].ID, queued.ID)
+	assert.Equals(t, entries[len(entries)-1].VisibleAt, renewed)
+
+	close(release)
+	worker.WorkerPool.Wait()
+
+}
+
+func TestQueueWorkerLostLease(t *testing.T) {
+
+	worker, queue := newTestQueueWorker()
+	clock := worker.Clock.(*FakeClock)
+	executor := NewFakeExecutor(nil)
+	worker.Configuration.Executor = executor
+
+	started := make(chan string, 2)
+	release := make(chan bool)
+	job := func(id string) blockingJob {
+		return blockingJob{jobType: DOC_TYPE_TRAINING_JOB, started: started, release: release, id: id}
+	}
+
+	assert.True(t, queue.ScheduleJob(JobDescriptor{DocIdToProcess: "t1"}) == nil)
+	assert.True(t, queue.ScheduleJob(JobDescriptor{DocIdToProcess: "t2"}) == nil)
+	running := submitTestQueueJob(t, worker, queue, job("t1"))
+	queued := submitTestQueueJob(t, worker, queue, job("t2"))
+	assert.Equals(t, <-started, "t1")
+
+	// both leases are lost, eg because they expired and went to another worker
+	assert.True(t, queue.Nack(running.ID, worker.WorkerID, 0) == nil)
+	assert.True(t, queue.Nack(queued.ID, worker.WorkerID, 0) == nil)
+	for i := 0; i < 1000 && clock.NumWaiters() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(worker.LeaseTTL / 3)
+	for i := 0; i < 1000 && len(executor.Killed()) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, containsString(executor.Killed(), "t1"))
+
+	// the queued job is never started, and neither entry is acked
+	close(release)
+	worker.WorkerPool.Wait()
+	assert.Equals(t, len(started), 0)
+	entries, err := queue.Entries()
+	assert.True(t, err == nil)
+	assert.Equals(t, len(entries), 2)
+	assert.Equals(t, worker.inFlight, 0)
+
+}
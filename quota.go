@@ -0,0 +1,336 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits on how much of the cluster a user can use.  A limit of zero means
+// unlimited.
+type Quota struct {
+	MaxBlobBytes              int64   `json:"max-blob-bytes"`
+	MaxConcurrentTrainingJobs int     `json:"max-concurrent-training-jobs"`
+	MaxTrainingHoursPerMonth  float64 `json:"max-training-hours-per-month"`
+	MaxClassifyRequestsPerDay int     `json:"max-classify-requests-per-day"`
+}
+
+// How much of the cluster a user is currently using
+type Usage struct {
+	BlobBytes              int64   `json:"blob-bytes"`
+	ConcurrentTrainingJobs int     `json:"concurrent-training-jobs"`
+	TrainingHoursThisMonth float64 `json:"training-hours-this-month"`
+	ClassifyRequestsToday  int     `json:"classify-requests-today"`
+}
+
+// How long the usage that quotas are checked against can be out of date.
+// See UsageCache.
+const DEFAULT_USAGE_CACHE_TTL = 30 * time.Second
+
+// Returned when an action would take a user over one of their quotas.  The
+// status is the http status code the REST api should respond with: 429 for
+// limits which reset over time, 403 for the rest.
+type QuotaError struct {
+	Status int
+	Quota  string
+	Limit  interface{}
+	Used   interface{}
+}
+
+func (e QuotaError) Error() string {
+	return fmt.Sprintf("Quota exceeded: %v.  Limit: %v, used: %v", e.Quota, e.Limit, e.Used)
+}
+
+// Check that none of the limits are negative.  Zero means unlimited.
+func (q Quota) validate() error {
+	if q.MaxBlobBytes < 0 || q.MaxConcurrentTrainingJobs < 0 ||
+		q.MaxTrainingHoursPerMonth < 0 || q.MaxClassifyRequestsPerDay < 0 {
+		return fmt.Errorf("Quota limits can't be negative: %+v", q)
+	}
+	return nil
+}
+
+// The actions which are subject to quotas
+const (
+	QUOTA_ACTION_STORE_BLOBS = "store-blobs"
+	QUOTA_ACTION_TRAIN       = "train"
+	QUOTA_ACTION_CLASSIFY    = "classify"
+)
+
+// Check whether a user with the given usage is allowed to perform the
+// action, and return a QuotaError if not.  Concurrent training jobs aren't
+// checked here, since extra training jobs wait in the queue rather than
+// being rejected.
+func (q Quota) Check(usage Usage, action string) error {
+
+	if q.MaxBlobBytes > 0 && usage.BlobBytes >= q.MaxBlobBytes {
+		return QuotaError{
+			Status: 403,
+			Quota:  "max-blob-bytes",
+			Limit:  q.MaxBlobBytes,
+			Used:   usage.BlobBytes,
+		}
+	}
+
+	switch action {
+	case QUOTA_ACTION_TRAIN:
+		if q.MaxTrainingHoursPerMonth > 0 && usage.TrainingHoursThisMonth >= q.MaxTrainingHoursPerMonth {
+			return QuotaError{
+				Status: 403,
+				Quota:  "max-training-hours-per-month",
+				Limit:  q.MaxTrainingHoursPerMonth,
+				Used:   usage.TrainingHoursThisMonth,
+			}
+		}
+	case QUOTA_ACTION_CLASSIFY:
+		if q.MaxClassifyRequestsPerDay > 0 && usage.ClassifyRequestsToday >= q.MaxClassifyRequestsPerDay {
+			return QuotaError{
+				Status: 429,
+				Quota:  "max-classify-requests-per-day",
+				Limit:  q.MaxClassifyRequestsPerDay,
+				Used:   usage.ClassifyRequestsToday,
+			}
+		}
+	}
+
+	return nil
+
+}
+
+// Figure out how much the user is using, from the job docs they own and the
+// sizes of the blobs stored for those docs.
+func ComputeUsage(config Configuration, db DocumentStore, userID string, now time.Time) (Usage, error) {
+
+	usages, err := computeAllUsages(config, db, now)
+	if err != nil {
+		return Usage{}, err
+	}
+	return usages[userID], nil
+
+}
+
+// Figure out how much every user is using.  This reads every doc and lists
+// every blob, so it's the same amount of work however many users there are.
+//
+// Key: user id
+// Value: the user's usage
+func computeAllUsages(config Configuration, db DocumentStore, now time.Time) (map[string]Usage, error) {
+
+	rows, err := allDocs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	blobStore, err := config.NewBlobStoreClient()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := blobStore.List("")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing blobs.  Err: %v", err)
+	}
+
+	return computeUsages(rows, blobs, now)
+
+}
+
+func computeUsage(rows []allDocsRow, blobs []BlobInfo, userID string, now time.Time) (Usage, error) {
+
+	usages, err := computeUsages(rows, blobs, now)
+	if err != nil {
+		return Usage{}, err
+	}
+	return usages[userID], nil
+
+}
+
+func computeUsages(rows []allDocsRow, blobs []BlobInfo, now time.Time) (map[string]Usage, error) {
+
+	usages := map[string]Usage{}
+
+	owners, err := docOwners(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, blob := range blobs {
+		docId, err := blobPathDocId(blob.Path)
+		if err != nil {
+			continue
+		}
+		userID, ok := owners[docId]
+		if !ok {
+			continue
+		}
+		usage := usages[userID]
+		usage.BlobBytes += blob.Size
+		usages[userID] = usage
+	}
+
+	now = now.UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	for _, row := range rows {
+
+		userID, ok := owners[row.Id]
+		if !ok {
+			continue
+		}
+
+		doc := struct {
+			ElasticThoughtDoc
+			ProcessingState ProcessingState `json:"processing-state"`
+			Lease           JobLease        `json:"lease"`
+			Attempts        []JobAttempt    `json:"attempts"`
+			CreatedAt       time.Time       `json:"created-at"`
+		}{}
+		if err := json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, fmt.Errorf("Error decoding doc: %v.  Err: %v", row.Id, err)
+		}
+
+		usage := usages[userID]
+		switch doc.Type {
+		case DOC_TYPE_TRAINING_JOB:
+			if doc.ProcessingState == Processing {
+				usage.ConcurrentTrainingJobs += 1
+			}
+			usage.TrainingHoursThisMonth += jobHoursSince(doc.Lease, doc.Attempts, monthStart, now)
+		case DOC_TYPE_CLASSIFY_JOB:
+			if !doc.CreatedAt.Before(dayStart) {
+				usage.ClassifyRequestsToday += 1
+			}
+		}
+		usages[userID] = usage
+
+	}
+
+	return usages, nil
+
+}
+
+// How many hours the job was processed for, counting only the time after
+// since.  Each unsuccessful attempt records how long it ran, and the latest
+// lease counts too unless it's one of those attempts.  Leases which haven't
+// been released yet count up until now.
+func jobHoursSince(lease JobLease, attempts []JobAttempt, since, now time.Time) float64 {
+
+	hours := 0.0
+	leaseIsAttempt := false
+	for _, attempt := range attempts {
+		hours += hoursBetween(attempt.Started, attempt.Failed, since)
+		if !attempt.Started.IsZero() && attempt.Started.Equal(lease.Acquired) {
+			leaseIsAttempt = true
+		}
+	}
+
+	if !leaseIsAttempt {
+		end := lease.Released
+		if end.IsZero() {
+			end = now
+		}
+		hours += hoursBetween(lease.Acquired, end, since)
+	}
+
+	return hours
+
+}
+
+// How many hours there are between start and end, counting only the time
+// after since.  Unknown start times count as nothing.
+func hoursBetween(start, end, since time.Time) float64 {
+
+	if start.IsZero() {
+		return 0
+	}
+	if start.Before(since) {
+		start = since
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start).Hours()
+
+}
+
+// Computing usage reads every doc and lists every blob, which is too much to
+// do for every request that's subject to a quota.  The cache computes the
+// usage of all users at once, and reuses it for TTL.  Users can go over
+// their quota by as much as they manage to do in that time.
+type UsageCache struct {
+	Configuration Configuration
+	TTL           time.Duration
+
+	mutex    sync.Mutex
+	computed time.Time
+	usages   map[string]Usage
+}
+
+func NewUsageCache(c Configuration) *UsageCache {
+	return &UsageCache{
+		Configuration: c,
+		TTL:           DEFAULT_USAGE_CACHE_TTL,
+	}
+}
+
+// Get the user's usage, recomputing the usage of all users if it's older
+// than the TTL
+func (u *UsageCache) Usage(db DocumentStore, userID string, now time.Time) (Usage, error) {
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.usages == nil || now.Sub(u.computed) >= u.TTL || now.Before(u.computed) {
+		usages, err := computeAllUsages(u.Configuration, db, now)
+		if err != nil {
+			return Usage{}, err
+		}
+		u.usages = usages
+		u.computed = now
+	}
+
+	return u.usages[userID], nil
+
+}
+
+// Find the owner of every doc, following references to parent docs for docs
+// that don't have a user-id of their own (see FindDocumentOwner).
+//
+// Key: doc id
+// Value: user id of the owner
+func docOwners(rows []allDocsRow) (map[string]string, error) {
+
+	docs := map[string]ownedDoc{}
+	for _, row := range rows {
+		doc := ownedDoc{}
+		if err := json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, fmt.Errorf("Error decoding doc: %v.  Err: %v", row.Id, err)
+		}
+		docs[row.Id] = doc
+	}
+
+	owners := map[string]string{}
+	for docId := range docs {
+		id := docId
+		for i := 0; i < maxOwnerLookupDepth; i++ {
+			doc, ok := docs[id]
+			if !ok {
+				break
+			}
+			if len(doc.UserID) > 0 {
+				owners[docId] = doc.UserID
+				break
+			}
+			parentIds := doc.parentIds()
+			if len(parentIds) == 0 {
+				break
+			}
+			id = parentIds[0]
+		}
+	}
+
+	return owners, nil
+
+}
@@ -0,0 +1,208 @@
+package elasticthought
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestComputeUsage(t *testing.T) {
+
+	now := time.Date(2015, time.March, 2, 12, 0, 0, 0, time.UTC)
+
+	docs := map[string]interface{}{
+		"datafile": map[string]interface{}{
+			"type":    DOC_TYPE_DATAFILE,
+			"user-id": "user:foo",
+		},
+		"dataset": map[string]interface{}{
+			"type":     DOC_TYPE_DATASET,
+			"training": map[string]interface{}{"datafile-id": "datafile"},
+		},
+		// started last month, still running
+		"training-running": map[string]interface{}{
+			"type":             DOC_TYPE_TRAINING_JOB,
+			"user-id":          "user:foo",
+			"processing-state": "processing",
+			"lease": map[string]interface{}{
+				"acquired": "2015-02-28T00:00:00Z",
+			},
+		},
+		"training-finished": map[string]interface{}{
+			"type":             DOC_TYPE_TRAINING_JOB,
+			"user-id":          "user:foo",
+			"processing-state": "finished_successfully",
+			"lease": map[string]interface{}{
+				"acquired": "2015-03-01T10:00:00Z",
+				"released": "2015-03-01T13:30:00Z",
+			},
+		},
+		// failed once and retried, so both attempts count
+		"training-retried": map[string]interface{}{
+			"type":             DOC_TYPE_TRAINING_JOB,
+			"user-id":          "user:foo",
+			"processing-state": "finished_successfully",
+			"attempts": []interface{}{
+				map[string]interface{}{
+					"started": "2015-03-01T00:00:00Z",
+					"failed":  "2015-03-01T01:00:00Z",
+				},
+			},
+			"lease": map[string]interface{}{
+				"acquired": "2015-03-01T02:00:00Z",
+				"released": "2015-03-01T04:00:00Z",
+			},
+		},
+		// the latest lease is the failed attempt, so it isn't counted twice
+		"training-failed": map[string]interface{}{
+			"type":             DOC_TYPE_TRAINING_JOB,
+			"user-id":          "user:foo",
+			"processing-state": "failed",
+			"attempts": []interface{}{
+				map[string]interface{}{
+					"started": "2015-03-01T05:00:00Z",
+					"failed":  "2015-03-01T05:30:00Z",
+				},
+			},
+			"lease": map[string]interface{}{
+				"acquired": "2015-03-01T05:00:00Z",
+				"released": "2015-03-01T05:30:00Z",
+			},
+		},
+		"training-other-user": map[string]interface{}{
+			"type":             DOC_TYPE_TRAINING_JOB,
+			"user-id":          "user:bar",
+			"processing-state": "processing",
+			"lease": map[string]interface{}{
+				"acquired": "2015-03-01T00:00:00Z",
+			},
+		},
+		"classify-today": map[string]interface{}{
+			"type":       DOC_TYPE_CLASSIFY_JOB,
+			"user-id":    "user:foo",
+			"created-at": "2015-03-02T01:00:00Z",
+		},
+		"classify-yesterday": map[string]interface{}{
+			"type":       DOC_TYPE_CLASSIFY_JOB,
+			"user-id":    "user:foo",
+			"created-at": "2015-03-01T23:00:00Z",
+		},
+	}
+
+	rows := []allDocsRow{}
+	for docId, doc := range docs {
+		raw, err := json.Marshal(doc)
+		assert.True(t, err == nil)
+		rows = append(rows, allDocsRow{Id: docId, Doc: raw})
+	}
+
+	blobs := []BlobInfo{
+		BlobInfo{Path: "datafile/data.tar.gz", Size: 1000},
+		BlobInfo{Path: "dataset/training.tar.gz", Size: 700},
+		BlobInfo{Path: "training-other-user/trained.caffemodel", Size: 5000},
+		BlobInfo{Path: "unknown/file", Size: 9000},
+	}
+
+	usage, err := computeUsage(rows, blobs, "user:foo", now)
+	assert.True(t, err == nil)
+	assert.Equals(t, usage, Usage{
+		BlobBytes:              1700,
+		ConcurrentTrainingJobs: 1,
+		TrainingHoursThisMonth: 36 + 3.5 + 1 + 2 + 0.5,
+		ClassifyRequestsToday:  1,
+	})
+
+}
+
+func TestQuotaCheck(t *testing.T) {
+
+	quota := Quota{
+		MaxBlobBytes:              1000,
+		MaxTrainingHoursPerMonth:  10,
+		MaxClassifyRequestsPerDay: 5,
+	}
+
+	usage := Usage{BlobBytes: 500, TrainingHoursThisMonth: 9.5, ClassifyRequestsToday: 4}
+	assert.True(t, quota.Check(usage, QUOTA_ACTION_STORE_BLOBS) == nil)
+	assert.True(t, quota.Check(usage, QUOTA_ACTION_TRAIN) == nil)
+	assert.True(t, quota.Check(usage, QUOTA_ACTION_CLASSIFY) == nil)
+
+	usage = Usage{TrainingHoursThisMonth: 10, ClassifyRequestsToday: 5}
+	assert.True(t, quota.Check(usage, QUOTA_ACTION_STORE_BLOBS) == nil)
+	assert.Equals(t, quota.Check(usage, QUOTA_ACTION_TRAIN).(QuotaError).Status, 403)
+	assert.Equals(t, quota.Check(usage, QUOTA_ACTION_CLASSIFY).(QuotaError).Status, 429)
+
+	// out of storage blocks everything
+	usage = Usage{BlobBytes: 1000}
+	for _, action := range []string{QUOTA_ACTION_STORE_BLOBS, QUOTA_ACTION_TRAIN, QUOTA_ACTION_CLASSIFY} {
+		err := quota.Check(usage, action).(QuotaError)
+		assert.Equals(t, err.Status, 403)
+		assert.Equals(t, err.Quota, "max-blob-bytes")
+	}
+
+	// no limits
+	usage = Usage{BlobBytes: 1 << 40, TrainingHoursThisMonth: 1000, ClassifyRequestsToday: 1000}
+	assert.True(t, Quota{}.Check(usage, QUOTA_ACTION_TRAIN) == nil)
+
+}
+
+func TestPriorityJobSchedulerConcurrentTrainingQuota(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC))
+	scheduler, downstream := newTestPriorityJobScheduler(clock)
+	scheduler.InFlightLimits = map[string]int{}
+	scheduler.Configuration.UserQuotas = map[string]Quota{
+		"user:a": Quota{MaxConcurrentTrainingJobs: 2},
+	}
+
+	for _, docId := range []string{"a1", "a2", "a3"} {
+		queueTrainingJob(scheduler, docId, "user:a", 0)
+	}
+	queueTrainingJob(scheduler, "b1", "user:b", 0)
+
+	// user a's third job waits, but user b isn't held up
+	assert.DeepEquals(t, downstream.scheduled, []string{"a1", "a2", "b1"})
+
+	finishJob(scheduler, "a1")
+	assert.DeepEquals(t, downstream.scheduled, []string{"a1", "a2", "b1", "a3"})
+
+}
+
+func TestUsageCache(t *testing.T) {
+
+	config := *NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://quota_test_%v", NewUuid())
+	config.CbfsUrl = "mock://mock"
+	db := config.DbConnection()
+
+	classifyJob := func() {
+		_, _, err := db.Insert(map[string]interface{}{
+			"type":       DOC_TYPE_CLASSIFY_JOB,
+			"user-id":    "user:foo",
+			"created-at": time.Now(),
+		})
+		assert.True(t, err == nil)
+	}
+
+	cache := NewUsageCache(config)
+	now := time.Now()
+
+	classifyJob()
+	usage, err := cache.Usage(db, "user:foo", now)
+	assert.True(t, err == nil)
+	assert.Equals(t, usage.ClassifyRequestsToday, 1)
+
+	// the usage is reused until the ttl is up
+	classifyJob()
+	usage, err = cache.Usage(db, "user:foo", now.Add(cache.TTL/2))
+	assert.True(t, err == nil)
+	assert.Equals(t, usage.ClassifyRequestsToday, 1)
+
+	usage, err = cache.Usage(db, "user:foo", now.Add(cache.TTL))
+	assert.True(t, err == nil)
+	assert.Equals(t, usage.ClassifyRequestsToday, 2)
+
+}
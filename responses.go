@@ -0,0 +1,29 @@
+package elasticthought
+
+// The response to creating a datafile
+type CreatedResponse struct {
+	Id string `json:"id"`
+}
+
+// The response to deleting a doc, listing every doc that was deleted along
+// with it
+type DeletedResponse struct {
+	Deleted []string `json:"deleted"`
+}
+
+// The blobs stored for a training job
+type ArtifactsResponse struct {
+	Artifacts []BlobInfo `json:"artifacts"`
+}
+
+// Where the user's jobs are in the queue, out of all of the queued jobs
+type QueueResponse struct {
+	Length int             `json:"length"`
+	Jobs   []QueuePosition `json:"jobs"`
+}
+
+// How much of the cluster the user is using, along with their quota
+type UsageResponse struct {
+	Usage Usage `json:"usage"`
+	Quota Quota `json:"quota"`
+}
@@ -0,0 +1,169 @@
+package elasticthought
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+)
+
+const (
+	// How long to wait before the first retry of a job that failed with a
+	// transient error.  The wait doubles with every attempt.
+	JOB_RETRY_BASE_BACKOFF = 10 * time.Second
+
+	// The longest to wait before retrying a job
+	JOB_RETRY_MAX_BACKOFF = 5 * time.Minute
+)
+
+// An error which is likely to go away if the operation is retried, such as
+// a network timeout or a 503 from the blob store.
+type TransientError struct {
+	Err error
+}
+
+func (e TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Mark an error as transient
+func NewTransientError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return TransientError{Err: err}
+}
+
+// Is it worth retrying the operation that caused this error?
+func IsTransientError(err error) bool {
+	switch e := err.(type) {
+	case TransientError:
+		return true
+	case net.Error:
+		return e.Timeout() || e.Temporary()
+	}
+	return err == io.ErrUnexpectedEOF
+}
+
+// Is this http status code worth retrying?
+func isTransientHTTPStatus(statusCode int) bool {
+	return statusCode >= 500 || statusCode == 429
+}
+
+// Like fmt.Errorf, but the result is transient if the cause is transient.
+// Use this to add context to an error without losing its classification.
+func wrapError(cause error, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if IsTransientError(cause) {
+		return NewTransientError(err)
+	}
+	return err
+}
+
+// A record of an unsuccessful attempt at processing a job.  The time between
+// when it started and failed is what the attempt used of the cluster.
+type JobAttempt struct {
+	WorkerID  string    `json:"worker-id"`
+	Started   time.Time `json:"started"`
+	Failed    time.Time `json:"failed"`
+	Error     string    `json:"error"`
+	Transient bool      `json:"transient"`
+}
+
+// How long to wait before making the next attempt, given how many
+// attempts have been made so far.
+func retryBackoff(attempts int) time.Duration {
+	backoff := JOB_RETRY_BASE_BACKOFF
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= JOB_RETRY_MAX_BACKOFF {
+			return JOB_RETRY_MAX_BACKOFF
+		}
+	}
+	return backoff
+}
+
+// Should a job that failed with this error be retried?
+func shouldRetryJob(job JobDoc, processingErr error, maxAttempts int) bool {
+	return IsTransientError(processingErr) && job.GetLease().Attempts < maxAttempts
+}
+
+// Record a failed attempt at processing a job in its attempts history.  If
+// the error is transient and the job hasn't used up its attempts, put it
+// back into the Pending state with a backoff period in its lease, so that the
+// scheduler holds it back until then without tying up this worker.
+// Otherwise mark the job as failed.
+func recordJobFailure(config Configuration, job JobDoc, processingErr error, clock Clock) error {
+
+	logg.LogError(processingErr)
+
+	db := config.DbConnection()
+
+	attempt := JobAttempt{
+		WorkerID:  job.GetLease().WorkerID,
+		Started:   job.GetLease().Acquired,
+		Failed:    clock.Now(),
+		Error:     processingErr.Error(),
+		Transient: IsTransientError(processingErr),
+	}
+
+	retry := shouldRetryJob(job, processingErr, DEFAULT_JOB_MAX_ATTEMPTS)
+	backoff := retryBackoff(job.GetLease().Attempts)
+	if retry {
+		logg.LogTo("JOB_SCHEDULER", "Transient error, retrying in %v: %v", backoff, processingErr)
+	}
+
+	updater := func(jobPtr interface{}) {
+		j := jobPtr.(JobDoc)
+		j.AddAttempt(attempt)
+		j.SetProcessingLog(attempt.Error)
+		if retry {
+			lease := j.GetLease()
+			lease.NotBefore = attempt.Failed.Add(backoff)
+			j.SetLease(lease)
+			j.SetProcessingState(Pending)
+		} else {
+			j.SetProcessingState(Failed)
+		}
+	}
+
+	// if the job has been reaped or cancelled in the meantime, leave it be
+	doneMetric := func(jobPtr interface{}) bool {
+		return jobPtr.(JobDoc).GetProcessingState() != Processing
+	}
+
+	refresh := func(jobPtr interface{}) error {
+		return jobPtr.(JobDoc).RefreshFromDB(db)
+	}
+
+	_, err := casUpdate(db, job, updater, doneMetric, refresh)
+	return err
+
+}
+
+// Put a failed job back into the Pending state so that it will be
+// rescheduled, with a fresh set of attempts.  Returns false if the job
+// was not in the Failed state.
+func RetryJob(config Configuration, job JobDoc) (bool, error) {
+
+	db := config.DbConnection()
+
+	updater := func(jobPtr interface{}) {
+		j := jobPtr.(JobDoc)
+		j.SetLease(JobLease{})
+		j.SetProcessingState(Pending)
+	}
+
+	doneMetric := func(jobPtr interface{}) bool {
+		return jobPtr.(JobDoc).GetProcessingState() != Failed
+	}
+
+	refresh := func(jobPtr interface{}) error {
+		return jobPtr.(JobDoc).RefreshFromDB(db)
+	}
+
+	return casUpdate(db, job, updater, doneMetric, refresh)
+
+}
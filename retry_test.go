@@ -0,0 +1,136 @@
+package elasticthought
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestIsTransientError(t *testing.T) {
+
+	assert.True(t, IsTransientError(NewTransientError(fmt.Errorf("503"))))
+	assert.True(t, IsTransientError(io.ErrUnexpectedEOF))
+	assert.False(t, IsTransientError(fmt.Errorf("caffe exited with status 1")))
+
+	// wrapping keeps the classification
+	wrapped := wrapError(NewTransientError(fmt.Errorf("503")), "Error writing blob: 503")
+	assert.True(t, IsTransientError(wrapped))
+	wrapped = wrapError(fmt.Errorf("bad"), "Error writing blob: bad")
+	assert.False(t, IsTransientError(wrapped))
+
+	assert.True(t, IsTransientError(s3ResponseError(503, []byte("<Error><Code>SlowDown</Code></Error>"))))
+	assert.False(t, IsTransientError(s3ResponseError(403, []byte("<Error><Code>AccessDenied</Code></Error>"))))
+
+}
+
+func TestOpenUrlTransient(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	_, err := openUrl(server.URL + "/unavailable")
+	assert.True(t, err != nil)
+	assert.True(t, IsTransientError(err))
+
+	_, err = openUrl(server.URL + "/missing")
+	assert.True(t, err != nil)
+	assert.False(t, IsTransientError(err))
+
+}
+
+func TestRetryBackoff(t *testing.T) {
+
+	assert.Equals(t, retryBackoff(1), JOB_RETRY_BASE_BACKOFF)
+	assert.Equals(t, retryBackoff(2), 2*JOB_RETRY_BASE_BACKOFF)
+	assert.Equals(t, retryBackoff(3), 4*JOB_RETRY_BASE_BACKOFF)
+	assert.Equals(t, retryBackoff(100), JOB_RETRY_MAX_BACKOFF)
+
+}
+
+func TestShouldRetryJob(t *testing.T) {
+
+	trainingJob := NewTrainingJob(*NewDefaultConfiguration())
+	trainingJob.Lease = JobLease{WorkerID: "worker", Deadline: time.Now(), Attempts: 1}
+
+	transientErr := NewTransientError(fmt.Errorf("timeout"))
+	assert.True(t, shouldRetryJob(trainingJob, transientErr, DEFAULT_JOB_MAX_ATTEMPTS))
+	assert.False(t, shouldRetryJob(trainingJob, fmt.Errorf("bad solver"), DEFAULT_JOB_MAX_ATTEMPTS))
+
+	trainingJob.Lease.Attempts = DEFAULT_JOB_MAX_ATTEMPTS
+	assert.False(t, shouldRetryJob(trainingJob, transientErr, DEFAULT_JOB_MAX_ATTEMPTS))
+
+}
+
+func TestRecordJobFailureBacksOff(t *testing.T) {
+
+	now := time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+
+	config := NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://retry_test_%v", NewUuid())
+	db := config.DbConnection()
+
+	trainingJob := NewTrainingJob(*config)
+	trainingJob.ProcessingState = Processing
+	trainingJob.Lease = JobLease{WorkerID: "worker", Acquired: now.Add(-time.Minute), Attempts: 2}
+	inserted, err := trainingJob.Insert(db)
+	assert.True(t, err == nil)
+
+	// returns straight away rather than waiting out the backoff, which is
+	// left to the scheduler
+	err = recordJobFailure(*config, inserted, NewTransientError(fmt.Errorf("503")), clock)
+	assert.True(t, err == nil)
+
+	assert.True(t, inserted.RefreshFromDB(db) == nil)
+	assert.Equals(t, inserted.ProcessingState, Pending)
+	assert.Equals(t, inserted.Lease.NotBefore, now.Add(retryBackoff(2)))
+	assert.Equals(t, len(inserted.Attempts), 1)
+	assert.Equals(t, inserted.Attempts[0].Failed, now)
+
+}
+
+func TestAcquireJobLeaseWaitsForBackoff(t *testing.T) {
+
+	// jobIsDone goes by the system clock
+	now := time.Now()
+	clock := NewFakeClock(now)
+
+	config := NewDefaultConfiguration()
+	config.DbUrl = fmt.Sprintf("mem://retry_test_%v", NewUuid())
+	db := config.DbConnection()
+
+	trainingJob := NewTrainingJob(*config)
+	trainingJob.ProcessingState = Pending
+	trainingJob.Lease = JobLease{Attempts: 1, NotBefore: now.Add(time.Minute)}
+	inserted, err := trainingJob.Insert(db)
+	assert.True(t, err == nil)
+
+	// whichever queue the job came from, it isn't run before its backoff
+	// is up, and the worker puts it back on the queue
+	acquired, err := acquireJobLease(db, inserted, "worker", clock, time.Minute)
+	assert.True(t, err == nil)
+	assert.False(t, acquired)
+	assert.True(t, inserted.RefreshFromDB(db) == nil)
+	assert.Equals(t, inserted.ProcessingState, Pending)
+
+	done, _ := jobIsDone(*config, inserted.Id)
+	assert.False(t, done)
+
+	clock.Advance(time.Minute)
+	acquired, err = acquireJobLease(db, inserted, "worker", clock, time.Minute)
+	assert.True(t, err == nil)
+	assert.True(t, acquired)
+	assert.Equals(t, inserted.Lease.Attempts, 2)
+
+}
@@ -0,0 +1,337 @@
+package elasticthought
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Who may call an endpoint
+type routeAuth int
+
+const (
+	routeAuthNone       routeAuth = iota // anyone
+	routeAuthUser                        // users, with Basic Auth credentials (see DbAuthRequired)
+	routeAuthQueueToken                  // workers with the queue token (see QueueTokenRequired)
+)
+
+// A REST API endpoint.  NewRouter registers exactly these with gin, and the
+// OpenAPI spec is generated from them, so the spec can't leave any out.
+type apiRoute struct {
+	Method  string
+	Path    string // in gin syntax, eg /datafiles/:datafile-id
+	Auth    routeAuth
+	Summary string
+	Handler func(EndpointContext, *gin.Context)
+
+	// Query parameters, keyed by name, with their descriptions
+	Query map[string]string
+
+	// The request and successful response bodies.  These are described by
+	// the json and binding tags of the structs given here, or are one of
+	// noBody, binaryBody, formBody or bodies (see OpenAPISpec).
+	Request  interface{}
+	Status   int
+	Response interface{}
+}
+
+// Every endpoint of the REST API
+func apiRoutes() []apiRoute {
+
+	gzip := binaryBody{ContentType: "application/x-gzip"}
+
+	return []apiRoute{
+
+		// not authenticated
+		{
+			Method: "POST", Path: "/users", Auth: routeAuthNone,
+			Summary: "Create a user",
+			Handler: EndpointContext.CreateUserEndpoint,
+			Request: User{}, Status: 201, Response: noBody{},
+		},
+		{
+			Method: "GET", Path: "/openapi.json", Auth: routeAuthNone,
+			Summary: "This OpenAPI specification",
+			Handler: EndpointContext.GetOpenAPIEndpoint,
+			Status:  200, Response: map[string]interface{}{},
+		},
+
+		// users
+		{
+			Method: "GET", Path: "/users/me/usage", Auth: routeAuthUser,
+			Summary: "How much of the cluster the user is using, along with their quota",
+			Handler: EndpointContext.GetUsageEndpoint,
+			Status:  200, Response: UsageResponse{},
+		},
+
+		// data
+		{
+			Method: "POST", Path: "/datafiles", Auth: routeAuthUser,
+			Summary: "Create a datafile from the url of a .tar.gz, or by uploading one",
+			Handler: EndpointContext.CreateDataFileEndpoint,
+			Query:   map[string]string{"filename": "The name of an uploaded datafile in the blob store"},
+			Request: bodies{Datafile{}, gzip}, Status: 201, Response: CreatedResponse{},
+		},
+		{
+			Method: "GET", Path: "/datafiles/:datafile-id", Auth: routeAuthUser,
+			Summary: "Get a datafile",
+			Handler: EndpointContext.GetDatafileEndpoint,
+			Status:  200, Response: Datafile{},
+		},
+		{
+			Method: "DELETE", Path: "/datafiles/:datafile-id", Auth: routeAuthUser,
+			Summary: "Delete a datafile",
+			Handler: EndpointContext.DeleteDatafileEndpoint,
+			Query:   cascadeQuery,
+			Status:  200, Response: DeletedResponse{},
+		},
+		{
+			Method: "POST", Path: "/datafiles/:datafile-id/retry", Auth: routeAuthUser,
+			Summary: "Retry downloading a datafile which failed",
+			Handler: EndpointContext.RetryDatafileEndpoint,
+			Request: noBody{}, Status: 200, Response: Datafile{},
+		},
+		{
+			Method: "POST", Path: "/datasets", Auth: routeAuthUser,
+			Summary: "Create a dataset from one or two datafiles",
+			Handler: EndpointContext.CreateDataSetsEndpoint,
+			Request: Dataset{}, Status: 201, Response: Dataset{},
+		},
+		{
+			Method: "GET", Path: "/datasets/:dataset-id", Auth: routeAuthUser,
+			Summary: "Get a dataset",
+			Handler: EndpointContext.GetDatasetEndpoint,
+			Status:  200, Response: Dataset{},
+		},
+		{
+			Method: "DELETE", Path: "/datasets/:dataset-id", Auth: routeAuthUser,
+			Summary: "Delete a dataset",
+			Handler: EndpointContext.DeleteDatasetEndpoint,
+			Query:   cascadeQuery,
+			Status:  200, Response: DeletedResponse{},
+		},
+		{
+			Method: "POST", Path: "/datasets/:dataset-id/retry", Auth: routeAuthUser,
+			Summary: "Retry splitting a dataset which failed",
+			Handler: EndpointContext.RetryDatasetEndpoint,
+			Request: noBody{}, Status: 200, Response: Dataset{},
+		},
+
+		// training
+		{
+			Method: "POST", Path: "/solvers", Auth: routeAuthUser,
+			Summary: "Create a solver from the urls of its prototxt specs",
+			Handler: EndpointContext.CreateSolverEndpoint,
+			Request: Solver{}, Status: 201, Response: Solver{},
+		},
+		{
+			Method: "GET", Path: "/solvers/:solver-id", Auth: routeAuthUser,
+			Summary: "Get a solver",
+			Handler: EndpointContext.GetSolverEndpoint,
+			Status:  200, Response: Solver{},
+		},
+		{
+			Method: "DELETE", Path: "/solvers/:solver-id", Auth: routeAuthUser,
+			Summary: "Delete a solver",
+			Handler: EndpointContext.DeleteSolverEndpoint,
+			Query:   cascadeQuery,
+			Status:  200, Response: DeletedResponse{},
+		},
+		{
+			Method: "POST", Path: "/training-jobs", Auth: routeAuthUser,
+			Summary: "Start training with a solver",
+			Handler: EndpointContext.CreateTrainingJob,
+			Request: TrainingJob{}, Status: 201, Response: TrainingJob{},
+		},
+		{
+			Method: "GET", Path: "/training-jobs/:training-job-id", Auth: routeAuthUser,
+			Summary: "Get a training job",
+			Handler: EndpointContext.GetTrainingJobEndpoint,
+			Status:  200, Response: TrainingJob{},
+		},
+		{
+			Method: "DELETE", Path: "/training-jobs/:training-job-id", Auth: routeAuthUser,
+			Summary: "Delete a training job, cancelling it if it's running",
+			Handler: EndpointContext.DeleteTrainingJobEndpoint,
+			Query:   cascadeQuery,
+			Status:  200, Response: DeletedResponse{},
+		},
+		{
+			Method: "POST", Path: "/training-jobs/:training-job-id/retry", Auth: routeAuthUser,
+			Summary: "Retry a training job which failed",
+			Handler: EndpointContext.RetryTrainingJobEndpoint,
+			Request: noBody{}, Status: 200, Response: TrainingJob{},
+		},
+		{
+			Method: "GET", Path: "/training-jobs/:training-job-id/artifacts", Auth: routeAuthUser,
+			Summary: "List the blobs stored for a training job",
+			Handler: EndpointContext.GetTrainingJobArtifactsEndpoint,
+			Status:  200, Response: ArtifactsResponse{},
+		},
+
+		// prediction
+		{
+			Method: "POST", Path: "/classifiers", Auth: routeAuthUser,
+			Summary: "Create a classifier from a training job",
+			Handler: EndpointContext.CreateClassifierEndpoint,
+			Request: Classifier{}, Status: 201, Response: Classifier{},
+		},
+		{
+			Method: "GET", Path: "/classifiers/:classifier-id", Auth: routeAuthUser,
+			Summary: "Get a classifier",
+			Handler: EndpointContext.GetClassifierEndpoint,
+			Status:  200, Response: Classifier{},
+		},
+		{
+			Method: "DELETE", Path: "/classifiers/:classifier-id", Auth: routeAuthUser,
+			Summary: "Delete a classifier",
+			Handler: EndpointContext.DeleteClassifierEndpoint,
+			Query:   cascadeQuery,
+			Status:  200, Response: DeletedResponse{},
+		},
+		{
+			Method: "POST", Path: "/classifiers/:classifier-id/classify", Auth: routeAuthUser,
+			Summary: "Classify images given as urls or uploaded files",
+			Handler: EndpointContext.CreateClassificationJobEndpoint,
+			Request: formBody{classifyForm{}}, Status: 201, Response: ClassifyJob{},
+		},
+		{
+			Method: "GET", Path: "/classifiers/:classifier-id/bundle", Auth: routeAuthUser,
+			Summary: "Download a .tar.gz bundle with everything needed to run the classifier",
+			Handler: EndpointContext.GetClassifierBundleEndpoint,
+			Status:  200, Response: gzip,
+		},
+		{
+			Method: "POST", Path: "/classifier-bundles", Auth: routeAuthUser,
+			Summary: "Create a classifier from a downloaded bundle",
+			Handler: EndpointContext.ImportClassifierBundleEndpoint,
+			Request: gzip, Status: 201, Response: Classifier{},
+		},
+		{
+			Method: "GET", Path: "/classify-jobs/:classify-job-id", Auth: routeAuthUser,
+			Summary: "Get a classify job, with its results once it's finished",
+			Handler: EndpointContext.GetClassifyJobEndpoint,
+			Status:  200, Response: ClassifyJob{},
+		},
+		{
+			Method: "DELETE", Path: "/classify-jobs/:classify-job-id", Auth: routeAuthUser,
+			Summary: "Delete a classify job",
+			Handler: EndpointContext.DeleteClassifyJobEndpoint,
+			Query:   cascadeQuery,
+			Status:  200, Response: DeletedResponse{},
+		},
+		{
+			Method: "POST", Path: "/classify-jobs/:classify-job-id/retry", Auth: routeAuthUser,
+			Summary: "Retry a classify job which failed",
+			Handler: EndpointContext.RetryClassifyJobEndpoint,
+			Request: noBody{}, Status: 200, Response: ClassifyJob{},
+		},
+
+		// blobs and the cluster
+		{
+			Method: "GET", Path: "/blobs/*path", Auth: routeAuthUser,
+			Summary: "Download a blob, such as a trained model, given its cbfs://<doc-id>/<file> path",
+			Handler: EndpointContext.GetBlobEndpoint,
+			Status:  200, Response: binaryBody{ContentType: "application/octet-stream"},
+		},
+		{
+			Method: "GET", Path: "/worker-slots", Auth: routeAuthUser,
+			Summary: "The jobs running and queued in this process's worker pool",
+			Handler: EndpointContext.GetWorkerSlotsEndpoint,
+			Status:  200, Response: WorkerPoolStatus{},
+		},
+		{
+			Method: "GET", Path: "/queue", Auth: routeAuthUser,
+			Summary: "Where the user's jobs are in the queue",
+			Handler: EndpointContext.GetQueueEndpoint,
+			Status:  200, Response: QueueResponse{},
+		},
+
+		// the http pull queue which remote workers lease jobs from
+		{
+			Method: "POST", Path: "/queue/jobs", Auth: routeAuthQueueToken,
+			Summary: "Add a job to the back of the pull queue",
+			Handler: EndpointContext.QueueScheduleJobEndpoint,
+			Request: JobDescriptor{}, Status: 201, Response: noBody{},
+		},
+		{
+			Method: "POST", Path: "/queue/leases", Auth: routeAuthQueueToken,
+			Summary: "Lease the job at the front of the pull queue, or get a 204 if there are none",
+			Handler: EndpointContext.QueueLeaseEndpoint,
+			Request: queueLeaseRequest{}, Status: 200, Response: QueueEntry{},
+		},
+		{
+			Method: "POST", Path: "/queue/leases/:entry-id/renew", Auth: routeAuthQueueToken,
+			Summary: "Extend a lease",
+			Handler: EndpointContext.QueueRenewEndpoint,
+			Request: queueLeaseRequest{}, Status: 200, Response: noBody{},
+		},
+		{
+			Method: "POST", Path: "/queue/leases/:entry-id/ack", Auth: routeAuthQueueToken,
+			Summary: "Remove a leased job from the queue once it's done",
+			Handler: EndpointContext.QueueAckEndpoint,
+			Request: queueLeaseRequest{}, Status: 200, Response: noBody{},
+		},
+		{
+			Method: "POST", Path: "/queue/leases/:entry-id/nack", Auth: routeAuthQueueToken,
+			Summary: "Give up a lease, so that the job can be leased again after delay-seconds",
+			Handler: EndpointContext.QueueNackEndpoint,
+			Request: queueLeaseRequest{}, Status: 200, Response: noBody{},
+		},
+	}
+
+}
+
+var cascadeQuery = map[string]string{
+	"cascade": "If true, also delete the docs which depend on this one, rather than failing with a 409",
+}
+
+// The multipart form used to classify images
+type classifyForm struct {
+	Urls     []string     `json:"urls"`
+	Files    []binaryBody `json:"files"`
+	Priority int          `json:"priority"`
+}
+
+// Create the gin engine serving the REST API, with every endpoint in
+// apiRoutes registered
+func NewRouter(config Configuration, context *EndpointContext) *gin.Engine {
+
+	ginEngine := gin.Default()
+
+	// every request gets an id, so that its errors can be found in the logs
+	ginEngine.Use(RequestIdentifier())
+
+	// all requests wrapped in database connection middleware
+	ginEngine.Use(DbConnector(config.DbUrl))
+
+	// TODO: bundle in static assets from ../../example directory into the
+	// binary using gobin-data and then allow them to be served up
+	// via the /example REST endpoint.
+	// ginEngine.Static("/example", "../../example")  <-- uncomment for quick hack rel path
+
+	// all endpoints in the authorized group require Basic Auth credentials
+	// which is enforced by the DbAuthRequired middleware.
+	authorized := ginEngine.Group("/")
+	authorized.Use(DbAuthRequired())
+
+	// the http pull queue is authorized by the shared queue token rather
+	// than by user
+	queue := ginEngine.Group("/")
+	queue.Use(QueueTokenRequired(config.QueueToken))
+
+	groups := map[routeAuth]*gin.RouterGroup{
+		routeAuthNone:       ginEngine.Group("/"),
+		routeAuthUser:       authorized,
+		routeAuthQueueToken: queue,
+	}
+
+	for _, route := range apiRoutes() {
+		handler := route.Handler
+		endpointContext := *context
+		groups[route.Auth].Handle(route.Method, route.Path, []gin.HandlerFunc{
+			func(c *gin.Context) { handler(endpointContext, c) },
+		})
+	}
+
+	return ginEngine
+
+}
@@ -0,0 +1,557 @@
+package elasticthought
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+	"github.com/dustin/httputil"
+)
+
+const (
+	// S3 requires all parts of a multipart upload except the last
+	// one to be at least 5 MB
+	S3_PART_SIZE = 5 * 1024 * 1024
+
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3TimeFormat       = "20060102T150405Z"
+	s3DateFormat       = "20060102"
+)
+
+// A blob store backed by S3 or any S3-compatible object store.  Blobs are
+// stored under s3://bucket/prefix, and requests use path-style addressing
+// so that the endpoint can point at a local S3-compatible server.
+type S3BlobStore struct {
+	bucket    string
+	prefix    string
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	partSize  int
+	client    *http.Client
+}
+
+type S3BlobHandle struct {
+	lastModified time.Time
+}
+
+func (h S3BlobHandle) Nodes() map[string]time.Time {
+	return map[string]time.Time{
+		"s3": h.lastModified,
+	}
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Create a new S3 blob store for a url of the form s3://bucket/prefix.  The
+// endpoint, region and credentials are taken from the configuration.
+func NewS3BlobStore(rawurl string, config Configuration) (*S3BlobStore, error) {
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "s3" || len(u.Host) == 0 {
+		return nil, fmt.Errorf("Expected s3://bucket/prefix, got: %v", rawurl)
+	}
+
+	s3BlobStore := &S3BlobStore{
+		bucket:    u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		endpoint:  strings.TrimSuffix(config.S3Endpoint, "/"),
+		region:    config.S3Region,
+		accessKey: config.S3AccessKey,
+		secretKey: config.S3SecretKey,
+		partSize:  S3_PART_SIZE,
+		client:    &http.Client{},
+	}
+
+	return s3BlobStore, nil
+
+}
+
+func (s S3BlobStore) Get(path string) (io.ReadCloser, error) {
+
+	resp, err := s.do("GET", path, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+
+}
+
+// Get the contents of a blob from the given offset onwards, with a Range
+// request so that the bytes before it aren't downloaded
+func (s S3BlobStore) GetFrom(path string, offset int64) (io.ReadCloser, error) {
+
+	headers := http.Header{}
+	headers.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := s.do("GET", path, nil, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+
+}
+
+// Put the contents of the reader into the blob store.  Small blobs are
+// uploaded with a single request, while anything larger than the part size
+// is streamed with a multipart upload, so that large models never need to
+// be held in memory all at once.
+func (s S3BlobStore) Put(srcname, dest string, r io.Reader, opts BlobPutOptions) error {
+
+	logg.LogTo("CBFS", "S3BlobStore.Put() called with: %v", dest)
+
+	firstPart, err := readPart(r, s.partSize)
+	if err != nil {
+		return err
+	}
+
+	headers := http.Header{}
+	if len(opts.ContentType) > 0 {
+		headers.Set("Content-Type", opts.ContentType)
+	}
+
+	if len(firstPart) < s.partSize {
+		resp, err := s.do("PUT", dest, nil, headers, firstPart)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	return s.putMultipart(dest, headers, firstPart, r)
+
+}
+
+func (s S3BlobStore) Rm(path string) error {
+
+	resp, err := s.do("DELETE", path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+
+}
+
+func (s S3BlobStore) OpenFile(path string) (BlobHandle, error) {
+
+	resp, err := s.do("HEAD", path, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		lastModified = time.Now()
+	}
+
+	return S3BlobHandle{lastModified: lastModified}, nil
+
+}
+
+func (s S3BlobStore) List(prefix string) ([]BlobInfo, error) {
+
+	blobInfos := []BlobInfo{}
+	continuationToken := ""
+
+	for {
+
+		params := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.listPrefix(prefix)},
+		}
+		if len(continuationToken) > 0 {
+			params.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := s.doKey("GET", "", params, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		listResult := s3ListBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&listResult)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range listResult.Contents {
+			blobInfo := BlobInfo{
+				Path:     s.blobPath(object.Key),
+				Size:     object.Size,
+				ModTime:  object.LastModified,
+				Checksum: strings.Trim(object.ETag, "\""),
+			}
+			blobInfos = append(blobInfos, blobInfo)
+		}
+
+		if !listResult.IsTruncated {
+			break
+		}
+		continuationToken = listResult.NextContinuationToken
+
+	}
+
+	return blobInfos, nil
+
+}
+
+func (s S3BlobStore) Stat(path string) (BlobInfo, error) {
+
+	resp, err := s.do("HEAD", path, nil, nil, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp.Body.Close()
+
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	blobInfo := BlobInfo{
+		Path:        strings.TrimPrefix(path, "/"),
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		ModTime:     lastModified,
+		Checksum:    strings.Trim(resp.Header.Get("ETag"), "\""),
+	}
+
+	return blobInfo, nil
+
+}
+
+func (s S3BlobStore) putMultipart(dest string, headers http.Header, firstPart []byte, r io.Reader) error {
+
+	resp, err := s.do("POST", dest, url.Values{"uploads": {""}}, headers, nil)
+	if err != nil {
+		return err
+	}
+	initResult := s3InitiateMultipartUploadResult{}
+	err = xml.NewDecoder(resp.Body).Decode(&initResult)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("Error starting multipart upload of %v: %v", dest, err)
+	}
+	uploadId := initResult.UploadId
+
+	// abort the upload on any error, otherwise the parts will hang around
+	abort := func(uploadErr error) error {
+		abortResp, err := s.do("DELETE", dest, url.Values{"uploadId": {uploadId}}, nil, nil)
+		if err != nil {
+			logg.LogError(fmt.Errorf("Error aborting upload %v of %v: %v", uploadId, dest, err))
+		} else {
+			abortResp.Body.Close()
+		}
+		return uploadErr
+	}
+
+	completed := s3CompleteMultipartUpload{}
+	part := firstPart
+	for partNumber := 1; len(part) > 0; partNumber++ {
+
+		params := url.Values{
+			"partNumber": {fmt.Sprintf("%v", partNumber)},
+			"uploadId":   {uploadId},
+		}
+		resp, err := s.do("PUT", dest, params, nil, part)
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body.Close()
+
+		logg.LogTo("CBFS", "Uploaded part %v of %v", partNumber, dest)
+
+		completed.Parts = append(completed.Parts, s3CompletedPart{
+			PartNumber: partNumber,
+			ETag:       resp.Header.Get("ETag"),
+		})
+
+		if len(part) < s.partSize {
+			break
+		}
+		part, err = readPart(r, s.partSize)
+		if err != nil {
+			return abort(err)
+		}
+
+	}
+
+	body, err := xml.Marshal(completed)
+	if err != nil {
+		return abort(err)
+	}
+	resp, err = s.do("POST", dest, url.Values{"uploadId": {uploadId}}, nil, body)
+	if err != nil {
+		return abort(err)
+	}
+	defer resp.Body.Close()
+
+	// S3 can return a 200 with an error in the body of a complete request
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return abort(err)
+	}
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		return abort(s3ResponseError(resp.StatusCode, respBody))
+	}
+
+	return nil
+
+}
+
+// Make a signed request against the object at path, and return an error
+// for any non-2xx response.
+func (s S3BlobStore) do(method, path string, params url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	return s.doKey(method, s.key(path), params, headers, body)
+}
+
+// Make a signed request against the object with the given key, or against
+// the bucket itself if the key is empty.
+func (s S3BlobStore) doKey(method, key string, params url.Values, headers http.Header, body []byte) (*http.Response, error) {
+
+	rawurl := fmt.Sprintf("%v/%v/%v", s.endpoint, s.bucket, awsUriEncode(key, false))
+	if len(params) > 0 {
+		rawurl = fmt.Sprintf("%v?%v", rawurl, awsCanonicalQuery(params))
+	}
+
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+
+	payloadHash := s3EmptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode == 404 {
+			// so that callers can tell a missing blob apart from s3 failing
+			return nil, httputil.HTTPErrorf(resp, "%v %v failed: %v", method, key, s3ResponseError(resp.StatusCode, respBody))
+		}
+		return nil, fmt.Errorf("%v %v failed: %v", method, key, s3ResponseError(resp.StatusCode, respBody))
+	}
+
+	return resp, nil
+
+}
+
+// Add AWS Signature Version 4 headers to the request
+func (s S3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+
+	amzDate := now.Format(s3TimeFormat)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	// sign the host header plus every header that was explicitly set
+	signedHeaderValues := map[string]string{
+		"host": req.URL.Host,
+	}
+	for k, v := range req.Header {
+		signedHeaderValues[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	headerNames := []string{}
+	for k := range signedHeaderValues {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+
+	canonicalHeaders := ""
+	for _, k := range headerNames {
+		canonicalHeaders += fmt.Sprintf("%v:%v\n", k, signedHeaderValues[k])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", now.Format(s3DateFormat), s.region)
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+s.secretKey), now.Format(s3DateFormat))
+	signingKey = hmacSha256(signingKey, s.region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	authorization := fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.accessKey,
+		scope,
+		signedHeaders,
+		signature,
+	)
+	req.Header.Set("Authorization", authorization)
+
+}
+
+// The object key for a blob path, taking the prefix into account
+func (s S3BlobStore) key(blobPath string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, blobPath), "/")
+}
+
+// The object key prefix to list for a blob path prefix.  Unlike key(),
+// this keeps any trailing slash, and always ends the store prefix with a
+// slash so that a store prefix of "models" doesn't match "models-old/..."
+func (s S3BlobStore) listPrefix(blobPrefix string) string {
+	blobPrefix = strings.TrimPrefix(blobPrefix, "/")
+	if len(s.prefix) == 0 {
+		return blobPrefix
+	}
+	return s.prefix + "/" + blobPrefix
+}
+
+// The blob path for an object key, ie, the key without the prefix
+func (s S3BlobStore) blobPath(key string) string {
+	if len(s.prefix) == 0 {
+		return key
+	}
+	return strings.TrimPrefix(key, s.prefix+"/")
+}
+
+// Read up to partSize bytes from the reader.  Returns a short (or empty)
+// slice once the reader is exhausted.
+func readPart(r io.Reader, partSize int) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(io.LimitReader(r, int64(partSize))); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+
+}
+
+func s3ResponseError(statusCode int, body []byte) error {
+	var err error
+	s3Err := s3Error{}
+	if xmlErr := xml.Unmarshal(body, &s3Err); xmlErr != nil || len(s3Err.Code) == 0 {
+		err = fmt.Errorf("%v response from s3", statusCode)
+	} else {
+		err = fmt.Errorf("%v response from s3: %v %v", statusCode, s3Err.Code, s3Err.Message)
+	}
+	if isTransientHTTPStatus(statusCode) {
+		return NewTransientError(err)
+	}
+	return err
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sorted, uri-encoded query string as required for the canonical request
+func awsCanonicalQuery(params url.Values) string {
+
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, k := range keys {
+		values := params[k]
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", awsUriEncode(k, true), awsUriEncode(v, true)))
+		}
+	}
+	return strings.Join(pairs, "&")
+
+}
+
+// Uri-encode every byte except the unreserved characters, as described in
+// the AWS Signature Version 4 docs.  Slashes are only encoded if encodeSlash
+// is true (they should not be encoded in object keys).
+func awsUriEncode(s string, encodeSlash bool) string {
+
+	encoded := bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+			encoded.WriteByte(c)
+		case c == '-' || c == '_' || c == '.' || c == '~':
+			encoded.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			encoded.WriteByte(c)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+
+}
@@ -15,20 +15,30 @@ import (
 	"github.com/golang/protobuf/proto"
 
 	"github.com/tleyden/elastic-thought/caffe"
-	"github.com/tleyden/go-couch"
 )
 
 // A solver can generate trained models, which ban be used to make predictions
 type Solver struct {
 	ElasticThoughtDoc
+	UserID              string `json:"user-id"`
 	DatasetId           string `json:"dataset-id"`
 	SpecificationUrl    string `json:"specification-url" binding:"required"`
 	SpecificationNetUrl string `json:"specification-net-url" binding:"required"`
 
+	// Whether training jobs need a gpu, in which case the docker executor
+	// gives their container Configuration.DockerGpuFlags.  This should agree
+	// with the solver_mode in the solver spec.
+	Gpu bool `json:"gpu"`
+
+	// The docker image to train with, when using the docker executor.  If
+	// empty, Configuration.DockerImage is used.
+	CaffeImage string `json:"caffe-image"`
+
 	// had to make exported, due to https://github.com/gin-gonic/gin/pull/123
 	// waiting for this to get merged into master branch, since go get
-	// pulls from master branch.
-	Configuration Configuration
+	// pulls from master branch.  It's never saved in the doc or sent to
+	// clients, since it holds credentials such as S3 keys and the queue token.
+	Configuration Configuration `json:"-"`
 
 	// distinguish between IMAGE_DATA, LEVELDB, LMDB, etc.
 	// this assumes that test and training input layers are
@@ -43,6 +53,17 @@ const (
 	DATA       = LayerType(caffe.V1LayerParameter_DATA)
 )
 
+// A prototxt spec (or classifier bundle) given by the user which couldn't be
+// fetched or parsed
+type InvalidSpecError struct {
+	Spec string // the url of the spec, or the bundle file
+	Err  error
+}
+
+func (e InvalidSpecError) Error() string {
+	return fmt.Sprintf("Invalid spec: %v.  Err: %v", e.Spec, e.Err)
+}
+
 // Create a new solver.  If you don't use this, you must set the
 // embedded ElasticThoughtDoc Type field.
 func NewSolver(config Configuration) *Solver {
@@ -54,7 +75,7 @@ func NewSolver(config Configuration) *Solver {
 
 // Insert into database (only call this if you know it doesn't arleady exist,
 // or else you'll end up w/ unwanted dupes)
-func (s Solver) Insert(db couch.Database) (*Solver, error) {
+func (s Solver) Insert(db DocumentStore) (*Solver, error) {
 
 	id, _, err := db.Insert(s)
 	if err != nil {
@@ -69,6 +90,7 @@ func (s Solver) Insert(db couch.Database) (*Solver, error) {
 		err := fmt.Errorf("Error fetching solver: %v.  Err: %v", id, err)
 		return nil, err
 	}
+	solver.Configuration = s.Configuration
 
 	return solver, nil
 
@@ -275,12 +297,12 @@ func isTestingPhase(layer *caffe.V1LayerParameter) bool {
 
 // download contents of solver-spec-url into cbfs://<solver-id>/spec.prototxt
 // and update solver object's solver-spec-url with cbfs url
-func (s Solver) DownloadSpecToBlobStore(db couch.Database, blobStore BlobStore) (*Solver, error) {
+func (s Solver) DownloadSpecToBlobStore(db DocumentStore, blobStore BlobStore) (*Solver, error) {
 
 	// rewrite the solver specification
 	solverSpecBytes, err := s.getModifiedSolverSpec()
 	if err != nil {
-		return nil, err
+		return nil, InvalidSpecError{Spec: s.SpecificationUrl, Err: err}
 	}
 
 	// save rewritten solver to blobStore
@@ -296,7 +318,7 @@ func (s Solver) DownloadSpecToBlobStore(db couch.Database, blobStore BlobStore)
 	// rewrite the solver net specification
 	solverSpecNetBytes, err := s.getModifiedSolverNetSpec()
 	if err != nil {
-		return nil, err
+		return nil, InvalidSpecError{Spec: s.SpecificationNetUrl, Err: err}
 	}
 
 	// save rewritten solver to blobStore
@@ -352,7 +374,7 @@ func (s Solver) saveToBlobStore(blobStore BlobStore, destPath string, reader io.
 }
 
 // Saves the solver to the db, returns latest rev
-func (s Solver) Save(db couch.Database) (*Solver, error) {
+func (s Solver) Save(db DocumentStore) (*Solver, error) {
 
 	// TODO: retry if 409 error
 	_, err := db.Edit(s)
@@ -366,6 +388,7 @@ func (s Solver) Save(db couch.Database) (*Solver, error) {
 	if err != nil {
 		return nil, err
 	}
+	solver.Configuration = s.Configuration
 
 	return solver, nil
 
@@ -404,7 +427,7 @@ func (s Solver) writeBlobStoreFile(config Configuration, destDirectory, sourceUr
 
 	// use cbfs client to open stream
 
-	cbfs, err := NewBlobStore(config.CbfsUrl)
+	cbfs, err := config.NewBlobStoreClient()
 	if err != nil {
 		return err
 	}
@@ -450,7 +473,7 @@ func (s Solver) SaveTrainTestData(config Configuration, destDirectory string) (t
 	trainingLabelIndex = []string{}
 
 	// create blob store client
-	blobStore, err := NewBlobStore(config.CbfsUrl)
+	blobStore, err := config.NewBlobStoreClient()
 	if err != nil {
 		return nil, err
 	}
@@ -22,14 +22,30 @@ type tarFile struct {
 	Body string
 }
 
-// Opens tar.gz stream
-func openTarGzStream(url string) (*tar.Reader, error) {
+// Open a stream to the content at url.  Errors which might go away if it's
+// tried again later are TransientErrors.
+func openUrl(url string) (io.ReadCloser, error) {
 
 	resp, err := http.Get(url)
 	if err != nil {
+		return nil, NewTransientError(err)
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		err := fmt.Errorf("%v response to GET on: %v", resp.StatusCode, url)
+		if isTransientHTTPStatus(resp.StatusCode) {
+			return nil, NewTransientError(err)
+		}
 		return nil, err
 	}
-	gzipReader, err := gzip.NewReader(resp.Body)
+	return resp.Body, nil
+
+}
+
+// Opens tar.gz stream
+func openTarGzStream(reader io.Reader) (*tar.Reader, error) {
+
+	gzipReader, err := gzip.NewReader(reader)
 	if err != nil {
 		return nil, err
 	}
@@ -85,6 +101,12 @@ func writeToDest(hdr *tar.Header, tr *tar.Reader, destDirectory string) error {
 
 	destPath := filepath.Join(destDirectory, hdr.Name)
 
+	// the tar may have been uploaded by anyone, so refuse entries such as
+	// a/../../etc/passwd which would be written outside of destDirectory
+	if !isWithinDirectory(destPath, destDirectory) {
+		return fmt.Errorf("Cannot process tar since %v is outside of the tar", hdr.Name)
+	}
+
 	if strings.HasPrefix(hdr.Name, ".") {
 		msg := "Cannot process tar since it has hidden files/directories " +
 			"which may cause issues.  If on OSX, set COPYFILE_DISABLE=1 and " +
@@ -129,6 +151,15 @@ func writeToDest(hdr *tar.Header, tr *tar.Reader, destDirectory string) error {
 
 }
 
+// Is path inside of dir, after both have been cleaned?
+func isWithinDirectory(path, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func createArchive(buf *bytes.Buffer, tarFiles []tarFile) {
 
 	// Create a new tar archive.
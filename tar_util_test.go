@@ -2,6 +2,9 @@ package elasticthought
 
 import (
 	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/couchbaselabs/go.assert"
@@ -35,3 +38,22 @@ func TestUntarGzWithToc(t *testing.T) {
 	// TODO: add asserations
 
 }
+
+func TestUntarRefusesEntriesOutsideDest(t *testing.T) {
+
+	destDir := filepath.Join(TempDir(), NewUuid())
+	escapedName := fmt.Sprintf("escaped-%v.txt", NewUuid())
+
+	buf := new(bytes.Buffer)
+	createArchive(buf, []tarFile{
+		{"foo/1.txt", "."},
+		{"foo/../../" + escapedName, "."},
+	})
+
+	_, err := untarWithToc(bytes.NewReader(buf.Bytes()), destDir)
+	assert.True(t, err != nil)
+
+	_, err = os.Stat(filepath.Join(filepath.Dir(destDir), escapedName))
+	assert.True(t, os.IsNotExist(err))
+
+}
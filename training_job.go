@@ -2,15 +2,12 @@ package elasticthought
 
 import (
 	"fmt"
-	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
 	"sync"
 
 	"github.com/couchbaselabs/logg"
-	"github.com/tleyden/go-couch"
 )
 
 // A training job represents a "training session" of a solver against training/test data
@@ -18,7 +15,10 @@ type TrainingJob struct {
 	ElasticThoughtDoc
 	ProcessingState ProcessingState `json:"processing-state"`
 	ProcessingLog   string          `json:"processing-log"`
+	Lease           JobLease        `json:"lease"`
+	Attempts        []JobAttempt    `json:"attempts"`
 	UserID          string          `json:"user-id"`
+	Priority        int             `json:"priority"`
 	SolverId        string          `json:"solver-id" binding:"required"`
 	StdOutUrl       string          `json:"std-out-url"`
 	StdErrUrl       string          `json:"std-err-url"`
@@ -27,8 +27,9 @@ type TrainingJob struct {
 
 	// had to make exported, due to https://github.com/gin-gonic/gin/pull/123
 	// waiting for this to get merged into master branch, since go get
-	// pulls from master branch.
-	Configuration Configuration
+	// pulls from master branch.  It's never saved in the doc or sent to
+	// clients, since it holds credentials such as S3 keys and the queue token.
+	Configuration Configuration `json:"-"`
 }
 
 // Create a new training job.  If you don't use this, you must set the
@@ -40,6 +41,10 @@ func NewTrainingJob(c Configuration) *TrainingJob {
 	}
 }
 
+func (j *TrainingJob) JobType() string {
+	return DOC_TYPE_TRAINING_JOB
+}
+
 // Run this job
 func (j *TrainingJob) Run(wg *sync.WaitGroup) {
 
@@ -47,7 +52,7 @@ func (j *TrainingJob) Run(wg *sync.WaitGroup) {
 
 	logg.LogTo("TRAINING_JOB", "Run() called!")
 
-	updatedState, err := j.UpdateProcessingState(Processing)
+	updatedState, stopLease, err := startJobLease(j.Configuration, j, j.Id)
 	if err != nil {
 		j.recordProcessingError(err)
 		return
@@ -57,6 +62,7 @@ func (j *TrainingJob) Run(wg *sync.WaitGroup) {
 		logg.LogTo("TRAINING_JOB", "%+v already processed.  Ignoring.", j)
 		return
 	}
+	defer stopLease()
 
 	j.StdOutUrl = j.getStdOutCbfsUrl()
 	j.StdErrUrl = j.getStdErrCbfsUrl()
@@ -126,13 +132,14 @@ func (j *TrainingJob) SetProcessingState(newState ProcessingState) {
 	j.ProcessingState = newState
 }
 
-func (j *TrainingJob) RefreshFromDB(db couch.Database) error {
+func (j *TrainingJob) RefreshFromDB(db DocumentStore) error {
 	trainingJob := TrainingJob{}
 	err := db.Retrieve(j.Id, &trainingJob)
 	if err != nil {
 		logg.LogTo("TRAINING_JOB", "Error getting latest: %v", err)
 		return err
 	}
+	trainingJob.Configuration = j.Configuration
 	*j = trainingJob
 	return nil
 }
@@ -152,32 +159,24 @@ func (j TrainingJob) runCaffe() error {
 	_, solverFilename := filepath.Split(solver.SpecificationUrl)
 	logg.LogTo("TRAINING_JOB", "solverFilename: %v", solverFilename)
 
-	// build command args
-	cmdArgs := []string{"train", fmt.Sprintf("--solver=%v", solverFilename)}
-	caffePath := "caffe"
-
-	// debugging
-	logg.LogTo("TRAINING_JOB", "Running %v with args %v", caffePath, cmdArgs)
-	logg.LogTo("TRAINING_JOB", "Path %v", os.Getenv("PATH"))
-	out, _ := exec.Command("ls", "-alh", "/usr/local/bin").Output()
-	logg.LogTo("TRAINING_JOB", "ls -alh /usr/local/bin: %v", string(out))
-
-	// explicitly check if caffe binary found on the PATH
-	lookPathResult, err := exec.LookPath("caffe")
+	executor, err := j.Configuration.NewExecutor()
 	if err != nil {
-		logg.LogError(fmt.Errorf("caffe not found on path: %v", err))
+		return err
 	}
-	logg.LogTo("TRAINING_JOB", "caffe found on path: %v", lookPathResult)
-
-	// Create Caffe command, but don't actually run it yet
-	cmd := exec.Command(caffePath, cmdArgs...)
 
-	// set the directory where the command will be run in (important
-	// because we depend on relative file paths to work)
-	cmd.Dir = j.getWorkDirectory()
+	spec := ExecSpec{
+		JobId:      j.Id,
+		Command:    "caffe",
+		Args:       []string{"train", fmt.Sprintf("--solver=%v", solverFilename)},
+		Dir:        j.getWorkDirectory(),
+		StdOutPath: j.getStdOutPath(),
+		StdErrPath: j.getStdErrPath(),
+		Image:      solver.CaffeImage,
+		Gpu:        solver.Gpu,
+	}
 
-	// run the command and save stdio to files and tee to stdio streams
-	if err := runCmdTeeStdio(cmd, j.getStdOutPath(), j.getStdErrPath()); err != nil {
+	// run the command and save stdio to files
+	if err := executor.Execute(spec); err != nil {
 		return err
 	}
 
@@ -222,8 +221,8 @@ func (j TrainingJob) runCaffe() error {
 	}
 	logg.LogTo("TRAINING_JOB", "updated caffe model url")
 
-	// TODO: add cbfs proxy so that we can get to this file
-	// via http://host:8080/cbfs/243224lkjlkj/caffe.model
+	// the model can be downloaded via the blob proxy endpoint at
+	// http://host:8080/blobs/243224lkjlkj/trained.caffemodel
 
 	return nil
 
@@ -393,9 +392,7 @@ func (j TrainingJob) saveTrainTestData(s Solver) error {
 
 // Codereview: de-dupe
 func (j TrainingJob) recordProcessingError(err error) {
-	logg.LogError(err)
-	db := j.Configuration.DbConnection()
-	if err := j.Failed(db, err); err != nil {
+	if err := recordJobFailure(j.Configuration, &j, err, systemClock{}); err != nil {
 		errMsg := fmt.Errorf("Error setting training job as failed: %v", err)
 		logg.LogError(errMsg)
 	}
@@ -438,7 +435,7 @@ func (j TrainingJob) writeSpecToFile(s Solver) error {
 // or else you'll end up w/ unwanted dupes)
 // TODO: use same approach as Classifier#Insert()
 // Codereview: de-dupe
-func (j TrainingJob) Insert(db couch.Database) (*TrainingJob, error) {
+func (j TrainingJob) Insert(db DocumentStore) (*TrainingJob, error) {
 
 	id, _, err := db.Insert(j)
 	if err != nil {
@@ -453,6 +450,7 @@ func (j TrainingJob) Insert(db couch.Database) (*TrainingJob, error) {
 		err := fmt.Errorf("Error fetching training job: %v.  Err: %v", id, err)
 		return nil, err
 	}
+	trainingJob.Configuration = j.Configuration
 
 	return trainingJob, nil
 
@@ -460,7 +458,7 @@ func (j TrainingJob) Insert(db couch.Database) (*TrainingJob, error) {
 
 // Update the state to record that it failed
 // Codereview: de-dupe
-func (j TrainingJob) Failed(db couch.Database, processingErr error) error {
+func (j TrainingJob) Failed(db DocumentStore, processingErr error) error {
 
 	_, err := j.UpdateProcessingState(Failed)
 	if err != nil {
@@ -481,7 +479,7 @@ func (j TrainingJob) Failed(db couch.Database, processingErr error) error {
 
 // Update the state to record that it succeeded
 // Codereview: de-dupe
-func (j TrainingJob) FinishedSuccessfully(db couch.Database, logPath string) error {
+func (j TrainingJob) FinishedSuccessfully(db DocumentStore, logPath string) error {
 
 	_, err := j.UpdateProcessingState(FinishedSuccessfully)
 	if err != nil {
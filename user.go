@@ -3,8 +3,6 @@ package elasticthought
 import (
 	"errors"
 	"fmt"
-
-	"github.com/tleyden/go-couch"
 )
 
 // An ElasticThought user.
@@ -33,7 +31,7 @@ func NewUserFromUser(other User) *User {
 
 // Does this username/password combo exist in the database?  If so, return the
 // user.  If not, return an error.
-func AuthenticateUser(db couch.Database, username, password string) (*User, error) {
+func AuthenticateUser(db DocumentStore, username, password string) (*User, error) {
 
 	userId := docIdFromUsername(username)
 
@@ -0,0 +1,53 @@
+package elasticthought
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dustin/httputil"
+)
+
+// Once a worker has run a job, is the job done with as far as the queue it
+// came from is concerned?  If not, it should be put back on the queue.  The
+// reason is for logging.
+func jobIsDone(config Configuration, docId string) (bool, string) {
+
+	doc := struct {
+		ElasticThoughtDoc
+		ProcessingState ProcessingState `json:"processing-state"`
+		Lease           JobLease        `json:"lease"`
+	}{}
+	err := config.DbConnection().Retrieve(docId, &doc)
+
+	switch {
+	case httputil.IsHTTPStatus(err, 404):
+		return true, "was deleted"
+	case err != nil:
+		return false, fmt.Sprintf("could not be checked on (%v)", err)
+	case doc.ProcessingState == FinishedSuccessfully || doc.ProcessingState == Failed:
+		return true, fmt.Sprintf("is %v", doc.ProcessingState)
+	case doc.ProcessingState == Pending && doc.Lease.BackingOff(time.Now()):
+		// the worker refused the job since it isn't due to be retried yet,
+		// so it needs to be delivered again later
+		return false, fmt.Sprintf("is backing off until %v", doc.Lease.NotBefore)
+	case doc.ProcessingState == Pending:
+		// the job hit a transient error and has put itself back to pending,
+		// which the changes listener will schedule again
+		return true, "will be retried"
+	case doc.Lease.WorkerID != DefaultWorkerID():
+		return true, fmt.Sprintf("is being processed by %v", doc.Lease.WorkerID)
+	}
+	return false, fmt.Sprintf("stopped while still %v", doc.ProcessingState)
+
+}
+
+// Block until the process gets a SIGINT or SIGTERM
+func WaitForShutdownSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	return <-signals
+}
@@ -0,0 +1,383 @@
+package elasticthought
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/logg"
+)
+
+// An amount of each of the resources on a worker machine.  This is used both
+// for the total capacity of a worker, and for what a single job needs.  A
+// worker capacity of zero for a resource means that resource isn't tracked.
+type ResourceSlots struct {
+	GPUs     int `json:"gpus"`
+	CPUCores int `json:"cpu-cores"`
+	MemoryMB int `json:"memory-mb"`
+}
+
+func (r ResourceSlots) add(other ResourceSlots) ResourceSlots {
+	return ResourceSlots{
+		GPUs:     r.GPUs + other.GPUs,
+		CPUCores: r.CPUCores + other.CPUCores,
+		MemoryMB: r.MemoryMB + other.MemoryMB,
+	}
+}
+
+func (r ResourceSlots) sub(other ResourceSlots) ResourceSlots {
+	return r.add(ResourceSlots{
+		GPUs:     -other.GPUs,
+		CPUCores: -other.CPUCores,
+		MemoryMB: -other.MemoryMB,
+	})
+}
+
+// The resources a job needs, limited to what the worker actually has, so that
+// a job which asks for more than the whole worker can still run (alone)
+// rather than waiting forever.  Untracked resources are dropped.
+func (r ResourceSlots) clampTo(capacity ResourceSlots) ResourceSlots {
+	clamp := func(need, have int) int {
+		if have <= 0 {
+			return 0
+		}
+		if need > have {
+			return have
+		}
+		return need
+	}
+	return ResourceSlots{
+		GPUs:     clamp(r.GPUs, capacity.GPUs),
+		CPUCores: clamp(r.CPUCores, capacity.CPUCores),
+		MemoryMB: clamp(r.MemoryMB, capacity.MemoryMB),
+	}
+}
+
+// Does r ask for a negative amount of anything?  Only a misconfiguration
+// can cause this.
+func (r ResourceSlots) hasNegative() bool {
+	return r.GPUs < 0 || r.CPUCores < 0 || r.MemoryMB < 0
+}
+
+// Are the resources in r all available within capacity?  A resource that
+// isn't needed always fits, even if capacity has been overcommitted to a
+// reservation.
+func (r ResourceSlots) fitsIn(capacity ResourceSlots) bool {
+	fits := func(need, have int) bool {
+		return need == 0 || need <= have
+	}
+	return fits(r.GPUs, capacity.GPUs) &&
+		fits(r.CPUCores, capacity.CPUCores) &&
+		fits(r.MemoryMB, capacity.MemoryMB)
+}
+
+// Returned by WorkerPool.Submit once the pool has started draining
+var ErrWorkerPoolDraining = errors.New("Worker pool is draining")
+
+// Jobs that know what type of job they are, so that the worker pool can
+// apply the right concurrency limit and resource requirements.
+type JobTyper interface {
+	JobType() string
+}
+
+// Runs jobs in goroutines, but never more at once than the per job type
+// concurrency limits and the worker's resource slots allow.  Jobs which
+// can't be started yet wait in a queue until a running job finishes.
+type WorkerPool struct {
+
+	// How many jobs of each type (eg, DOC_TYPE_TRAINING_JOB) can run at
+	// once.  Job types without a limit are unlimited.
+	Concurrency map[string]int
+
+	// The resources available on this worker
+	Capacity ResourceSlots
+
+	// The resources needed by each type of job
+	JobResources map[string]ResourceSlots
+
+	mutex       sync.Mutex
+	running     []*poolJob
+	queued      []*poolJob
+	inUse       ResourceSlots
+	outstanding sync.WaitGroup
+	draining    bool
+	jobFinished chan struct{} // closed when a running job finishes, if non-nil
+}
+
+type poolJob struct {
+	jobType   string
+	docId     string
+	resources ResourceSlots
+	runnable  Runnable
+}
+
+// The occupancy of a worker pool, as returned by the worker slots endpoint
+type WorkerPoolStatus struct {
+	Capacity ResourceSlots            `json:"capacity"`
+	InUse    ResourceSlots            `json:"in-use"`
+	JobTypes map[string]JobTypeStatus `json:"job-types"`
+}
+
+// The occupancy of a worker pool for a single type of job.  A limit of 0
+// means unlimited.
+type JobTypeStatus struct {
+	Limit   int      `json:"limit"`
+	Running []string `json:"running"`
+	Queued  []string `json:"queued"`
+}
+
+func NewWorkerPool(c Configuration) *WorkerPool {
+	return &WorkerPool{
+		Concurrency:  c.WorkerConcurrency,
+		Capacity:     c.WorkerSlots,
+		JobResources: c.JobResources,
+	}
+}
+
+// Queue the job described by jobDescriptor to be run as soon as there is a
+// free slot for it.  This never blocks.  Once the pool is draining, jobs are
+// refused with ErrWorkerPoolDraining, since they would never be started.
+func (p *WorkerPool) Submit(jobDescriptor JobDescriptor, job Runnable) error {
+
+	jobType := ""
+	if typer, ok := job.(JobTyper); ok {
+		jobType = typer.JobType()
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.draining {
+		logg.LogTo("JOB_SCHEDULER", "Draining, refusing %v job: %v", jobType, jobDescriptor.DocIdToProcess)
+		return ErrWorkerPoolDraining
+	}
+
+	p.outstanding.Add(1)
+	p.queued = append(p.queued, &poolJob{
+		jobType:   jobType,
+		docId:     jobDescriptor.DocIdToProcess,
+		resources: p.JobResources[jobType].clampTo(p.Capacity),
+		runnable:  job,
+	})
+
+	logg.LogTo("JOB_SCHEDULER", "Queued %v job: %v", jobType, jobDescriptor.DocIdToProcess)
+
+	p.dispatch()
+
+	return nil
+
+}
+
+// Wait until every submitted job has finished
+func (p *WorkerPool) Wait() {
+	p.outstanding.Wait()
+}
+
+// Stop starting queued jobs, and wait up to timeout for the running jobs to
+// finish.  The jobs that were still queued are removed from the pool and
+// returned, so that they can be handed back to whoever submitted them, along
+// with whether all of the running jobs finished in time.  The pool won't
+// start or accept any more jobs after this.
+func (p *WorkerPool) Drain(timeout time.Duration) ([]Runnable, bool) {
+
+	p.mutex.Lock()
+	p.draining = true
+	p.mutex.Unlock()
+
+	logg.LogTo("JOB_SCHEDULER", "Draining worker pool, waiting up to %v for running jobs", timeout)
+
+	deadline := time.After(timeout)
+	finishedInTime := true
+
+waitForRunning:
+	for {
+
+		p.mutex.Lock()
+		if len(p.running) == 0 {
+			p.mutex.Unlock()
+			break
+		}
+		if p.jobFinished == nil {
+			p.jobFinished = make(chan struct{})
+		}
+		jobFinished := p.jobFinished
+		p.mutex.Unlock()
+
+		select {
+		case <-jobFinished:
+		case <-deadline:
+			finishedInTime = false
+			break waitForRunning
+		}
+
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	unstarted := []Runnable{}
+	for _, job := range p.queued {
+		unstarted = append(unstarted, job.runnable)
+		p.outstanding.Done()
+	}
+	p.queued = nil
+
+	logg.LogTo("JOB_SCHEDULER", "Drained worker pool.  Unstarted: %v Still running: %v", len(unstarted), len(p.running))
+
+	return unstarted, finishedInTime
+
+}
+
+// The number of jobs the pool can run at once, counting each limited job
+// type, or 1 if none of them are limited.  Used to decide how many jobs a
+// worker should take from its queue at a time.
+func (p *WorkerPool) concurrencyLimit() int {
+	limit := 0
+	for _, jobTypeLimit := range p.Concurrency {
+		limit += jobTypeLimit
+	}
+	if limit < 1 {
+		return 1
+	}
+	return limit
+}
+
+// Get a snapshot of the pool's occupancy
+func (p *WorkerPool) Status() WorkerPoolStatus {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	status := WorkerPoolStatus{
+		Capacity: p.Capacity,
+		InUse:    p.inUse,
+		JobTypes: map[string]JobTypeStatus{},
+	}
+
+	statusFor := func(jobType string) JobTypeStatus {
+		jobTypeStatus, ok := status.JobTypes[jobType]
+		if !ok {
+			jobTypeStatus = JobTypeStatus{
+				Limit:   p.Concurrency[jobType],
+				Running: []string{},
+				Queued:  []string{},
+			}
+		}
+		return jobTypeStatus
+	}
+
+	for jobType := range p.Concurrency {
+		status.JobTypes[jobType] = statusFor(jobType)
+	}
+	for _, job := range p.running {
+		jobTypeStatus := statusFor(job.jobType)
+		jobTypeStatus.Running = append(jobTypeStatus.Running, job.docId)
+		status.JobTypes[job.jobType] = jobTypeStatus
+	}
+	for _, job := range p.queued {
+		jobTypeStatus := statusFor(job.jobType)
+		jobTypeStatus.Queued = append(jobTypeStatus.Queued, job.docId)
+		status.JobTypes[job.jobType] = jobTypeStatus
+	}
+
+	return status
+
+}
+
+// Start every queued job that there is room for, in the order they were
+// queued.  A job that doesn't fit doesn't hold up smaller jobs behind it,
+// but the oldest job that's waiting for resources has them reserved, so the
+// jobs behind it can only use what would be left over once it starts.
+// Otherwise a steady stream of small jobs could keep a big one (eg, a
+// training job needing the gpu) waiting forever.  Must be called with the
+// mutex held.
+func (p *WorkerPool) dispatch() {
+
+	if p.draining {
+		return
+	}
+
+	stillQueued := []*poolJob{}
+	reserved := ResourceSlots{}
+	reserving := false
+	for _, job := range p.queued {
+		if !p.belowConcurrencyLimit(job) {
+			stillQueued = append(stillQueued, job)
+			continue
+		}
+		// job resources have been clamped to the capacity, so untracked
+		// resources are always zero on both sides
+		if !job.resources.fitsIn(p.Capacity.sub(p.inUse).sub(reserved)) {
+			stillQueued = append(stillQueued, job)
+			if !reserving {
+				reserved = job.resources
+				reserving = true
+			}
+			continue
+		}
+		p.start(job)
+	}
+	p.queued = stillQueued
+
+}
+
+// Must be called with the mutex held
+func (p *WorkerPool) belowConcurrencyLimit(job *poolJob) bool {
+
+	if limit := p.Concurrency[job.jobType]; limit > 0 {
+		running := 0
+		for _, runningJob := range p.running {
+			if runningJob.jobType == job.jobType {
+				running += 1
+			}
+		}
+		if running >= limit {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// Must be called with the mutex held
+func (p *WorkerPool) start(job *poolJob) {
+
+	p.running = append(p.running, job)
+	p.inUse = p.inUse.add(job.resources)
+
+	logg.LogTo("JOB_SCHEDULER", "Starting %v job: %v", job.jobType, job.docId)
+
+	go func() {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		job.runnable.Run(wg)
+		p.finish(job)
+	}()
+
+}
+
+func (p *WorkerPool) finish(job *poolJob) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, runningJob := range p.running {
+		if runningJob == job {
+			p.running = append(p.running[:i], p.running[i+1:]...)
+			break
+		}
+	}
+	p.inUse = p.inUse.sub(job.resources)
+
+	logg.LogTo("JOB_SCHEDULER", "Finished %v job: %v", job.jobType, job.docId)
+
+	if p.jobFinished != nil {
+		close(p.jobFinished)
+		p.jobFinished = nil
+	}
+
+	p.dispatch()
+	p.outstanding.Done()
+
+}
@@ -0,0 +1,250 @@
+package elasticthought
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// A job which runs until it's released
+type blockingJob struct {
+	jobType string
+	started chan<- string
+	release chan bool
+	id      string
+}
+
+func (j blockingJob) JobType() string {
+	return j.jobType
+}
+
+func (j blockingJob) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	j.started <- j.id
+	<-j.release
+}
+
+func submitBlockingJob(pool *WorkerPool, started chan<- string, jobType, id string) blockingJob {
+	job := blockingJob{
+		jobType: jobType,
+		started: started,
+		release: make(chan bool),
+		id:      id,
+	}
+	pool.Submit(*NewJobDescriptor(id), job)
+	return job
+}
+
+func assertNothingStarted(t *testing.T, started <-chan string) {
+	select {
+	case id := <-started:
+		t.Fatalf("Unexpected job started: %v", id)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// Wait until Drain has been called on the pool, by another goroutine
+func waitUntilDraining(pool *WorkerPool) {
+	for {
+		pool.mutex.Lock()
+		draining := pool.draining
+		pool.mutex.Unlock()
+		if draining {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerPoolConcurrencyLimit(t *testing.T) {
+
+	pool := &WorkerPool{
+		Concurrency: map[string]int{DOC_TYPE_DATASET: 2},
+	}
+	started := make(chan string, 10)
+
+	job1 := submitBlockingJob(pool, started, DOC_TYPE_DATASET, "d1")
+	submitBlockingJob(pool, started, DOC_TYPE_DATASET, "d2")
+	submitBlockingJob(pool, started, DOC_TYPE_DATASET, "d3")
+
+	// job types without a limit aren't held up
+	classifyJob := submitBlockingJob(pool, started, DOC_TYPE_CLASSIFY_JOB, "c1")
+
+	startedIds := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		startedIds[<-started] = true
+	}
+	assert.True(t, startedIds["d1"] && startedIds["d2"] && startedIds["c1"])
+	assertNothingStarted(t, started)
+
+	status := pool.Status()
+	assert.Equals(t, status.JobTypes[DOC_TYPE_DATASET].Limit, 2)
+	assert.Equals(t, len(status.JobTypes[DOC_TYPE_DATASET].Running), 2)
+	assert.DeepEquals(t, status.JobTypes[DOC_TYPE_DATASET].Queued, []string{"d3"})
+	assert.DeepEquals(t, status.JobTypes[DOC_TYPE_CLASSIFY_JOB].Running, []string{"c1"})
+
+	// once a dataset job finishes, the queued one starts
+	job1.release <- true
+	assert.Equals(t, <-started, "d3")
+
+	classifyJob.release <- true
+
+}
+
+func TestWorkerPoolResourceSlots(t *testing.T) {
+
+	pool := &WorkerPool{
+		Capacity: ResourceSlots{GPUs: 1, CPUCores: 4},
+		JobResources: map[string]ResourceSlots{
+			DOC_TYPE_TRAINING_JOB: ResourceSlots{GPUs: 1, CPUCores: 1, MemoryMB: 4096},
+			DOC_TYPE_DATASET:      ResourceSlots{CPUCores: 8},
+		},
+	}
+	started := make(chan string, 10)
+
+	training1 := submitBlockingJob(pool, started, DOC_TYPE_TRAINING_JOB, "t1")
+	assert.Equals(t, <-started, "t1")
+
+	// memory isn't tracked, so only the gpu and a cpu core are in use
+	assert.Equals(t, pool.Status().InUse, ResourceSlots{GPUs: 1, CPUCores: 1})
+
+	// the second training job waits for the gpu
+	training2 := submitBlockingJob(pool, started, DOC_TYPE_TRAINING_JOB, "t2")
+	assertNothingStarted(t, started)
+
+	// a job asking for more cpus than the worker has waits until it can
+	// have all of them
+	dataset := submitBlockingJob(pool, started, DOC_TYPE_DATASET, "d1")
+	assertNothingStarted(t, started)
+
+	training1.release <- true
+	assert.Equals(t, <-started, "t2")
+	assertNothingStarted(t, started)
+
+	status := pool.Status()
+	assert.DeepEquals(t, status.JobTypes[DOC_TYPE_DATASET].Queued, []string{"d1"})
+
+	// once the worker is idle, the big job gets all of the cpus
+	training2.release <- true
+	assert.Equals(t, <-started, "d1")
+	assert.Equals(t, pool.Status().InUse, ResourceSlots{CPUCores: 4})
+
+	dataset.release <- true
+
+}
+
+func TestWorkerPoolReservesResourcesForWaitingJob(t *testing.T) {
+
+	pool := &WorkerPool{
+		Capacity: ResourceSlots{GPUs: 1, CPUCores: 2},
+		JobResources: map[string]ResourceSlots{
+			DOC_TYPE_TRAINING_JOB: ResourceSlots{GPUs: 1, CPUCores: 2},
+			DOC_TYPE_DATASET:      ResourceSlots{CPUCores: 1},
+		},
+	}
+	started := make(chan string, 10)
+
+	dataset1 := submitBlockingJob(pool, started, DOC_TYPE_DATASET, "d1")
+	assert.Equals(t, <-started, "d1")
+
+	// the training job needs both cpus, so it waits
+	training := submitBlockingJob(pool, started, DOC_TYPE_TRAINING_JOB, "t1")
+	assertNothingStarted(t, started)
+
+	// a smaller job behind it would fit in the free cpu, but that's
+	// reserved for the training job so that it isn't starved
+	dataset2 := submitBlockingJob(pool, started, DOC_TYPE_DATASET, "d2")
+	assertNothingStarted(t, started)
+
+	dataset1.release <- true
+	assert.Equals(t, <-started, "t1")
+	assertNothingStarted(t, started)
+
+	training.release <- true
+	assert.Equals(t, <-started, "d2")
+
+	dataset2.release <- true
+	pool.Wait()
+
+}
+
+func TestWorkerPoolWait(t *testing.T) {
+
+	pool := &WorkerPool{
+		Concurrency: map[string]int{DOC_TYPE_CLASSIFY_JOB: 1},
+	}
+	started := make(chan string, 10)
+
+	job1 := submitBlockingJob(pool, started, DOC_TYPE_CLASSIFY_JOB, "c1")
+	job2 := submitBlockingJob(pool, started, DOC_TYPE_CLASSIFY_JOB, "c2")
+
+	done := make(chan bool)
+	go func() {
+		pool.Wait()
+		done <- true
+	}()
+
+	<-started
+	job1.release <- true
+	<-started
+	job2.release <- true
+	<-done
+
+	assert.Equals(t, pool.Status().InUse, ResourceSlots{})
+
+}
+
+func TestWorkerPoolDrain(t *testing.T) {
+
+	pool := &WorkerPool{
+		Concurrency: map[string]int{DOC_TYPE_TRAINING_JOB: 1},
+	}
+	started := make(chan string, 10)
+
+	training1 := submitBlockingJob(pool, started, DOC_TYPE_TRAINING_JOB, "t1")
+	submitBlockingJob(pool, started, DOC_TYPE_TRAINING_JOB, "t2")
+	assert.Equals(t, <-started, "t1")
+
+	drained := make(chan []Runnable)
+	go func() {
+		unstarted, finishedInTime := pool.Drain(time.Minute)
+		assert.True(t, finishedInTime)
+		drained <- unstarted
+	}()
+
+	// the queued job isn't started when the running one finishes, it's
+	// handed back instead
+	waitUntilDraining(pool)
+	training1.release <- true
+	unstarted := <-drained
+	assertNothingStarted(t, started)
+	assert.Equals(t, len(unstarted), 1)
+	assert.Equals(t, unstarted[0].(blockingJob).id, "t2")
+
+	// jobs submitted from now on are refused rather than left queued
+	err := pool.Submit(*NewJobDescriptor("t3"), blockingJob{jobType: DOC_TYPE_TRAINING_JOB, id: "t3"})
+	assert.Equals(t, err, ErrWorkerPoolDraining)
+	assert.Equals(t, len(pool.Status().JobTypes[DOC_TYPE_TRAINING_JOB].Queued), 0)
+	pool.Wait()
+
+}
+
+func TestWorkerPoolDrainTimeout(t *testing.T) {
+
+	pool := &WorkerPool{}
+	started := make(chan string, 10)
+
+	job := submitBlockingJob(pool, started, DOC_TYPE_CLASSIFY_JOB, "c1")
+	<-started
+
+	unstarted, finishedInTime := pool.Drain(10 * time.Millisecond)
+	assert.False(t, finishedInTime)
+	assert.Equals(t, len(unstarted), 0)
+	assert.DeepEquals(t, pool.Status().JobTypes[DOC_TYPE_CLASSIFY_JOB].Running, []string{"c1"})
+
+	job.release <- true
+	pool.Wait()
+
+}